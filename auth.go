@@ -0,0 +1,78 @@
+package soju
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the credentials of users connecting to the bouncer.
+//
+// Authentication happens in two steps: the credentials are checked and
+// resolved to an external identity, then the identity is mapped to a soju
+// user. This allows external backends (e.g. LDAP or PAM) to use their own
+// naming scheme.
+type Authenticator interface {
+	// AuthenticatePassword checks a username and a password. On success, the
+	// external identity of the user is returned.
+	AuthenticatePassword(ctx context.Context, username, password string) (identity string, err error)
+	// AuthenticateCertificate checks a username and the TLS client
+	// certificate of the connection. On success, the external identity of
+	// the user is returned.
+	AuthenticateCertificate(ctx context.Context, username string, cert *x509.Certificate) (identity string, err error)
+	// LookupUser maps an external identity to the name of a soju user.
+	LookupUser(ctx context.Context, identity string) (username string, err error)
+}
+
+// dbAuthenticator authenticates users with the password hashes stored in the
+// database. External identities are soju usernames.
+type dbAuthenticator struct {
+	db Database
+}
+
+var _ Authenticator = (*dbAuthenticator)(nil)
+
+// NewDBAuthenticator creates an authenticator checking passwords against the
+// database.
+func NewDBAuthenticator(db Database) Authenticator {
+	return &dbAuthenticator{db}
+}
+
+func (auth *dbAuthenticator) AuthenticatePassword(ctx context.Context, username, password string) (string, error) {
+	u, err := auth.db.GetUser(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("user not found: %w", err)
+	}
+
+	// Password auth disabled
+	if u.Password == "" {
+		return "", fmt.Errorf("password auth disabled")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return "", fmt.Errorf("wrong password")
+	}
+
+	return u.Username, nil
+}
+
+func (auth *dbAuthenticator) AuthenticateCertificate(ctx context.Context, username string, cert *x509.Certificate) (string, error) {
+	u, err := auth.db.GetUser(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("user not found: %w", err)
+	}
+
+	fingerprint := certFingerprint(cert.Raw)
+	for _, fp := range u.CertFingerprints {
+		if fp == fingerprint {
+			return u.Username, nil
+		}
+	}
+	return "", fmt.Errorf("unknown certificate fingerprint %v", fingerprint)
+}
+
+func (auth *dbAuthenticator) LookupUser(ctx context.Context, identity string) (string, error) {
+	return identity, nil
+}
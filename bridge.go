@@ -69,6 +69,30 @@ func sendTopic(dc *downstreamConn, ch *upstreamChannel) {
 	}
 }
 
+// sendSavedTopic sends the last known topic of a channel, saved in the
+// database.
+func sendSavedTopic(dc *downstreamConn, net *network, ch *Channel) {
+	if ch.Topic == "" {
+		return
+	}
+
+	downstreamName := dc.marshalEntity(net, ch.Name)
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_TOPIC,
+		Params:  []string{dc.nick, downstreamName, ch.Topic},
+	})
+	if ch.TopicWho != "" {
+		topicWho := dc.marshalUserPrefix(net, irc.ParsePrefix(ch.TopicWho))
+		topicTime := strconv.FormatInt(ch.TopicTime.Unix(), 10)
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_topicwhotime,
+			Params:  []string{dc.nick, downstreamName, topicWho.String(), topicTime},
+		})
+	}
+}
+
 func sendNames(dc *downstreamConn, ch *upstreamChannel) {
 	downstreamName := dc.marshalEntity(ch.conn.network, ch.Name)
 
@@ -116,3 +140,33 @@ func sendNames(dc *downstreamConn, ch *upstreamChannel) {
 		Params:  []string{dc.nick, downstreamName, "End of /NAMES list"},
 	})
 }
+
+// forwardLocalChannel makes a downstream connection join a local channel.
+func forwardLocalChannel(dc *downstreamConn, ch *localChannel) {
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.prefix(),
+		Command: "JOIN",
+		Params:  []string{ch.Name},
+	})
+
+	if dc.caps.IsEnabled("soju.im/no-implicit-names") {
+		return
+	}
+
+	members := []string{dc.nick}
+	for _, nick := range ch.members() {
+		if casemapASCII(nick) != dc.nickCM {
+			members = append(members, nick)
+		}
+	}
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_NAMREPLY,
+		Params:  []string{dc.nick, "=", ch.Name, strings.Join(members, " ")},
+	})
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_ENDOFNAMES,
+		Params:  []string{dc.nick, ch.Name, "End of /NAMES list"},
+	})
+}
@@ -0,0 +1,95 @@
+package soju
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"gopkg.in/irc.v3"
+)
+
+// lookupCharset returns the character encoding with the given name. nil is
+// returned for UTF-8, which doesn't need any transcoding.
+func lookupCharset(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// messageTextParam returns the index of the free-form text parameter of a
+// message, or -1 if the message has none. Other parameters are protocol
+// tokens and must not be transcoded.
+func messageTextParam(msg *irc.Message) int {
+	var i int
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE", "TOPIC":
+		i = 1
+	case irc.RPL_TOPIC:
+		i = 2
+	default:
+		return -1
+	}
+	if i >= len(msg.Params) {
+		return -1
+	}
+	return i
+}
+
+// decodeMessage converts the text of a message received from a network using
+// the charset enc to UTF-8. Text which is already valid UTF-8 is left as-is,
+// since some clients on legacy networks send UTF-8 anyways.
+func decodeMessage(enc encoding.Encoding, msg *irc.Message) *irc.Message {
+	i := messageTextParam(msg)
+	if enc == nil || i < 0 || utf8.ValidString(msg.Params[i]) {
+		return msg
+	}
+	text, err := enc.NewDecoder().String(msg.Params[i])
+	if err != nil {
+		return msg
+	}
+	msg = msg.Copy()
+	msg.Params[i] = text
+	return msg
+}
+
+// encodeMessage converts the text of a message sent to a network from UTF-8
+// to the charset enc. Characters which cannot be represented are replaced
+// with a question mark.
+func encodeMessage(enc encoding.Encoding, msg *irc.Message) *irc.Message {
+	i := messageTextParam(msg)
+	if enc == nil || i < 0 {
+		return msg
+	}
+	msg = msg.Copy()
+	msg.Params[i] = encodeText(enc, msg.Params[i])
+	return msg
+}
+
+func encodeText(enc encoding.Encoding, text string) string {
+	if s, err := enc.NewEncoder().String(text); err == nil {
+		return s
+	}
+
+	// Slow path: encode characters one by one
+	var sb strings.Builder
+	encoder := enc.NewEncoder()
+	for _, r := range text {
+		s, err := encoder.String(string(r))
+		if err != nil {
+			s = "?"
+		}
+		sb.WriteString(s)
+	}
+	return sb.String()
+}
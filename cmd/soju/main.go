@@ -43,6 +43,7 @@ func (v *stringSliceFlag) Set(s string) error {
 var (
 	configPath string
 	debug      bool
+	logFormat  string
 
 	tlsCert atomic.Value // *tls.Certificate
 )
@@ -81,16 +82,49 @@ func loadConfig() (*config.Server, *soju.Config, error) {
 		tlsCert.Store(&cert)
 	}
 
+	upstreamResolver, err := soju.NewUpstreamResolver(raw.UpstreamDNS)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	cfg := &soju.Config{
-		Hostname:        raw.Hostname,
-		Title:           raw.Title,
-		LogPath:         raw.LogPath,
-		HTTPOrigins:     raw.HTTPOrigins,
-		AcceptProxyIPs:  raw.AcceptProxyIPs,
-		MaxUserNetworks: raw.MaxUserNetworks,
-		MultiUpstream:   raw.MultiUpstream,
-		UpstreamUserIPs: raw.UpstreamUserIPs,
-		MOTD:            motd,
+		Hostname:                raw.Hostname,
+		Title:                   raw.Title,
+		LogPath:                 raw.LogPath,
+		LogCompress:             raw.LogCompress,
+		LogQuota:                raw.LogQuota,
+		BacklogLimit:            raw.BacklogLimit,
+		HTTPOrigins:             raw.HTTPOrigins,
+		AcceptProxyIPs:          raw.AcceptProxyIPs,
+		MaxUserNetworks:         raw.MaxUserNetworks,
+		MaxUserDownstreams:      raw.MaxUserDownstreams,
+		MultiUpstream:           raw.MultiUpstream,
+		UpstreamUserIPs:         raw.UpstreamUserIPs,
+		UpstreamUserIPStrategy:  raw.UpstreamUserIPStrategy,
+		UpstreamResolver:        upstreamResolver,
+		DefaultUsername:         raw.DefaultUsername,
+		DefaultRealname:         raw.DefaultRealname,
+		IdentTemplate:           raw.IdentTemplate,
+		IdentOS:                 raw.IdentOS,
+		DownstreamIdleTimeout:   raw.DownstreamIdleTimeout,
+		WebSocketPingInterval:   raw.WebSocketPingInterval,
+		UpstreamMessageDelay:    raw.UpstreamMessageDelay,
+		UpstreamMessageBurst:    raw.UpstreamMessageBurst,
+		UpstreamConnectTimeout:  raw.UpstreamConnectTimeout,
+		UpstreamTLSMinVersion:   raw.UpstreamTLSMinVersion,
+		UpstreamTLSCipherSuites: raw.UpstreamTLSCipherSuites,
+		UserMessageDelay:        raw.UserMessageDelay,
+		UserMessageBurst:        raw.UserMessageBurst,
+		UserMessagePolicy:       raw.UserMessagePolicy,
+		NetworkChangeDelay:      raw.NetworkChangeDelay,
+		NetworkChangeBurst:      raw.NetworkChangeBurst,
+		UserEventQueueSize:      raw.UserEventQueueSize,
+		ReceiptsFlushInterval:   raw.ReceiptsFlushInterval,
+		MaxUpstreamAuthFailures: raw.MaxUpstreamAuthFailures,
+		MaxLoginFailures:        raw.MaxLoginFailures,
+		LoginLockout:            raw.LoginLockout,
+		OpenRegistration:        raw.OpenRegistration,
+		MOTD:                    motd,
 	}
 	return raw, cfg, nil
 }
@@ -100,23 +134,34 @@ func main() {
 	flag.Var((*stringSliceFlag)(&listen), "listen", "listening address")
 	flag.StringVar(&configPath, "config", "", "path to configuration file")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
+	flag.StringVar(&logFormat, "log-format", "text", "log format (text or json)")
 	flag.Parse()
 
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("unknown log format %q", logFormat)
+	}
+
 	cfg, serverCfg, err := loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cfg.Listen = append(cfg.Listen, listen...)
+	for _, addr := range listen {
+		cfg.Listen = append(cfg.Listen, config.Listener{Addr: addr})
+	}
 	if len(cfg.Listen) == 0 {
-		cfg.Listen = []string{":6697"}
+		cfg.Listen = []config.Listener{{Addr: ":6697"}}
 	}
 
 	if err := bumpOpenedFileLimit(); err != nil {
 		log.Printf("failed to bump max number of opened files: %v", err)
 	}
 
-	db, err := soju.OpenDB(cfg.SQLDriver, cfg.SQLSource)
+	db, err := soju.OpenDBWithOptions(cfg.SQLDriver, cfg.SQLSource, &soju.DatabaseOptions{
+		MaxOpenConns:    cfg.SQLMaxOpenConns,
+		MaxIdleConns:    cfg.SQLMaxIdleConns,
+		ConnMaxLifetime: cfg.SQLConnMaxLifetime,
+	})
 	if err != nil {
 		log.Fatalf("failed to open database: %v", err)
 	}
@@ -132,10 +177,14 @@ func main() {
 
 	srv := soju.NewServer(db)
 	srv.SetConfig(serverCfg)
-	srv.Logger = soju.NewLogger(log.Writer(), debug)
+	if logFormat == "json" {
+		srv.Logger = soju.NewJSONLogger(log.Writer(), debug)
+	} else {
+		srv.Logger = soju.NewLogger(log.Writer(), debug)
+	}
 
-	for _, listen := range cfg.Listen {
-		listen := listen // copy
+	for _, listenCfg := range cfg.Listen {
+		listen := listenCfg.Addr
 		listenURI := listen
 		if !strings.Contains(listenURI, ":/") {
 			// This is a raw domain name, make it an URL with an empty scheme
@@ -157,6 +206,9 @@ func main() {
 			}
 			ircsTLSCfg := tlsCfg.Clone()
 			ircsTLSCfg.NextProtos = []string{"irc"}
+			// Client certificates are checked against the fingerprints
+			// enrolled by users, see SASL EXTERNAL
+			ircsTLSCfg.ClientAuth = tls.RequestClientCert
 			lc := net.ListenConfig{
 				KeepAlive: downstreamKeepAlive,
 			}
@@ -164,10 +216,12 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start TLS listener on %q: %v", listen, err)
 			}
+			l = tcpNoDelayListener(l, listenCfg.TCPNoDelay)
 			ln := tls.NewListener(l, ircsTLSCfg)
 			ln = proxyProtoListener(ln, srv)
+			options := &soju.ListenerOptions{WriteTimeout: listenCfg.WriteTimeout}
 			go func() {
-				if err := srv.Serve(ln); err != nil {
+				if err := srv.ServeWithOptions(ln, options); err != nil {
 					log.Printf("serving %q: %v", listen, err)
 				}
 			}()
@@ -183,9 +237,11 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
+			ln = tcpNoDelayListener(ln, listenCfg.TCPNoDelay)
 			ln = proxyProtoListener(ln, srv)
+			options := &soju.ListenerOptions{WriteTimeout: listenCfg.WriteTimeout}
 			go func() {
-				if err := srv.Serve(ln); err != nil {
+				if err := srv.ServeWithOptions(ln, options); err != nil {
 					log.Printf("serving %q: %v", listen, err)
 				}
 			}()
@@ -195,8 +251,9 @@ func main() {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
 			ln = proxyProtoListener(ln, srv)
+			options := &soju.ListenerOptions{WriteTimeout: listenCfg.WriteTimeout}
 			go func() {
-				if err := srv.Serve(ln); err != nil {
+				if err := srv.ServeWithOptions(ln, options); err != nil {
 					log.Printf("serving %q: %v", listen, err)
 				}
 			}()
@@ -208,10 +265,11 @@ func main() {
 			if _, _, err := net.SplitHostPort(addr); err != nil {
 				addr = addr + ":https"
 			}
+			options := &soju.ListenerOptions{WriteTimeout: listenCfg.WriteTimeout}
 			httpSrv := http.Server{
 				Addr:      addr,
 				TLSConfig: tlsCfg,
-				Handler:   srv,
+				Handler:   srv.HTTPHandler(options),
 			}
 			go func() {
 				if err := httpSrv.ListenAndServeTLS("", ""); err != nil {
@@ -223,9 +281,10 @@ func main() {
 			if _, _, err := net.SplitHostPort(addr); err != nil {
 				addr = addr + ":http"
 			}
+			options := &soju.ListenerOptions{WriteTimeout: listenCfg.WriteTimeout}
 			httpSrv := http.Server{
 				Addr:    addr,
-				Handler: srv,
+				Handler: srv.HTTPHandler(options),
 			}
 			go func() {
 				if err := httpSrv.ListenAndServe(); err != nil {
@@ -321,24 +380,61 @@ func main() {
 		log.Fatal(err)
 	}
 
+	shutdownTimeout := cfg.ShutdownTimeout
 	for sig := range sigCh {
 		switch sig {
 		case syscall.SIGHUP:
 			log.Print("reloading configuration")
-			_, serverCfg, err := loadConfig()
+			newCfg, serverCfg, err := loadConfig()
 			if err != nil {
 				log.Printf("failed to reloading configuration: %v", err)
 			} else {
 				srv.SetConfig(serverCfg)
+				shutdownTimeout = newCfg.ShutdownTimeout
 			}
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Print("shutting down server")
-			srv.Shutdown()
+			ctx := context.Background()
+			if shutdownTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+				defer cancel()
+			}
+			if err := srv.ShutdownContext(ctx); err != nil {
+				log.Printf("forcing exit: %v", err)
+			}
 			return
 		}
 	}
 }
 
+// tcpNoDelayListener overrides the TCP_NODELAY option of accepted connections.
+// By default, Go enables TCP_NODELAY.
+func tcpNoDelayListener(ln net.Listener, noDelay *bool) net.Listener {
+	if noDelay == nil {
+		return ln
+	}
+	return &noDelayListener{Listener: ln, noDelay: *noDelay}
+}
+
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (ln *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(ln.noDelay); err != nil {
+			log.Printf("failed to set TCP_NODELAY: %v", err)
+		}
+	}
+	return conn, nil
+}
+
 func proxyProtoListener(ln net.Listener, srv *soju.Server) net.Listener {
 	return &proxyproto.Listener{
 		Listener: ln,
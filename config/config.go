@@ -1,14 +1,30 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
+	"math"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"git.sr.ht/~emersion/go-scfg"
 )
 
+// Bounds and defaults of the upstream flood protection parameters
+const (
+	DefaultUpstreamMessageDelay = 2 * time.Second
+	DefaultUpstreamMessageBurst = 10
+
+	MinUpstreamMessageDelay = 100 * time.Millisecond
+	MaxUpstreamMessageDelay = time.Minute
+	MinUpstreamMessageBurst = 1
+	MaxUpstreamMessageBurst = 100
+)
+
 type IPSet []*net.IPNet
 
 func (set IPSet) Contains(ip net.IP) bool {
@@ -36,23 +52,88 @@ type TLS struct {
 	CertPath, KeyPath string
 }
 
+type Listener struct {
+	Addr string
+
+	// Timeout for writing a message to a client, zero for the default
+	WriteTimeout time.Duration
+	// Whether to set TCP_NODELAY on connections, nil for the default (true)
+	TCPNoDelay *bool
+}
+
 type Server struct {
-	Listen   []string
+	Listen   []Listener
 	TLS      *TLS
 	Hostname string
 	Title    string
 	MOTDPath string
 
+	DefaultUsername string
+	DefaultRealname string
+	IdentTemplate   string
+	IdentOS         string
+
 	SQLDriver string
 	SQLSource string
 	LogPath   string
 
+	// Connection pool settings of the database, zero for the defaults
+	SQLMaxOpenConns    int
+	SQLMaxIdleConns    int
+	SQLConnMaxLifetime time.Duration
+
+	LogCompress bool
+	// Maximum size in bytes of the message logs of each user, zero for no
+	// limit
+	LogQuota int64
+	// Maximum number of messages replayed per target to clients without
+	// chathistory support, zero to disable the replay
+	BacklogLimit int
+
 	HTTPOrigins    []string
 	AcceptProxyIPs IPSet
 
-	MaxUserNetworks int
-	MultiUpstream   bool
-	UpstreamUserIPs []*net.IPNet
+	MaxUserNetworks    int
+	MaxUserDownstreams int
+	MultiUpstream      bool
+	UpstreamUserIPs    []*net.IPNet
+	// How addresses are picked from UpstreamUserIPs: "linear" or "hash"
+	UpstreamUserIPStrategy string
+	// DNS server used to resolve upstream hostnames, empty for the system
+	// resolver
+	UpstreamDNS           string
+	DownstreamIdleTimeout time.Duration
+	WebSocketPingInterval time.Duration
+	UpstreamMessageDelay  time.Duration
+	UpstreamMessageBurst  int
+	UserMessageDelay      time.Duration
+	UserMessageBurst      int
+	UserMessagePolicy     string
+	NetworkChangeDelay    time.Duration
+	NetworkChangeBurst    int
+	// Capacity of the event queue of each user
+	UserEventQueueSize int
+	// Interval at which modified delivery receipts are saved
+	ReceiptsFlushInterval time.Duration
+	// Timeout for connecting to upstream networks, including the TLS
+	// handshake
+	UpstreamConnectTimeout time.Duration
+	// TLS policy for upstream connections: minimum protocol version, and
+	// cipher suites allowed for TLS 1.2 and below (nil for Go's defaults)
+	UpstreamTLSMinVersion   uint16
+	UpstreamTLSCipherSuites []uint16
+
+	MaxUpstreamAuthFailures int
+	// Number of consecutive failed logins for a username or from an IP
+	// address after which logins are locked out, zero to disable
+	MaxLoginFailures int
+	LoginLockout     time.Duration
+
+	OpenRegistration bool
+
+	// Maximum time to wait for users to stop when shutting down, zero for no
+	// limit
+	ShutdownTimeout time.Duration
 }
 
 func Defaults() *Server {
@@ -61,11 +142,26 @@ func Defaults() *Server {
 		hostname = "localhost"
 	}
 	return &Server{
-		Hostname:        hostname,
-		SQLDriver:       "sqlite3",
-		SQLSource:       "soju.db",
-		MaxUserNetworks: -1,
-		MultiUpstream:   true,
+		Hostname:               hostname,
+		SQLDriver:              "sqlite3",
+		SQLSource:              "soju.db",
+		BacklogLimit:           4000,
+		MaxUserNetworks:        -1,
+		MaxUserDownstreams:     -1,
+		MultiUpstream:          true,
+		UpstreamUserIPStrategy: "linear",
+		UpstreamMessageDelay:   DefaultUpstreamMessageDelay,
+		UpstreamMessageBurst:   DefaultUpstreamMessageBurst,
+		UpstreamConnectTimeout: 15 * time.Second,
+		UpstreamTLSMinVersion:  tls.VersionTLS12,
+		UserMessageBurst:       10,
+		UserMessagePolicy:      "queue",
+		NetworkChangeBurst:     5,
+		UserEventQueueSize:     64,
+		ReceiptsFlushInterval:  time.Minute,
+
+		MaxUpstreamAuthFailures: 5,
+		LoginLockout:            time.Minute,
 	}
 }
 
@@ -82,11 +178,11 @@ func parse(cfg scfg.Block) (*Server, error) {
 	for _, d := range cfg {
 		switch d.Name {
 		case "listen":
-			var uri string
-			if err := d.ParseParams(&uri); err != nil {
+			l, err := parseListener(d)
+			if err != nil {
 				return nil, err
 			}
-			srv.Listen = append(srv.Listen, uri)
+			srv.Listen = append(srv.Listen, *l)
 		case "hostname":
 			if err := d.ParseParams(&srv.Hostname); err != nil {
 				return nil, err
@@ -95,6 +191,31 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if err := d.ParseParams(&srv.Title); err != nil {
 				return nil, err
 			}
+		case "default-username":
+			if err := d.ParseParams(&srv.DefaultUsername); err != nil {
+				return nil, err
+			}
+			if strings.ContainsAny(srv.DefaultUsername, " ") {
+				return nil, fmt.Errorf("directive %q: template must not contain spaces", d.Name)
+			}
+		case "ident-template":
+			if err := d.ParseParams(&srv.IdentTemplate); err != nil {
+				return nil, err
+			}
+			if strings.ContainsAny(srv.IdentTemplate, " :,") {
+				return nil, fmt.Errorf("directive %q: template must not contain spaces, colons or commas", d.Name)
+			}
+		case "ident-os":
+			if err := d.ParseParams(&srv.IdentOS); err != nil {
+				return nil, err
+			}
+			if srv.IdentOS == "" || strings.ContainsAny(srv.IdentOS, " :,") {
+				return nil, fmt.Errorf("directive %q: invalid operating system token", d.Name)
+			}
+		case "default-realname":
+			if err := d.ParseParams(&srv.DefaultRealname); err != nil {
+				return nil, err
+			}
 		case "motd":
 			if err := d.ParseParams(&srv.MOTDPath); err != nil {
 				return nil, err
@@ -109,6 +230,34 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if err := d.ParseParams(&srv.SQLDriver, &srv.SQLSource); err != nil {
 				return nil, err
 			}
+		case "db-max-open-conns", "db-max-idle-conns":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: count must be positive", d.Name)
+			}
+			if d.Name == "db-max-open-conns" {
+				srv.SQLMaxOpenConns = v
+			} else {
+				srv.SQLMaxIdleConns = v
+			}
+		case "db-conn-max-lifetime":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", d.Name)
+			}
+			srv.SQLConnMaxLifetime = v
 		case "log":
 			var driver string
 			if err := d.ParseParams(&driver, &srv.LogPath); err != nil {
@@ -117,6 +266,40 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if driver != "fs" {
 				return nil, fmt.Errorf("directive %q: unknown driver %q", d.Name, driver)
 			}
+		case "log-compress":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseBool(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.LogCompress = v
+		case "log-quota":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := ParseSize(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: size must not be negative", d.Name)
+			}
+			srv.LogQuota = v
+		case "backlog-limit":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: limit must not be negative", d.Name)
+			}
+			srv.BacklogLimit = v
 		case "http-origin":
 			srv.HTTPOrigins = d.Params
 		case "accept-proxy-ip":
@@ -141,6 +324,225 @@ func parse(cfg scfg.Block) (*Server, error) {
 			if srv.MaxUserNetworks, err = strconv.Atoi(max); err != nil {
 				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
 			}
+		case "max-user-downstreams":
+			var max string
+			if err := d.ParseParams(&max); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.MaxUserDownstreams, err = strconv.Atoi(max); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+		case "downstream-idle-timeout":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: duration must not be negative", d.Name)
+			}
+			srv.DownstreamIdleTimeout = v
+		case "websocket-ping-interval":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: duration must not be negative", d.Name)
+			}
+			srv.WebSocketPingInterval = v
+		case "upstream-message-delay":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < MinUpstreamMessageDelay || v > MaxUpstreamMessageDelay {
+				return nil, fmt.Errorf("directive %q: delay must be between %v and %v", d.Name, MinUpstreamMessageDelay, MaxUpstreamMessageDelay)
+			}
+			srv.UpstreamMessageDelay = v
+		case "receipts-flush-interval":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < time.Second || v > 10*time.Minute {
+				return nil, fmt.Errorf("directive %q: interval must be between 1s and 10m", d.Name)
+			}
+			srv.ReceiptsFlushInterval = v
+		case "upstream-connect-timeout":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", d.Name)
+			}
+			srv.UpstreamConnectTimeout = v
+		case "upstream-message-burst":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < MinUpstreamMessageBurst || v > MaxUpstreamMessageBurst {
+				return nil, fmt.Errorf("directive %q: burst must be between %v and %v", d.Name, MinUpstreamMessageBurst, MaxUpstreamMessageBurst)
+			}
+			srv.UpstreamMessageBurst = v
+		case "user-message-delay":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 || v > time.Minute {
+				return nil, fmt.Errorf("directive %q: delay must be between 0 and 1m", d.Name)
+			}
+			srv.UserMessageDelay = v
+		case "user-message-burst":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 1 || v > 100 {
+				return nil, fmt.Errorf("directive %q: burst must be between 1 and 100", d.Name)
+			}
+			srv.UserMessageBurst = v
+		case "network-change-delay":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 || v > 24*time.Hour {
+				return nil, fmt.Errorf("directive %q: delay must be between 0 and 24h", d.Name)
+			}
+			srv.NetworkChangeDelay = v
+		case "network-change-burst":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 1 || v > 100 {
+				return nil, fmt.Errorf("directive %q: burst must be between 1 and 100", d.Name)
+			}
+			srv.NetworkChangeBurst = v
+		case "user-message-policy":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			switch str {
+			case "queue", "drop", "notice":
+				srv.UserMessagePolicy = str
+			default:
+				return nil, fmt.Errorf("directive %q: unknown policy %q", d.Name, str)
+			}
+		case "user-event-queue-size":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: size must be positive", d.Name)
+			}
+			srv.UserEventQueueSize = v
+		case "upstream-tls-min-version":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := ParseTLSVersion(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.UpstreamTLSMinVersion = v
+		case "upstream-tls-ciphers":
+			if len(d.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one cipher suite", d.Name)
+			}
+			ids, err := ParseTLSCipherSuites(d.Params)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.UpstreamTLSCipherSuites = ids
+		case "shutdown-timeout":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", d.Name)
+			}
+			srv.ShutdownTimeout = v
+		case "max-upstream-auth-failures":
+			var max string
+			if err := d.ParseParams(&max); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(max)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: limit must not be negative", d.Name)
+			}
+			srv.MaxUpstreamAuthFailures = v
+		case "max-login-failures":
+			var max string
+			if err := d.ParseParams(&max); err != nil {
+				return nil, err
+			}
+			v, err := strconv.Atoi(max)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v < 0 {
+				return nil, fmt.Errorf("directive %q: limit must not be negative", d.Name)
+			}
+			srv.MaxLoginFailures = v
+		case "login-lockout":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", d.Name)
+			}
+			srv.LoginLockout = v
 		case "multi-upstream-mode":
 			var str string
 			if err := d.ParseParams(&str); err != nil {
@@ -151,6 +553,16 @@ func parse(cfg scfg.Block) (*Server, error) {
 				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
 			}
 			srv.MultiUpstream = v
+		case "open-registration":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseBool(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			srv.OpenRegistration = v
 		case "upstream-user-ip":
 			if len(srv.UpstreamUserIPs) > 0 {
 				return nil, fmt.Errorf("directive %q: can only be specified once", d.Name)
@@ -174,10 +586,164 @@ func parse(cfg scfg.Block) (*Server, error) {
 				}
 				srv.UpstreamUserIPs = append(srv.UpstreamUserIPs, n)
 			}
+		case "upstream-dns":
+			var str string
+			if err := d.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			u, err := url.Parse(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", d.Name, err)
+			}
+			switch u.Scheme {
+			case "udp", "tcp", "https":
+			default:
+				return nil, fmt.Errorf("directive %q: unsupported scheme %q (supported schemes: udp, tcp, https)", d.Name, u.Scheme)
+			}
+			if u.Host == "" {
+				return nil, fmt.Errorf("directive %q: missing host", d.Name)
+			}
+			srv.UpstreamDNS = str
+		case "upstream-user-ip-strategy":
+			var strategy string
+			if err := d.ParseParams(&strategy); err != nil {
+				return nil, err
+			}
+			switch strategy {
+			case "linear", "hash":
+				srv.UpstreamUserIPStrategy = strategy
+			default:
+				return nil, fmt.Errorf("directive %q: unknown strategy %q", d.Name, strategy)
+			}
 		default:
 			return nil, fmt.Errorf("unknown directive %q", d.Name)
 		}
 	}
 
+	if srv.SQLMaxOpenConns > 0 && srv.SQLMaxIdleConns > srv.SQLMaxOpenConns {
+		return nil, fmt.Errorf("directive \"db-max-idle-conns\": count must not exceed db-max-open-conns")
+	}
+
 	return srv, nil
 }
+
+// ParseSize parses a size in bytes, optionally followed by a K, M, G or T
+// binary unit suffix (e.g. "512M").
+func ParseSize(str string) (int64, error) {
+	s := str
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		case 'T', 't':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	if v > math.MaxInt64/mult || v < math.MinInt64/mult {
+		return 0, fmt.Errorf("size %q too large", str)
+	}
+	return v * mult, nil
+}
+
+var tlsVersions = []struct {
+	name    string
+	version uint16
+}{
+	{"1.0", tls.VersionTLS10},
+	{"1.1", tls.VersionTLS11},
+	{"1.2", tls.VersionTLS12},
+	{"1.3", tls.VersionTLS13},
+}
+
+// ParseTLSVersion parses a TLS protocol version, e.g. "1.2".
+func ParseTLSVersion(str string) (uint16, error) {
+	for _, v := range tlsVersions {
+		if v.name == str {
+			return v.version, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (must be 1.0, 1.1, 1.2 or 1.3)", str)
+}
+
+// FormatTLSVersion formats a TLS protocol version, e.g. "1.2".
+func FormatTLSVersion(version uint16) string {
+	for _, v := range tlsVersions {
+		if v.version == version {
+			return v.name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ParseTLSCipherSuites parses a list of TLS cipher suite names, as defined in
+// the IANA registry (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). Insecure
+// cipher suites are accepted, for legacy servers.
+func ParseTLSCipherSuites(names []string) ([]uint16, error) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, suite := range suites {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
+
+func parseListener(d *scfg.Directive) (*Listener, error) {
+	var l Listener
+	if err := d.ParseParams(&l.Addr); err != nil {
+		return nil, err
+	}
+
+	for _, child := range d.Children {
+		switch child.Name {
+		case "write-timeout":
+			var str string
+			if err := child.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if v <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			l.WriteTimeout = v
+		case "tcp-nodelay":
+			var str string
+			if err := child.ParseParams(&str); err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseBool(str)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			l.TCPNoDelay = &v
+		default:
+			return nil, fmt.Errorf("directive %q: unknown directive %q", d.Name, child.Name)
+		}
+	}
+
+	return &l, nil
+}
@@ -2,6 +2,7 @@ package soju
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -27,22 +28,63 @@ type ircConn interface {
 	LocalAddr() net.Addr
 }
 
+type netConn net.Conn
+
+type netIRCConn struct {
+	*irc.Conn
+	netConn
+}
+
 func newNetIRCConn(c net.Conn) ircConn {
-	type netConn net.Conn
-	return struct {
-		*irc.Conn
-		netConn
-	}{irc.NewConn(c), c}
+	return netIRCConn{irc.NewConn(c), c}
+}
+
+// tlsConnectionState returns the TLS state of a connection, or nil if the
+// connection doesn't use TLS.
+func tlsConnectionState(ic ircConn) *tls.ConnectionState {
+	nc, ok := ic.(netIRCConn)
+	if !ok {
+		return nil
+	}
+
+	var c net.Conn = nc.netConn
+	for {
+		switch cc := c.(type) {
+		case *tls.Conn:
+			state := cc.ConnectionState()
+			return &state
+		case interface{ Raw() net.Conn }: // e.g. PROXY protocol
+			c = cc.Raw()
+		default:
+			return nil
+		}
+	}
 }
 
+// WebSocket subprotocols defined in the IRCv3 WebSocket specification. With
+// the binary subprotocol, messages aren't required to be valid UTF-8.
+const (
+	websocketBinarySubprotocol = "binary.ircv3.net"
+	websocketTextSubprotocol   = "text.ircv3.net"
+)
+
+// websocketSubprotocols lists the supported subprotocols, by order of
+// preference.
+var websocketSubprotocols = []string{websocketBinarySubprotocol, websocketTextSubprotocol}
+
 type websocketIRCConn struct {
 	conn                        *websocket.Conn
 	readDeadline, writeDeadline time.Time
 	remoteAddr                  string
+	binary                      bool
 }
 
-func newWebsocketIRCConn(c *websocket.Conn, remoteAddr string) ircConn {
-	return &websocketIRCConn{conn: c, remoteAddr: remoteAddr}
+func newWebsocketIRCConn(c *websocket.Conn, remoteAddr string) *websocketIRCConn {
+	return &websocketIRCConn{
+		conn:       c,
+		remoteAddr: remoteAddr,
+		binary:     strings.EqualFold(c.Subprotocol(), websocketBinarySubprotocol),
+	}
 }
 
 func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
@@ -65,14 +107,23 @@ func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
 }
 
 func (wic *websocketIRCConn) WriteMessage(msg *irc.Message) error {
-	b := []byte(strings.ToValidUTF8(msg.String(), string(unicode.ReplacementChar)))
+	// Text frames must contain valid UTF-8, binary frames are sent as-is
+	typ := websocket.MessageText
+	var b []byte
+	if wic.binary {
+		typ = websocket.MessageBinary
+		b = []byte(msg.String())
+	} else {
+		b = []byte(strings.ToValidUTF8(msg.String(), string(unicode.ReplacementChar)))
+	}
+
 	ctx := context.Background()
 	if !wic.writeDeadline.IsZero() {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, wic.writeDeadline)
 		defer cancel()
 	}
-	return wic.conn.Write(ctx, websocket.MessageText, b)
+	return wic.conn.Write(ctx, typ, b)
 }
 
 func isErrWebSocketClosed(err error) bool {
@@ -89,6 +140,24 @@ func (wic *websocketIRCConn) Close() error {
 	return err
 }
 
+// pingLoop sends a WebSocket ping at the specified interval, and closes the
+// connection if a ping isn't answered before the next one is due. It returns
+// when the connection is closed.
+func (wic *websocketIRCConn) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := wic.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			wic.Close()
+			return
+		}
+	}
+}
+
 func (wic *websocketIRCConn) SetReadDeadline(t time.Time) error {
 	wic.readDeadline = t
 	return nil
@@ -123,27 +192,52 @@ type connOptions struct {
 	Logger         Logger
 	RateLimitDelay time.Duration
 	RateLimitBurst int
+	WriteTimeout   time.Duration // zero for the default
+	// If non-nil, blocks until a message can be sent, on top of the
+	// connection rate limit
+	WaitMessage func(ctx context.Context, msg *irc.Message) error
+	// If non-nil, reports whether the text of a message may contain
+	// credentials and must be left out of the logs
+	Redact func(msg *irc.Message) bool
+	// If true, SendMessage never blocks: outgoing messages are queued in
+	// memory until they're written, or until the write timeout closes the
+	// connection if the other side stops reading
+	UnboundedQueue bool
 }
 
 type conn struct {
 	conn   ircConn
 	srv    *Server
 	logger Logger
+	redact func(msg *irc.Message) bool
 
-	lock     sync.Mutex
-	outgoing chan<- *irc.Message
-	closed   bool
-	closedCh chan struct{}
+	lock      sync.Mutex
+	outgoing  chan<- *irc.Message
+	closed    bool
+	closedCh  chan struct{}
+	closeOnce *sync.Once // closes closedCh, shared by copies
 }
 
 func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 	outgoing := make(chan *irc.Message, 64)
 	c := &conn{
-		conn:     ic,
-		srv:      srv,
-		outgoing: outgoing,
-		logger:   options.Logger,
-		closedCh: make(chan struct{}),
+		conn:      ic,
+		srv:       srv,
+		outgoing:  outgoing,
+		logger:    options.Logger,
+		redact:    options.Redact,
+		closedCh:  make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+
+	timeout := options.WriteTimeout
+	if timeout == 0 {
+		timeout = writeTimeout
+	}
+
+	var writes <-chan *irc.Message = outgoing
+	if options.UnboundedQueue {
+		writes = queueMessages(outgoing)
 	}
 
 	go func() {
@@ -151,13 +245,18 @@ func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 		defer cancel()
 
 		rl := rate.NewLimiter(rate.Every(options.RateLimitDelay), options.RateLimitBurst)
-		for msg := range outgoing {
+		for msg := range writes {
 			if err := rl.Wait(ctx); err != nil {
 				break
 			}
+			if options.WaitMessage != nil {
+				if err := options.WaitMessage(ctx, msg); err != nil {
+					break
+				}
+			}
 
-			c.logger.Debugf("sent: %v", msg)
-			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			c.logger.Debugf("sent: %v", c.redactMessage(msg))
+			c.conn.SetWriteDeadline(time.Now().Add(timeout))
 			if err := c.conn.WriteMessage(msg); err != nil {
 				c.logger.Printf("failed to write message: %v", err)
 				break
@@ -168,8 +267,10 @@ func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 		} else {
 			c.logger.Debugf("connection closed")
 		}
+		// The connection may have been closed by Shutdown
+		c.closeOnce.Do(func() { close(c.closedCh) })
 		// Drain the outgoing channel to prevent SendMessage from blocking
-		for range outgoing {
+		for range writes {
 			// This space is intentionally left blank
 		}
 	}()
@@ -178,6 +279,67 @@ func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 	return c
 }
 
+// queueMessages forwards the messages received from in to the returned
+// channel, queueing them in memory so that sending to in never blocks. The
+// returned channel is closed once in is closed and the queue is empty.
+func queueMessages(in <-chan *irc.Message) <-chan *irc.Message {
+	out := make(chan *irc.Message)
+	go func() {
+		defer close(out)
+
+		var queue []*irc.Message
+		for in != nil || len(queue) > 0 {
+			var send chan<- *irc.Message
+			var next *irc.Message
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, msg)
+			case send <- next:
+				queue[0] = nil // allow the message to be garbage collected
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// redactMessage returns a version of msg suitable for logging, with server
+// passwords and SASL payloads left out.
+func redactMessage(msg *irc.Message) *irc.Message {
+	switch msg.Command {
+	case "PASS", "WEBIRC", "AUTHENTICATE":
+	default:
+		return msg
+	}
+	msg = msg.Copy()
+	for i := range msg.Params {
+		msg.Params[i] = "<redacted>"
+	}
+	return msg
+}
+
+// redactMessage is like the redactMessage function, but also leaves out the
+// text of the messages selected by connOptions.Redact.
+func (c *conn) redactMessage(msg *irc.Message) *irc.Message {
+	if c.redact == nil || !c.redact(msg) {
+		return redactMessage(msg)
+	}
+	msg = msg.Copy()
+	for i := 1; i < len(msg.Params); i++ {
+		msg.Params[i] = "<redacted>"
+	}
+	return msg
+}
+
 func (c *conn) isClosed() bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -196,10 +358,26 @@ func (c *conn) Close() error {
 	err := c.conn.Close()
 	c.closed = true
 	close(c.outgoing)
-	close(c.closedCh)
+	c.closeOnce.Do(func() { close(c.closedCh) })
 	return err
 }
 
+// Shutdown closes the connection once the queued outgoing messages have been
+// sent, e.g. to deliver an ERROR message. It is safe to call from any
+// goroutine.
+func (c *conn) Shutdown() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return fmt.Errorf("connection already closed")
+	}
+
+	c.closed = true
+	close(c.outgoing)
+	return nil
+}
+
 func (c *conn) ReadMessage() (*irc.Message, error) {
 	msg, err := c.conn.ReadMessage()
 	if isErrClosed(err) {
@@ -208,7 +386,7 @@ func (c *conn) ReadMessage() (*irc.Message, error) {
 		return nil, err
 	}
 
-	c.logger.Debugf("received: %v", msg)
+	c.logger.Debugf("received: %v", c.redactMessage(msg))
 	return msg, nil
 }
 
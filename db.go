@@ -2,6 +2,7 @@ package soju
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/url"
 	"strings"
@@ -31,6 +32,12 @@ type Database interface {
 
 	GetReadReceipt(ctx context.Context, networkID int64, name string) (*ReadReceipt, error)
 	StoreReadReceipt(ctx context.Context, networkID int64, receipt *ReadReceipt) error
+
+	// Subscribe returns a channel receiving changes made by other soju
+	// instances sharing the same database. The channel is closed when the
+	// context is cancelled. Failures to notify other instances of our own
+	// changes are reported to logger from then on.
+	Subscribe(ctx context.Context, logger Logger) (<-chan DatabaseEvent, error)
 }
 
 type MetricsCollectorDatabase interface {
@@ -38,17 +45,70 @@ type MetricsCollectorDatabase interface {
 	RegisterMetrics(r prometheus.Registerer) error
 }
 
+// DatabaseOptions contains the connection pool settings of a database. Zero
+// values leave the database/sql defaults.
+type DatabaseOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func (options *DatabaseOptions) validate() error {
+	if options.MaxOpenConns < 0 || options.MaxIdleConns < 0 {
+		return fmt.Errorf("connection count must not be negative")
+	}
+	if options.ConnMaxLifetime < 0 {
+		return fmt.Errorf("connection lifetime must not be negative")
+	}
+	if options.MaxOpenConns > 0 && options.MaxIdleConns > options.MaxOpenConns {
+		return fmt.Errorf("max idle connections (%v) exceeds max open connections (%v)", options.MaxIdleConns, options.MaxOpenConns)
+	}
+	return nil
+}
+
+func (options *DatabaseOptions) apply(db *sql.DB) {
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+	}
+	if options.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(options.MaxIdleConns)
+	}
+	if options.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	}
+}
+
 func OpenDB(driver, source string) (Database, error) {
+	return OpenDBWithOptions(driver, source, &DatabaseOptions{})
+}
+
+// OpenDBWithOptions is like OpenDB, but applies connection pool settings.
+func OpenDBWithOptions(driver, source string, options *DatabaseOptions) (Database, error) {
+	if err := options.validate(); err != nil {
+		return nil, fmt.Errorf("invalid database options: %v", err)
+	}
+
 	switch driver {
 	case "sqlite3":
-		return OpenSqliteDB(source)
+		return openSqliteDB(source, options)
 	case "postgres":
-		return OpenPostgresDB(source)
+		return openPostgresDB(source, options)
 	default:
 		return nil, fmt.Errorf("unsupported database driver: %q", driver)
 	}
 }
 
+// DatabaseEvent is sent when a user or network record has been created,
+// updated or deleted by another soju instance.
+type DatabaseEvent struct {
+	UserID int64
+	// Zero if the user record itself has changed
+	NetworkID int64
+	// Username of the user record, empty if it has been deleted or if a
+	// network record has changed
+	Username string
+}
+
 type DatabaseStats struct {
 	Users    int64
 	Networks int64
@@ -61,14 +121,55 @@ type User struct {
 	Password string // hashed
 	Realname string
 	Admin    bool
+	Timezone string // IANA time zone name, empty for UTC
+	MOTD     string
+
+	// Nick or hostmask patterns of ignored senders
+	IgnoreMasks []string
+	// Whether messages from ignored senders are still logged
+	LogIgnored bool
+	// Maximum number of concurrent downstream connections: zero means the
+	// server default, a negative value means no limit
+	MaxDownstreams int
+	// SHA-256 fingerprints (lowercase hex) of the TLS client certificates
+	// accepted for SASL EXTERNAL authentication
+	CertFingerprints []string
+	// Source IP addresses used to connect to upstream networks, overriding
+	// the address picked from the upstream-user-ip ranges
+	UpstreamIPs []string
+	// Maximum size in bytes of the user's message logs: zero means the server
+	// default, a negative value means no limit
+	LogQuota int64
+	// Whether the user can manage the users it owns with admin commands,
+	// without being a server admin
+	LimitedAdmin bool
+	// ID of the limited admin owning this user, zero if none
+	Owner int64
+	// Maximum number of messages replayed per target when a downstream
+	// connection is established: zero means the server default
+	BacklogLimit int
+	// Message store of the user, one of the msgStore* constants: empty means
+	// the server default
+	MsgStore string
+	// Delay between network creations and deletions once the burst is
+	// exhausted: zero means the server default, a negative value means no
+	// limit
+	NetworkChangeDelay time.Duration
 }
 
 type SASL struct {
 	Mechanism string
+	// Ordered list of mechanisms to attempt during registration, each one
+	// being tried if the previous one failed. If empty, only Mechanism is
+	// attempted.
+	Mechanisms []string
 
 	Plain struct {
 		Username string
 		Password string
+		// Authorization identity, if different from Username. Only used by
+		// the PLAIN mechanism.
+		Authzid string
 	}
 
 	// TLS client certificate authentication.
@@ -80,6 +181,39 @@ type SASL struct {
 	}
 }
 
+// NickServ contains credentials sent to the nickname service of networks
+// without SASL support.
+type NickServ struct {
+	// Nickname of the service, empty for "NickServ"
+	Nick string
+	// Template of the message sent to the service, empty for
+	// defaultNickServCommand. "{nick}" and "{password}" are replaced with the
+	// current nickname and the password.
+	Command  string
+	Password string
+}
+
+// mechanisms returns the ordered list of mechanisms to attempt.
+func (auth *SASL) mechanisms() []string {
+	if len(auth.Mechanisms) > 0 {
+		return auth.Mechanisms
+	}
+	if auth.Mechanism != "" {
+		return []string{auth.Mechanism}
+	}
+	return nil
+}
+
+// uses checks whether the credentials for a mechanism are needed.
+func (auth *SASL) uses(mech string) bool {
+	for _, m := range auth.mechanisms() {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
 type Network struct {
 	ID              int64
 	Name            string
@@ -91,6 +225,115 @@ type Network struct {
 	ConnectCommands []string
 	SASL            SASL
 	Enabled         bool
+	NoLogging       bool
+	FallbackNicks   []string
+	MOTD            string
+	AutoJoin        []AutoJoinChannel
+	// Relay post-registration SASL exchanges from downstreams to the upstream
+	SASLPassthrough bool
+	// Upstream flood protection parameters, zero for the server default
+	MessageDelay time.Duration
+	MessageBurst int
+	// Character encoding of the network, empty for UTF-8
+	Charset string
+	// Don't mark the user as away when no client is connected
+	NoAutoAway bool
+	// Away message set when no client is connected, empty for the default
+	AwayMessage string
+	// Group used by clients to organize networks, slash-separated for nested
+	// groups (e.g. "work/internal"). Not interpreted by soju.
+	Group string
+	// Split messages too long for the upstream server instead of letting the
+	// server truncate them
+	SplitLongMessages bool
+	// Reply to CTCP queries when no client is attached. CTCPVersion and
+	// CTCPSource override the VERSION and SOURCE replies.
+	CTCPAutoReply bool
+	CTCPVersion   string
+	CTCPSource    string
+	// Act as a thin relay: messages aren't stored, channels are never
+	// auto-detached and no backlog is replayed
+	Passthrough bool
+	// Timeout for connecting to the network, zero for the server default
+	ConnectTimeout time.Duration
+	// Never auto-detach channels, regardless of their detach-after setting
+	NoAutoDetach bool
+	// Position of the network when presented to clients, lowest first. Zero
+	// means no explicit position: such networks are listed last, by ID.
+	SortOrder int
+	// Hex-encoded SHA-256 fingerprint of the expected upstream TLS
+	// certificate or of its public key (SPKI). If set, it replaces the
+	// validation against the system CA pool.
+	TLSFingerprint string
+	// Handling of the NOTICEs sent by the server itself: empty to relay them,
+	// "drop" or "redirect" to a separate query. The policy only applies to
+	// the notices matching a ServerNoticeDeny pattern (or to all of them if
+	// there is none) and no ServerNoticeAllow pattern.
+	ServerNotices     string
+	ServerNoticeAllow []string
+	ServerNoticeDeny  []string
+	// Only connect to the network while a client is attached to it, and
+	// disconnect OnDemandGrace after the last client leaves (zero for the
+	// server default)
+	OnDemand      bool
+	OnDemandGrace time.Duration
+	// Identify with NickServ after connecting if SASL didn't log in, unless
+	// NickServ.Password is empty
+	NickServ NickServ
+	// WEBIRC credentials sent before registering, so that the upstream server
+	// sees the user's IP address instead of soju's, unless WebIRCPassword is
+	// empty
+	WebIRCPassword string
+	WebIRCGateway  string
+	// Pacing of the JOIN messages sent upon connection: at most JoinBatch
+	// channels per message (zero for the server's advertised limit), and one
+	// message every JoinDelay (zero to only apply the message rate limit)
+	JoinDelay time.Duration
+	JoinBatch int
+	// Minimum TLS version, overriding the server's upstream TLS policy (zero
+	// for the server default)
+	TLSMinVersion uint16
+	// Shift the server-time tags of the messages received from the network
+	// when its clock is off, see maxServerTimeSkew
+	CorrectServerTime bool
+
+	// STS policy of the network, only used for plain-text addresses
+	STSPort      int
+	STSExpiresAt time.Time
+}
+
+// AutoJoinChannel is a channel joined each time soju connects to a network.
+type AutoJoinChannel struct {
+	Name string
+	Key  string
+}
+
+func formatAutoJoin(channels []AutoJoinChannel) string {
+	l := make([]string, len(channels))
+	for i, ch := range channels {
+		l[i] = ch.Name
+		if ch.Key != "" {
+			l[i] += " " + ch.Key
+		}
+	}
+	return strings.Join(l, "\r\n")
+}
+
+func parseAutoJoin(s string) []AutoJoinChannel {
+	var channels []AutoJoinChannel
+	for _, line := range strings.Split(s, "\r\n") {
+		if line == "" {
+			continue
+		}
+		var ch AutoJoinChannel
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			ch.Name, ch.Key = line[:i], line[i+1:]
+		} else {
+			ch.Name = line
+		}
+		channels = append(channels, ch)
+	}
+	return channels
 }
 
 func (net *Network) GetName() string {
@@ -163,6 +406,19 @@ func parseFilter(filter string) (MessageFilter, error) {
 	return 0, fmt.Errorf("unknown filter: %q", filter)
 }
 
+func (filter MessageFilter) String() string {
+	switch filter {
+	case FilterNone:
+		return "none"
+	case FilterHighlight:
+		return "highlight"
+	case FilterMessage:
+		return "message"
+	default:
+		return "default"
+	}
+}
+
 type Channel struct {
 	ID   int64
 	Name string
@@ -175,6 +431,23 @@ type Channel struct {
 	ReattachOn    MessageFilter
 	DetachAfter   time.Duration
 	DetachOn      MessageFilter
+	// Whether JOIN, PART, KICK and QUIT messages are relayed as well while
+	// detached, unless RelayDetached is FilterNone
+	RelayDetachedMembership bool
+	// Whether no notification is ever sent for the channel, even for
+	// highlights: detached messages aren't relayed regardless of RelayDetached
+	Muted bool
+
+	NoLogging bool
+
+	// SortOrder is the position of the channel in the channel list, set by the
+	// user. Channels with a zero sort order are listed last.
+	SortOrder int
+
+	// Last known topic, used when the upstream connection is down
+	Topic     string
+	TopicWho  string // prefix of the user who set the topic
+	TopicTime time.Time
 }
 
 type DeliveryReceipt struct {
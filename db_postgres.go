@@ -2,20 +2,28 @@ package soju
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"math"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 const postgresQueryTimeout = 5 * time.Second
 
+// postgresNotifyChannel is the channel used to broadcast changes to other
+// soju instances via LISTEN/NOTIFY.
+const postgresNotifyChannel = "soju"
+
 const postgresConfigSchema = `
 CREATE TABLE IF NOT EXISTS "Config" (
 	id SMALLINT PRIMARY KEY,
@@ -30,10 +38,23 @@ CREATE TABLE "User" (
 	username VARCHAR(255) NOT NULL UNIQUE,
 	password VARCHAR(255),
 	admin BOOLEAN NOT NULL DEFAULT FALSE,
-	realname VARCHAR(255)
+	realname VARCHAR(255),
+	timezone VARCHAR(255),
+	motd TEXT,
+	ignore_masks TEXT,
+	log_ignored BOOLEAN NOT NULL DEFAULT FALSE,
+	max_downstreams INTEGER NOT NULL DEFAULT 0,
+	cert_fingerprints TEXT,
+	upstream_ips TEXT,
+	log_quota BIGINT NOT NULL DEFAULT 0,
+	limited_admin BOOLEAN NOT NULL DEFAULT FALSE,
+	owner INTEGER REFERENCES "User"(id) ON DELETE SET NULL,
+	backlog_limit INTEGER NOT NULL DEFAULT 0,
+	msg_store VARCHAR(255),
+	network_change_delay INTEGER NOT NULL DEFAULT 0
 );
 
-CREATE TYPE sasl_mechanism AS ENUM ('PLAIN', 'EXTERNAL');
+CREATE TYPE sasl_mechanism AS ENUM ('PLAIN', 'EXTERNAL', 'SCRAM-SHA-256');
 
 CREATE TABLE "Network" (
 	id SERIAL PRIMARY KEY,
@@ -51,6 +72,44 @@ CREATE TABLE "Network" (
 	sasl_external_cert BYTEA,
 	sasl_external_key BYTEA,
 	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	no_logging BOOLEAN NOT NULL DEFAULT FALSE,
+	fallback_nicks VARCHAR(1023),
+	motd TEXT,
+	sts_port INTEGER NOT NULL DEFAULT 0,
+	sts_expires_at BIGINT NOT NULL DEFAULT 0,
+	auto_join TEXT,
+	sasl_passthrough BOOLEAN NOT NULL DEFAULT FALSE,
+	message_delay INTEGER NOT NULL DEFAULT 0,
+	message_burst INTEGER NOT NULL DEFAULT 0,
+	sasl_mechanisms VARCHAR(255),
+	charset VARCHAR(255),
+	no_auto_away BOOLEAN NOT NULL DEFAULT FALSE,
+	away_message TEXT,
+	group_name VARCHAR(255),
+	split_long_messages BOOLEAN NOT NULL DEFAULT FALSE,
+	ctcp_auto_reply BOOLEAN NOT NULL DEFAULT FALSE,
+	ctcp_version TEXT,
+	ctcp_source TEXT,
+	passthrough BOOLEAN NOT NULL DEFAULT FALSE,
+	connect_timeout INTEGER NOT NULL DEFAULT 0,
+	no_auto_detach BOOLEAN NOT NULL DEFAULT FALSE,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	tls_fingerprint TEXT,
+	server_notices TEXT,
+	server_notice_allow TEXT,
+	server_notice_deny TEXT,
+	on_demand BOOLEAN NOT NULL DEFAULT FALSE,
+	on_demand_grace INTEGER NOT NULL DEFAULT 0,
+	sasl_plain_authzid VARCHAR(255),
+	nickserv_nick VARCHAR(255),
+	nickserv_command TEXT,
+	nickserv_password VARCHAR(255),
+	webirc_password VARCHAR(255),
+	webirc_gateway VARCHAR(255),
+	join_delay INTEGER NOT NULL DEFAULT 0,
+	join_batch INTEGER NOT NULL DEFAULT 0,
+	tls_min_version INTEGER NOT NULL DEFAULT 0,
+	correct_server_time BOOLEAN NOT NULL DEFAULT FALSE,
 	UNIQUE("user", addr, nick),
 	UNIQUE("user", name)
 );
@@ -66,6 +125,13 @@ CREATE TABLE "Channel" (
 	reattach_on INTEGER NOT NULL DEFAULT 0,
 	detach_after INTEGER NOT NULL DEFAULT 0,
 	detach_on INTEGER NOT NULL DEFAULT 0,
+	no_logging BOOLEAN NOT NULL DEFAULT FALSE,
+	topic TEXT,
+	topic_who VARCHAR(255),
+	topic_time BIGINT NOT NULL DEFAULT 0,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	relay_detached_membership BOOLEAN NOT NULL DEFAULT FALSE,
+	muted BOOLEAN NOT NULL DEFAULT FALSE,
 	UNIQUE(network, name)
 );
 
@@ -106,19 +172,138 @@ var postgresMigrations = []string{
 			UNIQUE(network, target)
 		);
 	`,
+	`
+		ALTER TABLE "Network" ADD COLUMN no_logging BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "Channel" ADD COLUMN no_logging BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	`ALTER TABLE "User" ADD COLUMN timezone VARCHAR(255)`,
+	`ALTER TABLE "Network" ADD COLUMN fallback_nicks VARCHAR(1023)`,
+	`
+		ALTER TABLE "User" ADD COLUMN motd TEXT;
+		ALTER TABLE "Network" ADD COLUMN motd TEXT;
+	`,
+	`
+		ALTER TABLE "Channel" ADD COLUMN topic TEXT;
+		ALTER TABLE "Channel" ADD COLUMN topic_who VARCHAR(255);
+		ALTER TABLE "Channel" ADD COLUMN topic_time BIGINT NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE "User" ADD COLUMN ignore_masks TEXT;
+		ALTER TABLE "User" ADD COLUMN log_ignored BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	`
+		ALTER TABLE "Network" ADD COLUMN sts_port INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN sts_expires_at BIGINT NOT NULL DEFAULT 0;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN auto_join TEXT`,
+	`ALTER TABLE "User" ADD COLUMN max_downstreams INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "Network" ADD COLUMN sasl_passthrough BOOLEAN NOT NULL DEFAULT FALSE`,
+	`
+		ALTER TABLE "Network" ADD COLUMN message_delay INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN message_burst INTEGER NOT NULL DEFAULT 0;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN sasl_mechanisms VARCHAR(255)`,
+	`ALTER TABLE "Channel" ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "User" ADD COLUMN cert_fingerprints TEXT`,
+	`ALTER TABLE "Network" ADD COLUMN charset VARCHAR(255)`,
+	`ALTER TABLE "User" ADD COLUMN upstream_ips TEXT`,
+	`
+		ALTER TABLE "Network" ADD COLUMN no_auto_away BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "Network" ADD COLUMN away_message TEXT;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN group_name VARCHAR(255)`,
+	`ALTER TABLE "User" ADD COLUMN log_quota BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE "Network" ADD COLUMN split_long_messages BOOLEAN NOT NULL DEFAULT FALSE`,
+	`
+		ALTER TABLE "Network" ADD COLUMN ctcp_auto_reply BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "Network" ADD COLUMN ctcp_version TEXT;
+		ALTER TABLE "Network" ADD COLUMN ctcp_source TEXT;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT FALSE`,
+	// ALTER TYPE ... ADD VALUE can't run in a transaction before
+	// PostgreSQL 12: re-create the type instead
+	`
+		ALTER TYPE sasl_mechanism RENAME TO sasl_mechanism_old;
+		CREATE TYPE sasl_mechanism AS ENUM ('PLAIN', 'EXTERNAL', 'SCRAM-SHA-256');
+		ALTER TABLE "Network"
+			ALTER COLUMN sasl_mechanism
+			TYPE sasl_mechanism
+			USING sasl_mechanism::text::sasl_mechanism;
+		DROP TYPE sasl_mechanism_old;
+	`,
+	`
+		ALTER TABLE "User" ADD COLUMN limited_admin BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "User" ADD COLUMN owner INTEGER REFERENCES "User"(id) ON DELETE SET NULL;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN connect_timeout INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "Network" ADD COLUMN no_auto_detach BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE "Network" ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "Network" ADD COLUMN tls_fingerprint TEXT`,
+	`
+		ALTER TABLE "Network" ADD COLUMN server_notices TEXT;
+		ALTER TABLE "Network" ADD COLUMN server_notice_allow TEXT;
+		ALTER TABLE "Network" ADD COLUMN server_notice_deny TEXT;
+	`,
+	`ALTER TABLE "User" ADD COLUMN backlog_limit INTEGER NOT NULL DEFAULT 0`,
+	`
+		ALTER TABLE "Network" ADD COLUMN on_demand BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "Network" ADD COLUMN on_demand_grace INTEGER NOT NULL DEFAULT 0;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN sasl_plain_authzid VARCHAR(255)`,
+	`
+		ALTER TABLE "Network" ADD COLUMN nickserv_nick VARCHAR(255);
+		ALTER TABLE "Network" ADD COLUMN nickserv_command TEXT;
+		ALTER TABLE "Network" ADD COLUMN nickserv_password VARCHAR(255);
+	`,
+	`ALTER TABLE "Channel" ADD COLUMN relay_detached_membership BOOLEAN NOT NULL DEFAULT FALSE`,
+	`
+		ALTER TABLE "Network" ADD COLUMN webirc_password VARCHAR(255);
+		ALTER TABLE "Network" ADD COLUMN webirc_gateway VARCHAR(255);
+	`,
+	`ALTER TABLE "Channel" ADD COLUMN muted BOOLEAN NOT NULL DEFAULT FALSE`,
+	`
+		ALTER TABLE "Network" ADD COLUMN join_delay INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN join_batch INTEGER NOT NULL DEFAULT 0;
+	`,
+	`ALTER TABLE "User" ADD COLUMN msg_store VARCHAR(255)`,
+	`ALTER TABLE "Network" ADD COLUMN tls_min_version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "Network" ADD COLUMN correct_server_time BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE "User" ADD COLUMN network_change_delay INTEGER NOT NULL DEFAULT 0`,
 }
 
 type PostgresDB struct {
-	db *sql.DB
+	db     *sql.DB
+	source string
+	// Random ID used to ignore our own notifications
+	instanceID string
+	// Logger used to report notification failures, set by Subscribe
+	loggerLock sync.Mutex
+	logger     Logger
 }
 
 func OpenPostgresDB(source string) (Database, error) {
+	return openPostgresDB(source, &DatabaseOptions{})
+}
+
+func openPostgresDB(source string, options *DatabaseOptions) (Database, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+
 	sqlPostgresDB, err := sql.Open("postgres", source)
 	if err != nil {
 		return nil, err
 	}
-
-	db := &PostgresDB{db: sqlPostgresDB}
+	options.apply(sqlPostgresDB)
+
+	db := &PostgresDB{
+		db:         sqlPostgresDB,
+		source:     source,
+		instanceID: hex.EncodeToString(b[:]),
+		// Until a server subscribes, e.g. for sojuctl
+		logger: NewLogger(log.Writer(), false),
+	}
 	if err := db.upgrade(); err != nil {
 		sqlPostgresDB.Close()
 		return nil, err
@@ -176,6 +361,70 @@ func (db *PostgresDB) Close() error {
 	return db.db.Close()
 }
 
+func (db *PostgresDB) Subscribe(ctx context.Context, logger Logger) (<-chan DatabaseEvent, error) {
+	db.loggerLock.Lock()
+	db.logger = logger
+	db.loggerLock.Unlock()
+
+	listener := pq.NewListener(db.source, time.Second, time.Minute, nil)
+	if err := listener.Listen(postgresNotifyChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	ch := make(chan DatabaseEvent)
+	go func() {
+		defer close(ch)
+		defer listener.Close()
+
+		for {
+			var n *pq.Notification
+			select {
+			case n = <-listener.Notify:
+			case <-ctx.Done():
+				return
+			}
+			if n == nil {
+				// The connection has been re-established, notifications
+				// may have been lost
+				continue
+			}
+
+			fields := strings.Fields(n.Extra)
+			if len(fields) < 3 || fields[0] == db.instanceID {
+				continue
+			}
+			var ev DatabaseEvent
+			if _, err := fmt.Sscanf(fields[1]+" "+fields[2], "%d %d", &ev.UserID, &ev.NetworkID); err != nil {
+				continue
+			}
+			if len(fields) > 3 {
+				ev.Username = fields[3]
+			}
+
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// notify broadcasts a change to other soju instances. The change has already
+// been committed, so errors are only logged: other instances will pick it up
+// when they restart.
+func (db *PostgresDB) notify(ctx context.Context, userID, networkID int64, username string) {
+	payload := fmt.Sprintf("%v %v %v %v", db.instanceID, userID, networkID, username)
+	if _, err := db.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresNotifyChannel, payload); err != nil {
+		db.loggerLock.Lock()
+		logger := db.logger
+		db.loggerLock.Unlock()
+		logger.Printf("failed to notify other instances of a database change: %v", err)
+	}
+}
+
 func (db *PostgresDB) RegisterMetrics(r prometheus.Registerer) error {
 	if err := r.Register(&postgresMetricsCollector{db}); err != nil {
 		return err
@@ -204,7 +453,11 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx,
-		`SELECT id, username, password, admin, realname FROM "User"`)
+		`SELECT id, username, password, admin, realname, timezone, motd,
+			ignore_masks, log_ignored, max_downstreams, cert_fingerprints,
+			upstream_ips, log_quota, limited_admin, owner, backlog_limit,
+			msg_store, network_change_delay
+		FROM "User"`)
 	if err != nil {
 		return nil, err
 	}
@@ -213,12 +466,28 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, realname sql.NullString
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname); err != nil {
+		var password, realname, timezone, motd, ignoreMasks, certFingerprints, upstreamIPs, msgStore sql.NullString
+		var owner sql.NullInt64
+		var networkChangeDelay int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname, &timezone, &motd, &ignoreMasks, &user.LogIgnored, &user.MaxDownstreams, &certFingerprints, &upstreamIPs, &user.LogQuota, &user.LimitedAdmin, &owner, &user.BacklogLimit, &msgStore, &networkChangeDelay); err != nil {
 			return nil, err
 		}
+		user.Owner = owner.Int64
 		user.Password = password.String
 		user.Realname = realname.String
+		user.Timezone = timezone.String
+		user.MOTD = motd.String
+		user.MsgStore = msgStore.String
+		user.NetworkChangeDelay = time.Duration(networkChangeDelay) * time.Millisecond
+		if ignoreMasks.Valid {
+			user.IgnoreMasks = strings.Split(ignoreMasks.String, " ")
+		}
+		if certFingerprints.Valid {
+			user.CertFingerprints = strings.Split(certFingerprints.String, " ")
+		}
+		if upstreamIPs.Valid {
+			user.UpstreamIPs = strings.Split(upstreamIPs.String, " ")
+		}
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -234,15 +503,35 @@ func (db *PostgresDB) GetUser(ctx context.Context, username string) (*User, erro
 
 	user := &User{Username: username}
 
-	var password, realname sql.NullString
+	var password, realname, timezone, motd, ignoreMasks, certFingerprints, upstreamIPs, msgStore sql.NullString
+	var owner sql.NullInt64
+	var networkChangeDelay int64
 	row := db.db.QueryRowContext(ctx,
-		`SELECT id, password, admin, realname FROM "User" WHERE username = $1`,
+		`SELECT id, password, admin, realname, timezone, motd, ignore_masks, log_ignored,
+			max_downstreams, cert_fingerprints, upstream_ips, log_quota, limited_admin,
+			owner, backlog_limit, msg_store, network_change_delay
+		FROM "User"
+		WHERE username = $1`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &realname); err != nil {
+	if err := row.Scan(&user.ID, &password, &user.Admin, &realname, &timezone, &motd, &ignoreMasks, &user.LogIgnored, &user.MaxDownstreams, &certFingerprints, &upstreamIPs, &user.LogQuota, &user.LimitedAdmin, &owner, &user.BacklogLimit, &msgStore, &networkChangeDelay); err != nil {
 		return nil, err
 	}
+	user.Owner = owner.Int64
 	user.Password = password.String
 	user.Realname = realname.String
+	user.Timezone = timezone.String
+	user.MOTD = motd.String
+	user.MsgStore = msgStore.String
+	user.NetworkChangeDelay = time.Duration(networkChangeDelay) * time.Millisecond
+	if ignoreMasks.Valid {
+		user.IgnoreMasks = strings.Split(ignoreMasks.String, " ")
+	}
+	if certFingerprints.Valid {
+		user.CertFingerprints = strings.Split(certFingerprints.String, " ")
+	}
+	if upstreamIPs.Valid {
+		user.UpstreamIPs = strings.Split(upstreamIPs.String, " ")
+	}
 	return user, nil
 }
 
@@ -252,30 +541,58 @@ func (db *PostgresDB) StoreUser(ctx context.Context, user *User) error {
 
 	password := toNullString(user.Password)
 	realname := toNullString(user.Realname)
+	timezone := toNullString(user.Timezone)
+	motd := toNullString(user.MOTD)
+	ignoreMasks := toNullString(strings.Join(user.IgnoreMasks, " "))
+	certFingerprints := toNullString(strings.Join(user.CertFingerprints, " "))
+	upstreamIPs := toNullString(strings.Join(user.UpstreamIPs, " "))
+	owner := toNullInt64(user.Owner)
+	msgStore := toNullString(user.MsgStore)
 
 	var err error
 	if user.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
-			INSERT INTO "User" (username, password, admin, realname)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO "User" (username, password, admin, realname, timezone, motd,
+				ignore_masks, log_ignored, max_downstreams, cert_fingerprints,
+				upstream_ips, log_quota, limited_admin, owner, backlog_limit, msg_store,
+				network_change_delay)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+				$17)
 			RETURNING id`,
-			user.Username, password, user.Admin, realname).Scan(&user.ID)
+			user.Username, password, user.Admin, realname, timezone, motd, ignoreMasks,
+			user.LogIgnored, user.MaxDownstreams, certFingerprints, upstreamIPs,
+			user.LogQuota, user.LimitedAdmin, owner, user.BacklogLimit,
+			msgStore, user.NetworkChangeDelay.Milliseconds()).Scan(&user.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "User"
-			SET password = $1, admin = $2, realname = $3
-			WHERE id = $4`,
-			password, user.Admin, realname, user.ID)
+			SET username = $1, password = $2, admin = $3, realname = $4, timezone = $5,
+				motd = $6, ignore_masks = $7, log_ignored = $8, max_downstreams = $9,
+				cert_fingerprints = $10, upstream_ips = $11, log_quota = $12,
+				limited_admin = $13, owner = $14, backlog_limit = $15, msg_store = $16,
+				network_change_delay = $17
+			WHERE id = $18`,
+			user.Username, password, user.Admin, realname, timezone, motd, ignoreMasks,
+			user.LogIgnored, user.MaxDownstreams, certFingerprints, upstreamIPs,
+			user.LogQuota, user.LimitedAdmin, owner, user.BacklogLimit, msgStore,
+			user.NetworkChangeDelay.Milliseconds(), user.ID)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	db.notify(ctx, user.ID, 0, user.Username)
+	return nil
 }
 
 func (db *PostgresDB) DeleteUser(ctx context.Context, id int64) error {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
 
-	_, err := db.db.ExecContext(ctx, `DELETE FROM "User" WHERE id = $1`, id)
-	return err
+	if _, err := db.db.ExecContext(ctx, `DELETE FROM "User" WHERE id = $1`, id); err != nil {
+		return err
+	}
+	db.notify(ctx, id, 0, "")
+	return nil
 }
 
 func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network, error) {
@@ -284,7 +601,16 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, pass, connect_commands, sasl_mechanism,
-			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, enabled
+			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, enabled,
+			no_logging, fallback_nicks, motd, sts_port, sts_expires_at, auto_join,
+			sasl_passthrough, message_delay, message_burst, sasl_mechanisms, charset,
+			no_auto_away, away_message, group_name, split_long_messages, ctcp_auto_reply,
+			ctcp_version, ctcp_source, passthrough, connect_timeout, no_auto_detach,
+			sort_order, tls_fingerprint, server_notices, server_notice_allow,
+			server_notice_deny, on_demand, on_demand_grace, sasl_plain_authzid,
+			nickserv_nick, nickserv_command, nickserv_password, webirc_password,
+			webirc_gateway, join_delay, join_batch, tls_min_version,
+			correct_server_time
 		FROM "Network"
 		WHERE "user" = $1`, userID)
 	if err != nil {
@@ -296,10 +622,25 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 	for rows.Next() {
 		var net Network
 		var name, nick, username, realname, pass, connectCommands sql.NullString
-		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var saslMechanism, saslPlainUsername, saslPlainPassword, saslPlainAuthzid sql.NullString
+		var fallbackNicks, motd, autoJoin, saslMechanisms, charset, awayMessage, group, tlsFingerprint sql.NullString
+		var ctcpVersion, ctcpSource sql.NullString
+		var serverNotices, serverNoticeAllow, serverNoticeDeny sql.NullString
+		var nickServNick, nickServCommand, nickServPassword sql.NullString
+		var webIRCPassword, webIRCGateway sql.NullString
+		var stsExpiresAt, messageDelay, connectTimeout, onDemandGrace, joinDelay int64
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled,
+			&net.NoLogging, &fallbackNicks, &motd, &net.STSPort, &stsExpiresAt, &autoJoin,
+			&net.SASLPassthrough, &messageDelay, &net.MessageBurst, &saslMechanisms, &charset,
+			&net.NoAutoAway, &awayMessage, &group, &net.SplitLongMessages,
+			&net.CTCPAutoReply, &ctcpVersion, &ctcpSource, &net.Passthrough,
+			&connectTimeout, &net.NoAutoDetach, &net.SortOrder, &tlsFingerprint,
+			&serverNotices, &serverNoticeAllow, &serverNoticeDeny, &net.OnDemand,
+			&onDemandGrace, &saslPlainAuthzid, &nickServNick, &nickServCommand,
+			&nickServPassword, &webIRCPassword, &webIRCGateway, &joinDelay,
+			&net.JoinBatch, &net.TLSMinVersion, &net.CorrectServerTime)
 		if err != nil {
 			return nil, err
 		}
@@ -314,6 +655,40 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.SASL.Plain.Authzid = saslPlainAuthzid.String
+		net.NickServ.Nick = nickServNick.String
+		net.NickServ.Command = nickServCommand.String
+		net.NickServ.Password = nickServPassword.String
+		net.WebIRCPassword = webIRCPassword.String
+		net.WebIRCGateway = webIRCGateway.String
+		if saslMechanisms.Valid {
+			net.SASL.Mechanisms = strings.Split(saslMechanisms.String, ",")
+		}
+		net.Charset = charset.String
+		net.AwayMessage = awayMessage.String
+		net.Group = group.String
+		net.TLSFingerprint = tlsFingerprint.String
+		net.CTCPVersion = ctcpVersion.String
+		net.CTCPSource = ctcpSource.String
+		net.ServerNotices = serverNotices.String
+		if serverNoticeAllow.Valid {
+			net.ServerNoticeAllow = strings.Split(serverNoticeAllow.String, "\r\n")
+		}
+		if serverNoticeDeny.Valid {
+			net.ServerNoticeDeny = strings.Split(serverNoticeDeny.String, "\r\n")
+		}
+		if fallbackNicks.Valid {
+			net.FallbackNicks = strings.Split(fallbackNicks.String, ",")
+		}
+		net.MOTD = motd.String
+		if stsExpiresAt != 0 {
+			net.STSExpiresAt = time.Unix(stsExpiresAt, 0)
+		}
+		net.AutoJoin = parseAutoJoin(autoJoin.String)
+		net.MessageDelay = time.Duration(messageDelay) * time.Millisecond
+		net.ConnectTimeout = time.Duration(connectTimeout) * time.Millisecond
+		net.OnDemandGrace = time.Duration(onDemandGrace) * time.Millisecond
+		net.JoinDelay = time.Duration(joinDelay) * time.Millisecond
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -333,55 +708,142 @@ func (db *PostgresDB) StoreNetwork(ctx context.Context, userID int64, network *N
 	realname := toNullString(network.Realname)
 	pass := toNullString(network.Pass)
 	connectCommands := toNullString(strings.Join(network.ConnectCommands, "\r\n"))
+	fallbackNicks := toNullString(strings.Join(network.FallbackNicks, ","))
+	motd := toNullString(network.MOTD)
+	autoJoin := toNullString(formatAutoJoin(network.AutoJoin))
+	var stsExpiresAt int64
+	if !network.STSExpiresAt.IsZero() {
+		stsExpiresAt = network.STSExpiresAt.Unix()
+	}
 
-	var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+	var saslMechanism, saslPlainUsername, saslPlainPassword, saslPlainAuthzid sql.NullString
 	if network.SASL.Mechanism != "" {
 		saslMechanism = toNullString(network.SASL.Mechanism)
-		switch network.SASL.Mechanism {
-		case "PLAIN":
-			saslPlainUsername = toNullString(network.SASL.Plain.Username)
-			saslPlainPassword = toNullString(network.SASL.Plain.Password)
-			network.SASL.External.CertBlob = nil
-			network.SASL.External.PrivKeyBlob = nil
-		case "EXTERNAL":
-			// keep saslPlain* nil
+	}
+	for _, mech := range network.SASL.mechanisms() {
+		switch mech {
+		case "PLAIN", "EXTERNAL", scramSHA256:
+			// ok
 		default:
-			return fmt.Errorf("soju: cannot store network: unsupported SASL mechanism %q", network.SASL.Mechanism)
+			return fmt.Errorf("soju: cannot store network: unsupported SASL mechanism %q", mech)
 		}
 	}
+	if network.SASL.uses("PLAIN") || network.SASL.uses(scramSHA256) {
+		saslPlainUsername = toNullString(network.SASL.Plain.Username)
+		saslPlainPassword = toNullString(network.SASL.Plain.Password)
+	}
+	if network.SASL.uses("PLAIN") {
+		saslPlainAuthzid = toNullString(network.SASL.Plain.Authzid)
+	}
+	if network.SASL.Mechanism != "" && !network.SASL.uses("EXTERNAL") {
+		network.SASL.External.CertBlob = nil
+		network.SASL.External.PrivKeyBlob = nil
+	}
+	saslMechanisms := toNullString(strings.Join(network.SASL.Mechanisms, ","))
+	charset := toNullString(network.Charset)
+	awayMessage := toNullString(network.AwayMessage)
+	group := toNullString(network.Group)
+	tlsFingerprint := toNullString(network.TLSFingerprint)
+	serverNotices := toNullString(network.ServerNotices)
+	serverNoticeAllow := toNullString(strings.Join(network.ServerNoticeAllow, "\r\n"))
+	serverNoticeDeny := toNullString(strings.Join(network.ServerNoticeDeny, "\r\n"))
+	ctcpVersion := toNullString(network.CTCPVersion)
+	ctcpSource := toNullString(network.CTCPSource)
+	nickServNick := toNullString(network.NickServ.Nick)
+	nickServCommand := toNullString(network.NickServ.Command)
+	nickServPassword := toNullString(network.NickServ.Password)
+	webIRCPassword := toNullString(network.WebIRCPassword)
+	webIRCGateway := toNullString(network.WebIRCGateway)
 
 	var err error
 	if network.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
 			INSERT INTO "Network" ("user", name, addr, nick, username, realname, pass, connect_commands,
 				sasl_mechanism, sasl_plain_username, sasl_plain_password, sasl_external_cert,
-				sasl_external_key, enabled)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+				sasl_external_key, enabled, no_logging, fallback_nicks, motd, sts_port,
+				sts_expires_at, auto_join, sasl_passthrough, message_delay, message_burst,
+				sasl_mechanisms, charset, no_auto_away, away_message, group_name,
+				split_long_messages, ctcp_auto_reply, ctcp_version, ctcp_source, passthrough,
+				connect_timeout, no_auto_detach, sort_order, tls_fingerprint, server_notices,
+				server_notice_allow, server_notice_deny, on_demand, on_demand_grace,
+				sasl_plain_authzid, nickserv_nick, nickserv_command, nickserv_password,
+				webirc_password, webirc_gateway, join_delay, join_batch,
+				tls_min_version, correct_server_time)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17,
+				$18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33,
+				$34, $35, $36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47, $48,
+				$49, $50, $51, $52)
 			RETURNING id`,
 			userID, netName, network.Addr, nick, netUsername, realname, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.Enabled).Scan(&network.ID)
+			network.SASL.External.PrivKeyBlob, network.Enabled, network.NoLogging,
+			fallbackNicks, motd, network.STSPort, stsExpiresAt, autoJoin,
+			network.SASLPassthrough, network.MessageDelay.Milliseconds(),
+			network.MessageBurst, saslMechanisms, charset, network.NoAutoAway,
+			awayMessage, group, network.SplitLongMessages, network.CTCPAutoReply,
+			ctcpVersion, ctcpSource, network.Passthrough,
+			network.ConnectTimeout.Milliseconds(), network.NoAutoDetach,
+			network.SortOrder, tlsFingerprint, serverNotices, serverNoticeAllow,
+			serverNoticeDeny, network.OnDemand,
+			network.OnDemandGrace.Milliseconds(), saslPlainAuthzid, nickServNick,
+			nickServCommand, nickServPassword, webIRCPassword, webIRCGateway,
+			network.JoinDelay.Milliseconds(), network.JoinBatch,
+			network.TLSMinVersion, network.CorrectServerTime).Scan(&network.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "Network"
 			SET name = $2, addr = $3, nick = $4, username = $5, realname = $6, pass = $7,
 				connect_commands = $8, sasl_mechanism = $9, sasl_plain_username = $10,
 				sasl_plain_password = $11, sasl_external_cert = $12, sasl_external_key = $13,
-				enabled = $14
+				enabled = $14, no_logging = $15, fallback_nicks = $16, motd = $17,
+				sts_port = $18, sts_expires_at = $19, auto_join = $20, sasl_passthrough = $21,
+				message_delay = $22, message_burst = $23, sasl_mechanisms = $24,
+				charset = $25, no_auto_away = $26, away_message = $27, group_name = $28,
+				split_long_messages = $29, ctcp_auto_reply = $30, ctcp_version = $31,
+				ctcp_source = $32, passthrough = $33, connect_timeout = $34,
+				no_auto_detach = $35, sort_order = $36, tls_fingerprint = $37,
+				server_notices = $38, server_notice_allow = $39, server_notice_deny = $40,
+				on_demand = $41, on_demand_grace = $42, sasl_plain_authzid = $43,
+				nickserv_nick = $44, nickserv_command = $45, nickserv_password = $46,
+				webirc_password = $47, webirc_gateway = $48, join_delay = $49,
+				join_batch = $50, tls_min_version = $51,
+				correct_server_time = $52
 			WHERE id = $1`,
 			network.ID, netName, network.Addr, nick, netUsername, realname, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.Enabled)
+			network.SASL.External.PrivKeyBlob, network.Enabled, network.NoLogging,
+			fallbackNicks, motd, network.STSPort, stsExpiresAt, autoJoin,
+			network.SASLPassthrough, network.MessageDelay.Milliseconds(),
+			network.MessageBurst, saslMechanisms, charset, network.NoAutoAway,
+			awayMessage, group, network.SplitLongMessages, network.CTCPAutoReply,
+			ctcpVersion, ctcpSource, network.Passthrough,
+			network.ConnectTimeout.Milliseconds(), network.NoAutoDetach,
+			network.SortOrder, tlsFingerprint, serverNotices, serverNoticeAllow,
+			serverNoticeDeny, network.OnDemand, network.OnDemandGrace.Milliseconds(),
+			saslPlainAuthzid, nickServNick, nickServCommand, nickServPassword,
+			webIRCPassword, webIRCGateway, network.JoinDelay.Milliseconds(),
+			network.JoinBatch, network.TLSMinVersion, network.CorrectServerTime)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	db.notify(ctx, userID, network.ID, "")
+	return nil
 }
 
 func (db *PostgresDB) DeleteNetwork(ctx context.Context, id int64) error {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
 
-	_, err := db.db.ExecContext(ctx, `DELETE FROM "Network" WHERE id = $1`, id)
-	return err
+	var userID int64
+	err := db.db.QueryRowContext(ctx, `DELETE FROM "Network" WHERE id = $1 RETURNING "user"`, id).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	db.notify(ctx, userID, id, "")
+	return nil
 }
 
 func (db *PostgresDB) ListChannels(ctx context.Context, networkID int64) ([]Channel, error) {
@@ -390,7 +852,8 @@ func (db *PostgresDB) ListChannels(ctx context.Context, networkID int64) ([]Chan
 
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after,
-			detach_on
+			detach_on, no_logging, topic, topic_who, topic_time, sort_order, relay_detached_membership,
+			muted
 		FROM "Channel"
 		WHERE network = $1`, networkID)
 	if err != nil {
@@ -401,14 +864,19 @@ func (db *PostgresDB) ListChannels(ctx context.Context, networkID int64) ([]Chan
 	var channels []Channel
 	for rows.Next() {
 		var ch Channel
-		var key, detachedInternalMsgID sql.NullString
-		var detachAfter int64
-		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn); err != nil {
+		var key, detachedInternalMsgID, topic, topicWho sql.NullString
+		var detachAfter, topicTime int64
+		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn, &ch.NoLogging, &topic, &topicWho, &topicTime, &ch.SortOrder, &ch.RelayDetachedMembership, &ch.Muted); err != nil {
 			return nil, err
 		}
 		ch.Key = key.String
 		ch.DetachedInternalMsgID = detachedInternalMsgID.String
 		ch.DetachAfter = time.Duration(detachAfter) * time.Second
+		ch.Topic = topic.String
+		ch.TopicWho = topicWho.String
+		if topicTime != 0 {
+			ch.TopicTime = time.Unix(topicTime, 0)
+		}
 		channels = append(channels, ch)
 	}
 	if err := rows.Err(); err != nil {
@@ -424,24 +892,37 @@ func (db *PostgresDB) StoreChannel(ctx context.Context, networkID int64, ch *Cha
 
 	key := toNullString(ch.Key)
 	detachAfter := int64(math.Ceil(ch.DetachAfter.Seconds()))
+	topic := toNullString(ch.Topic)
+	topicWho := toNullString(ch.TopicWho)
+	var topicTime int64
+	if !ch.TopicTime.IsZero() {
+		topicTime = ch.TopicTime.Unix()
+	}
 
 	var err error
 	if ch.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
 			INSERT INTO "Channel" (network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on,
-				detach_after, detach_on)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				detach_after, detach_on, no_logging, topic, topic_who, topic_time, sort_order,
+				relay_detached_membership, muted)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 			RETURNING id`,
 			networkID, ch.Name, key, ch.Detached, toNullString(ch.DetachedInternalMsgID),
-			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn).Scan(&ch.ID)
+			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn, ch.NoLogging,
+			topic, topicWho, topicTime, ch.SortOrder, ch.RelayDetachedMembership,
+			ch.Muted).Scan(&ch.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "Channel"
 			SET name = $2, key = $3, detached = $4, detached_internal_msgid = $5,
-				relay_detached = $6, reattach_on = $7, detach_after = $8, detach_on = $9
+				relay_detached = $6, reattach_on = $7, detach_after = $8, detach_on = $9,
+				no_logging = $10, topic = $11, topic_who = $12, topic_time = $13,
+				sort_order = $14, relay_detached_membership = $15, muted = $16
 			WHERE id = $1`,
 			ch.ID, ch.Name, key, ch.Detached, toNullString(ch.DetachedInternalMsgID),
-			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn)
+			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn, ch.NoLogging,
+			topic, topicWho, topicTime, ch.SortOrder, ch.RelayDetachedMembership,
+			ch.Muted)
 	}
 	return err
 }
@@ -18,11 +18,24 @@ const sqliteQueryTimeout = 5 * time.Second
 
 const sqliteSchema = `
 CREATE TABLE User (
-	id INTEGER PRIMARY KEY,
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	username TEXT NOT NULL UNIQUE,
 	password TEXT,
 	admin INTEGER NOT NULL DEFAULT 0,
-	realname TEXT
+	realname TEXT,
+	timezone TEXT,
+	motd TEXT,
+	ignore_masks TEXT,
+	log_ignored INTEGER NOT NULL DEFAULT 0,
+	max_downstreams INTEGER NOT NULL DEFAULT 0,
+	cert_fingerprints TEXT,
+	upstream_ips TEXT,
+	log_quota INTEGER NOT NULL DEFAULT 0,
+	limited_admin INTEGER NOT NULL DEFAULT 0,
+	owner INTEGER REFERENCES User(id),
+	backlog_limit INTEGER NOT NULL DEFAULT 0,
+	msg_store TEXT,
+	network_change_delay INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE Network (
@@ -41,6 +54,44 @@ CREATE TABLE Network (
 	sasl_external_cert BLOB,
 	sasl_external_key BLOB,
 	enabled INTEGER NOT NULL DEFAULT 1,
+	no_logging INTEGER NOT NULL DEFAULT 0,
+	fallback_nicks TEXT,
+	motd TEXT,
+	sts_port INTEGER NOT NULL DEFAULT 0,
+	sts_expires_at INTEGER NOT NULL DEFAULT 0,
+	auto_join TEXT,
+	sasl_passthrough INTEGER NOT NULL DEFAULT 0,
+	message_delay INTEGER NOT NULL DEFAULT 0,
+	message_burst INTEGER NOT NULL DEFAULT 0,
+	sasl_mechanisms TEXT,
+	charset TEXT,
+	no_auto_away INTEGER NOT NULL DEFAULT 0,
+	away_message TEXT,
+	group_name TEXT,
+	split_long_messages INTEGER NOT NULL DEFAULT 0,
+	ctcp_auto_reply INTEGER NOT NULL DEFAULT 0,
+	ctcp_version TEXT,
+	ctcp_source TEXT,
+	passthrough INTEGER NOT NULL DEFAULT 0,
+	connect_timeout INTEGER NOT NULL DEFAULT 0,
+	no_auto_detach INTEGER NOT NULL DEFAULT 0,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	tls_fingerprint TEXT,
+	server_notices TEXT,
+	server_notice_allow TEXT,
+	server_notice_deny TEXT,
+	on_demand INTEGER NOT NULL DEFAULT 0,
+	on_demand_grace INTEGER NOT NULL DEFAULT 0,
+	sasl_plain_authzid TEXT,
+	nickserv_nick TEXT,
+	nickserv_command TEXT,
+	nickserv_password TEXT,
+	webirc_password TEXT,
+	webirc_gateway TEXT,
+	join_delay INTEGER NOT NULL DEFAULT 0,
+	join_batch INTEGER NOT NULL DEFAULT 0,
+	tls_min_version INTEGER NOT NULL DEFAULT 0,
+	correct_server_time INTEGER NOT NULL DEFAULT 0,
 	FOREIGN KEY(user) REFERENCES User(id),
 	UNIQUE(user, addr, nick),
 	UNIQUE(user, name)
@@ -57,6 +108,13 @@ CREATE TABLE Channel (
 	reattach_on INTEGER NOT NULL DEFAULT 0,
 	detach_after INTEGER NOT NULL DEFAULT 0,
 	detach_on INTEGER NOT NULL DEFAULT 0,
+	no_logging INTEGER NOT NULL DEFAULT 0,
+	topic TEXT,
+	topic_who TEXT,
+	topic_time INTEGER NOT NULL DEFAULT 0,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	relay_detached_membership INTEGER NOT NULL DEFAULT 0,
+	muted INTEGER NOT NULL DEFAULT 0,
 	FOREIGN KEY(network) REFERENCES Network(id),
 	UNIQUE(network, name)
 );
@@ -189,6 +247,127 @@ var sqliteMigrations = []string{
 			UNIQUE(network, target)
 		);
 	`,
+	`
+		ALTER TABLE Network ADD COLUMN no_logging INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Channel ADD COLUMN no_logging INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE User ADD COLUMN timezone TEXT",
+	"ALTER TABLE Network ADD COLUMN fallback_nicks TEXT",
+	`
+		ALTER TABLE User ADD COLUMN motd TEXT;
+		ALTER TABLE Network ADD COLUMN motd TEXT;
+	`,
+	`
+		ALTER TABLE Channel ADD COLUMN topic TEXT;
+		ALTER TABLE Channel ADD COLUMN topic_who TEXT;
+		ALTER TABLE Channel ADD COLUMN topic_time INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE User ADD COLUMN ignore_masks TEXT;
+		ALTER TABLE User ADD COLUMN log_ignored INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE Network ADD COLUMN sts_port INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN sts_expires_at INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE Network ADD COLUMN auto_join TEXT",
+	"ALTER TABLE User ADD COLUMN max_downstreams INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN sasl_passthrough INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE Network ADD COLUMN message_delay INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN message_burst INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE Network ADD COLUMN sasl_mechanisms TEXT",
+	"ALTER TABLE Channel ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE User ADD COLUMN cert_fingerprints TEXT",
+	"ALTER TABLE Network ADD COLUMN charset TEXT",
+	"ALTER TABLE User ADD COLUMN upstream_ips TEXT",
+	`
+		ALTER TABLE Network ADD COLUMN no_auto_away INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN away_message TEXT;
+	`,
+	"ALTER TABLE Network ADD COLUMN group_name TEXT",
+	"ALTER TABLE User ADD COLUMN log_quota INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN split_long_messages INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE Network ADD COLUMN ctcp_auto_reply INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN ctcp_version TEXT;
+		ALTER TABLE Network ADD COLUMN ctcp_source TEXT;
+	`,
+	"ALTER TABLE Network ADD COLUMN passthrough INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE User ADD COLUMN limited_admin INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN owner INTEGER REFERENCES User(id);
+	`,
+	"ALTER TABLE Network ADD COLUMN connect_timeout INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN no_auto_detach INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN tls_fingerprint TEXT",
+	`
+		ALTER TABLE Network ADD COLUMN server_notices TEXT;
+		ALTER TABLE Network ADD COLUMN server_notice_allow TEXT;
+		ALTER TABLE Network ADD COLUMN server_notice_deny TEXT;
+	`,
+	"ALTER TABLE User ADD COLUMN backlog_limit INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE Network ADD COLUMN on_demand INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN on_demand_grace INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE Network ADD COLUMN sasl_plain_authzid TEXT",
+	`
+		ALTER TABLE Network ADD COLUMN nickserv_nick TEXT;
+		ALTER TABLE Network ADD COLUMN nickserv_command TEXT;
+		ALTER TABLE Network ADD COLUMN nickserv_password TEXT;
+	`,
+	"ALTER TABLE Channel ADD COLUMN relay_detached_membership INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE Network ADD COLUMN webirc_password TEXT;
+		ALTER TABLE Network ADD COLUMN webirc_gateway TEXT;
+	`,
+	"ALTER TABLE Channel ADD COLUMN muted INTEGER NOT NULL DEFAULT 0",
+	`
+		ALTER TABLE Network ADD COLUMN join_delay INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN join_batch INTEGER NOT NULL DEFAULT 0;
+	`,
+	"ALTER TABLE User ADD COLUMN msg_store TEXT",
+	"ALTER TABLE Network ADD COLUMN tls_min_version INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE Network ADD COLUMN correct_server_time INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE User ADD COLUMN network_change_delay INTEGER NOT NULL DEFAULT 0",
+	// Never reuse the IDs of deleted users, they may still be referenced
+	// (e.g. as the owner of running users)
+	`
+		CREATE TABLE UserNew (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password TEXT,
+			admin INTEGER NOT NULL DEFAULT 0,
+			realname TEXT,
+			timezone TEXT,
+			motd TEXT,
+			ignore_masks TEXT,
+			log_ignored INTEGER NOT NULL DEFAULT 0,
+			max_downstreams INTEGER NOT NULL DEFAULT 0,
+			cert_fingerprints TEXT,
+			upstream_ips TEXT,
+			log_quota INTEGER NOT NULL DEFAULT 0,
+			limited_admin INTEGER NOT NULL DEFAULT 0,
+			owner INTEGER REFERENCES User(id),
+			backlog_limit INTEGER NOT NULL DEFAULT 0,
+			msg_store TEXT,
+			network_change_delay INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO UserNew (id, username, password, admin, realname, timezone,
+				motd, ignore_masks, log_ignored, max_downstreams, cert_fingerprints,
+				upstream_ips, log_quota, limited_admin, owner, backlog_limit,
+				msg_store, network_change_delay)
+			SELECT id, username, password, admin, realname, timezone, motd,
+				ignore_masks, log_ignored, max_downstreams, cert_fingerprints,
+				upstream_ips, log_quota, limited_admin, owner, backlog_limit,
+				msg_store, network_change_delay
+			FROM User;
+		DROP TABLE User;
+		ALTER TABLE UserNew RENAME TO User;
+	`,
 }
 
 type SqliteDB struct {
@@ -197,10 +376,15 @@ type SqliteDB struct {
 }
 
 func OpenSqliteDB(source string) (Database, error) {
+	return openSqliteDB(source, &DatabaseOptions{})
+}
+
+func openSqliteDB(source string, options *DatabaseOptions) (Database, error) {
 	sqlSqliteDB, err := sql.Open("sqlite3", source)
 	if err != nil {
 		return nil, err
 	}
+	options.apply(sqlSqliteDB)
 
 	db := &SqliteDB{db: sqlSqliteDB}
 	if err := db.upgrade(); err != nil {
@@ -217,6 +401,17 @@ func (db *SqliteDB) Close() error {
 	return db.db.Close()
 }
 
+// Subscribe implements Database. SQLite databases cannot be shared by multiple
+// soju instances, so no event is ever sent.
+func (db *SqliteDB) Subscribe(ctx context.Context, logger Logger) (<-chan DatabaseEvent, error) {
+	ch := make(chan DatabaseEvent)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
 func (db *SqliteDB) upgrade() error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -282,6 +477,13 @@ func (db *SqliteDB) Stats(ctx context.Context) (*DatabaseStats, error) {
 	return &stats, nil
 }
 
+func toNullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: v,
+		Valid: v != 0,
+	}
+}
+
 func toNullString(s string) sql.NullString {
 	return sql.NullString{
 		String: s,
@@ -297,7 +499,11 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx,
-		"SELECT id, username, password, admin, realname FROM User")
+		`SELECT id, username, password, admin, realname, timezone, motd,
+			ignore_masks, log_ignored, max_downstreams, cert_fingerprints,
+			upstream_ips, log_quota, limited_admin, owner, backlog_limit,
+			msg_store, network_change_delay
+		FROM User`)
 	if err != nil {
 		return nil, err
 	}
@@ -306,12 +512,28 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, realname sql.NullString
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname); err != nil {
+		var password, realname, timezone, motd, ignoreMasks, certFingerprints, upstreamIPs, msgStore sql.NullString
+		var owner sql.NullInt64
+		var networkChangeDelay int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &realname, &timezone, &motd, &ignoreMasks, &user.LogIgnored, &user.MaxDownstreams, &certFingerprints, &upstreamIPs, &user.LogQuota, &user.LimitedAdmin, &owner, &user.BacklogLimit, &msgStore, &networkChangeDelay); err != nil {
 			return nil, err
 		}
+		user.Owner = owner.Int64
 		user.Password = password.String
 		user.Realname = realname.String
+		user.Timezone = timezone.String
+		user.MOTD = motd.String
+		user.MsgStore = msgStore.String
+		user.NetworkChangeDelay = time.Duration(networkChangeDelay) * time.Millisecond
+		if ignoreMasks.Valid {
+			user.IgnoreMasks = strings.Split(ignoreMasks.String, " ")
+		}
+		if certFingerprints.Valid {
+			user.CertFingerprints = strings.Split(certFingerprints.String, " ")
+		}
+		if upstreamIPs.Valid {
+			user.UpstreamIPs = strings.Split(upstreamIPs.String, " ")
+		}
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -330,15 +552,35 @@ func (db *SqliteDB) GetUser(ctx context.Context, username string) (*User, error)
 
 	user := &User{Username: username}
 
-	var password, realname sql.NullString
+	var password, realname, timezone, motd, ignoreMasks, certFingerprints, upstreamIPs, msgStore sql.NullString
+	var owner sql.NullInt64
+	var networkChangeDelay int64
 	row := db.db.QueryRowContext(ctx,
-		"SELECT id, password, admin, realname FROM User WHERE username = ?",
+		`SELECT id, password, admin, realname, timezone, motd, ignore_masks, log_ignored,
+			max_downstreams, cert_fingerprints, upstream_ips, log_quota, limited_admin,
+			owner, backlog_limit, msg_store, network_change_delay
+		FROM User
+		WHERE username = ?`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &realname); err != nil {
+	if err := row.Scan(&user.ID, &password, &user.Admin, &realname, &timezone, &motd, &ignoreMasks, &user.LogIgnored, &user.MaxDownstreams, &certFingerprints, &upstreamIPs, &user.LogQuota, &user.LimitedAdmin, &owner, &user.BacklogLimit, &msgStore, &networkChangeDelay); err != nil {
 		return nil, err
 	}
+	user.Owner = owner.Int64
 	user.Password = password.String
 	user.Realname = realname.String
+	user.Timezone = timezone.String
+	user.MOTD = motd.String
+	user.MsgStore = msgStore.String
+	user.NetworkChangeDelay = time.Duration(networkChangeDelay) * time.Millisecond
+	if ignoreMasks.Valid {
+		user.IgnoreMasks = strings.Split(ignoreMasks.String, " ")
+	}
+	if certFingerprints.Valid {
+		user.CertFingerprints = strings.Split(certFingerprints.String, " ")
+	}
+	if upstreamIPs.Valid {
+		user.UpstreamIPs = strings.Split(upstreamIPs.String, " ")
+	}
 	return user, nil
 }
 
@@ -354,20 +596,48 @@ func (db *SqliteDB) StoreUser(ctx context.Context, user *User) error {
 		sql.Named("password", toNullString(user.Password)),
 		sql.Named("admin", user.Admin),
 		sql.Named("realname", toNullString(user.Realname)),
+		sql.Named("timezone", toNullString(user.Timezone)),
+		sql.Named("motd", toNullString(user.MOTD)),
+		sql.Named("ignore_masks", toNullString(strings.Join(user.IgnoreMasks, " "))),
+		sql.Named("log_ignored", user.LogIgnored),
+		sql.Named("max_downstreams", user.MaxDownstreams),
+		sql.Named("cert_fingerprints", toNullString(strings.Join(user.CertFingerprints, " "))),
+		sql.Named("upstream_ips", toNullString(strings.Join(user.UpstreamIPs, " "))),
+		sql.Named("log_quota", user.LogQuota),
+		sql.Named("limited_admin", user.LimitedAdmin),
+		sql.Named("owner", toNullInt64(user.Owner)),
+		sql.Named("backlog_limit", user.BacklogLimit),
+		sql.Named("msg_store", toNullString(user.MsgStore)),
+		sql.Named("network_change_delay", user.NetworkChangeDelay.Milliseconds()),
+
+		sql.Named("id", user.ID), // only for UPDATE
 	}
 
 	var err error
 	if user.ID != 0 {
 		_, err = db.db.ExecContext(ctx, `
-			UPDATE User SET password = :password, admin = :admin,
-				realname = :realname WHERE username = :username`,
+			UPDATE User SET username = :username, password = :password, admin = :admin,
+				realname = :realname, timezone = :timezone, motd = :motd,
+				ignore_masks = :ignore_masks, log_ignored = :log_ignored,
+				max_downstreams = :max_downstreams, cert_fingerprints = :cert_fingerprints,
+				upstream_ips = :upstream_ips, log_quota = :log_quota,
+				limited_admin = :limited_admin, owner = :owner,
+				backlog_limit = :backlog_limit, msg_store = :msg_store,
+				network_change_delay = :network_change_delay
+			WHERE id = :id`,
 			args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO
-			User(username, password, admin, realname)
-			VALUES (:username, :password, :admin, :realname)`,
+			User(username, password, admin, realname, timezone, motd, ignore_masks,
+				log_ignored, max_downstreams, cert_fingerprints, upstream_ips,
+				log_quota, limited_admin, owner, backlog_limit, msg_store,
+				network_change_delay)
+			VALUES (:username, :password, :admin, :realname, :timezone, :motd,
+				:ignore_masks, :log_ignored, :max_downstreams, :cert_fingerprints,
+				:upstream_ips, :log_quota, :limited_admin, :owner, :backlog_limit,
+				:msg_store, :network_change_delay)`,
 			args...)
 		if err != nil {
 			return err
@@ -429,6 +699,11 @@ func (db *SqliteDB) DeleteUser(ctx context.Context, id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "UPDATE User SET owner = NULL WHERE owner = ?", id)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.ExecContext(ctx, "DELETE FROM User WHERE id = ?", id)
 	if err != nil {
 		return err
@@ -447,7 +722,15 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, pass,
 			connect_commands, sasl_mechanism, sasl_plain_username, sasl_plain_password,
-			sasl_external_cert, sasl_external_key, enabled
+			sasl_external_cert, sasl_external_key, enabled, no_logging, fallback_nicks,
+			motd, sts_port, sts_expires_at, auto_join, sasl_passthrough, message_delay,
+			message_burst, sasl_mechanisms, charset, no_auto_away, away_message,
+			group_name, split_long_messages, ctcp_auto_reply, ctcp_version, ctcp_source,
+			passthrough, connect_timeout, no_auto_detach, sort_order, tls_fingerprint,
+			server_notices, server_notice_allow, server_notice_deny, on_demand,
+			on_demand_grace, sasl_plain_authzid, nickserv_nick, nickserv_command,
+			nickserv_password, webirc_password, webirc_gateway, join_delay, join_batch,
+			tls_min_version, correct_server_time
 		FROM Network
 		WHERE user = ?`,
 		userID)
@@ -460,10 +743,25 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 	for rows.Next() {
 		var net Network
 		var name, nick, username, realname, pass, connectCommands sql.NullString
-		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var saslMechanism, saslPlainUsername, saslPlainPassword, saslPlainAuthzid sql.NullString
+		var fallbackNicks, motd, autoJoin, saslMechanisms, charset, awayMessage, group, tlsFingerprint sql.NullString
+		var ctcpVersion, ctcpSource sql.NullString
+		var serverNotices, serverNoticeAllow, serverNoticeDeny sql.NullString
+		var nickServNick, nickServCommand, nickServPassword sql.NullString
+		var webIRCPassword, webIRCGateway sql.NullString
+		var stsExpiresAt, messageDelay, connectTimeout, onDemandGrace, joinDelay int64
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.Enabled,
+			&net.NoLogging, &fallbackNicks, &motd, &net.STSPort, &stsExpiresAt, &autoJoin,
+			&net.SASLPassthrough, &messageDelay, &net.MessageBurst, &saslMechanisms, &charset,
+			&net.NoAutoAway, &awayMessage, &group, &net.SplitLongMessages,
+			&net.CTCPAutoReply, &ctcpVersion, &ctcpSource, &net.Passthrough,
+			&connectTimeout, &net.NoAutoDetach, &net.SortOrder, &tlsFingerprint,
+			&serverNotices, &serverNoticeAllow, &serverNoticeDeny, &net.OnDemand,
+			&onDemandGrace, &saslPlainAuthzid, &nickServNick, &nickServCommand,
+			&nickServPassword, &webIRCPassword, &webIRCGateway, &joinDelay,
+			&net.JoinBatch, &net.TLSMinVersion, &net.CorrectServerTime)
 		if err != nil {
 			return nil, err
 		}
@@ -478,6 +776,40 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.SASL.Plain.Authzid = saslPlainAuthzid.String
+		net.NickServ.Nick = nickServNick.String
+		net.NickServ.Command = nickServCommand.String
+		net.NickServ.Password = nickServPassword.String
+		net.WebIRCPassword = webIRCPassword.String
+		net.WebIRCGateway = webIRCGateway.String
+		if saslMechanisms.Valid {
+			net.SASL.Mechanisms = strings.Split(saslMechanisms.String, ",")
+		}
+		net.Charset = charset.String
+		net.AwayMessage = awayMessage.String
+		net.Group = group.String
+		net.TLSFingerprint = tlsFingerprint.String
+		net.CTCPVersion = ctcpVersion.String
+		net.CTCPSource = ctcpSource.String
+		net.ServerNotices = serverNotices.String
+		if serverNoticeAllow.Valid {
+			net.ServerNoticeAllow = strings.Split(serverNoticeAllow.String, "\r\n")
+		}
+		if serverNoticeDeny.Valid {
+			net.ServerNoticeDeny = strings.Split(serverNoticeDeny.String, "\r\n")
+		}
+		if fallbackNicks.Valid {
+			net.FallbackNicks = strings.Split(fallbackNicks.String, ",")
+		}
+		net.MOTD = motd.String
+		if stsExpiresAt != 0 {
+			net.STSExpiresAt = time.Unix(stsExpiresAt, 0)
+		}
+		net.AutoJoin = parseAutoJoin(autoJoin.String)
+		net.MessageDelay = time.Duration(messageDelay) * time.Millisecond
+		net.ConnectTimeout = time.Duration(connectTimeout) * time.Millisecond
+		net.OnDemandGrace = time.Duration(onDemandGrace) * time.Millisecond
+		net.JoinDelay = time.Duration(joinDelay) * time.Millisecond
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -494,21 +826,35 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
 	defer cancel()
 
-	var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+	var stsExpiresAt int64
+	if !network.STSExpiresAt.IsZero() {
+		stsExpiresAt = network.STSExpiresAt.Unix()
+	}
+
+	var saslMechanism, saslPlainUsername, saslPlainPassword, saslPlainAuthzid sql.NullString
 	if network.SASL.Mechanism != "" {
 		saslMechanism = toNullString(network.SASL.Mechanism)
-		switch network.SASL.Mechanism {
-		case "PLAIN":
-			saslPlainUsername = toNullString(network.SASL.Plain.Username)
-			saslPlainPassword = toNullString(network.SASL.Plain.Password)
-			network.SASL.External.CertBlob = nil
-			network.SASL.External.PrivKeyBlob = nil
-		case "EXTERNAL":
-			// keep saslPlain* nil
+	}
+	for _, mech := range network.SASL.mechanisms() {
+		switch mech {
+		case "PLAIN", "EXTERNAL", scramSHA256:
+			// ok
 		default:
-			return fmt.Errorf("soju: cannot store network: unsupported SASL mechanism %q", network.SASL.Mechanism)
+			return fmt.Errorf("soju: cannot store network: unsupported SASL mechanism %q", mech)
 		}
 	}
+	if network.SASL.uses("PLAIN") || network.SASL.uses(scramSHA256) {
+		saslPlainUsername = toNullString(network.SASL.Plain.Username)
+		saslPlainPassword = toNullString(network.SASL.Plain.Password)
+	}
+	if network.SASL.uses("PLAIN") {
+		saslPlainAuthzid = toNullString(network.SASL.Plain.Authzid)
+	}
+	if network.SASL.Mechanism != "" && !network.SASL.uses("EXTERNAL") {
+		network.SASL.External.CertBlob = nil
+		network.SASL.External.PrivKeyBlob = nil
+	}
+	saslMechanisms := toNullString(strings.Join(network.SASL.Mechanisms, ","))
 
 	args := []interface{}{
 		sql.Named("name", toNullString(network.Name)),
@@ -524,6 +870,44 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 		sql.Named("sasl_external_cert", network.SASL.External.CertBlob),
 		sql.Named("sasl_external_key", network.SASL.External.PrivKeyBlob),
 		sql.Named("enabled", network.Enabled),
+		sql.Named("no_logging", network.NoLogging),
+		sql.Named("fallback_nicks", toNullString(strings.Join(network.FallbackNicks, ","))),
+		sql.Named("motd", toNullString(network.MOTD)),
+		sql.Named("sts_port", network.STSPort),
+		sql.Named("sts_expires_at", stsExpiresAt),
+		sql.Named("auto_join", toNullString(formatAutoJoin(network.AutoJoin))),
+		sql.Named("sasl_passthrough", network.SASLPassthrough),
+		sql.Named("message_delay", network.MessageDelay.Milliseconds()),
+		sql.Named("message_burst", network.MessageBurst),
+		sql.Named("sasl_mechanisms", saslMechanisms),
+		sql.Named("charset", toNullString(network.Charset)),
+		sql.Named("no_auto_away", network.NoAutoAway),
+		sql.Named("away_message", toNullString(network.AwayMessage)),
+		sql.Named("group_name", toNullString(network.Group)),
+		sql.Named("split_long_messages", network.SplitLongMessages),
+		sql.Named("ctcp_auto_reply", network.CTCPAutoReply),
+		sql.Named("ctcp_version", toNullString(network.CTCPVersion)),
+		sql.Named("ctcp_source", toNullString(network.CTCPSource)),
+		sql.Named("passthrough", network.Passthrough),
+		sql.Named("connect_timeout", network.ConnectTimeout.Milliseconds()),
+		sql.Named("no_auto_detach", network.NoAutoDetach),
+		sql.Named("sort_order", network.SortOrder),
+		sql.Named("tls_fingerprint", toNullString(network.TLSFingerprint)),
+		sql.Named("server_notices", toNullString(network.ServerNotices)),
+		sql.Named("server_notice_allow", toNullString(strings.Join(network.ServerNoticeAllow, "\r\n"))),
+		sql.Named("server_notice_deny", toNullString(strings.Join(network.ServerNoticeDeny, "\r\n"))),
+		sql.Named("on_demand", network.OnDemand),
+		sql.Named("on_demand_grace", network.OnDemandGrace.Milliseconds()),
+		sql.Named("sasl_plain_authzid", saslPlainAuthzid),
+		sql.Named("nickserv_nick", toNullString(network.NickServ.Nick)),
+		sql.Named("nickserv_command", toNullString(network.NickServ.Command)),
+		sql.Named("nickserv_password", toNullString(network.NickServ.Password)),
+		sql.Named("webirc_password", toNullString(network.WebIRCPassword)),
+		sql.Named("webirc_gateway", toNullString(network.WebIRCGateway)),
+		sql.Named("join_delay", network.JoinDelay.Milliseconds()),
+		sql.Named("join_batch", network.JoinBatch),
+		sql.Named("tls_min_version", network.TLSMinVersion),
+		sql.Named("correct_server_time", network.CorrectServerTime),
 
 		sql.Named("id", network.ID), // only for UPDATE
 		sql.Named("user", userID),   // only for INSERT
@@ -537,17 +921,57 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 				realname = :realname, pass = :pass, connect_commands = :connect_commands,
 				sasl_mechanism = :sasl_mechanism, sasl_plain_username = :sasl_plain_username, sasl_plain_password = :sasl_plain_password,
 				sasl_external_cert = :sasl_external_cert, sasl_external_key = :sasl_external_key,
-				enabled = :enabled
+				enabled = :enabled, no_logging = :no_logging, fallback_nicks = :fallback_nicks,
+				motd = :motd, sts_port = :sts_port, sts_expires_at = :sts_expires_at,
+				auto_join = :auto_join, sasl_passthrough = :sasl_passthrough,
+				message_delay = :message_delay, message_burst = :message_burst,
+				sasl_mechanisms = :sasl_mechanisms, charset = :charset,
+				no_auto_away = :no_auto_away, away_message = :away_message,
+				group_name = :group_name, split_long_messages = :split_long_messages,
+				ctcp_auto_reply = :ctcp_auto_reply, ctcp_version = :ctcp_version,
+				ctcp_source = :ctcp_source, passthrough = :passthrough,
+				connect_timeout = :connect_timeout, no_auto_detach = :no_auto_detach,
+				sort_order = :sort_order, tls_fingerprint = :tls_fingerprint,
+				server_notices = :server_notices,
+				server_notice_allow = :server_notice_allow,
+				server_notice_deny = :server_notice_deny,
+				on_demand = :on_demand, on_demand_grace = :on_demand_grace,
+				sasl_plain_authzid = :sasl_plain_authzid,
+				nickserv_nick = :nickserv_nick, nickserv_command = :nickserv_command,
+				nickserv_password = :nickserv_password,
+				webirc_password = :webirc_password, webirc_gateway = :webirc_gateway,
+				join_delay = :join_delay, join_batch = :join_batch,
+				tls_min_version = :tls_min_version,
+				correct_server_time = :correct_server_time
 			WHERE id = :id`, args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO Network(user, name, addr, nick, username, realname, pass,
 				connect_commands, sasl_mechanism, sasl_plain_username,
-				sasl_plain_password, sasl_external_cert, sasl_external_key, enabled)
+				sasl_plain_password, sasl_external_cert, sasl_external_key, enabled,
+				no_logging, fallback_nicks, motd, sts_port, sts_expires_at, auto_join,
+				sasl_passthrough, message_delay, message_burst, sasl_mechanisms,
+				charset, no_auto_away, away_message, group_name, split_long_messages,
+				ctcp_auto_reply, ctcp_version, ctcp_source, passthrough,
+				connect_timeout, no_auto_detach, sort_order, tls_fingerprint,
+				server_notices, server_notice_allow, server_notice_deny, on_demand,
+				on_demand_grace, sasl_plain_authzid, nickserv_nick, nickserv_command,
+				nickserv_password, webirc_password, webirc_gateway, join_delay,
+				join_batch, tls_min_version, correct_server_time)
 			VALUES (:user, :name, :addr, :nick, :username, :realname, :pass,
 				:connect_commands, :sasl_mechanism, :sasl_plain_username,
-				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :enabled)`,
+				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :enabled,
+				:no_logging, :fallback_nicks, :motd, :sts_port, :sts_expires_at, :auto_join,
+				:sasl_passthrough, :message_delay, :message_burst, :sasl_mechanisms,
+				:charset, :no_auto_away, :away_message, :group_name,
+				:split_long_messages, :ctcp_auto_reply, :ctcp_version, :ctcp_source,
+				:passthrough, :connect_timeout, :no_auto_detach, :sort_order,
+				:tls_fingerprint, :server_notices, :server_notice_allow,
+				:server_notice_deny, :on_demand, :on_demand_grace, :sasl_plain_authzid,
+				:nickserv_nick, :nickserv_command, :nickserv_password,
+				:webirc_password, :webirc_gateway, :join_delay, :join_batch,
+				:tls_min_version, :correct_server_time)`,
 			args...)
 		if err != nil {
 			return err
@@ -602,7 +1026,9 @@ func (db *SqliteDB) ListChannels(ctx context.Context, networkID int64) ([]Channe
 
 	rows, err := db.db.QueryContext(ctx, `SELECT
 			id, name, key, detached, detached_internal_msgid,
-			relay_detached, reattach_on, detach_after, detach_on
+			relay_detached, reattach_on, detach_after, detach_on, no_logging,
+			topic, topic_who, topic_time, sort_order, relay_detached_membership,
+			muted
 		FROM Channel
 		WHERE network = ?`, networkID)
 	if err != nil {
@@ -613,14 +1039,19 @@ func (db *SqliteDB) ListChannels(ctx context.Context, networkID int64) ([]Channe
 	var channels []Channel
 	for rows.Next() {
 		var ch Channel
-		var key, detachedInternalMsgID sql.NullString
-		var detachAfter int64
-		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn); err != nil {
+		var key, detachedInternalMsgID, topic, topicWho sql.NullString
+		var detachAfter, topicTime int64
+		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn, &ch.NoLogging, &topic, &topicWho, &topicTime, &ch.SortOrder, &ch.RelayDetachedMembership, &ch.Muted); err != nil {
 			return nil, err
 		}
 		ch.Key = key.String
 		ch.DetachedInternalMsgID = detachedInternalMsgID.String
 		ch.DetachAfter = time.Duration(detachAfter) * time.Second
+		ch.Topic = topic.String
+		ch.TopicWho = topicWho.String
+		if topicTime != 0 {
+			ch.TopicTime = time.Unix(topicTime, 0)
+		}
 		channels = append(channels, ch)
 	}
 	if err := rows.Err(); err != nil {
@@ -637,6 +1068,11 @@ func (db *SqliteDB) StoreChannel(ctx context.Context, networkID int64, ch *Chann
 	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
 	defer cancel()
 
+	var topicTime int64
+	if !ch.TopicTime.IsZero() {
+		topicTime = ch.TopicTime.Unix()
+	}
+
 	args := []interface{}{
 		sql.Named("network", networkID),
 		sql.Named("name", ch.Name),
@@ -647,6 +1083,13 @@ func (db *SqliteDB) StoreChannel(ctx context.Context, networkID int64, ch *Chann
 		sql.Named("reattach_on", ch.ReattachOn),
 		sql.Named("detach_after", int64(math.Ceil(ch.DetachAfter.Seconds()))),
 		sql.Named("detach_on", ch.DetachOn),
+		sql.Named("no_logging", ch.NoLogging),
+		sql.Named("topic", toNullString(ch.Topic)),
+		sql.Named("topic_who", toNullString(ch.TopicWho)),
+		sql.Named("topic_time", topicTime),
+		sql.Named("sort_order", ch.SortOrder),
+		sql.Named("relay_detached_membership", ch.RelayDetachedMembership),
+		sql.Named("muted", ch.Muted),
 
 		sql.Named("id", ch.ID), // only for UPDATE
 	}
@@ -656,12 +1099,16 @@ func (db *SqliteDB) StoreChannel(ctx context.Context, networkID int64, ch *Chann
 		_, err = db.db.ExecContext(ctx, `UPDATE Channel
 			SET network = :network, name = :name, key = :key, detached = :detached,
 				detached_internal_msgid = :detached_internal_msgid, relay_detached = :relay_detached,
-				reattach_on = :reattach_on, detach_after = :detach_after, detach_on = :detach_on
+				reattach_on = :reattach_on, detach_after = :detach_after, detach_on = :detach_on,
+				no_logging = :no_logging, topic = :topic, topic_who = :topic_who,
+				topic_time = :topic_time, sort_order = :sort_order,
+				relay_detached_membership = :relay_detached_membership,
+				muted = :muted
 			WHERE id = :id`, args...)
 	} else {
 		var res sql.Result
-		res, err = db.db.ExecContext(ctx, `INSERT INTO Channel(network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after, detach_on)
-			VALUES (:network, :name, :key, :detached, :detached_internal_msgid, :relay_detached, :reattach_on, :detach_after, :detach_on)`, args...)
+		res, err = db.db.ExecContext(ctx, `INSERT INTO Channel(network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after, detach_on, no_logging, topic, topic_who, topic_time, sort_order, relay_detached_membership, muted)
+			VALUES (:network, :name, :key, :detached, :detached_internal_msgid, :relay_detached, :reattach_on, :detach_after, :detach_on, :no_logging, :topic, :topic_who, :topic_time, :sort_order, :relay_detached_membership, :muted)`, args...)
 		if err != nil {
 			return err
 		}
@@ -3,12 +3,16 @@ package soju
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/mail"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -49,10 +53,21 @@ func newNeedMoreParamsError(cmd string) ircError {
 }
 
 func newChatHistoryError(subcommand string, target string) ircError {
-	return ircError{&irc.Message{
-		Command: "FAIL",
-		Params:  []string{"CHATHISTORY", "MESSAGE_ERROR", subcommand, target, "Messages could not be retrieved"},
-	}}
+	return newFailError("CHATHISTORY", "MESSAGE_ERROR", subcommand, target, "Messages could not be retrieved")
+}
+
+// newStandardReply creates a standard reply message, as defined in the IRCv3
+// standard-replies specification. kind is one of FAIL, WARN or NOTE. The last
+// parameter is a human-readable description.
+func newStandardReply(kind, cmd, code string, params ...string) *irc.Message {
+	return &irc.Message{
+		Command: kind,
+		Params:  append([]string{cmd, code}, params...),
+	}
+}
+
+func newFailError(cmd, code string, params ...string) ircError {
+	return ircError{newStandardReply("FAIL", cmd, code, params...)}
 }
 
 // authError is an authentication error.
@@ -89,13 +104,17 @@ func newInvalidUsernameOrPasswordError(err error) error {
 	}
 }
 
+func newInvalidCertificateError(err error) error {
+	return &authError{
+		err:    err,
+		reason: "Invalid username or client certificate",
+	}
+}
+
 func parseBouncerNetID(subcommand, s string) (int64, error) {
 	id, err := strconv.ParseInt(s, 10, 64)
 	if err != nil || id <= 0 {
-		return 0, ircError{&irc.Message{
-			Command: "FAIL",
-			Params:  []string{"BOUNCER", "INVALID_NETID", subcommand, s, "Invalid network ID"},
-		}}
+		return 0, newFailError("BOUNCER", "INVALID_NETID", subcommand, s, "Invalid network ID")
 	}
 	return id, nil
 }
@@ -123,6 +142,45 @@ func fillNetworkAddrAttrs(attrs irc.Tags, network *Network) {
 	}
 }
 
+func getChannelAttrs(network *network, ch *Channel) irc.Tags {
+	detached, joined, muted := "0", "0", "0"
+	if ch.Detached {
+		detached = "1"
+	}
+	if uc := network.conn; uc != nil && uc.channels.Value(ch.Name) != nil {
+		joined = "1"
+	}
+	if ch.Muted {
+		muted = "1"
+	}
+	return irc.Tags{
+		"detached": irc.TagValue(detached),
+		"joined":   irc.TagValue(joined),
+		"muted":    irc.TagValue(muted),
+	}
+}
+
+func updateChannelAttrs(ch *Channel, attrs irc.Tags, subcommand string) error {
+	for k, v := range attrs {
+		switch k {
+		case "muted":
+			switch v {
+			case "1":
+				ch.Muted = true
+			case "0":
+				ch.Muted = false
+			default:
+				return newFailError("BOUNCER", "INVALID_ATTRIBUTE", subcommand, k, "Invalid muted value")
+			}
+		case "detached", "joined":
+			return newFailError("BOUNCER", "READ_ONLY_ATTRIBUTE", subcommand, k, "Read-only attribute")
+		default:
+			return newFailError("BOUNCER", "UNKNOWN_ATTRIBUTE", subcommand, k, "Unknown attribute")
+		}
+	}
+	return nil
+}
+
 func getNetworkAttrs(network *network) irc.Tags {
 	state := "disconnected"
 	if uc := network.conn; uc != nil {
@@ -138,13 +196,32 @@ func getNetworkAttrs(network *network) irc.Tags {
 	if network.Username != "" {
 		attrs["username"] = irc.TagValue(network.Username)
 	}
-	if realname := GetRealname(&network.user.User, &network.Network); realname != "" {
+	if realname := network.user.srv.getRealname(&network.user.User, &network.Network); realname != "" {
 		attrs["realname"] = irc.TagValue(realname)
 	}
 
+	if network.Group != "" {
+		attrs["group"] = irc.TagValue(network.Group)
+	}
+	if network.SortOrder != 0 {
+		attrs["order"] = irc.TagValue(strconv.Itoa(network.SortOrder))
+	}
+
 	if network.lastError != nil {
 		attrs["error"] = irc.TagValue(network.lastError.Error())
 	}
+	if network.lastErrorCode != "" {
+		attrs["error-code"] = irc.TagValue(network.lastErrorCode)
+	}
+	if network.lastErrorReason != "" {
+		attrs["error-reason"] = irc.TagValue(network.lastErrorReason)
+	}
+	if !network.lastConnected.IsZero() {
+		attrs["last-connected"] = irc.TagValue(formatServerTime(network.lastConnected))
+	}
+	if !network.lastErrorTime.IsZero() {
+		attrs["last-error-time"] = irc.TagValue(formatServerTime(network.lastErrorTime))
+	}
 
 	fillNetworkAddrAttrs(attrs, &network.Network)
 
@@ -190,21 +267,23 @@ func updateNetworkAttrs(record *Network, attrs irc.Tags, subcommand string) erro
 			record.Realname = s
 		case "pass":
 			record.Pass = s
+		case "group":
+			record.Group = s
+		case "order":
+			order, err := strconv.Atoi(s)
+			if err != nil && s != "" {
+				return newFailError("BOUNCER", "INVALID_ATTRIBUTE", subcommand, k, "Invalid order")
+			}
+			record.SortOrder = order
 		default:
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"BOUNCER", "UNKNOWN_ATTRIBUTE", subcommand, k, "Unknown attribute"},
-			}}
+			return newFailError("BOUNCER", "UNKNOWN_ATTRIBUTE", subcommand, k, "Unknown attribute")
 		}
 	}
 
 	if updateAddr {
 		record.Addr = networkAddrFromAttrs(addrAttrs)
 		if record.Addr == "" {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"BOUNCER", "NEED_ATTRIBUTE", subcommand, "host", "Missing required host attribute"},
-			}}
+			return newFailError("BOUNCER", "NEED_ATTRIBUTE", subcommand, "host", "Missing required host attribute")
 		}
 	}
 
@@ -225,17 +304,26 @@ const illegalNickChars = " :@!*?$,."
 // permanentDownstreamCaps is the list of always-supported downstream
 // capabilities.
 var permanentDownstreamCaps = map[string]string{
-	"batch":         "",
-	"cap-notify":    "",
-	"echo-message":  "",
-	"invite-notify": "",
-	"server-time":   "",
-	"setname":       "",
-
+	"batch":            "",
+	"cap-notify":       "",
+	"echo-message":     "",
+	"invite-notify":    "",
+	"server-time":      "",
+	"setname":          "",
+	"standard-replies": "",
+	"labeled-response": "",
+
+	// Batches are split into separate messages for upstreams which don't
+	// support them, and multiline messages for downstreams which don't
+	"draft/multiline": downstreamMultilineCap,
+
+	"soju.im/backlog-limit":           "",
 	"soju.im/bouncer-networks":        "",
 	"soju.im/bouncer-networks-notify": "",
+	"soju.im/filter-targets":          "",
 	"soju.im/no-implicit-names":       "",
 	"soju.im/read":                    "",
+	"soju.im/resume":                  "",
 }
 
 // needAllDownstreamCaps is the list of downstream capabilities that
@@ -249,9 +337,18 @@ var needAllDownstreamCaps = map[string]string{
 	"message-tags":   "",
 	"multi-prefix":   "",
 
+	"extended-monitor":       "",
 	"draft/extended-monitor": "",
 }
 
+// upstreamCapAliases maps downstream capabilities to an upstream capability
+// which can be used in their place, e.g. for capabilities which have been
+// renamed when ratified.
+var upstreamCapAliases = map[string]string{
+	"extended-monitor":       "draft/extended-monitor",
+	"draft/extended-monitor": "extended-monitor",
+}
+
 // passthroughIsupport is the set of ISUPPORT tokens that are directly passed
 // through from the upstream server to downstream clients.
 //
@@ -283,12 +380,13 @@ var passthroughIsupport = map[string]bool{
 	"TOPICLEN":      true,
 	"USERLEN":       true,
 	"UTF8ONLY":      true,
-	"WHOX":          true,
 }
 
 type downstreamSASL struct {
 	server                       sasl.Server
+	mechanism                    string
 	plainUsername, plainPassword string
+	externalIdentity             string
 	pendingResp                  bytes.Buffer
 }
 
@@ -299,6 +397,7 @@ type downstreamRegistration struct {
 
 	networkName string
 	networkID   int64
+	resumeToken string
 
 	negotiatingCaps bool
 }
@@ -328,14 +427,37 @@ type downstreamConn struct {
 	registration *downstreamRegistration // nil after RPL_WELCOME
 
 	lastBatchRef uint64
+	// Replies to the labeled command being handled, nil if none
+	labeled *labeledResponse
+	// draft/multiline batch being received, nil if none
+	multiline *multilineBatch
+	// Beginning of the record being received by "user import -part"
+	importPart string
 
 	monitored casemapMap
+
+	// Targets whose live messages are relayed, indexed by network ID; nil if
+	// the downstream hasn't set a filter
+	targetFilter map[int64]*casemapMap
+	// Channels joined on registration while the upstream connection was
+	// down, indexed by network ID. Our JOIN for these is not relayed again
+	// once the upstream connection is back.
+	restoredChannels map[int64]*casemapMap
+	// Maximum backlog size requested via BACKLOGLIMIT, nil if none
+	requestedBacklogLimit *int
+	// Token allowing the connection to be resumed, empty if none
+	resumeToken string
 }
 
-func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
+func newDownstreamConn(srv *Server, ic ircConn, id uint64, listenerOptions *ListenerOptions) *downstreamConn {
 	remoteAddr := ic.RemoteAddr().String()
-	logger := &prefixLogger{srv.Logger, fmt.Sprintf("downstream %q: ", remoteAddr)}
-	options := connOptions{Logger: logger}
+	logger := newPrefixLogger(srv.Logger, "downstream", remoteAddr)
+	// A client slow to read its messages must not delay the user goroutine,
+	// and thus the other connections of the user
+	options := connOptions{Logger: logger, UnboundedQueue: true}
+	if listenerOptions != nil {
+		options.WriteTimeout = listenerOptions.WriteTimeout
+	}
 	dc := &downstreamConn{
 		conn:         *newConn(srv, ic, &options),
 		id:           id,
@@ -356,6 +478,19 @@ func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
 		dc.caps.Available[k] = v
 	}
 	dc.caps.Available["sasl"] = "PLAIN"
+	if tlsConnectionState(ic) != nil {
+		dc.caps.Available["sasl"] = "PLAIN,EXTERNAL"
+	}
+	if srv.Config().OpenRegistration {
+		// Registered accounts are soju users, so registration must happen
+		// before the connection is bound to a user
+		v := "before-connect,custom-account-name"
+		if srv.EmailVerifier != nil {
+			v += ",email-required"
+		}
+		dc.caps.Available["draft/account-registration"] = v
+	}
+	dc.caps.Available["soju.im/account-required"] = formatInstancePolicy(srv.Config())
 	// TODO: this is racy, we should only enable chathistory after
 	// authentication and then check that user.msgStore implements
 	// chatHistoryMessageStore
@@ -366,6 +501,23 @@ func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
 	return dc
 }
 
+// formatInstancePolicy returns the value of the soju.im/account-required
+// capability, which describes the instance policies to clients before they
+// log in.
+func formatInstancePolicy(cfg *Config) string {
+	var l []string
+	if cfg.OpenRegistration {
+		l = append(l, "open-registration")
+	}
+	if cfg.MultiUpstream {
+		l = append(l, "multi-upstream")
+	}
+	if cfg.MaxUserNetworks >= 0 {
+		l = append(l, fmt.Sprintf("max-networks=%v", cfg.MaxUserNetworks))
+	}
+	return strings.Join(l, ",")
+}
+
 func (dc *downstreamConn) prefix() *irc.Prefix {
 	return &irc.Prefix{
 		Name: dc.nick,
@@ -528,6 +680,13 @@ func (dc *downstreamConn) ReadMessage() (*irc.Message, error) {
 }
 
 func (dc *downstreamConn) readMessages(ch chan<- event) error {
+	var activity chan struct{}
+	if timeout := dc.srv.Config().DownstreamIdleTimeout; timeout > 0 {
+		activity = make(chan struct{}, 1)
+		defer close(activity)
+		go dc.watchIdle(timeout, activity)
+	}
+
 	for {
 		msg, err := dc.ReadMessage()
 		if errors.Is(err, io.EOF) {
@@ -536,16 +695,65 @@ func (dc *downstreamConn) readMessages(ch chan<- event) error {
 			return fmt.Errorf("failed to read IRC command: %v", err)
 		}
 
+		select {
+		case activity <- struct{}{}:
+		default:
+			// An activity notification is already pending, or the idle
+			// timeout is disabled
+		}
+
 		ch <- eventDownstreamMessage{msg, dc}
 	}
 
 	return nil
 }
 
+const idlePingToken = "soju-idle"
+
+// watchIdle sends a PING to the downstream when it hasn't sent anything for
+// the specified duration, and closes it if it stays idle for the same
+// duration after that. It returns when the activity channel is closed.
+func (dc *downstreamConn) watchIdle(timeout time.Duration, activity <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	pinged := false
+	for {
+		select {
+		case _, ok := <-activity:
+			if !ok {
+				return
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+			pinged = false
+		case <-timer.C:
+			if pinged {
+				dc.logger.Debugf("closing idle connection after %v without activity", 2*timeout)
+				dc.Close()
+				return
+			}
+			// conn.SendMessage is safe to call from any goroutine
+			dc.conn.SendMessage(context.TODO(), &irc.Message{
+				Command: "PING",
+				Params:  []string{idlePingToken},
+			})
+			timer.Reset(timeout)
+			pinged = true
+		}
+	}
+}
+
 // SendMessage sends an outgoing message.
 //
 // This can only called from the user goroutine.
 func (dc *downstreamConn) SendMessage(msg *irc.Message) {
+	if isMultilineMessage(msg) {
+		dc.sendMultiline(msg)
+		return
+	}
 	if !dc.caps.IsEnabled("message-tags") {
 		if msg.Command == "TAGMSG" {
 			return
@@ -595,10 +803,160 @@ func (dc *downstreamConn) SendMessage(msg *irc.Message) {
 		msg.Prefix = nil
 	}
 
+	if dc.labeled != nil {
+		dc.labeled.add(msg)
+		return
+	}
+	dc.writeMessage(msg)
+}
+
+func (dc *downstreamConn) writeMessage(msg *irc.Message) {
 	dc.srv.metrics.downstreamOutMessagesTotal.Inc()
 	dc.conn.SendMessage(context.TODO(), msg)
 }
 
+// labeledResponse collects the replies to a downstream command carrying a
+// label, to send them back as a labeled response once the command has been
+// fully processed.
+type labeledResponse struct {
+	dc    *downstreamConn
+	label string
+	msgs  []*irc.Message
+	// Reference of the labeled batch, once it has been sent
+	batchRef string
+	// Whether the command is still being handled by the downstream
+	handling bool
+	// Number of commands forwarded to upstreams whose replies are pending
+	pending int
+	// Whether a command has been forwarded to an upstream which can't label
+	// its replies
+	untracked bool
+}
+
+// maxLabeledResponseMessages is the number of replies buffered for a labeled
+// response. Past this limit, the labeled batch is sent right away and the
+// next replies are sent as they come.
+const maxLabeledResponseMessages = 100
+
+// add collects a reply to the labeled command.
+func (lr *labeledResponse) add(msg *irc.Message) {
+	if lr.batchRef == "" && len(lr.msgs) < maxLabeledResponseMessages {
+		lr.msgs = append(lr.msgs, msg)
+		return
+	}
+	if lr.batchRef == "" {
+		lr.startBatch()
+	}
+	lr.dc.writeMessage(lr.batchMessage(msg))
+}
+
+// startBatch sends the start of the labeled batch and the replies collected
+// so far.
+func (lr *labeledResponse) startBatch() {
+	dc := lr.dc
+	dc.lastBatchRef++
+	lr.batchRef = fmt.Sprintf("%v", dc.lastBatchRef)
+	dc.writeMessage(&irc.Message{
+		Tags:    irc.Tags{"label": irc.TagValue(lr.label)},
+		Prefix:  dc.srv.prefix(),
+		Command: "BATCH",
+		Params:  []string{"+" + lr.batchRef, "labeled-response"},
+	})
+	for _, msg := range lr.msgs {
+		dc.writeMessage(lr.batchMessage(msg))
+	}
+	lr.msgs = nil
+}
+
+// batchMessage tags a reply with the labeled batch reference.
+func (lr *labeledResponse) batchMessage(msg *irc.Message) *irc.Message {
+	// Messages of nested batches are already tagged
+	if _, ok := msg.Tags["batch"]; ok {
+		return msg
+	}
+	msg = msg.Copy()
+	if msg.Tags == nil {
+		msg.Tags = make(irc.Tags)
+	}
+	msg.Tags["batch"] = irc.TagValue(lr.batchRef)
+	return msg
+}
+
+// beginLabeledResponse starts collecting the replies to msg if it carries a
+// label. It returns nil if the replies aren't labeled.
+func (dc *downstreamConn) beginLabeledResponse(msg *irc.Message) *labeledResponse {
+	label, ok := msg.Tags["label"]
+	if !ok || label == "" || !dc.caps.IsEnabled("labeled-response") || !dc.caps.IsEnabled("batch") {
+		return nil
+	}
+	lr := &labeledResponse{dc: dc, label: string(label), handling: true}
+	dc.labeled = lr
+	return lr
+}
+
+// endLabeledResponse stops collecting the replies to a labeled command handled
+// by the downstream. The replies are sent right away, unless replies from
+// upstreams are still pending.
+func (dc *downstreamConn) endLabeledResponse(lr *labeledResponse) {
+	if lr == nil {
+		return
+	}
+	dc.labeled = nil
+	lr.handling = false
+	if lr.pending == 0 {
+		dc.sendLabeledResponse(lr)
+	}
+}
+
+// release marks a forwarded command as complete, and sends the replies if it
+// was the last pending one.
+func (lr *labeledResponse) release() {
+	lr.pending--
+	if lr.pending == 0 && !lr.handling {
+		lr.dc.sendLabeledResponse(lr)
+	}
+}
+
+func (dc *downstreamConn) sendLabeledResponse(lr *labeledResponse) {
+	if lr.batchRef != "" {
+		dc.writeMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BATCH",
+			Params:  []string{"-" + lr.batchRef},
+		})
+		return
+	}
+
+	label := irc.TagValue(lr.label)
+	switch len(lr.msgs) {
+	case 0:
+		// The upstream replies may still be on their way, an ACK would
+		// wrongly tell the client that there is no reply
+		if lr.untracked {
+			return
+		}
+		dc.writeMessage(&irc.Message{
+			Tags:    irc.Tags{"label": label},
+			Prefix:  dc.srv.prefix(),
+			Command: "ACK",
+		})
+	case 1:
+		msg := lr.msgs[0].Copy()
+		if msg.Tags == nil {
+			msg.Tags = make(irc.Tags)
+		}
+		msg.Tags["label"] = label
+		dc.writeMessage(msg)
+	default:
+		lr.startBatch()
+		dc.writeMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BATCH",
+			Params:  []string{"-" + lr.batchRef},
+		})
+	}
+}
+
 func (dc *downstreamConn) SendBatch(typ string, params []string, tags irc.Tags, f func(batchRef irc.TagValue)) {
 	dc.lastBatchRef++
 	ref := fmt.Sprintf("%v", dc.lastBatchRef)
@@ -625,6 +983,14 @@ func (dc *downstreamConn) SendBatch(typ string, params []string, tags irc.Tags,
 
 // sendMessageWithID sends an outgoing message with the specified internal ID.
 func (dc *downstreamConn) sendMessageWithID(msg *irc.Message, id string) {
+	if id != "" && msg.Tags["msgid"] == "" && dc.caps.IsEnabled("draft/chathistory") {
+		// Allow clients to use the message as a CHATHISTORY cursor. The
+		// upstream message ID is kept: it is stored along with the message,
+		// so that replies and reactions refer to the same ID in the live
+		// messages and in the history.
+		msg = msg.Copy()
+		msg.Tags["msgid"] = irc.TagValue(id)
+	}
 	dc.SendMessage(msg)
 
 	if id == "" || !dc.messageSupportsBacklog(msg) || dc.caps.IsEnabled("draft/chathistory") {
@@ -670,6 +1036,9 @@ func (dc *downstreamConn) sendPing(msgID string) {
 }
 
 func (dc *downstreamConn) handlePong(token string) {
+	if token == idlePingToken {
+		return // readMessages has already recorded the activity
+	}
 	if !strings.HasPrefix(token, "soju-msgid-") {
 		dc.logger.Printf("received unrecognized PONG token %q", token)
 		return
@@ -761,8 +1130,16 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 			break
 		}
 
-		if err := dc.authenticate(ctx, credentials.plainUsername, credentials.plainPassword); err != nil {
-			dc.logger.Printf("SASL authentication error for user %q: %v", credentials.plainUsername, err)
+		var username string
+		if credentials.mechanism == "EXTERNAL" {
+			username = credentials.externalIdentity
+			err = dc.authenticateExternal(ctx, username)
+		} else {
+			username = credentials.plainUsername
+			err = dc.authenticate(ctx, username, credentials.plainPassword)
+		}
+		if err != nil {
+			dc.logger.Printf("SASL %v authentication error for user %q: %v", credentials.mechanism, username, err)
 			dc.endSASL(&irc.Message{
 				Prefix:  dc.srv.prefix(),
 				Command: irc.ERR_SASLFAIL,
@@ -776,6 +1153,22 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 		// see how many clients that breaks. See:
 		// https://github.com/ircv3/ircv3-specifications/pull/476
 		dc.endSASL(nil)
+	case "REGISTER":
+		if err := dc.handleRegisterCommand(ctx, msg); err != nil {
+			return err
+		}
+	case "VERIFY":
+		if err := dc.handleVerifyCommand(ctx, msg); err != nil {
+			return err
+		}
+	case "BACKLOGLIMIT":
+		if err := dc.handleBacklogLimitCommand(msg); err != nil {
+			return err
+		}
+	case "RESUME":
+		if err := dc.handleResumeCommand(msg); err != nil {
+			return err
+		}
 	case "BOUNCER":
 		var subcommand string
 		if err := parseMessageParams(msg, &subcommand); err != nil {
@@ -790,10 +1183,7 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 			}
 
 			if dc.user == nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"BOUNCER", "ACCOUNT_REQUIRED", "BIND", "Authentication needed to bind to bouncer network"},
-				}}
+				return newFailError("BOUNCER", "ACCOUNT_REQUIRED", "BIND", "Authentication needed to bind to bouncer network")
 			}
 
 			id, err := parseBouncerNetID(subcommand, idStr)
@@ -978,6 +1368,18 @@ func (dc *downstreamConn) handleAuthenticateCommand(msg *irc.Message) (result *d
 				dc.sasl.plainPassword = password
 				return nil
 			}))
+		case "EXTERNAL":
+			if tlsConnectionState(dc.conn.conn) == nil {
+				return nil, ircError{&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: irc.ERR_SASLFAIL,
+					Params:  []string{dc.nick, "SASL EXTERNAL requires a TLS connection"},
+				}}
+			}
+			server = sasl.NewExternalServer(func(identity string) error {
+				dc.sasl.externalIdentity = identity
+				return nil
+			})
 		default:
 			return nil, ircError{&irc.Message{
 				Prefix:  dc.srv.prefix(),
@@ -986,7 +1388,7 @@ func (dc *downstreamConn) handleAuthenticateCommand(msg *irc.Message) (result *d
 			}}
 		}
 
-		dc.sasl = &downstreamSASL{server: server}
+		dc.sasl = &downstreamSASL{server: server, mechanism: mech}
 	} else {
 		chunk := msg.Params[0]
 		if chunk == "+" {
@@ -1040,6 +1442,52 @@ func (dc *downstreamConn) handleAuthenticateCommand(msg *irc.Message) (result *d
 	}
 }
 
+// relayAuthenticateCommand forwards a post-registration AUTHENTICATE message
+// as-is to the upstream server, instead of terminating SASL at soju. The
+// upstream replies are relayed back by the upstream connection.
+func (dc *downstreamConn) relayAuthenticateCommand(ctx context.Context, uc *upstreamConn, msg *irc.Message) error {
+	if !dc.caps.IsEnabled("sasl") {
+		return ircError{&irc.Message{
+			Command: irc.ERR_SASLFAIL,
+			Params:  []string{dc.nick, "AUTHENTICATE requires the \"sasl\" capability to be enabled"},
+		}}
+	}
+	if len(msg.Params) == 0 {
+		return ircError{&irc.Message{
+			Command: irc.ERR_SASLFAIL,
+			Params:  []string{dc.nick, "Missing AUTHENTICATE argument"},
+		}}
+	}
+
+	if uc.saslPassthroughID == 0 {
+		if uc.saslClient != nil || len(uc.pendingCmds["AUTHENTICATE"]) > 0 {
+			return ircError{&irc.Message{
+				Command: irc.ERR_SASLFAIL,
+				Params:  []string{dc.nick, "Another authentication attempt is already in progress"},
+			}}
+		}
+		if msg.Params[0] == "*" {
+			return ircError{&irc.Message{
+				Command: irc.ERR_SASLABORTED,
+				Params:  []string{dc.nick, "SASL authentication aborted"},
+			}}
+		}
+		uc.logger.Printf("relaying SASL %v authentication from downstream", strings.ToUpper(msg.Params[0]))
+		uc.saslPassthroughID = dc.id
+	} else if uc.saslPassthroughID != dc.id {
+		return ircError{&irc.Message{
+			Command: irc.ERR_SASLFAIL,
+			Params:  []string{dc.nick, "Another authentication attempt is already in progress"},
+		}}
+	}
+
+	uc.SendMessage(ctx, &irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  msg.Params[:1],
+	})
+	return nil
+}
+
 func (dc *downstreamConn) endSASL(msg *irc.Message) {
 	if dc.sasl == nil {
 		return
@@ -1094,6 +1542,10 @@ func (dc *downstreamConn) unsetSupportedCap(name string) {
 	})
 }
 
+func (dc *downstreamConn) supportsExtendedMonitor() bool {
+	return dc.caps.IsEnabled("extended-monitor") || dc.caps.IsEnabled("draft/extended-monitor")
+}
+
 func (dc *downstreamConn) updateSupportedCaps() {
 	supportedCaps := make(map[string]bool)
 	for cap := range needAllDownstreamCaps {
@@ -1101,7 +1553,11 @@ func (dc *downstreamConn) updateSupportedCaps() {
 	}
 	dc.forEachUpstream(func(uc *upstreamConn) {
 		for cap, supported := range supportedCaps {
-			supportedCaps[cap] = supported && uc.caps.IsEnabled(cap)
+			enabled := uc.caps.IsEnabled(cap)
+			if alias, ok := upstreamCapAliases[cap]; ok {
+				enabled = enabled || uc.caps.IsEnabled(alias)
+			}
+			supportedCaps[cap] = supported && enabled
 		}
 	})
 
@@ -1113,7 +1569,10 @@ func (dc *downstreamConn) updateSupportedCaps() {
 		}
 	}
 
-	if uc := dc.upstream(); uc != nil && uc.supportsSASL("PLAIN") {
+	if uc := dc.upstream(); uc != nil && uc.network.SASLPassthrough && uc.caps.IsEnabled("sasl") {
+		// Advertise the upstream mechanisms, since AUTHENTICATE is relayed
+		dc.setSupportedCap("sasl", uc.caps.Available["sasl"])
+	} else if uc != nil && uc.supportsSASL("PLAIN") {
 		dc.setSupportedCap("sasl", "PLAIN")
 	} else if dc.network != nil {
 		dc.unsetSupportedCap("sasl")
@@ -1201,9 +1660,9 @@ func (dc *downstreamConn) updateRealname() {
 	if uc := dc.upstream(); uc != nil {
 		realname = uc.realname
 	} else if dc.network != nil {
-		realname = GetRealname(&dc.user.User, &dc.network.Network)
+		realname = dc.srv.getRealname(&dc.user.User, &dc.network.Network)
 	} else {
-		realname = GetRealname(&dc.user.User, nil)
+		realname = dc.srv.getRealname(&dc.user.User, nil)
 	}
 
 	if realname != dc.realname {
@@ -1288,21 +1747,90 @@ func unmarshalUsername(rawUsername string) (username, client, network string) {
 func (dc *downstreamConn) authenticate(ctx context.Context, username, password string) error {
 	username, clientName, networkName := unmarshalUsername(username)
 
-	u, err := dc.srv.db.GetUser(ctx, username)
+	now := time.Now()
+	if err := dc.checkLoginLockout(username, now); err != nil {
+		return err
+	}
+
+	identity, err := dc.srv.Authenticator.AuthenticatePassword(ctx, username, password)
+	if err != nil {
+		dc.loginFailed(username, now)
+		return newInvalidUsernameOrPasswordError(err)
+	}
+	dc.srv.logins.reset(username, dc.hostname)
+
+	username, err = dc.srv.Authenticator.LookupUser(ctx, identity)
 	if err != nil {
-		return newInvalidUsernameOrPasswordError(fmt.Errorf("user not found: %w", err))
+		return newInvalidUsernameOrPasswordError(fmt.Errorf("failed to look up user for identity %q: %w", identity, err))
+	}
+
+	return dc.setAuthenticatedUser(username, clientName, networkName)
+}
+
+// checkLoginLockout returns an error if logins for the username or from the
+// connection's IP address are locked out after repeated failures. username
+// may be empty.
+func (dc *downstreamConn) checkLoginLockout(username string, now time.Time) error {
+	if until := dc.srv.logins.lockedUntil(username, dc.hostname, now); !until.IsZero() {
+		return &authError{
+			err:    fmt.Errorf("too many failed login attempts, locked out until %v", until.Format(time.RFC3339)),
+			reason: "Too many failed login attempts, try again later",
+		}
+	}
+	return nil
+}
+
+// loginFailed records a failed login attempt for the username and the
+// connection's IP address. username may be empty.
+func (dc *downstreamConn) loginFailed(username string, now time.Time) {
+	cfg := dc.srv.Config()
+	dc.srv.logins.fail(username, dc.hostname, now, cfg.MaxLoginFailures, cfg.LoginLockout)
+}
+
+// authenticateExternal authenticates a user with the TLS client certificate
+// of the connection. If username is empty, the username sent with USER is
+// used.
+func (dc *downstreamConn) authenticateExternal(ctx context.Context, username string) error {
+	if username == "" {
+		username = dc.registration.username
+	}
+	if username == "" {
+		return &authError{
+			err:    fmt.Errorf("missing username"),
+			reason: "Username required, send it with USER before AUTHENTICATE",
+		}
+	}
+	username, clientName, networkName := unmarshalUsername(username)
+
+	state := tlsConnectionState(dc.conn.conn)
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return &authError{
+			err:    fmt.Errorf("no client certificate"),
+			reason: "No TLS client certificate provided",
+		}
 	}
 
-	// Password auth disabled
-	if u.Password == "" {
-		return newInvalidUsernameOrPasswordError(fmt.Errorf("password auth disabled"))
+	now := time.Now()
+	if err := dc.checkLoginLockout(username, now); err != nil {
+		return err
+	}
+
+	identity, err := dc.srv.Authenticator.AuthenticateCertificate(ctx, username, state.PeerCertificates[0])
+	if err != nil {
+		dc.loginFailed(username, now)
+		return newInvalidCertificateError(err)
 	}
+	dc.srv.logins.reset(username, dc.hostname)
 
-	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	username, err = dc.srv.Authenticator.LookupUser(ctx, identity)
 	if err != nil {
-		return newInvalidUsernameOrPasswordError(fmt.Errorf("wrong password"))
+		return newInvalidCertificateError(fmt.Errorf("failed to look up user for identity %q: %w", identity, err))
 	}
 
+	return dc.setAuthenticatedUser(username, clientName, networkName)
+}
+
+func (dc *downstreamConn) setAuthenticatedUser(username, clientName, networkName string) error {
 	dc.user = dc.srv.getUser(username)
 	if dc.user == nil {
 		return fmt.Errorf("user exists in the DB but hasn't been loaded by the bouncer -- a restart may help")
@@ -1312,6 +1840,169 @@ func (dc *downstreamConn) authenticate(ctx context.Context, username, password s
 	return nil
 }
 
+// handleResumeCommand authenticates the connection with a token issued by the
+// soju.im/resume extension. The suspended session is restored once the
+// connection is registered, see welcome.
+func (dc *downstreamConn) handleResumeCommand(msg *irc.Message) error {
+	var token string
+	if err := parseMessageParams(msg, &token); err != nil {
+		return newFailError("RESUME", "NEED_MORE_PARAMS", "Missing parameters")
+	}
+	if dc.user != nil {
+		return newFailError("RESUME", "ALREADY_AUTHENTICATED", "You are already authenticated")
+	}
+
+	// Tokens aren't tied to a username: only the IP address is limited
+	now := time.Now()
+	if err := dc.checkLoginLockout("", now); err != nil {
+		return newFailError("RESUME", "INVALID_TOKEN", authErrorReason(err))
+	}
+
+	u := dc.srv.resume.claim(token)
+	if u == nil || dc.srv.getUser(u.Username) != u {
+		dc.loginFailed("", now)
+		return newFailError("RESUME", "INVALID_TOKEN", "Invalid or expired token")
+	}
+
+	dc.user = u
+	dc.registration.resumeToken = token
+	return nil
+}
+
+// handleRegisterCommand creates a new user with the
+// draft/account-registration extension.
+func (dc *downstreamConn) handleRegisterCommand(ctx context.Context, msg *irc.Message) error {
+	var account, email, password string
+	if err := parseMessageParams(msg, &account, &email, &password); err != nil {
+		return err
+	}
+
+	if !dc.srv.Config().OpenRegistration {
+		return newFailError("REGISTER", "TEMPORARILY_UNAVAILABLE", account, "Account registration is disabled")
+	}
+	if dc.user != nil {
+		return newFailError("REGISTER", "ALREADY_AUTHENTICATED", account, "You are already authenticated")
+	}
+	if account == "*" {
+		if dc.registration.nick == "" {
+			return newFailError("REGISTER", "NEED_NICK", account, "Send NICK before REGISTER, or specify an account name")
+		}
+		account = dc.registration.nick
+	}
+	if err := checkUsername(account); err != nil {
+		return newFailError("REGISTER", "BAD_ACCOUNT_NAME", account, "Invalid account name: "+err.Error())
+	}
+
+	now := time.Now()
+	if !dc.srv.registration.allow(dc.hostname, now) {
+		return newFailError("REGISTER", "TEMPORARILY_UNAVAILABLE", account, "Too many registration attempts, try again later")
+	}
+
+	if len(password) < registrationMinPasswordLen {
+		return newFailError("REGISTER", "WEAK_PASSWORD", account, fmt.Sprintf("Password must be at least %v characters long", registrationMinPasswordLen))
+	}
+	verifier := dc.srv.EmailVerifier
+	if verifier != nil {
+		if email == "*" {
+			return newFailError("REGISTER", "INVALID_EMAIL", account, "An e-mail address is required")
+		}
+		if _, err := mail.ParseAddress(email); err != nil {
+			return newFailError("REGISTER", "INVALID_EMAIL", account, "Invalid e-mail address")
+		}
+	}
+	if dc.srv.getUser(account) != nil || dc.srv.registration.isPending(account, now) {
+		return newFailError("REGISTER", "ACCOUNT_EXISTS", account, "Account already exists")
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	record := &User{
+		Username: account,
+		Password: string(hashed),
+	}
+
+	if verifier == nil {
+		return dc.completeRegistration(ctx, "REGISTER", record)
+	}
+
+	code, err := generateVerificationCode()
+	if err != nil {
+		return fmt.Errorf("failed to generate verification code: %v", err)
+	}
+	if err := verifier.SendVerificationCode(ctx, account, email, code); err != nil {
+		dc.logger.Printf("failed to send verification code for account %q: %v", account, err)
+		return newFailError("REGISTER", "TEMPORARILY_UNAVAILABLE", account, "Failed to send verification code")
+	}
+	dc.srv.registration.addPending(record, code, now)
+
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: "REGISTER",
+		Params:  []string{"VERIFICATION_REQUIRED", account, "A verification code has been sent to " + email},
+	})
+	return nil
+}
+
+// handleVerifyCommand completes an account registration which requires
+// verification.
+func (dc *downstreamConn) handleVerifyCommand(ctx context.Context, msg *irc.Message) error {
+	var account, code string
+	if err := parseMessageParams(msg, &account, &code); err != nil {
+		return err
+	}
+
+	if !dc.srv.Config().OpenRegistration {
+		return newFailError("VERIFY", "TEMPORARILY_UNAVAILABLE", account, "Account registration is disabled")
+	}
+	if dc.user != nil {
+		return newFailError("VERIFY", "ALREADY_AUTHENTICATED", account, "You are already authenticated")
+	}
+
+	now := time.Now()
+	if !dc.srv.registration.allow(dc.hostname, now) {
+		return newFailError("VERIFY", "TEMPORARILY_UNAVAILABLE", account, "Too many registration attempts, try again later")
+	}
+
+	record := dc.srv.registration.verify(account, code, now)
+	if record == nil {
+		return newFailError("VERIFY", "INVALID_CODE", account, "Invalid verification code")
+	}
+	return dc.completeRegistration(ctx, "VERIFY", record)
+}
+
+// completeRegistration creates the user for a registered account and
+// authenticates the connection as this user.
+func (dc *downstreamConn) completeRegistration(ctx context.Context, cmd string, record *User) error {
+	if _, err := dc.srv.createUser(ctx, record); err != nil {
+		if dc.srv.getUser(record.Username) != nil {
+			return newFailError(cmd, "ACCOUNT_EXISTS", record.Username, "Account already exists")
+		}
+		dc.logger.Printf("failed to create user %q: %v", record.Username, err)
+		return newFailError(cmd, "TEMPORARILY_UNAVAILABLE", record.Username, "Failed to create account")
+	}
+	dc.logger.Printf("registered user %q", record.Username)
+
+	if err := dc.setAuthenticatedUser(record.Username, "", ""); err != nil {
+		return err
+	}
+
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: cmd,
+		Params:  []string{"SUCCESS", record.Username, "Account successfully registered"},
+	})
+	return nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a DER-encoded
+// certificate, in lowercase hex.
+func certFingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
 func (dc *downstreamConn) register(ctx context.Context) error {
 	if dc.registered {
 		panic("tried to register twice")
@@ -1330,10 +2021,7 @@ func (dc *downstreamConn) register(ctx context.Context) error {
 	if dc.user == nil {
 		if password == "" {
 			if dc.caps.IsEnabled("sasl") {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"*", "ACCOUNT_REQUIRED", "Authentication required"},
-				}}
+				return newFailError("*", "ACCOUNT_REQUIRED", "Authentication required")
 			} else {
 				return ircError{&irc.Message{
 					Command: irc.ERR_PASSWDMISMATCH,
@@ -1380,10 +2068,7 @@ func (dc *downstreamConn) loadNetwork(ctx context.Context) error {
 	if id := dc.registration.networkID; id != 0 {
 		network := dc.user.getNetworkByID(id)
 		if network == nil {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"BOUNCER", "INVALID_NETID", fmt.Sprintf("%v", id), "Unknown network ID"},
-			}}
+			return newFailError("BOUNCER", "INVALID_NETID", fmt.Sprintf("%v", id), "Unknown network ID")
 		}
 		dc.network = network
 		return nil
@@ -1453,13 +2138,46 @@ func (dc *downstreamConn) loadNetwork(ctx context.Context) error {
 	return nil
 }
 
+// motd returns the MOTD to send to the downstream connection upon
+// registration. Connections bound to a network only get the network notes,
+// since the upstream MOTD can be fetched via the MOTD command.
+func (dc *downstreamConn) motd() string {
+	if dc.network != nil {
+		return dc.network.MOTD
+	}
+	if dc.user.MOTD != "" {
+		return dc.user.MOTD
+	}
+	return dc.srv.Config().MOTD
+}
+
 func (dc *downstreamConn) welcome(ctx context.Context) error {
 	if dc.user == nil || !dc.registered {
 		panic("tried to welcome an unregistered connection")
 	}
 
 	remoteAddr := dc.conn.RemoteAddr().String()
-	dc.logger = &prefixLogger{dc.srv.Logger, fmt.Sprintf("user %q: downstream %q: ", dc.user.Username, remoteAddr)}
+	dc.logger = newPrefixLogger(dc.user.logger, "downstream", remoteAddr)
+
+	var session *suspendedSession
+	if token := dc.registration.resumeToken; token != "" {
+		session = dc.user.resumeSession(token)
+		if session == nil {
+			// The session has expired in the meantime
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "FAIL",
+				Params:  []string{"RESUME", "INVALID_TOKEN", "Invalid or expired token"},
+			})
+		} else {
+			dc.clientName = session.clientName
+			dc.registration.networkID = session.networkID
+			dc.registration.networkName = ""
+			if session.isMultiUpstream {
+				dc.registration.networkName = "*"
+			}
+		}
+	}
 
 	// TODO: doing this might take some time. We should do it in dc.register
 	// instead, but we'll potentially be adding a new network and this must be
@@ -1470,6 +2188,14 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 
 	dc.registration = nil
 
+	if session != nil {
+		dc.monitored = session.monitored
+		dc.targetFilter = session.targetFilter
+		if dc.requestedBacklogLimit == nil {
+			dc.requestedBacklogLimit = session.requestedBacklogLimit
+		}
+	}
+
 	dc.updateSupportedCaps()
 
 	if uc := dc.upstream(); uc != nil {
@@ -1484,6 +2210,12 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 	isupport := []string{
 		fmt.Sprintf("CHATHISTORY=%v", chatHistoryLimit),
 		"CASEMAPPING=ascii",
+		// Upstreams without WHOX get their replies converted
+		"WHOX",
+	}
+
+	if _, ok := dc.user.msgStore.(chatHistoryMessageStore); ok {
+		isupport = append(isupport, "MSGREFTYPES=timestamp,msgid")
 	}
 
 	if dc.network != nil {
@@ -1494,10 +2226,6 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 	if title := dc.srv.Config().Title; dc.network == nil && title != "" {
 		isupport = append(isupport, "NETWORK="+encodeISUPPORT(title))
 	}
-	if dc.network == nil && !dc.isMultiUpstream {
-		isupport = append(isupport, "WHOX")
-	}
-
 	if uc := dc.upstream(); uc != nil {
 		for k := range passthroughIsupport {
 			v, ok := uc.isupport[k]
@@ -1512,6 +2240,13 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 		}
 	}
 
+	if session != nil {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "RESUME",
+			Params:  []string{"SUCCESS", dc.nick},
+		})
+	}
 	dc.SendMessage(&irc.Message{
 		Prefix:  dc.srv.prefix(),
 		Command: irc.RPL_WELCOME,
@@ -1530,6 +2265,18 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 	for _, msg := range generateIsupport(dc.srv.prefix(), dc.nick, isupport) {
 		dc.SendMessage(msg)
 	}
+	if dc.caps.IsEnabled("soju.im/resume") {
+		token, err := dc.srv.resume.issue(dc.user)
+		if err != nil {
+			return fmt.Errorf("failed to generate resume token: %v", err)
+		}
+		dc.resumeToken = token
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "RESUME",
+			Params:  []string{"TOKEN", token},
+		})
+	}
 	if uc := dc.upstream(); uc != nil {
 		dc.SendMessage(&irc.Message{
 			Prefix:  dc.srv.prefix(),
@@ -1549,7 +2296,7 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 	dc.updateRealname()
 	dc.updateAccount()
 
-	if motd := dc.user.srv.Config().MOTD; motd != "" && dc.network == nil {
+	if motd := dc.motd(); motd != "" {
 		for _, msg := range generateMOTD(dc.srv.prefix(), dc.nick, motd) {
 			dc.SendMessage(msg)
 		}
@@ -1580,29 +2327,74 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 		})
 	}
 
-	dc.forEachUpstream(func(uc *upstreamConn) {
-		for _, entry := range uc.channels.innerMap {
-			ch := entry.value.(*upstreamChannel)
-			if !ch.complete {
-				continue
+	dc.forEachNetwork(func(net *network) {
+		attached := newCasemapMap(0)
+		attached.SetCasemapping(net.casemap)
+		for _, name := range net.attachedChannels() {
+			attached.SetValue(name, nil)
+			if net.conn == nil {
+				dc.addRestoredChannel(net, name)
 			}
-			record := uc.network.channels.Value(ch.Name)
-			if record != nil && record.Detached {
+			// A resumed connection already knows about these channels
+			if session != nil && session.hasChannel(net.ID, name) {
 				continue
 			}
 
 			dc.SendMessage(&irc.Message{
 				Prefix:  dc.prefix(),
 				Command: "JOIN",
-				Params:  []string{dc.marshalEntity(ch.conn.network, ch.Name)},
+				Params:  []string{dc.marshalEntity(net, name)},
 			})
 
-			forwardChannel(ctx, dc, ch)
+			if uc := net.conn; uc != nil {
+				forwardChannel(ctx, dc, uc.channels.Value(name))
+			} else {
+				// The upstream connection is down, restore the saved
+				// channel with its last known topic
+				sendSavedTopic(dc, net, net.channels.Value(name))
+			}
+		}
+
+		if session == nil || session.channels[net.ID] == nil {
+			return
+		}
+		for _, entry := range session.channels[net.ID].innerMap {
+			if attached.Has(entry.originalKey) {
+				continue
+			}
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.prefix(),
+				Command: "PART",
+				Params:  []string{dc.marshalEntity(net, entry.originalKey)},
+			})
 		}
 	})
 
+	if dc.isMultiUpstream {
+		for _, ch := range dc.user.sortedLocalChannels() {
+			if session == nil || !session.hasChannel(0, ch.Name) {
+				forwardLocalChannel(dc, ch)
+			}
+
+			history := ch.pendingMessages(dc.clientName)
+			if len(history) == 0 {
+				continue
+			}
+			dc.SendBatch("chathistory", []string{ch.Name}, nil, func(batchRef irc.TagValue) {
+				for _, msg := range history {
+					msg = msg.Copy()
+					if !dc.caps.IsEnabled("server-time") {
+						dc.prefixBacklogTimestamp(msg)
+					}
+					msg.Tags["batch"] = batchRef
+					dc.SendMessage(msg)
+				}
+			})
+		}
+	}
+
 	dc.forEachNetwork(func(net *network) {
-		if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil {
+		if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil || net.Passthrough {
 			return
 		}
 
@@ -1615,6 +2407,8 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 			}
 		}
 		if firstClient {
+			net.reconcileDeliveryReceipts(ctx, dc.clientName)
+
 			net.delivered.ForEachTarget(func(target string) {
 				lastDelivered := net.delivered.LoadID(target, dc.clientName)
 				if lastDelivered == "" {
@@ -1632,12 +2426,56 @@ func (dc *downstreamConn) welcome(ctx context.Context) error {
 				}
 				net.delivered.StoreID(target, dc.clientName, lastID)
 			})
+
+			// Flush the receipts right away: if they were only saved when the
+			// client disconnects, the backlog would be replayed again after an
+			// unclean shutdown
+			net.storeClientDeliveryReceipts(ctx, dc.clientName)
 		}
 	})
 
 	return nil
 }
 
+// isTargetFiltered reports whether live messages sent to a target are
+// suppressed by the target filter of the downstream connection.
+func (dc *downstreamConn) isTargetFiltered(net *network, target string) bool {
+	if dc.targetFilter == nil {
+		return false
+	}
+	m := dc.targetFilter[net.ID]
+	return m == nil || !m.Has(target)
+}
+
+func (dc *downstreamConn) addRestoredChannel(net *network, channel string) {
+	if dc.restoredChannels == nil {
+		dc.restoredChannels = make(map[int64]*casemapMap)
+	}
+	m := dc.restoredChannels[net.ID]
+	if m == nil {
+		cm := newCasemapMap(0)
+		cm.SetCasemapping(net.casemap)
+		m = &cm
+		dc.restoredChannels[net.ID] = m
+	}
+	m.SetValue(channel, nil)
+}
+
+// isChannelRestored checks whether our JOIN for a channel was already sent
+// while the upstream connection was down. The channel is forgotten, so that
+// the next JOIN is relayed.
+func (dc *downstreamConn) isChannelRestored(net *network, channel string) bool {
+	m := dc.restoredChannels[net.ID]
+	if m == nil || !m.Has(channel) {
+		return false
+	}
+	m.Delete(channel)
+	if m.Len() == 0 {
+		delete(dc.restoredChannels, net.ID)
+	}
+	return true
+}
+
 // messageSupportsBacklog checks whether the provided message can be sent as
 // part of an history batch.
 func (dc *downstreamConn) messageSupportsBacklog(msg *irc.Message) bool {
@@ -1651,8 +2489,31 @@ func (dc *downstreamConn) messageSupportsBacklog(msg *irc.Message) bool {
 	return false
 }
 
+// backlogLimit returns the maximum number of messages replayed per target,
+// capped by the limit requested by the client if any.
+func (dc *downstreamConn) backlogLimit() int {
+	limit := dc.user.backlogLimit()
+	if dc.requestedBacklogLimit != nil && *dc.requestedBacklogLimit < limit {
+		limit = *dc.requestedBacklogLimit
+	}
+	return limit
+}
+
+func (dc *downstreamConn) handleBacklogLimitCommand(msg *irc.Message) error {
+	var str string
+	if err := parseMessageParams(msg, &str); err != nil {
+		return newFailError("BACKLOGLIMIT", "NEED_MORE_PARAMS", "Missing parameters")
+	}
+	limit, err := strconv.Atoi(str)
+	if err != nil || limit < 0 {
+		return newFailError("BACKLOGLIMIT", "INVALID_PARAMS", str, "Invalid backlog limit")
+	}
+	dc.requestedBacklogLimit = &limit
+	return nil
+}
+
 func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, target, msgID string) {
-	if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil {
+	if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil || net.Passthrough {
 		return
 	}
 
@@ -1661,8 +2522,13 @@ func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, t
 	ctx, cancel := context.WithTimeout(ctx, backlogTimeout)
 	defer cancel()
 
+	limit := dc.backlogLimit()
+	if limit == 0 {
+		return
+	}
+
 	targetCM := net.casemap(target)
-	history, err := dc.user.msgStore.LoadLatestID(ctx, &net.Network, targetCM, msgID, backlogLimit)
+	history, err := dc.user.msgStore.LoadLatestID(ctx, &net.Network, targetCM, msgID, limit)
 	if err != nil {
 		dc.logger.Printf("failed to send backlog for %q: %v", target, err)
 		return
@@ -1672,9 +2538,12 @@ func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, t
 		for _, msg := range history {
 			if ch != nil && ch.Detached {
 				if net.detachedMessageNeedsRelay(ch, msg) {
-					dc.relayDetachedMessage(net, msg)
+					dc.relayDetachedMessage(net, target, msg)
 				}
 			} else {
+				if !dc.caps.IsEnabled("server-time") {
+					dc.prefixBacklogTimestamp(msg)
+				}
 				msg.Tags["batch"] = batchRef
 				dc.SendMessage(dc.marshalMessage(msg, net))
 			}
@@ -1682,17 +2551,71 @@ func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, t
 	})
 }
 
-func (dc *downstreamConn) relayDetachedMessage(net *network, msg *irc.Message) {
+// prefixBacklogTimestamp inserts the time of a backlog message at the start of
+// its text, in the user's time zone. This is used for clients which don't
+// support server-time.
+func (dc *downstreamConn) prefixBacklogTimestamp(msg *irc.Message) {
 	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
 		return
 	}
+	t, err := time.Parse(serverTimeLayout, string(msg.Tags["time"]))
+	if err != nil {
+		return
+	}
 
-	sender := msg.Prefix.Name
-	target, text := msg.Params[0], msg.Params[1]
-	if net.isHighlight(msg) {
-		sendServiceNOTICE(dc, fmt.Sprintf("highlight in %v: <%v> %v", dc.marshalEntity(net, target), sender, text))
+	timestamp := "[" + t.In(dc.user.location()).Format("2006-01-02 15:04:05") + "] "
+	text := msg.Params[1]
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "\x01ACTION " + timestamp + strings.TrimPrefix(text, "\x01ACTION ")
+	} else if strings.HasPrefix(text, "\x01") {
+		// Don't break other CTCP messages
+		return
 	} else {
-		sendServiceNOTICE(dc, fmt.Sprintf("message in %v: <%v> %v", dc.marshalEntity(net, target), sender, text))
+		text = timestamp + text
+	}
+	msg.Params[1] = text
+}
+
+func (dc *downstreamConn) relayDetachedMessage(net *network, channel string, msg *irc.Message) {
+	sender := msg.Prefix.Name
+	target := dc.marshalEntity(net, channel)
+
+	// The last parameter is the optional reason of membership changes
+	var reason string
+	switch msg.Command {
+	case "PART":
+		if len(msg.Params) > 1 {
+			reason = msg.Params[1]
+		}
+	case "KICK":
+		if len(msg.Params) > 2 {
+			reason = msg.Params[2]
+		}
+	case "QUIT":
+		if len(msg.Params) > 0 {
+			reason = msg.Params[0]
+		}
+	}
+	if reason != "" {
+		reason = " (" + reason + ")"
+	}
+
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		text := msg.Params[1]
+		if net.isHighlight(msg) {
+			sendServiceNOTICE(dc, fmt.Sprintf("highlight in %v: <%v> %v", target, sender, text))
+		} else {
+			sendServiceNOTICE(dc, fmt.Sprintf("message in %v: <%v> %v", target, sender, text))
+		}
+	case "JOIN":
+		sendServiceNOTICE(dc, fmt.Sprintf("join in %v: %v", target, sender))
+	case "PART":
+		sendServiceNOTICE(dc, fmt.Sprintf("part in %v: %v%v", target, sender, reason))
+	case "KICK":
+		sendServiceNOTICE(dc, fmt.Sprintf("kick in %v: %v by %v%v", target, msg.Params[1], sender, reason))
+	case "QUIT":
+		sendServiceNOTICE(dc, fmt.Sprintf("quit in %v: %v%v", target, sender, reason))
 	}
 }
 
@@ -1719,6 +2642,7 @@ func (dc *downstreamConn) runUntilRegistered() error {
 			return fmt.Errorf("failed to read IRC command: %w", err)
 		}
 
+		lr := dc.beginLabeledResponse(msg)
 		err = dc.handleMessage(ctx, msg)
 		if ircErr, ok := err.(ircError); ok {
 			ircErr.Message.Prefix = dc.srv.prefix()
@@ -1726,12 +2650,17 @@ func (dc *downstreamConn) runUntilRegistered() error {
 		} else if err != nil {
 			return fmt.Errorf("failed to handle IRC command %q: %v", msg, err)
 		}
+		dc.endLabeledResponse(lr)
 	}
 
 	return nil
 }
 
 func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.Message) error {
+	if mb := dc.multiline; mb != nil && msg.Tags["batch"] == irc.TagValue(mb.ref) {
+		return dc.appendMultiline(msg)
+	}
+
 	switch msg.Command {
 	case "CAP":
 		var subCmd string
@@ -1863,10 +2792,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 		if err != nil {
 			dc.logger.Printf("failed to update realname: %v", err)
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"SETNAME", "CANNOT_CHANGE_REALNAME", "Failed to update realname"},
-			}}
+			return newFailError("SETNAME", "CANNOT_CHANGE_REALNAME", "Failed to update realname")
 		}
 
 		if dc.network == nil {
@@ -1953,6 +2879,16 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		}
 
 		for _, name := range strings.Split(namesStr, ",") {
+			if dc.isMultiUpstream && dc.user.localChannels[casemapASCII(name)] != nil {
+				// Local channels are joined again on the next connection
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.prefix(),
+					Command: "PART",
+					Params:  []string{name},
+				})
+				continue
+			}
+
 			uc, upstreamName, err := dc.unmarshalEntity(name)
 			if err != nil {
 				return err
@@ -2238,16 +3174,8 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			options = msg.Params[1]
 		}
 
-		optionsParts := strings.SplitN(options, "%", 2)
-		// TODO: add support for WHOX flags in optionsParts[0]
-		var fields, whoxToken string
-		if len(optionsParts) == 2 {
-			optionsParts := strings.SplitN(optionsParts[1], ",", 2)
-			fields = strings.ToLower(optionsParts[0])
-			if len(optionsParts) == 2 && strings.Contains(fields, "t") {
-				whoxToken = optionsParts[1]
-			}
-		}
+		// TODO: add support for WHOX flags
+		_, fields, whoxToken := parseWHOXOptions(options)
 
 		// TODO: support mixed bouncer/upstream WHO queries
 		maskCM := casemapASCII(mask)
@@ -2488,6 +3416,13 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				continue
 			}
 
+			if dc.isMultiUpstream && dc.user.localChannels[casemapASCII(name)] != nil {
+				return ircError{&irc.Message{
+					Command: irc.ERR_CANNOTSENDTOCHAN,
+					Params:  []string{dc.nick, name, "Local channels are read-only"},
+				}}
+			}
+
 			if casemapASCII(name) == serviceNickCM {
 				if dc.caps.IsEnabled("echo-message") {
 					echoTags := tags.Copy()
@@ -2510,6 +3445,10 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				return err
 			}
 
+			// The upstream server would strip the client tags, leaving an
+			// empty TAGMSG: only relay it to the other downstreams
+			sendUpstream := msg.Command != "TAGMSG" || uc.caps.IsEnabled("message-tags")
+
 			if msg.Command == "PRIVMSG" && uc.network.casemap(upstreamName) == "nickserv" {
 				dc.handleNickServPRIVMSG(ctx, uc, text)
 			}
@@ -2519,24 +3458,48 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				unmarshaledText = dc.unmarshalText(uc, text)
 			}
 
-			upstreamParams := []string{upstreamName}
-			if msg.Command != "TAGMSG" {
-				upstreamParams = append(upstreamParams, unmarshaledText)
+			// The chunks of a split message share the labeled response of
+			// the command: their replies are sent in a single labeled batch
+			texts := []string{unmarshaledText}
+			if msg.Command != "TAGMSG" && uc.network.SplitLongMessages {
+				texts = splitText(unmarshaledText, uc.maxTextLength(msg.Command, upstreamName))
 			}
 
-			uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
-				Tags:    tags,
-				Command: msg.Command,
-				Params:  upstreamParams,
-			})
+			for _, upstreamText := range texts {
+				if sendUpstream {
+					if !dc.user.allowUpstreamMessage() {
+						if dc.srv.Config().UserMessagePolicy == userMessagePolicyNotice {
+							sendServiceNOTICE(dc, fmt.Sprintf("message to %q dropped: message rate limit exceeded", name))
+						}
+						continue
+					}
+
+					upstreamParams := []string{upstreamName}
+					if msg.Command != "TAGMSG" {
+						upstreamParams = append(upstreamParams, upstreamText)
+					}
+
+					uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
+						Tags:    tags.Copy(),
+						Command: msg.Command,
+						Params:  upstreamParams,
+					})
+
+					// If the upstream supports echo message, we'll produce the message
+					// when it is echoed from the upstream.
+					// Otherwise, produce/log it here because it's the last time we'll see it.
+					if uc.caps.IsEnabled("echo-message") {
+						continue
+					}
+				}
 
-			// If the upstream supports echo message, we'll produce the message
-			// when it is echoed from the upstream.
-			// Otherwise, produce/log it here because it's the last time we'll see it.
-			if !uc.caps.IsEnabled("echo-message") {
+				echoText := text
+				if len(texts) > 1 {
+					echoText = upstreamText
+				}
 				echoParams := []string{upstreamName}
 				if msg.Command != "TAGMSG" {
-					echoParams = append(echoParams, text)
+					echoParams = append(echoParams, echoText)
 				}
 
 				echoTags := tags.Copy()
@@ -2598,6 +3561,10 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			}}
 		}
 
+		if uc.network.SASLPassthrough {
+			return dc.relayAuthenticateCommand(ctx, uc, msg)
+		}
+
 		credentials, err := dc.handleAuthenticateCommand(msg)
 		if err != nil {
 			return err
@@ -2629,14 +3596,66 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 		uc := dc.upstream()
 		if uc == nil || !uc.caps.IsEnabled("draft/account-registration") {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{msg.Command, "TEMPORARILY_UNAVAILABLE", "*", "Upstream network account registration not supported"},
-			}}
+			return newFailError(msg.Command, "TEMPORARILY_UNAVAILABLE", "*", "Upstream network account registration not supported")
 		}
 
 		uc.logger.Printf("starting %v with account name %v", msg.Command, msg.Params[0])
 		uc.enqueueCommand(dc, msg)
+	case "FILTERTARGETS":
+		if !dc.caps.IsEnabled("soju.im/filter-targets") {
+			return newUnknownCommandError(msg.Command)
+		}
+
+		var subcommand string
+		if err := parseMessageParams(msg, &subcommand); err != nil {
+			return err
+		}
+
+		switch strings.ToUpper(subcommand) {
+		case "SET":
+			var targets string
+			if err := parseMessageParams(msg, nil, &targets); err != nil {
+				return err
+			}
+
+			filter := make(map[int64]*casemapMap)
+			n := 0
+			for _, target := range strings.Split(targets, ",") {
+				if target == "" {
+					continue
+				}
+				// Hard limit, just to avoid having downstreams fill our map
+				if n >= 1000 {
+					return newFailError("FILTERTARGETS", "LIMIT_EXCEEDED", subcommand, "Too many targets")
+				}
+
+				net, name, err := dc.unmarshalEntityNetwork(target)
+				if err != nil {
+					return newFailError("FILTERTARGETS", "INVALID_TARGET", subcommand, target, "Invalid target")
+				}
+
+				m := filter[net.ID]
+				if m == nil {
+					cm := newCasemapMap(0)
+					cm.SetCasemapping(net.casemap)
+					m = &cm
+					filter[net.ID] = m
+				}
+				m.SetValue(name, nil)
+				n++
+			}
+			dc.targetFilter = filter
+		case "CLEAR":
+			dc.targetFilter = nil
+		default:
+			return newFailError("FILTERTARGETS", "INVALID_PARAMS", subcommand, "Unknown subcommand")
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "FILTERTARGETS",
+			Params:  msg.Params,
+		})
 	case "MONITOR":
 		// MONITOR is unsupported in multi-upstream mode
 		uc := dc.upstream()
@@ -2746,7 +3765,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		var target, limitStr string
 		var boundsStr [2]string
 		switch subcommand {
-		case "AFTER", "BEFORE", "LATEST":
+		case "AFTER", "BEFORE", "LATEST", "AROUND":
 			if err := parseMessageParams(msg, nil, &target, &boundsStr[0], &limitStr); err != nil {
 				return err
 			}
@@ -2765,11 +3784,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				return err
 			}
 		default:
-			// TODO: support AROUND
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"CHATHISTORY", "INVALID_PARAMS", subcommand, "Unknown command"},
-			}}
+			return newFailError("CHATHISTORY", "INVALID_PARAMS", subcommand, "Unknown command")
 		}
 
 		// We don't save history for our service
@@ -2792,46 +3807,83 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		}
 		entity = network.casemap(entity)
 
-		// TODO: support msgid criteria
+		// Targets excluded from logging have no history
+		if subcommand != "TARGETS" && network.isLoggingDisabled(entity) {
+			dc.SendBatch("chathistory", []string{target}, nil, func(batchRef irc.TagValue) {})
+			return nil
+		}
+
 		var bounds [2]time.Time
-		bounds[0] = parseChatHistoryBound(boundsStr[0])
+		var boundID string
+		bounds[0], boundID = parseChatHistoryBound(boundsStr[0])
 		if subcommand == "LATEST" && boundsStr[0] == "*" {
 			bounds[0] = time.Now()
+		} else if boundID != "" {
+			// Both internal and upstream message IDs are accepted
+			if subcommand == "TARGETS" {
+				return newFailError("CHATHISTORY", "INVALID_PARAMS", subcommand, boundsStr[0], "Invalid first bound")
+			}
 		} else if bounds[0].IsZero() {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"CHATHISTORY", "INVALID_PARAMS", subcommand, boundsStr[0], "Invalid first bound"},
-			}}
+			return newFailError("CHATHISTORY", "INVALID_PARAMS", subcommand, boundsStr[0], "Invalid first bound")
 		}
 
 		if boundsStr[1] != "" {
-			bounds[1] = parseChatHistoryBound(boundsStr[1])
+			// Only the first bound may be a message ID
+			bounds[1], _ = parseChatHistoryBound(boundsStr[1])
 			if bounds[1].IsZero() {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"CHATHISTORY", "INVALID_PARAMS", subcommand, boundsStr[1], "Invalid second bound"},
-				}}
+				return newFailError("CHATHISTORY", "INVALID_PARAMS", subcommand, boundsStr[1], "Invalid second bound")
 			}
 		}
 
 		limit, err := strconv.Atoi(limitStr)
 		if err != nil || limit < 0 || limit > chatHistoryLimit {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"CHATHISTORY", "INVALID_PARAMS", subcommand, limitStr, "Invalid limit"},
-			}}
+			return newFailError("CHATHISTORY", "INVALID_PARAMS", subcommand, limitStr, "Invalid limit")
 		}
 
 		eventPlayback := dc.caps.IsEnabled("draft/event-playback")
 
 		var history []*irc.Message
 		switch subcommand {
-		case "BEFORE", "LATEST":
-			history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit, eventPlayback)
+		case "LATEST":
+			if boundID != "" {
+				history, err = store.LoadLatestID(ctx, &network.Network, entity, boundID, limit)
+			} else {
+				history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit, eventPlayback)
+			}
+		case "BEFORE":
+			if boundID != "" {
+				history, err = store.LoadBeforeID(ctx, &network.Network, entity, boundID, time.Time{}, limit, eventPlayback)
+			} else {
+				history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit, eventPlayback)
+			}
 		case "AFTER":
-			history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], time.Now(), limit, eventPlayback)
+			if boundID != "" {
+				history, err = store.LoadAfterID(ctx, &network.Network, entity, boundID, time.Now(), limit, eventPlayback)
+			} else {
+				history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], time.Now(), limit, eventPlayback)
+			}
+		case "AROUND":
+			if boundID != "" {
+				history, err = store.LoadAroundID(ctx, &network.Network, entity, boundID, limit, eventPlayback)
+				break
+			}
+			history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], time.Time{}, limit/2, eventPlayback)
+			if err != nil {
+				break
+			}
+			// Messages sent at the exact timestamp are part of the second half
+			var after []*irc.Message
+			after, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0].Add(-1), time.Now(), limit-len(history), eventPlayback)
+			history = append(history, after...)
 		case "BETWEEN":
-			if bounds[0].Before(bounds[1]) {
+			if boundID != "" {
+				// The direction can't be known without the message time:
+				// assume the second bound is after the message
+				history, err = store.LoadAfterID(ctx, &network.Network, entity, boundID, bounds[1], limit, eventPlayback)
+				if err == nil && len(history) == 0 {
+					history, err = store.LoadBeforeID(ctx, &network.Network, entity, boundID, bounds[1], limit, eventPlayback)
+				}
+			} else if bounds[0].Before(bounds[1]) {
 				history, err = store.LoadAfterTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
 			} else {
 				history, err = store.LoadBeforeTime(ctx, &network.Network, entity, bounds[0], bounds[1], limit, eventPlayback)
@@ -2841,17 +3893,23 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			targets, err := store.ListTargets(ctx, &network.Network, bounds[0], bounds[1], limit, eventPlayback)
 			if err != nil {
 				dc.logger.Printf("failed fetching targets for chathistory: %v", err)
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"CHATHISTORY", "MESSAGE_ERROR", subcommand, "Failed to retrieve targets"},
-				}}
+				return newFailError("CHATHISTORY", "MESSAGE_ERROR", subcommand, "Failed to retrieve targets")
 			}
 
+			// Targets are sorted by latest message: only move channels with an
+			// explicit sort order to the front
+			sort.SliceStable(targets, func(i, j int) bool {
+				return sortOrderLess(network.channelSortOrder(targets[i].Name), network.channelSortOrder(targets[j].Name))
+			})
+
 			dc.SendBatch("draft/chathistory-targets", nil, nil, func(batchRef irc.TagValue) {
 				for _, target := range targets {
 					if ch := network.channels.Value(target.Name); ch != nil && ch.Detached {
 						continue
 					}
+					if network.isLoggingDisabled(target.Name) {
+						continue
+					}
 
 					dc.SendMessage(&irc.Message{
 						Tags:    irc.Tags{"batch": batchRef},
@@ -2875,13 +3933,12 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				dc.SendMessage(dc.marshalMessage(msg, network))
 			}
 		})
+	case "BACKLOGLIMIT":
+		return dc.handleBacklogLimitCommand(msg)
 	case "READ":
 		var target, criteria string
 		if err := parseMessageParams(msg, &target); err != nil {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"READ", "NEED_MORE_PARAMS", "Missing parameters"},
-			}}
+			return newFailError("READ", "NEED_MORE_PARAMS", "Missing parameters")
 		}
 		if len(msg.Params) > 1 {
 			criteria = msg.Params[1]
@@ -2906,10 +3963,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		r, err := dc.srv.db.GetReadReceipt(ctx, network.ID, entityCM)
 		if err != nil {
 			dc.logger.Printf("failed to get the read receipt for %q: %v", entity, err)
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"READ", "INTERNAL_ERROR", target, "Internal error"},
-			}}
+			return newFailError("READ", "INTERNAL_ERROR", target, "Internal error")
 		} else if r == nil {
 			r = &ReadReceipt{
 				Target: entityCM,
@@ -2921,18 +3975,12 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			// TODO: support msgid criteria
 			criteriaParts := strings.SplitN(criteria, "=", 2)
 			if len(criteriaParts) != 2 || criteriaParts[0] != "timestamp" {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"READ", "INVALID_PARAMS", criteria, "Unknown criteria"},
-				}}
+				return newFailError("READ", "INVALID_PARAMS", criteria, "Unknown criteria")
 			}
 
 			timestamp, err := time.Parse(serverTimeLayout, criteriaParts[1])
 			if err != nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"READ", "INVALID_PARAMS", criteria, "Invalid criteria"},
-				}}
+				return newFailError("READ", "INVALID_PARAMS", criteria, "Invalid criteria")
 			}
 			now := time.Now()
 			if timestamp.After(now) {
@@ -2942,10 +3990,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				r.Timestamp = timestamp
 				if err := dc.srv.db.StoreReadReceipt(ctx, network.ID, r); err != nil {
 					dc.logger.Printf("failed to store receipt for %q: %v", entity, err)
-					return ircError{&irc.Message{
-						Command: "FAIL",
-						Params:  []string{"READ", "INTERNAL_ERROR", target, "Internal error"},
-					}}
+					return newFailError("READ", "INTERNAL_ERROR", target, "Internal error")
 				}
 				broadcast = true
 			}
@@ -2966,7 +4011,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		})
 	case "SEARCH":
 		store, ok := dc.user.msgStore.(searchMessageStore)
-		if !ok {
+		if !ok || !dc.caps.IsEnabled("soju.im/search") {
 			return ircError{&irc.Message{
 				Command: irc.ERR_UNKNOWNCOMMAND,
 				Params:  []string{dc.nick, "SEARCH", "Unknown command"},
@@ -2979,9 +4024,10 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		attrs := irc.ParseTags(attrsStr)
 
 		var uc *upstreamConn
-		const searchMaxLimit = 100
+		var highlight bool
+		const searchDefaultLimit = 100
 		opts := searchOptions{
-			limit: searchMaxLimit,
+			limit: searchDefaultLimit,
 		}
 		for name, v := range attrs {
 			value := string(v)
@@ -2989,10 +4035,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			case "before", "after":
 				timestamp, err := time.Parse(serverTimeLayout, value)
 				if err != nil {
-					return ircError{&irc.Message{
-						Command: "FAIL",
-						Params:  []string{"SEARCH", "INVALID_PARAMS", name, "Invalid criteria"},
-					}}
+					return newFailError("SEARCH", "INVALID_PARAMS", name, "Invalid criteria")
 				}
 				switch name {
 				case "after":
@@ -3005,10 +4048,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			case "in":
 				u, upstreamName, err := dc.unmarshalEntity(value)
 				if err != nil {
-					return ircError{&irc.Message{
-						Command: "FAIL",
-						Params:  []string{"SEARCH", "INVALID_PARAMS", name, "Invalid criteria"},
-					}}
+					return newFailError("SEARCH", "INVALID_PARAMS", name, "Invalid criteria")
 				}
 				uc = u
 				opts.in = u.network.casemap(upstreamName)
@@ -3017,37 +4057,70 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			case "limit":
 				limit, err := strconv.Atoi(value)
 				if err != nil || limit <= 0 {
-					return ircError{&irc.Message{
-						Command: "FAIL",
-						Params:  []string{"SEARCH", "INVALID_PARAMS", name, "Invalid limit"},
-					}}
+					return newFailError("SEARCH", "INVALID_PARAMS", name, "Invalid limit")
 				}
 				opts.limit = limit
+			case "highlight":
+				highlight = true
 			}
 		}
-		if uc == nil {
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"SEARCH", "INVALID_PARAMS", "in", "The in parameter is mandatory"},
-			}}
+		if opts.limit > chatHistoryLimit {
+			opts.limit = chatHistoryLimit
 		}
-		if opts.limit > searchMaxLimit {
-			opts.limit = searchMaxLimit
+
+		// Without the in parameter, highlights are searched in all targets
+		// of the bound network, or of all networks
+		var networks []*network
+		if uc != nil {
+			networks = []*network{uc.network}
+		} else if !highlight {
+			return newFailError("SEARCH", "INVALID_PARAMS", "in", "The in parameter is mandatory")
+		} else if dc.network != nil {
+			networks = []*network{dc.network}
+		} else {
+			networks = dc.user.networks
 		}
 
-		messages, err := store.Search(ctx, &uc.network.Network, opts)
-		if err != nil {
-			dc.logger.Printf("failed fetching messages for search: %v", err)
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"SEARCH", "INTERNAL_ERROR", "Messages could not be retrieved"},
-			}}
+		var messages []*irc.Message
+		for _, net := range networks {
+			netOpts := opts
+			if opts.from != "" {
+				if dc.network == nil {
+					// Strip the network suffix from the nickname, if any
+					if i := strings.LastIndexByte(opts.from, '/'); i >= 0 && opts.from[i+1:] == net.GetName() {
+						netOpts.from = opts.from[:i]
+					}
+				}
+				netOpts.from = net.casemap(netOpts.from)
+				netOpts.casemap = net.casemap
+			}
+			if highlight {
+				// Highlights are evaluated against the current nickname
+				netOpts.highlight = net.isHighlight
+			}
+			if net.isLoggingDisabled(opts.in) {
+				continue
+			}
+			// Messages logged before logging was disabled are hidden
+			netOpts.exclude = net.isLoggingDisabled
+
+			l, err := store.Search(ctx, &net.Network, netOpts)
+			if err != nil {
+				dc.logger.Printf("failed fetching messages for search: %v", err)
+				return newFailError("SEARCH", "INTERNAL_ERROR", "Messages could not be retrieved")
+			}
+			for _, msg := range l {
+				messages = append(messages, dc.marshalMessage(msg, net))
+			}
+		}
+		if len(networks) > 1 {
+			messages = sortSearchResults(messages, &opts)
 		}
 
 		dc.SendBatch("soju.im/search", nil, nil, func(batchRef irc.TagValue) {
 			for _, msg := range messages {
 				msg.Tags["batch"] = batchRef
-				dc.SendMessage(dc.marshalMessage(msg, uc.network))
+				dc.SendMessage(msg)
 			}
 		})
 	case "BOUNCER":
@@ -3058,10 +4131,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 		switch strings.ToUpper(subcommand) {
 		case "BIND":
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"BOUNCER", "REGISTRATION_IS_COMPLETED", "BIND", "Cannot bind to a network after registration"},
-			}}
+			return newFailError("BOUNCER", "REGISTRATION_IS_COMPLETED", "BIND", "Cannot bind to a network after registration")
 		case "LISTNETWORKS":
 			dc.SendBatch("soju.im/bouncer-networks", nil, nil, func(batchRef irc.TagValue) {
 				for _, network := range dc.user.networks {
@@ -3096,10 +4166,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 			network, err := dc.user.createNetwork(ctx, record)
 			if err != nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"BOUNCER", "UNKNOWN_ERROR", subcommand, fmt.Sprintf("Failed to create network: %v", err)},
-				}}
+				return newFailError("BOUNCER", "UNKNOWN_ERROR", subcommand, fmt.Sprintf("Failed to create network: %v", err))
 			}
 
 			dc.SendMessage(&irc.Message{
@@ -3120,10 +4187,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 			net := dc.user.getNetworkByID(id)
 			if net == nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID"},
-				}}
+				return newFailError("BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID")
 			}
 
 			record := net.Network // copy network record because we'll mutate it
@@ -3140,10 +4204,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 			_, err = dc.user.updateNetwork(ctx, &record)
 			if err != nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"BOUNCER", "UNKNOWN_ERROR", subcommand, fmt.Sprintf("Failed to update network: %v", err)},
-				}}
+				return newFailError("BOUNCER", "UNKNOWN_ERROR", subcommand, fmt.Sprintf("Failed to update network: %v", err))
 			}
 
 			dc.SendMessage(&irc.Message{
@@ -3151,6 +4212,100 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				Command: "BOUNCER",
 				Params:  []string{"CHANGENETWORK", idStr},
 			})
+		case "RECONNECTNETWORK", "DISCONNECTNETWORK":
+			var idStr string
+			if err := parseMessageParams(msg, nil, &idStr); err != nil {
+				return err
+			}
+			id, err := parseBouncerNetID(subcommand, idStr)
+			if err != nil {
+				return err
+			}
+
+			net := dc.user.getNetworkByID(id)
+			if net == nil {
+				return newFailError("BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID")
+			}
+
+			if strings.ToUpper(subcommand) == "RECONNECTNETWORK" {
+				if !net.Enabled {
+					return newFailError("BOUNCER", "UNKNOWN_ERROR", subcommand, "Network is disabled")
+				}
+				dc.user.reconnectNetwork(net)
+			} else {
+				dc.user.disconnectNetwork(net)
+			}
+
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BOUNCER",
+				Params:  []string{strings.ToUpper(subcommand), idStr},
+			})
+		case "LISTCHANNELS":
+			var idStr string
+			if err := parseMessageParams(msg, nil, &idStr); err != nil {
+				return err
+			}
+			id, err := parseBouncerNetID(subcommand, idStr)
+			if err != nil {
+				return err
+			}
+
+			net := dc.user.getNetworkByID(id)
+			if net == nil {
+				return newFailError("BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID")
+			}
+
+			channels := net.sortedChannels()
+
+			dc.SendBatch("soju.im/bouncer-channels", []string{idStr}, nil, func(batchRef irc.TagValue) {
+				for _, ch := range channels {
+					attrs := getChannelAttrs(net, ch)
+					dc.SendMessage(&irc.Message{
+						Tags:    irc.Tags{"batch": batchRef},
+						Prefix:  dc.srv.prefix(),
+						Command: "BOUNCER",
+						Params:  []string{"CHANNEL", idStr, ch.Name, attrs.String()},
+					})
+				}
+			})
+		case "CHANGECHANNEL":
+			var idStr, name, attrsStr string
+			if err := parseMessageParams(msg, nil, &idStr, &name, &attrsStr); err != nil {
+				return err
+			}
+			id, err := parseBouncerNetID(subcommand, idStr)
+			if err != nil {
+				return err
+			}
+			attrs := irc.ParseTags(attrsStr)
+
+			net := dc.user.getNetworkByID(id)
+			if net == nil {
+				return newFailError("BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID")
+			}
+
+			ch := net.channels.Value(name)
+			if ch == nil {
+				return newFailError("BOUNCER", "INVALID_CHANNEL", subcommand, idStr, name, "Channel not found")
+			}
+
+			record := *ch // copy channel record because we'll mutate it
+			if err := updateChannelAttrs(&record, attrs, subcommand); err != nil {
+				return err
+			}
+
+			if err := dc.srv.db.StoreChannel(ctx, net.ID, &record); err != nil {
+				return newFailError("BOUNCER", "UNKNOWN_ERROR", subcommand, fmt.Sprintf("Failed to update channel: %v", err))
+			}
+			*ch = record
+
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BOUNCER",
+				Params:  []string{"CHANGECHANNEL", idStr, ch.Name},
+			})
+			dc.user.notifyBouncerChannelState(net, ch)
 		case "DELNETWORK":
 			var idStr string
 			if err := parseMessageParams(msg, nil, &idStr); err != nil {
@@ -3163,10 +4318,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 
 			net := dc.user.getNetworkByID(id)
 			if net == nil {
-				return ircError{&irc.Message{
-					Command: "FAIL",
-					Params:  []string{"BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID"},
-				}}
+				return newFailError("BOUNCER", "INVALID_NETID", subcommand, idStr, "Invalid network ID")
 			}
 
 			if err := dc.user.deleteNetwork(ctx, net.ID); err != nil {
@@ -3179,11 +4331,10 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				Params:  []string{"DELNETWORK", idStr},
 			})
 		default:
-			return ircError{&irc.Message{
-				Command: "FAIL",
-				Params:  []string{"BOUNCER", "UNKNOWN_COMMAND", subcommand, "Unknown subcommand"},
-			}}
+			return newFailError("BOUNCER", "UNKNOWN_COMMAND", subcommand, "Unknown subcommand")
 		}
+	case "BATCH":
+		return dc.handleBatch(ctx, msg)
 	default:
 		dc.logger.Printf("unhandled message: %v", msg)
 
@@ -43,23 +43,42 @@ func splitHostPort(addr string) (host string, port int, err error) {
 	return host, port, err
 }
 
+// defaultIdentOS is the operating system token sent in ident responses by
+// default. "OTHER" indicates that the user ID isn't a system user name.
+const defaultIdentOS = "OTHER"
+
+type identEntry struct {
+	os    string
+	ident string
+}
+
 // Identd implements an ident server, as described in RFC 1413.
 type Identd struct {
-	entries map[identKey]string
+	entries map[identKey]identEntry
 	lock    sync.RWMutex
 }
 
 func NewIdentd() *Identd {
-	return &Identd{entries: make(map[identKey]string)}
+	return &Identd{entries: make(map[identKey]identEntry)}
 }
 
+// Store registers the ident of a connection.
 func (s *Identd) Store(remoteAddr, localAddr, ident string) {
+	s.StoreWithOS(remoteAddr, localAddr, "", ident)
+}
+
+// StoreWithOS is like Store, but also sets the operating system token of the
+// response, empty for "OTHER".
+func (s *Identd) StoreWithOS(remoteAddr, localAddr, os, ident string) {
 	k, err := newIdentKey(remoteAddr, localAddr)
 	if err != nil {
 		return
 	}
+	if os == "" {
+		os = defaultIdentOS
+	}
 	s.lock.Lock()
-	s.entries[*k] = ident
+	s.entries[*k] = identEntry{os: os, ident: ident}
 	s.lock.Unlock()
 }
 
@@ -120,15 +139,15 @@ func (s *Identd) handle(c net.Conn) {
 		}
 
 		s.lock.RLock()
-		ident := s.entries[k]
+		entry, ok := s.entries[k]
 		s.lock.RUnlock()
 
-		if ident == "" {
+		if !ok || entry.ident == "" {
 			fmt.Fprintf(c, "%s : ERROR : NO-USER\r\n", l)
 			break
 		}
 
-		fmt.Fprintf(c, "%s : USERID : OTHER : %s\r\n", l, ident)
+		fmt.Fprintf(c, "%s : USERID : %s : %s\r\n", l, entry.os, entry.ident)
 	}
 }
 
@@ -3,6 +3,7 @@ package soju
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -323,9 +324,63 @@ type batch struct {
 	Params []string
 	Outer  *batch // if not-nil, this batch is nested in Outer
 	Label  string
+	// Lines received so far, for draft/multiline batches
+	Multiline *multilineBatch
 }
 
-func join(channels, keys []string) []*irc.Message {
+// splitText splits the text of a PRIVMSG or NOTICE message into chunks of at
+// most maxLen bytes. The text is split at word boundaries when possible, and
+// never in the middle of a UTF-8 sequence. CTCP ACTIONs are split into multiple
+// ACTIONs, other CTCP messages are left as-is.
+func splitText(text string, maxLen int) []string {
+	if len(text) <= maxLen {
+		return []string{text}
+	}
+
+	const actionPrefix, actionSuffix = "\x01ACTION ", "\x01"
+	if strings.HasPrefix(text, actionPrefix) && strings.HasSuffix(text, actionSuffix) {
+		action := strings.TrimSuffix(strings.TrimPrefix(text, actionPrefix), actionSuffix)
+		chunks := splitText(action, maxLen-len(actionPrefix)-len(actionSuffix))
+		for i, chunk := range chunks {
+			chunks[i] = actionPrefix + chunk + actionSuffix
+		}
+		return chunks
+	} else if strings.HasPrefix(text, "\x01") {
+		return []string{text}
+	}
+
+	if maxLen < utf8.UTFMax {
+		maxLen = utf8.UTFMax
+	}
+
+	var chunks []string
+	for len(text) > maxLen {
+		// The space at the split point is dropped
+		if i := strings.LastIndexByte(text[:maxLen+1], ' '); i > 0 {
+			chunks = append(chunks, text[:i])
+			text = text[i+1:]
+			continue
+		}
+
+		i := maxLen
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		if i == 0 {
+			i = maxLen
+		}
+		chunks = append(chunks, text[:i])
+		text = text[i:]
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// join generates JOIN messages for a list of channels. If maxTargets is
+// non-zero, each message contains at most maxTargets channels.
+func join(channels, keys []string, maxTargets int) []*irc.Message {
 	// Put channels with a key first
 	js := joinSorter{channels, keys}
 	sort.Sort(&js)
@@ -335,6 +390,7 @@ func join(channels, keys []string) []*irc.Message {
 
 	var msgs []*irc.Message
 	var channelsBuf, keysBuf strings.Builder
+	targets := 0
 	for i, channel := range channels {
 		key := keys[i]
 
@@ -343,7 +399,7 @@ func join(channels, keys []string) []*irc.Message {
 			n += 1 + len(key)
 		}
 
-		if channelsBuf.Len() > 0 && n > maxLength {
+		if channelsBuf.Len() > 0 && (n > maxLength || (maxTargets > 0 && targets >= maxTargets)) {
 			// No room for the new channel in this message
 			params := []string{channelsBuf.String()}
 			if keysBuf.Len() > 0 {
@@ -352,12 +408,14 @@ func join(channels, keys []string) []*irc.Message {
 			msgs = append(msgs, &irc.Message{Command: "JOIN", Params: params})
 			channelsBuf.Reset()
 			keysBuf.Reset()
+			targets = 0
 		}
 
 		if channelsBuf.Len() > 0 {
 			channelsBuf.WriteByte(',')
 		}
 		channelsBuf.WriteString(channel)
+		targets++
 		if key != "" {
 			if keysBuf.Len() > 0 {
 				keysBuf.WriteByte(',')
@@ -717,22 +775,103 @@ func isHighlight(text, nick string) bool {
 	}
 }
 
+// normalizeMask expands a nickname into a full "nick!user@host" mask.
+func normalizeMask(mask string) string {
+	if !strings.ContainsAny(mask, "!@") {
+		return mask + "!*@*"
+	}
+	if !strings.Contains(mask, "@") {
+		return mask + "@*"
+	}
+	if !strings.Contains(mask, "!") {
+		return "*!" + mask
+	}
+	return mask
+}
+
+// matchMask checks whether s matches the mask. The wildcard "*" matches any
+// sequence of characters and "?" matches exactly one character.
+func matchMask(mask, s string) bool {
+	var starMask, starS int
+	star := false
+	i, j := 0, 0
+	for j < len(s) {
+		switch {
+		case i < len(mask) && mask[i] == '*':
+			star = true
+			starMask, starS = i, j
+			i++
+		case i < len(mask) && (mask[i] == '?' || mask[i] == s[j]):
+			i++
+			j++
+		case star:
+			starS++
+			i, j = starMask+1, starS
+		default:
+			return false
+		}
+	}
+	for i < len(mask) && mask[i] == '*' {
+		i++
+	}
+	return i == len(mask)
+}
+
+// stsPolicy is an IRCv3 STS policy, see
+// https://ircv3.net/specs/extensions/sts
+type stsPolicy struct {
+	Port     int
+	Duration *time.Duration
+}
+
+func parseSTSPolicy(value string) (*stsPolicy, error) {
+	var policy stsPolicy
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		k := parts[0]
+		var v string
+		if len(parts) == 2 {
+			v = parts[1]
+		}
+
+		switch k {
+		case "port":
+			port, err := strconv.Atoi(v)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid port %q", v)
+			}
+			policy.Port = port
+		case "duration":
+			sec, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %q", v)
+			}
+			d := time.Duration(sec) * time.Second
+			policy.Duration = &d
+		}
+	}
+	return &policy, nil
+}
+
 // parseChatHistoryBound parses the given CHATHISTORY parameter as a bound.
-// The zero time is returned on error.
-func parseChatHistoryBound(param string) time.Time {
+// Either a timestamp or a message ID is returned. The zero time and an empty
+// message ID are returned on error.
+func parseChatHistoryBound(param string) (time.Time, string) {
 	parts := strings.SplitN(param, "=", 2)
 	if len(parts) != 2 {
-		return time.Time{}
+		return time.Time{}, ""
 	}
 	switch parts[0] {
 	case "timestamp":
 		timestamp, err := time.Parse(serverTimeLayout, parts[1])
 		if err != nil {
-			return time.Time{}
+			return time.Time{}, ""
 		}
-		return timestamp
+		return timestamp, ""
+	case "msgid":
+		return time.Time{}, parts[1]
 	default:
-		return time.Time{}
+		return time.Time{}, ""
 	}
 }
 
@@ -740,8 +879,24 @@ func parseChatHistoryBound(param string) time.Time {
 // RPL_WHOSPCRPL messages.
 var whoxFields = []byte("tcuihsnfdlaor")
 
+// parseWHOXOptions splits the second WHO parameter into its flags, WHOX fields
+// and WHOX token. The fields are empty if the WHO query isn't a WHOX query.
+func parseWHOXOptions(options string) (flags, fields, token string) {
+	optionsParts := strings.SplitN(options, "%", 2)
+	flags = optionsParts[0]
+	if len(optionsParts) == 2 {
+		optionsParts := strings.SplitN(optionsParts[1], ",", 2)
+		fields = strings.ToLower(optionsParts[0])
+		if len(optionsParts) == 2 && strings.Contains(fields, "t") {
+			token = optionsParts[1]
+		}
+	}
+	return flags, fields, token
+}
+
 type whoxInfo struct {
 	Token    string
+	Channel  string
 	Username string
 	Hostname string
 	Server   string
@@ -756,7 +911,10 @@ func (info *whoxInfo) get(field byte) string {
 	case 't':
 		return info.Token
 	case 'c':
-		return "*"
+		if info.Channel == "" {
+			return "*"
+		}
+		return info.Channel
 	case 'u':
 		return info.Username
 	case 'i':
@@ -789,10 +947,11 @@ func (info *whoxInfo) get(field byte) string {
 
 func generateWHOXReply(prefix *irc.Prefix, nick, fields string, info *whoxInfo) *irc.Message {
 	if fields == "" {
+		channel := info.get('c')
 		return &irc.Message{
 			Prefix:  prefix,
 			Command: irc.RPL_WHOREPLY,
-			Params:  []string{nick, "*", info.Username, info.Hostname, info.Server, info.Nickname, info.Flags, "0 " + info.Realname},
+			Params:  []string{nick, channel, info.Username, info.Hostname, info.Server, info.Nickname, info.Flags, "0 " + info.Realname},
 		}
 	}
 
@@ -1,7 +1,9 @@
 package soju
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestIsHighlight(t *testing.T) {
@@ -32,3 +34,152 @@ func TestIsHighlight(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchMask(t *testing.T) {
+	testCases := []struct {
+		mask  string
+		s     string
+		match bool
+	}{
+		{"nick!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@*.example.org", "nick!user@irc.example.org", true},
+		{"*!*@*.example.org", "nick!user@example.org", false},
+		{"n?ck!user@*", "nick!user@host", true},
+		{"n?ck!user@*", "nck!user@host", false},
+		{"*!*@*", "nick!user@host", true},
+		{"[nick]!*@*", "[nick]!user@host", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+	}
+
+	for _, tc := range testCases {
+		if match := matchMask(tc.mask, tc.s); match != tc.match {
+			t.Errorf("matchMask(%q, %q) = %v, but want %v", tc.mask, tc.s, match, tc.match)
+		}
+	}
+}
+
+func TestNormalizeMask(t *testing.T) {
+	testCases := map[string]string{
+		"nick":           "nick!*@*",
+		"nick!user":      "nick!user@*",
+		"user@host":      "*!user@host",
+		"*@host":         "*!*@host",
+		"nick!user@host": "nick!user@host",
+	}
+
+	for mask, want := range testCases {
+		if got := normalizeMask(mask); got != want {
+			t.Errorf("normalizeMask(%q) = %q, but want %q", mask, got, want)
+		}
+	}
+}
+
+func TestParseSTSPolicy(t *testing.T) {
+	policy, err := parseSTSPolicy("port=6697,duration=300,preload")
+	if err != nil {
+		t.Fatalf("parseSTSPolicy() failed: %v", err)
+	}
+	if policy.Port != 6697 {
+		t.Errorf("invalid port: got %v, want %v", policy.Port, 6697)
+	}
+	if policy.Duration == nil || *policy.Duration != 300*time.Second {
+		t.Errorf("invalid duration: got %v, want %v", policy.Duration, 300*time.Second)
+	}
+
+	policy, err = parseSTSPolicy("port=6697")
+	if err != nil {
+		t.Fatalf("parseSTSPolicy() failed: %v", err)
+	}
+	if policy.Duration != nil {
+		t.Errorf("invalid duration: got %v, want none", *policy.Duration)
+	}
+
+	for _, s := range []string{"port=abc", "port=0", "duration=-1"} {
+		if _, err := parseSTSPolicy(s); err == nil {
+			t.Errorf("parseSTSPolicy(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestParseWHOXOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options string
+		flags   string
+		fields  string
+		token   string
+	}{
+		{"empty", "", "", "", ""},
+		{"flags", "o", "o", "", ""},
+		{"fields", "%na", "", "na", ""},
+		{"token", "%tna,42", "", "tna", "42"},
+		{"tokenWithoutField", "%na,42", "", "na", ""},
+		{"flagsAndFields", "o%CNA", "o", "cna", ""},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			flags, fields, token := parseWHOXOptions(tc.options)
+			if flags != tc.flags || fields != tc.fields || token != tc.token {
+				t.Errorf("parseWHOXOptions(%q) = %q, %q, %q, but want %q, %q, %q", tc.options, flags, fields, token, tc.flags, tc.fields, tc.token)
+			}
+		})
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	testCases := []struct {
+		name   string
+		text   string
+		maxLen int
+		chunks []string
+	}{
+		{"short", "hello world", 20, []string{"hello world"}},
+		{"words", "hello there world", 11, []string{"hello there", "world"}},
+		{"longWord", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"utf8", "ééé", 5, []string{"éé", "é"}},
+		{"trailingSpace", "abcde ", 5, []string{"abcde"}},
+		{"action", "\x01ACTION waves hello\x01", 18, []string{"\x01ACTION waves\x01", "\x01ACTION hello\x01"}},
+		{"ctcp", "\x01VERSION some long reply\x01", 10, []string{"\x01VERSION some long reply\x01"}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := splitText(tc.text, tc.maxLen)
+			if !reflect.DeepEqual(chunks, tc.chunks) {
+				t.Errorf("splitText(%q, %v) = %q, but want %q", tc.text, tc.maxLen, chunks, tc.chunks)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	testCases := []struct {
+		name       string
+		channels   []string
+		keys       []string
+		maxTargets int
+		params     [][]string
+	}{
+		{"unlimited", []string{"#a", "#b", "#c"}, []string{"", "", ""}, 0, [][]string{{"#a,#b,#c"}}},
+		{"batch", []string{"#a", "#b", "#c"}, []string{"", "", ""}, 2, [][]string{{"#a,#b"}, {"#c"}}},
+		{"keys", []string{"#a", "#b", "#c"}, []string{"", "k", ""}, 2, [][]string{{"#b,#a", "k"}, {"#c"}}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			var params [][]string
+			for _, msg := range join(tc.channels, tc.keys, tc.maxTargets) {
+				params = append(params, msg.Params)
+			}
+			if !reflect.DeepEqual(params, tc.params) {
+				t.Errorf("join(%q, %q, %v) = %q, but want %q", tc.channels, tc.keys, tc.maxTargets, params, tc.params)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package soju
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum duration of a lockout after repeated login failures
+	loginMaxLockout = 24 * time.Hour
+	// Time after which the failed login attempts of a username or IP address
+	// are forgotten
+	loginFailureWindow = time.Hour
+)
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func (lf *loginFailures) expired(now time.Time) bool {
+	return now.Sub(lf.last) >= loginFailureWindow && !now.Before(lf.lockedUntil)
+}
+
+// loginLimiter keeps track of failed downstream authentication attempts per
+// username and per IP address, to slow down credential stuffing. Usernames
+// are case-insensitive.
+type loginLimiter struct {
+	lock   sync.Mutex
+	byUser map[string]*loginFailures
+	byIP   map[string]*loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		byUser: make(map[string]*loginFailures),
+		byIP:   make(map[string]*loginFailures),
+	}
+}
+
+// lockedUntil returns the time until which logins for the username or from
+// the IP address are rejected, or the zero time if they are allowed. username
+// may be empty.
+func (ll *loginLimiter) lockedUntil(username, ip string, now time.Time) time.Time {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	failures := []*loginFailures{ll.byIP[ip]}
+	if username != "" {
+		failures = append(failures, ll.byUser[casemapASCII(username)])
+	}
+
+	var until time.Time
+	for _, lf := range failures {
+		if lf != nil && now.Before(lf.lockedUntil) && lf.lockedUntil.After(until) {
+			until = lf.lockedUntil
+		}
+	}
+	return until
+}
+
+// fail records a failed login attempt. Once maxFailures consecutive failures
+// are reached, logins are locked out for the lockout duration, doubled for
+// each subsequent failure. A zero maxFailures disables the limit. If username
+// is empty, only the IP address is recorded.
+func (ll *loginLimiter) fail(username, ip string, now time.Time, maxFailures int, lockout time.Duration) {
+	if maxFailures <= 0 {
+		return
+	}
+
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	record := func(m map[string]*loginFailures, k string) {
+		lf := m[k]
+		if lf == nil {
+			lf = new(loginFailures)
+			m[k] = lf
+		}
+		lf.count++
+		lf.last = now
+		if lf.count < maxFailures {
+			return
+		}
+
+		d := lockout
+		for i := maxFailures; i < lf.count && d < loginMaxLockout; i++ {
+			d *= 2
+		}
+		if d > loginMaxLockout {
+			d = loginMaxLockout
+		}
+		lf.lockedUntil = now.Add(d)
+	}
+	if username != "" {
+		record(ll.byUser, casemapASCII(username))
+	}
+	record(ll.byIP, ip)
+}
+
+// prune forgets the expired failed login attempts. It's called periodically
+// to bound the memory usage.
+func (ll *loginLimiter) prune(now time.Time) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	for _, m := range []map[string]*loginFailures{ll.byUser, ll.byIP} {
+		for k, lf := range m {
+			if lf.expired(now) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// reset forgets the failed login attempts for the username and the IP
+// address, after a successful login.
+func (ll *loginLimiter) reset(username, ip string) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	delete(ll.byUser, casemapASCII(username))
+	delete(ll.byIP, ip)
+}
+
+// clear removes the lockout for a username or an IP address. It returns false
+// if there was no recorded failure for it.
+func (ll *loginLimiter) clear(name string) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	_, okUser := ll.byUser[casemapASCII(name)]
+	_, okIP := ll.byIP[name]
+	delete(ll.byUser, casemapASCII(name))
+	delete(ll.byIP, name)
+	return okUser || okIP
+}
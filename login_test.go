@@ -0,0 +1,59 @@
+package soju
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	ll := newLoginLimiter()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if until := ll.lockedUntil("alice", "192.0.2.1", now); !until.IsZero() {
+			t.Fatalf("locked out after %v failures", i)
+		}
+		ll.fail("alice", "192.0.2.1", now, 3, time.Minute)
+	}
+
+	if until := ll.lockedUntil("Alice", "192.0.2.2", now); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("username lockout: got %v, want %v", until, now.Add(time.Minute))
+	}
+	if until := ll.lockedUntil("bob", "192.0.2.1", now); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("IP lockout: got %v, want %v", until, now.Add(time.Minute))
+	}
+
+	ll.fail("alice", "192.0.2.1", now, 3, time.Minute)
+	if until := ll.lockedUntil("alice", "192.0.2.2", now); !until.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("doubled lockout: got %v, want %v", until, now.Add(2*time.Minute))
+	}
+
+	if !ll.clear("alice") {
+		t.Errorf("clear: no failures recorded")
+	}
+	if until := ll.lockedUntil("alice", "192.0.2.2", now); !until.IsZero() {
+		t.Errorf("still locked out after clear until %v", until)
+	}
+
+	ll.reset("bob", "192.0.2.1")
+	if until := ll.lockedUntil("bob", "192.0.2.1", now); !until.IsZero() {
+		t.Errorf("still locked out after reset until %v", until)
+	}
+
+	for i := 0; i < 3; i++ {
+		ll.fail("", "192.0.2.4", now, 3, time.Minute)
+	}
+	if until := ll.lockedUntil("", "192.0.2.4", now); until.IsZero() {
+		t.Errorf("IP not locked out without a username")
+	}
+	if _, ok := ll.byUser[""]; ok {
+		t.Errorf("failures recorded for an empty username")
+	}
+	ll.reset("", "192.0.2.4")
+
+	ll.fail("carol", "192.0.2.3", now, 3, time.Minute)
+	ll.prune(now.Add(loginFailureWindow))
+	if len(ll.byUser) != 0 || len(ll.byIP) != 0 {
+		t.Errorf("expired failures not pruned")
+	}
+}
@@ -5,12 +5,23 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"sort"
 	"time"
 
 	"git.sr.ht/~sircmpwn/go-bare"
 	"gopkg.in/irc.v3"
 )
 
+// Message stores which can be selected per user with User.MsgStore
+const (
+	// Messages are logged to disk, if enabled on the server
+	msgStorePersistent = "persistent"
+	// Messages are kept in memory for the backlog, and lost on restart
+	msgStoreMemory = "memory"
+	// Messages aren't stored at all
+	msgStoreNone = "none"
+)
+
 // messageStore is a per-user store for IRC messages.
 type messageStore interface {
 	Close() error
@@ -22,6 +33,50 @@ type messageStore interface {
 	// entity and date, up to a count of limit messages, sorted from oldest to newest.
 	LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error)
 	Append(network *Network, entity string, msg *irc.Message) (id string, err error)
+	// Stats returns statistics about the stored messages. The values may be
+	// cached.
+	Stats() (*messageStoreStats, error)
+	// Purge deletes the stored messages of the given network and entity. If
+	// entity is empty, the messages of all entities of the network are
+	// deleted. If network is nil, all messages are deleted.
+	Purge(network *Network, entity string) error
+}
+
+// messageStoreStats contains statistics about a message store.
+type messageStoreStats struct {
+	Messages int64
+	// Size in bytes of the messages on disk, zero for in-memory stores
+	Size int64
+	// Time of the oldest message, zero if the store is empty
+	Oldest time.Time
+}
+
+// storedClientTags lists the client tags persisted along with messages, so
+// that replies and reactions are kept in the history.
+var storedClientTags = []string{"+draft/reply", "+draft/react"}
+
+// filterStoredTags returns the tags persisted along with a message: the
+// message ID assigned by the upstream server, so that replies and reactions
+// can refer to messages loaded from the history, and the client tags listed
+// in storedClientTags.
+func filterStoredTags(tags irc.Tags) irc.Tags {
+	filtered := filterStoredClientTags(tags)
+	if v := tags["msgid"]; v != "" {
+		filtered["msgid"] = v
+	}
+	return filtered
+}
+
+// filterStoredClientTags returns the subset of tags listed in
+// storedClientTags.
+func filterStoredClientTags(tags irc.Tags) irc.Tags {
+	filtered := make(irc.Tags)
+	for _, k := range storedClientTags {
+		if v, ok := tags[k]; ok {
+			filtered[k] = v
+		}
+	}
+	return filtered
 }
 
 type chatHistoryTarget struct {
@@ -49,15 +104,59 @@ type chatHistoryMessageStore interface {
 	// end is after start.
 	// If events is false, only PRIVMSG/NOTICE messages are considered.
 	LoadAfterTime(ctx context.Context, network *Network, entity string, start, end time.Time, limit int, events bool) ([]*irc.Message, error)
+	// LoadBeforeID loads up to limit messages before the message with the
+	// specified ID down to end. end may be zero. The ID is either an internal
+	// message ID or the msgid tag of a stored message.
+	// If events is false, only PRIVMSG/NOTICE messages are considered.
+	LoadBeforeID(ctx context.Context, network *Network, entity, id string, end time.Time, limit int, events bool) ([]*irc.Message, error)
+	// LoadAfterID loads up to limit messages after the message with the
+	// specified ID up to end. end may be zero. The ID is either an internal
+	// message ID or the msgid tag of a stored message.
+	// If events is false, only PRIVMSG/NOTICE messages are considered.
+	LoadAfterID(ctx context.Context, network *Network, entity, id string, end time.Time, limit int, events bool) ([]*irc.Message, error)
+	// LoadAroundID loads up to limit messages around the message with the
+	// specified ID, including the message itself. Up to half of the messages
+	// are before the message with the specified ID. The ID is either an
+	// internal message ID or the msgid tag of a stored message.
+	// If events is false, only PRIVMSG/NOTICE messages are considered.
+	LoadAroundID(ctx context.Context, network *Network, entity, id string, limit int, events bool) ([]*irc.Message, error)
 }
 
 type searchOptions struct {
 	start time.Time
 	end   time.Time
 	limit int
-	from  string
-	in    string
+	from  string // casemapped with casemap
+	in    string // empty to search all targets
 	text  string
+	// If non-nil, only messages for which highlight returns true match
+	highlight func(msg *irc.Message) bool
+	// If non-nil, targets for which exclude returns true aren't searched
+	// when searching all targets
+	exclude func(target string) bool
+
+	casemap casemapping
+}
+
+// sortSearchResults sorts messages chronologically and keeps at most
+// opts.limit of them: the oldest ones when searching forwards from
+// opts.start, the latest ones otherwise.
+func sortSearchResults(messages []*irc.Message, opts *searchOptions) []*irc.Message {
+	msgTime := func(msg *irc.Message) time.Time {
+		t, _ := time.Parse(serverTimeLayout, string(msg.Tags["time"]))
+		return t
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return msgTime(messages[i]).Before(msgTime(messages[j]))
+	})
+	if len(messages) > opts.limit {
+		if !opts.start.IsZero() {
+			messages = messages[:opts.limit]
+		} else {
+			messages = messages[len(messages)-opts.limit:]
+		}
+	}
+	return messages
 }
 
 // searchMessageStore is a message store that supports server-side search
@@ -2,13 +2,17 @@ package soju
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"git.sr.ht/~sircmpwn/go-bare"
@@ -18,8 +22,20 @@ import (
 const (
 	fsMessageStoreMaxFiles = 20
 	fsMessageStoreMaxTries = 100
+
+	// Log files of past days are compressed once they haven't been written
+	// to for fsMessageStoreCompressDelay
+	fsMessageStoreCompressDelay = time.Hour
+	fsMessageStoreCompressedExt = ".gz"
+
+	// The size of the logs is computed again once a day, or every
+	// fsMessageStoreUsageRetryDelay while it's over the quota, to notice
+	// space freed by compression or by removed log files
+	fsMessageStoreUsageRetryDelay = 5 * time.Minute
 )
 
+var errFSMessageStoreQuotaExceeded = errors.New("message log quota exceeded")
+
 func escapeFilename(unsafe string) (safe string) {
 	if unsafe == "." {
 		return "-"
@@ -69,11 +85,118 @@ func formatFSMsgID(netID int64, entity string, t time.Time, offset int64) string
 	return formatMsgID(netID, entity, &id)
 }
 
+// compareFSMsgIDs compares the positions of two message IDs in the logs. It
+// returns a negative value if a refers to an older message than b, a positive
+// value if a refers to a newer message, and zero if both are equal.
+func compareFSMsgIDs(a, b string) (int, error) {
+	_, _, ta, offsetA, err := parseFSMsgID(a)
+	if err != nil {
+		return 0, err
+	}
+	_, _, tb, offsetB, err := parseFSMsgID(b)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case ta.Before(tb):
+		return -1, nil
+	case ta.After(tb):
+		return 1, nil
+	case offsetA < offsetB:
+		return -1, nil
+	case offsetA > offsetB:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// fsMessageStoreDir is the state shared by the stores and the compressor for
+// the logs directory of a user.
+//
+// Its lock prevents log files from being compressed while they're written to,
+// or while logs are being deleted or renamed. It's never held while
+// (de)compressing files, and only blocks the stores of the same user.
+type fsMessageStoreDir struct {
+	sync.Mutex
+
+	// Number of stores which have each log file opened for appending. These
+	// files are never compressed.
+	openFiles map[string]int
+}
+
+var (
+	fsMessageStoreDirsLock sync.Mutex
+	fsMessageStoreDirs     = make(map[string]*fsMessageStoreDir) // indexed by path
+)
+
+// getFSMessageStoreDir returns the shared state of a user's logs directory.
+func getFSMessageStoreDir(path string) *fsMessageStoreDir {
+	fsMessageStoreDirsLock.Lock()
+	defer fsMessageStoreDirsLock.Unlock()
+
+	dir := fsMessageStoreDirs[path]
+	if dir == nil {
+		dir = &fsMessageStoreDir{openFiles: make(map[string]int)}
+		fsMessageStoreDirs[path] = dir
+	}
+	return dir
+}
+
+// acquire marks a log file as opened for appending. The caller must hold the
+// lock.
+func (dir *fsMessageStoreDir) acquire(path string) {
+	dir.openFiles[path]++
+}
+
+// release undoes acquire. The caller must hold the lock.
+func (dir *fsMessageStoreDir) release(path string) {
+	if dir.openFiles[path] <= 1 {
+		delete(dir.openFiles, path)
+	} else {
+		dir.openFiles[path]--
+	}
+}
+
 type fsMessageStoreFile struct {
 	*os.File
+	dir     *fsMessageStoreDir
 	lastUse time.Time
 }
 
+// openFSMessageStoreFile opens a log file for appending. Messages may be
+// appended to a past day which has already been compressed: the file is
+// decompressed first, without holding the lock of dir.
+func openFSMessageStoreFile(dir *fsMessageStoreDir, path string) (*fsMessageStoreFile, error) {
+	// Prevent the file from being compressed from now on
+	dir.Lock()
+	dir.acquire(path)
+	dir.Unlock()
+
+	f, err := func() (*os.File, error) {
+		if err := decompressLogFile(path); err != nil {
+			return nil, fmt.Errorf("failed to decompress message log file %q: %v", path, err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open message log file %q: %v", path, err)
+		}
+		return f, nil
+	}()
+	if err != nil {
+		dir.Lock()
+		dir.release(path)
+		dir.Unlock()
+		return nil, err
+	}
+	return &fsMessageStoreFile{File: f, dir: dir}, nil
+}
+
+// Close closes the log file. The caller must hold the lock of its directory.
+func (f *fsMessageStoreFile) Close() error {
+	f.dir.release(f.Name())
+	return f.File.Close()
+}
+
 // fsMessageStore is a per-user on-disk store for IRC messages.
 //
 // It mimicks the ZNC log layout and format. See the ZNC source:
@@ -81,9 +204,32 @@ type fsMessageStoreFile struct {
 type fsMessageStore struct {
 	root string
 	user *User
+	dir  *fsMessageStoreDir
 
 	// Write-only files used by Append
 	files map[string]*fsMessageStoreFile // indexed by entity
+
+	// quota returns the maximum size of the logs in bytes, zero or a
+	// negative value for no limit. May be nil.
+	quota func() int64
+	// Size of the logs in bytes. It's computed by walking the logs directory,
+	// and updated by Append in-between.
+	usage     int64
+	usageTime time.Time // zero if usage needs to be computed
+	// Statistics about the logs. They're computed by walking the logs
+	// directory once a day, and updated by Append in-between.
+	stats     messageStoreStats
+	statsDate date
+	// Line counts of the log files, indexed by path without the compressed
+	// file extension. Only the files modified since they've been counted
+	// are read again when computing statistics.
+	statsFiles map[string]fsMessageStoreFileStats
+}
+
+type fsMessageStoreFileStats struct {
+	modTime  time.Time
+	messages int64
+	first    string
 }
 
 var _ messageStore = (*fsMessageStore)(nil)
@@ -94,6 +240,7 @@ func newFSMessageStore(root string, user *User) *fsMessageStore {
 	return &fsMessageStore{
 		root:  filepath.Join(root, escapeFilename(user.Username)),
 		user:  user,
+		dir:   getFSMessageStoreDir(filepath.Join(root, escapeFilename(user.Username))),
 		files: make(map[string]*fsMessageStoreFile),
 	}
 }
@@ -124,12 +271,67 @@ func (ms *fsMessageStore) LastMsgID(network *Network, entity string, t time.Time
 	return formatFSMsgID(network.ID, entity, t, fi.Size()-1), nil
 }
 
+// currentUsage returns the size of the logs in bytes.
+func (ms *fsMessageStore) currentUsage(quota int64) (int64, error) {
+	now := time.Now()
+	if !ms.usageTime.IsZero() {
+		maxAge := 24 * time.Hour
+		if ms.usage >= quota {
+			maxAge = fsMessageStoreUsageRetryDelay
+		}
+		if now.Sub(ms.usageTime) < maxAge {
+			return ms.usage, nil
+		}
+	}
+
+	var usage int64
+	err := filepath.WalkDir(ms.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed concurrently, e.g. when compressed
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		usage += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute message logs size: %v", err)
+	}
+
+	ms.usage = usage
+	ms.usageTime = now
+	return usage, nil
+}
+
 func (ms *fsMessageStore) Append(network *Network, entity string, msg *irc.Message) (string, error) {
 	s := formatMessage(msg)
 	if s == "" {
 		return "", nil
 	}
 
+	if ms.quota != nil {
+		if quota := ms.quota(); quota > 0 {
+			usage, err := ms.currentUsage(quota)
+			if err != nil {
+				return "", err
+			}
+			if usage >= quota {
+				return "", errFSMessageStoreQuotaExceeded
+			}
+		}
+	}
+
 	var t time.Time
 	if tag, ok := msg.Tags["time"]; ok {
 		var err error
@@ -146,21 +348,28 @@ func (ms *fsMessageStore) Append(network *Network, entity string, msg *irc.Messa
 
 	// TODO: handle non-monotonic clock behaviour
 	path := ms.logPath(network, entity, t)
+	var ff *fsMessageStoreFile
 	if f == nil || f.Name() != path {
 		dir := filepath.Dir(path)
 		if err := os.MkdirAll(dir, 0750); err != nil {
 			return "", fmt.Errorf("failed to create message logs directory %q: %v", dir, err)
 		}
 
-		ff, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+		var err error
+		ff, err = openFSMessageStoreFile(ms.dir, path)
 		if err != nil {
-			return "", fmt.Errorf("failed to open message log file %q: %v", path, err)
+			return "", err
 		}
+	}
+
+	ms.dir.Lock()
+	defer ms.dir.Unlock()
 
+	if ff != nil {
 		if f != nil {
 			f.Close()
 		}
-		f = &fsMessageStoreFile{File: ff}
+		f = ff
 		ms.files[entity] = f
 	}
 
@@ -187,27 +396,190 @@ func (ms *fsMessageStore) Append(network *Network, entity string, msg *irc.Messa
 		return "", fmt.Errorf("failed to generate message ID: %v", err)
 	}
 
-	_, err = fmt.Fprintf(f, "[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), s)
+	n, err := fmt.Fprintf(f, "[%02d:%02d:%02d] %s\n", t.Hour(), t.Minute(), t.Second(), s)
+	ms.usage += int64(n)
+	ms.stats.Size += int64(n)
 	if err != nil {
 		return "", fmt.Errorf("failed to log message to %q: %v", f.Name(), err)
 	}
 
+	ms.stats.Messages++
+	if ms.stats.Oldest.IsZero() || t.Before(ms.stats.Oldest) {
+		ms.stats.Oldest = truncateSecond(t)
+	}
+
 	return msgID, nil
 }
 
+func (ms *fsMessageStore) Stats() (*messageStoreStats, error) {
+	today := newDate(time.Now())
+	if ms.statsDate == today {
+		stats := ms.stats
+		return &stats, nil
+	}
+
+	var stats messageStoreStats
+	files := make(map[string]fsMessageStoreFileStats)
+	err := filepath.WalkDir(ms.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		name := strings.TrimSuffix(d.Name(), fsMessageStoreCompressedExt)
+		day, err := time.ParseInLocation("2006-01-02.log", name, time.Local)
+		if err != nil {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Compressing a file preserves its modification time
+		key := strings.TrimSuffix(path, fsMessageStoreCompressedExt)
+		fileStats, ok := ms.statsFiles[key]
+		if !ok || !fileStats.modTime.Equal(fi.ModTime()) {
+			n, first, err := countLogFileLines(path)
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("failed to read %q: %v", path, err)
+			}
+			fileStats = fsMessageStoreFileStats{
+				modTime:  fi.ModTime(),
+				messages: n,
+				first:    first,
+			}
+		}
+		files[key] = fileStats
+		n, first := fileStats.messages, fileStats.first
+
+		stats.Size += fi.Size()
+		stats.Messages += n
+		if n == 0 {
+			return nil
+		}
+
+		// Malformed lines are considered to be from the start of the day
+		var hour, minute, second int
+		fmt.Sscanf(first, "[%02d:%02d:%02d] ", &hour, &minute, &second)
+		t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, time.Local)
+		if stats.Oldest.IsZero() || t.Before(stats.Oldest) {
+			stats.Oldest = t
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute message logs statistics: %v", err)
+	}
+
+	ms.stats = stats
+	ms.statsDate = today
+	ms.statsFiles = files
+	return &stats, nil
+}
+
+// countLogFileLines returns the number of lines and the first line of a
+// possibly compressed log file.
+func countLogFileLines(path string) (n int64, first string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if filepath.Ext(path) == fsMessageStoreCompressedExt {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, "", err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if n == 0 {
+			first = sc.Text()
+		}
+		n++
+	}
+	return n, first, sc.Err()
+}
+
 func (ms *fsMessageStore) Close() error {
+	ms.dir.Lock()
+	defer ms.dir.Unlock()
+
 	var closeErr error
 	for _, f := range ms.files {
 		if err := f.Close(); err != nil {
 			closeErr = fmt.Errorf("failed to close message store: %v", err)
 		}
 	}
+	ms.files = make(map[string]*fsMessageStoreFile)
 	return closeErr
 }
 
 // formatMessage formats a message log line. It assumes a well-formed IRC
 // message.
+//
+// The tags returned by filterStoredTags are written as an IRCv3 tag string
+// before the message text, e.g. "@msgid=123;+draft/reply=456 <nick> text".
 func formatMessage(msg *irc.Message) string {
+	s := formatMessageText(msg)
+	if s == "" {
+		return ""
+	}
+	if strings.ToUpper(msg.Command) == "TAGMSG" && len(filterStoredClientTags(msg.Tags)) == 0 {
+		return ""
+	}
+	tags := filterStoredTags(msg.Tags)
+	if isMultilineMessage(msg) {
+		msg = msg.Copy()
+		msg.Params[1] = multilineEscaper.Replace(msg.Params[1])
+		tags[fsMultilineTag] = ""
+		s = formatMessageText(msg)
+	}
+	if len(tags) > 0 {
+		s = "@" + tags.String() + " " + s
+	}
+	return s
+}
+
+// fsMultilineTag marks log lines holding a multiline message. Line breaks are
+// escaped as a backslash followed by "n", and backslashes are doubled.
+const fsMultilineTag = "soju.im/multiline"
+
+var multilineEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+// unescapeMultiline reverses multilineEscaper.
+func unescapeMultiline(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' {
+				sb.WriteByte('\n')
+			} else {
+				sb.WriteByte(s[i])
+			}
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func formatMessageText(msg *irc.Message) string {
 	switch strings.ToUpper(msg.Command) {
 	case "NICK":
 		return fmt.Sprintf("*** %s is now known as %s", msg.Prefix.Name, msg.Params[0])
@@ -240,6 +612,8 @@ func formatMessage(msg *irc.Message) string {
 		return fmt.Sprintf("*** %s changes topic to '%s'", msg.Prefix.Name, topic)
 	case "MODE":
 		return fmt.Sprintf("*** %s sets mode: %s", msg.Prefix.Name, strings.Join(msg.Params[1:], " "))
+	case "TAGMSG":
+		return fmt.Sprintf("*** Tags: %s", msg.Prefix.Name)
 	case "NOTICE":
 		return fmt.Sprintf("-%s- %s", msg.Prefix.Name, msg.Params[1])
 	case "PRIVMSG":
@@ -261,6 +635,19 @@ func (ms *fsMessageStore) parseMessage(line string, network *Network, entity str
 	}
 	line = line[11:]
 
+	var tags irc.Tags
+	multiline := false
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, time.Time{}, nil
+		}
+		rawTags := irc.ParseTags(line[1:i])
+		_, multiline = rawTags[fsMultilineTag]
+		tags = filterStoredTags(rawTags)
+		line = line[i+1:]
+	}
+
 	var cmd string
 	var prefix *irc.Prefix
 	var params []string
@@ -270,6 +657,16 @@ func (ms *fsMessageStore) parseMessage(line string, network *Network, entity str
 			return nil, time.Time{}, nil
 		}
 		switch parts[0] {
+		case "Tags:":
+			sender := parts[1]
+			cmd = "TAGMSG"
+			prefix = &irc.Prefix{Name: sender}
+			target := entity
+			if entity == sender {
+				// See the PRIVMSG and NOTICE case below
+				target = GetNick(ms.user, network)
+			}
+			params = []string{target}
 		case "Joins:", "Parts:", "Quits:":
 			args := strings.SplitN(parts[1], " ", 3)
 			if len(args) < 2 {
@@ -382,16 +779,22 @@ func (ms *fsMessageStore) parseMessage(line string, network *Network, entity str
 			// the message was received, but we can't do a lot better.
 			entity = GetNick(ms.user, network)
 		}
+		if multiline {
+			text = unescapeMultiline(text)
+		}
 		params = []string{entity, text}
 	}
 
 	year, month, day := ref.Date()
 	t := time.Date(year, month, day, hour, minute, second, 0, time.Local)
 
+	if tags == nil {
+		tags = make(irc.Tags)
+	}
+	tags["time"] = irc.TagValue(formatServerTime(t))
+
 	msg := &irc.Message{
-		Tags: map[string]irc.TagValue{
-			"time": irc.TagValue(formatServerTime(t)),
-		},
+		Tags:    tags,
 		Prefix:  prefix,
 		Command: cmd,
 		Params:  params,
@@ -399,9 +802,13 @@ func (ms *fsMessageStore) parseMessage(line string, network *Network, entity str
 	return msg, t, nil
 }
 
-func (ms *fsMessageStore) parseMessagesBefore(network *Network, entity string, ref time.Time, end time.Time, events bool, limit int, afterOffset int64, selector func(m *irc.Message) bool) ([]*irc.Message, error) {
+// parseMessagesBefore parses up to limit messages of the log file for ref
+// which are before ref and after end. If afterOffset isn't negative, the line
+// containing afterOffset and the lines before it are skipped. If beforeOffset
+// isn't negative, the lines starting at or after beforeOffset are skipped.
+func (ms *fsMessageStore) parseMessagesBefore(network *Network, entity string, ref time.Time, end time.Time, events bool, limit int, afterOffset, beforeOffset int64, selector func(m *irc.Message) bool) ([]*irc.Message, error) {
 	path := ms.logPath(network, entity, ref)
-	f, err := os.Open(path)
+	f, err := openLogFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -415,14 +822,22 @@ func (ms *fsMessageStore) parseMessagesBefore(network *Network, entity string, r
 
 	sc := bufio.NewScanner(f)
 
+	var offset int64
 	if afterOffset >= 0 {
-		if _, err := f.Seek(afterOffset, io.SeekStart); err != nil {
+		if err := skipLogFile(f, afterOffset); err != nil {
 			return nil, nil
 		}
 		sc.Scan() // skip till next newline
+		offset = afterOffset + int64(len(sc.Bytes())) + 1
 	}
 
 	for sc.Scan() {
+		lineOffset := offset
+		offset += int64(len(sc.Bytes())) + 1
+		if beforeOffset >= 0 && lineOffset >= beforeOffset {
+			break
+		}
+
 		msg, t, err := ms.parseMessage(sc.Text(), network, entity, ref, events)
 		if err != nil {
 			return nil, err
@@ -435,6 +850,9 @@ func (ms *fsMessageStore) parseMessagesBefore(network *Network, entity string, r
 			continue
 		}
 
+		if msg.Tags["msgid"] == "" {
+			msg.Tags["msgid"] = irc.TagValue(formatFSMsgID(network.ID, entity, ref, lineOffset))
+		}
 		historyRing[cur%limit] = msg
 		cur++
 	}
@@ -458,9 +876,12 @@ func (ms *fsMessageStore) parseMessagesBefore(network *Network, entity string, r
 	}
 }
 
-func (ms *fsMessageStore) parseMessagesAfter(network *Network, entity string, ref time.Time, end time.Time, events bool, limit int, selector func(m *irc.Message) bool) ([]*irc.Message, error) {
+// parseMessagesAfter parses up to limit messages of the log file for ref
+// which are after ref and before end. If afterOffset isn't negative, the lines
+// starting before afterOffset are skipped instead of the messages before ref.
+func (ms *fsMessageStore) parseMessagesAfter(network *Network, entity string, ref time.Time, end time.Time, events bool, limit int, afterOffset int64, selector func(m *irc.Message) bool) ([]*irc.Message, error) {
 	path := ms.logPath(network, entity, ref)
-	f, err := os.Open(path)
+	f, err := openLogFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -469,13 +890,26 @@ func (ms *fsMessageStore) parseMessagesAfter(network *Network, entity string, re
 	}
 	defer f.Close()
 
-	var history []*irc.Message
 	sc := bufio.NewScanner(f)
+
+	var offset int64
+	if afterOffset > 0 {
+		if err := skipLogFile(f, afterOffset-1); err != nil {
+			return nil, nil
+		}
+		sc.Scan() // skip till next newline
+		offset = afterOffset + int64(len(sc.Bytes()))
+	}
+
+	var history []*irc.Message
 	for sc.Scan() && len(history) < limit {
+		lineOffset := offset
+		offset += int64(len(sc.Bytes())) + 1
+
 		msg, t, err := ms.parseMessage(sc.Text(), network, entity, ref, events)
 		if err != nil {
 			return nil, err
-		} else if msg == nil || !t.After(ref) {
+		} else if msg == nil || (afterOffset < 0 && !t.After(ref)) {
 			continue
 		} else if !t.Before(end) {
 			break
@@ -484,6 +918,9 @@ func (ms *fsMessageStore) parseMessagesAfter(network *Network, entity string, re
 			continue
 		}
 
+		if msg.Tags["msgid"] == "" {
+			msg.Tags["msgid"] = irc.TagValue(formatFSMsgID(network.ID, entity, ref, lineOffset))
+		}
 		history = append(history, msg)
 	}
 	if sc.Err() != nil {
@@ -504,7 +941,7 @@ func (ms *fsMessageStore) getBeforeTime(ctx context.Context, network *Network, e
 	remaining := limit
 	tries := 0
 	for remaining > 0 && tries < fsMessageStoreMaxTries && end.Before(start) {
-		buf, err := ms.parseMessagesBefore(network, entity, start, end, events, remaining, -1, selector)
+		buf, err := ms.parseMessagesBefore(network, entity, start, end, events, remaining, -1, -1, selector)
 		if err != nil {
 			return nil, err
 		}
@@ -541,7 +978,7 @@ func (ms *fsMessageStore) getAfterTime(ctx context.Context, network *Network, en
 	remaining := limit
 	tries := 0
 	for remaining > 0 && tries < fsMessageStoreMaxTries && start.Before(end) {
-		buf, err := ms.parseMessagesAfter(network, entity, start, end, events, remaining, selector)
+		buf, err := ms.parseMessagesAfter(network, entity, start, end, events, remaining, -1, selector)
 		if err != nil {
 			return nil, err
 		}
@@ -566,20 +1003,181 @@ func (ms *fsMessageStore) LoadAfterTime(ctx context.Context, network *Network, e
 	return ms.getAfterTime(ctx, network, entity, start, end, limit, events, nil)
 }
 
+// parseEntityFSMsgID parses a message ID and checks that it belongs to the
+// specified network and entity.
+func parseEntityFSMsgID(network *Network, entity, id string) (time.Time, int64, error) {
+	idNet, idEntity, t, offset, err := parseFSMsgID(id)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if idNet != network.ID || idEntity != entity {
+		return time.Time{}, 0, fmt.Errorf("cannot find message ID: message ID doesn't match network/entity")
+	}
+	return t, offset, nil
+}
+
+// resolveMsgID returns the day and offset of a message. The message is
+// either referred to by an internal message ID, or by the msgid tag assigned
+// by the upstream server, in which case the log files are searched from the
+// most recent one.
+func (ms *fsMessageStore) resolveMsgID(ctx context.Context, network *Network, entity, id string) (time.Time, int64, error) {
+	if _, _, err := parseMsgID(id, nil); err == nil {
+		return parseEntityFSMsgID(network, entity, id)
+	}
+
+	day := truncateDay(time.Now())
+	tries := 0
+	for tries < fsMessageStoreMaxTries {
+		offset, err := ms.findMsgID(network, entity, day, id)
+		if os.IsNotExist(err) {
+			tries++
+		} else if err != nil {
+			return time.Time{}, 0, err
+		} else if offset >= 0 {
+			return day, offset, nil
+		} else {
+			tries = 0
+		}
+		day = day.AddDate(0, 0, -1)
+
+		if err := ctx.Err(); err != nil {
+			return time.Time{}, 0, err
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("cannot find message ID %q", id)
+}
+
+// findMsgID returns the offset of the line of the log file for day storing
+// the message with the specified msgid tag, or -1 if there is none.
+func (ms *fsMessageStore) findMsgID(network *Network, entity string, day time.Time, id string) (int64, error) {
+	f, err := openLogFile(ms.logPath(network, entity, day))
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+
+	// The value is escaped in the tag string
+	needle := strings.TrimPrefix(irc.Tags{"msgid": irc.TagValue(id)}.String(), "msgid=")
+
+	sc := bufio.NewScanner(f)
+	var offset int64
+	for sc.Scan() {
+		line := sc.Text()
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+
+		if len(line) < 12 || line[11] != '@' || !strings.Contains(line, needle) {
+			continue
+		}
+		i := strings.IndexByte(line[11:], ' ')
+		if i < 0 {
+			continue
+		}
+		if string(irc.ParseTags(line[12 : 11+i])["msgid"]) == id {
+			return lineOffset, nil
+		}
+	}
+	if sc.Err() != nil {
+		return -1, fmt.Errorf("failed to find message ID: scanner error: %v", sc.Err())
+	}
+	return -1, nil
+}
+
+func (ms *fsMessageStore) LoadBeforeID(ctx context.Context, network *Network, entity, id string, end time.Time, limit int, events bool) ([]*irc.Message, error) {
+	day, offset, err := ms.resolveMsgID(ctx, network, entity, id)
+	if err != nil {
+		return nil, err
+	}
+	end = end.In(time.Local)
+
+	var history []*irc.Message
+	if offset >= 0 && limit > 0 {
+		dayEnd := day.AddDate(0, 0, 1).Add(-1)
+		history, err = ms.parseMessagesBefore(network, entity, dayEnd, end, events, limit, -1, offset, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if remaining := limit - len(history); remaining > 0 && end.Before(day) {
+		before, err := ms.getBeforeTime(ctx, network, entity, day.Add(-1), end, remaining, events, nil)
+		if err != nil {
+			return nil, err
+		}
+		history = append(before, history...)
+	}
+
+	return history, nil
+}
+
+// getAfterID loads up to limit messages after the message with the specified
+// ID up to end. If inclusive is true, the message itself is returned as well.
+func (ms *fsMessageStore) getAfterID(ctx context.Context, network *Network, entity, id string, end time.Time, limit int, events, inclusive bool) ([]*irc.Message, error) {
+	day, offset, err := ms.resolveMsgID(ctx, network, entity, id)
+	if err != nil {
+		return nil, err
+	}
+	if end.IsZero() {
+		end = time.Now()
+	} else {
+		end = end.In(time.Local)
+	}
+
+	afterOffset := offset
+	if afterOffset < 0 {
+		afterOffset = 0
+	} else if !inclusive {
+		afterOffset++
+	}
+
+	var history []*irc.Message
+	tries := 0
+	for len(history) < limit && tries < fsMessageStoreMaxTries && day.Before(end) {
+		buf, err := ms.parseMessagesAfter(network, entity, day, end, events, limit-len(history), afterOffset, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) == 0 {
+			tries++
+		} else {
+			tries = 0
+		}
+		history = append(history, buf...)
+		afterOffset = 0
+		day = day.AddDate(0, 0, 1)
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+func (ms *fsMessageStore) LoadAfterID(ctx context.Context, network *Network, entity, id string, end time.Time, limit int, events bool) ([]*irc.Message, error) {
+	return ms.getAfterID(ctx, network, entity, id, end, limit, events, false)
+}
+
+func (ms *fsMessageStore) LoadAroundID(ctx context.Context, network *Network, entity, id string, limit int, events bool) ([]*irc.Message, error) {
+	before, err := ms.LoadBeforeID(ctx, network, entity, id, time.Time{}, limit/2, events)
+	if err != nil {
+		return nil, err
+	}
+	after, err := ms.getAfterID(ctx, network, entity, id, time.Time{}, limit-len(before), events, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(before, after...), nil
+}
+
 func (ms *fsMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error) {
 	var afterTime time.Time
 	var afterOffset int64
 	if id != "" {
-		var idNet int64
-		var idEntity string
 		var err error
-		idNet, idEntity, afterTime, afterOffset, err = parseFSMsgID(id)
+		afterTime, afterOffset, err = ms.resolveMsgID(ctx, network, entity, id)
 		if err != nil {
 			return nil, err
 		}
-		if idNet != network.ID || idEntity != entity {
-			return nil, fmt.Errorf("cannot find message ID: message ID doesn't match network/entity")
-		}
 	}
 
 	history := make([]*irc.Message, limit)
@@ -592,7 +1190,7 @@ func (ms *fsMessageStore) LoadLatestID(ctx context.Context, network *Network, en
 			offset = afterOffset
 		}
 
-		buf, err := ms.parseMessagesBefore(network, entity, t, time.Time{}, false, remaining, offset, nil)
+		buf, err := ms.parseMessagesBefore(network, entity, t, time.Time{}, false, remaining, offset, -1, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -696,31 +1294,534 @@ func (ms *fsMessageStore) ListTargets(ctx context.Context, network *Network, sta
 func (ms *fsMessageStore) Search(ctx context.Context, network *Network, opts searchOptions) ([]*irc.Message, error) {
 	text := strings.ToLower(opts.text)
 	selector := func(m *irc.Message) bool {
-		if opts.from != "" && m.User != opts.from {
+		if opts.from != "" && opts.casemap(m.Prefix.Name) != opts.from {
 			return false
 		}
 		if text != "" && !strings.Contains(strings.ToLower(m.Params[1]), text) {
 			return false
 		}
+		if opts.highlight != nil && !opts.highlight(m) {
+			return false
+		}
 		return true
 	}
+	if opts.in != "" {
+		return ms.searchTarget(ctx, network, opts.in, &opts, selector)
+	}
+
+	// Target directory names are already escaped, escaping them again is a
+	// no-op
+	rootPath := filepath.Join(ms.root, escapeFilename(network.GetName()))
+	entries, err := os.ReadDir(rootPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var messages []*irc.Message
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if opts.exclude != nil && opts.exclude(entry.Name()) {
+			continue
+		}
+		l, err := ms.searchTarget(ctx, network, entry.Name(), &opts, selector)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, l...)
+	}
+	return sortSearchResults(messages, &opts), nil
+}
+
+func (ms *fsMessageStore) searchTarget(ctx context.Context, network *Network, entity string, opts *searchOptions, selector func(m *irc.Message) bool) ([]*irc.Message, error) {
 	if !opts.start.IsZero() {
-		return ms.getAfterTime(ctx, network, opts.in, opts.start, opts.end, opts.limit, false, selector)
+		return ms.getAfterTime(ctx, network, entity, opts.start, opts.end, opts.limit, false, selector)
 	} else {
-		return ms.getBeforeTime(ctx, network, opts.in, opts.end, opts.start, opts.limit, false, selector)
+		return ms.getBeforeTime(ctx, network, entity, opts.end, opts.start, opts.limit, false, selector)
 	}
 }
 
 func (ms *fsMessageStore) RenameNetwork(oldNet, newNet *Network) error {
 	oldDir := filepath.Join(ms.root, escapeFilename(oldNet.GetName()))
 	newDir := filepath.Join(ms.root, escapeFilename(newNet.GetName()))
-	// Avoid loosing data by overwriting an existing directory
+	// Avoid losing data by overwriting an existing directory
 	if _, err := os.Stat(newDir); err == nil {
 		return fmt.Errorf("destination %q already exists", newDir)
 	}
 	return os.Rename(oldDir, newDir)
 }
 
+// renameFSMessageStoreUser moves the logs of a renamed user. The message store
+// of the user must be closed.
+func renameFSMessageStoreUser(root string, oldUser, newUser *User) error {
+	oldDir := filepath.Join(root, escapeFilename(oldUser.Username))
+	newDir := filepath.Join(root, escapeFilename(newUser.Username))
+	if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+		return nil // no logs yet
+	}
+	// Avoid losing data by overwriting an existing directory
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("destination %q already exists", newDir)
+	}
+	return os.Rename(oldDir, newDir)
+}
+
+// RenameTarget moves the logs of a target to another target. If the
+// destination already has logs, an error is returned unless merge is set, in
+// which case the logs of both targets are merged day by day.
+//
+// It returns a function converting message IDs referring to the logs of either
+// target into message IDs referring to the same messages in the new logs.
+func (ms *fsMessageStore) RenameTarget(network *Network, oldEntity, newEntity string, merge bool) (mapMsgID func(id string) string, err error) {
+	netDir := filepath.Join(ms.root, escapeFilename(network.GetName()))
+	oldDir := filepath.Join(netDir, escapeFilename(oldEntity))
+	newDir := filepath.Join(netDir, escapeFilename(newEntity))
+	if oldDir == newDir {
+		return nil, fmt.Errorf("source and destination are the same")
+	}
+
+	if _, err := os.Stat(oldDir); err != nil {
+		return nil, fmt.Errorf("no logs found for %q: %v", oldEntity, err)
+	}
+
+	ms.dir.Lock()
+	defer ms.dir.Unlock()
+
+	// Close the files we may be appending to
+	for entity, f := range ms.files {
+		if dir := filepath.Dir(f.Name()); dir == oldDir || dir == newDir {
+			f.Close()
+			delete(ms.files, entity)
+		}
+	}
+
+	// Offsets of the lines of merged files, by entity and file name
+	offsets := map[string]map[string]*fsLogOffsets{
+		oldEntity: make(map[string]*fsLogOffsets),
+		newEntity: make(map[string]*fsLogOffsets),
+	}
+	mapMsgID = func(id string) string {
+		netID, entity, t, offset, err := parseFSMsgID(id)
+		if err != nil || (entity != oldEntity && entity != newEntity) {
+			return id
+		}
+		if lo := offsets[entity][t.Format("2006-01-02.log")]; lo != nil {
+			offset = lo.mapOffset(offset)
+		}
+		return formatFSMsgID(netID, newEntity, t, offset)
+	}
+
+	if _, err := os.Stat(newDir); os.IsNotExist(err) {
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return nil, err
+		}
+		return mapMsgID, nil
+	} else if err != nil {
+		return nil, err
+	} else if !merge {
+		return nil, fmt.Errorf("destination %q already exists", newDir)
+	}
+
+	entries, err := os.ReadDir(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		oldPath := filepath.Join(oldDir, entry.Name())
+		newPath := filepath.Join(newDir, entry.Name())
+		// Merge with the destination file even if only one of both files
+		// has been compressed
+		if err := decompressLogFile(strings.TrimSuffix(oldPath, fsMessageStoreCompressedExt)); err != nil {
+			return nil, err
+		}
+		if err := decompressLogFile(strings.TrimSuffix(newPath, fsMessageStoreCompressedExt)); err != nil {
+			return nil, err
+		}
+		oldPath = strings.TrimSuffix(oldPath, fsMessageStoreCompressedExt)
+		newPath = strings.TrimSuffix(newPath, fsMessageStoreCompressedExt)
+		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+			if err := os.Rename(oldPath, newPath); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		newOffsets, oldOffsets, err := mergeLogFiles(newPath, oldPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge %q into %q: %v", oldPath, newPath, err)
+		}
+		name := filepath.Base(newPath)
+		offsets[oldEntity][name] = oldOffsets
+		offsets[newEntity][name] = newOffsets
+		if err := os.Remove(oldPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapMsgID, os.Remove(oldDir)
+}
+
+func (ms *fsMessageStore) Purge(network *Network, entity string) error {
+	dir := ms.root
+	if network != nil {
+		dir = filepath.Join(dir, escapeFilename(network.GetName()))
+		if entity != "" {
+			dir = filepath.Join(dir, escapeFilename(entity))
+		}
+	}
+
+	ms.dir.Lock()
+	defer ms.dir.Unlock()
+
+	// Close the files we may be appending to
+	for k, f := range ms.files {
+		if strings.HasPrefix(f.Name(), dir+string(filepath.Separator)) {
+			f.Close()
+			delete(ms.files, k)
+		}
+	}
+
+	// Force the size and statistics to be computed again
+	ms.usageTime = time.Time{}
+	ms.statsDate = date{}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to delete message logs: %v", err)
+	}
+	return nil
+}
+
+// fsLogOffsets maps the offsets of the lines of a log file to their offsets
+// in the file it has been merged into.
+type fsLogOffsets struct {
+	old, new []int64 // line start offsets, sorted by old offset
+}
+
+// mapOffset returns the new offset of the line containing the given offset.
+func (lo *fsLogOffsets) mapOffset(offset int64) int64 {
+	i := sort.Search(len(lo.old), func(i int) bool {
+		return lo.old[i] > offset
+	})
+	if i == 0 {
+		return offset
+	}
+	return lo.new[i-1]
+}
+
+func (lo *fsLogOffsets) Len() int {
+	return len(lo.old)
+}
+
+func (lo *fsLogOffsets) Less(i, j int) bool {
+	return lo.old[i] < lo.old[j]
+}
+
+func (lo *fsLogOffsets) Swap(i, j int) {
+	lo.old[i], lo.old[j] = lo.old[j], lo.old[i]
+	lo.new[i], lo.new[j] = lo.new[j], lo.new[i]
+}
+
+// mergeLogFiles merges the lines of src into dst, keeping them sorted by
+// timestamp. It returns the new offsets of the lines of both files.
+func mergeLogFiles(dst, src string) (dstOffsets, srcOffsets *fsLogOffsets, err error) {
+	dstLines, err := readLogLines(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcLines, err := readLogLines(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type logLine struct {
+		text    string
+		offsets *fsLogOffsets
+		offset  int64
+	}
+	dstOffsets = new(fsLogOffsets)
+	srcOffsets = new(fsLogOffsets)
+	var lines []logLine
+	for _, file := range []struct {
+		lines   []string
+		offsets *fsLogOffsets
+	}{
+		{dstLines, dstOffsets},
+		{srcLines, srcOffsets},
+	} {
+		var offset int64
+		for _, l := range file.lines {
+			lines = append(lines, logLine{l, file.offsets, offset})
+			offset += int64(len(l)) + 1
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		// Lines start with a "[15:04:05]" timestamp
+		return logLineTime(lines[i].text) < logLineTime(lines[j].text)
+	})
+
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(f)
+	var offset int64
+	for _, l := range lines {
+		w.WriteString(l.text)
+		w.WriteByte('\n')
+		l.offsets.old = append(l.offsets.old, l.offset)
+		l.offsets.new = append(l.offsets.new, offset)
+		offset += int64(len(l.text)) + 1
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, nil, err
+	}
+	for _, lo := range []*fsLogOffsets{dstOffsets, srcOffsets} {
+		sort.Sort(lo)
+	}
+	return dstOffsets, srcOffsets, os.Rename(tmp, dst)
+}
+
+func readLogLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, sc.Err()
+}
+
+// gzipFile is a compressed log file opened for reading.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.f.Close()
+}
+
+// openLogFile opens a log file for reading. If the file has been compressed,
+// it's transparently decompressed.
+func openLogFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+
+	f, err = os.Open(path + fsMessageStoreCompressedExt)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: r, f: f}, nil
+}
+
+// skipLogFile skips the first offset bytes of a log file opened with
+// openLogFile. Offsets always refer to the uncompressed file.
+func skipLogFile(r io.Reader, offset int64) error {
+	if f, ok := r.(*os.File); ok {
+		_, err := f.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, offset)
+	return err
+}
+
+// errLogFileBusy is returned by compressLogFile when the log file is opened
+// for appending or has been modified while being compressed.
+var errLogFileBusy = errors.New("log file is in use")
+
+// compressLogFile replaces an uncompressed log file with a compressed copy,
+// preserving its modification time.
+//
+// The file is compressed without holding the lock of dir, so that stores
+// aren't blocked for too long. The copy is only swapped in if the file isn't
+// opened for appending and hasn't been modified in the meantime.
+func compressLogFile(dir *fsMessageStoreDir, path string) error {
+	dir.Lock()
+	busy := dir.openFiles[path] > 0
+	dir.Unlock()
+	if busy {
+		return errLogFileBusy
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := path + fsMessageStoreCompressedExt
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(f)
+	if _, err := io.Copy(w, src); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dir.Lock()
+	defer dir.Unlock()
+
+	if dir.openFiles[path] > 0 {
+		os.Remove(tmp)
+		return errLogFileBusy
+	}
+	if cur, err := os.Stat(path); err != nil {
+		os.Remove(tmp)
+		return err
+	} else if cur.Size() != fi.Size() || !cur.ModTime().Equal(fi.ModTime()) {
+		os.Remove(tmp)
+		return errLogFileBusy
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// decompressLogFile restores the uncompressed log file at path if only a
+// compressed copy exists.
+func decompressLogFile(path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	gzPath := path + fsMessageStoreCompressedExt
+	if _, err := os.Stat(gzPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	r, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return os.Remove(gzPath)
+}
+
+// compressFSMessageStore compresses the log files of all users stored under
+// root, except the ones of the current day and the ones recently written to.
+func compressFSMessageStore(ctx context.Context, root string, now time.Time) (int, error) {
+	today := now.Format("2006-01-02") + ".log"
+	n := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Logs may be deleted concurrently
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || filepath.Ext(name) != ".log" || name >= today {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if now.Sub(fi.ModTime()) < fsMessageStoreCompressDelay {
+			return nil
+		}
+
+		// Logs are stored under a directory per user
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		userDir := filepath.Join(root, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+
+		err = compressLogFile(getFSMessageStoreDir(userDir), path)
+		if os.IsNotExist(err) || err == errLogFileBusy {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to compress %q: %v", path, err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func logLineTime(line string) string {
+	if len(line) < 10 {
+		return ""
+	}
+	return line[:10]
+}
+
 func truncateDay(t time.Time) time.Time {
 	year, month, day := t.Date()
 	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
@@ -0,0 +1,242 @@
+package soju
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+func TestFSMessageStoreFormatParse(t *testing.T) {
+	user := &User{Username: "soju"}
+	network := &Network{ID: 1, Name: "testnet", Nick: "soju"}
+	ms := newFSMessageStore(t.TempDir(), user)
+
+	ref := time.Date(2022, 1, 2, 12, 34, 56, 0, time.Local)
+	prefix := &irc.Prefix{Name: "alice", User: "a", Host: "example.org"}
+	testCases := []struct {
+		name string
+		msg  *irc.Message
+	}{
+		{"privmsg", &irc.Message{
+			Prefix:  prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", "hello"},
+		}},
+		{"notice", &irc.Message{
+			Prefix:  prefix,
+			Command: "NOTICE",
+			Params:  []string{"#soju", "hello"},
+		}},
+		{"action", &irc.Message{
+			Prefix:  prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", "\x01ACTION waves\x01"},
+		}},
+		{"tags", &irc.Message{
+			Tags:    irc.Tags{"msgid": "a;b c", "+draft/reply": "xyz"},
+			Prefix:  prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", "@not a tag"},
+		}},
+		{"multiline", &irc.Message{
+			Tags:    irc.Tags{"msgid": "abc"},
+			Prefix:  prefix,
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", "hello\\n\nworld\n\nbye"},
+		}},
+		{"reaction", &irc.Message{
+			Tags:    irc.Tags{"msgid": "abc", "+draft/reply": "xyz", "+draft/react": "👍"},
+			Prefix:  &irc.Prefix{Name: "alice"},
+			Command: "TAGMSG",
+			Params:  []string{"#soju"},
+		}},
+		{"join", &irc.Message{
+			Prefix:  prefix,
+			Command: "JOIN",
+			Params:  []string{"#soju"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			line := ref.Format("[15:04:05] ") + formatMessage(tc.msg)
+			msg, msgTime, err := ms.parseMessage(line, network, "#soju", ref, true)
+			if err != nil {
+				t.Fatalf("failed to parse %q: %v", line, err)
+			}
+			if msg == nil {
+				t.Fatalf("failed to parse %q: message skipped", line)
+			}
+			if !msgTime.Equal(ref) {
+				t.Errorf("parsed time of %q: want %v, got %v", line, ref, msgTime)
+			}
+
+			want := tc.msg.Copy()
+			if want.Tags == nil {
+				want.Tags = make(irc.Tags)
+			}
+			want.Tags["time"] = irc.TagValue(formatServerTime(ref))
+			if want.Command != "JOIN" {
+				// Only the nickname is stored
+				want.Prefix = &irc.Prefix{Name: want.Prefix.Name}
+			}
+			if !reflect.DeepEqual(msg, want) {
+				t.Errorf("round trip of %q: want %v, got %v", line, want, msg)
+			}
+		})
+	}
+}
+
+func TestFSMessageStoreUpstreamMsgID(t *testing.T) {
+	user := &User{Username: "soju"}
+	network := &Network{ID: 1, Name: "testnet", Nick: "soju"}
+	ms := newFSMessageStore(t.TempDir(), user)
+	defer ms.Close()
+
+	now := time.Now()
+	for i, text := range []string{"one", "two", "three"} {
+		msg := &irc.Message{
+			Tags: irc.Tags{
+				"msgid": irc.TagValue("upstream-" + text),
+				"time":  irc.TagValue(formatServerTime(now.Add(time.Duration(i-3) * time.Second))),
+			},
+			Prefix:  &irc.Prefix{Name: "alice", User: "a", Host: "example.org"},
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", text},
+		}
+		if _, err := ms.Append(network, "#soju", msg); err != nil {
+			t.Fatalf("failed to append message: %v", err)
+		}
+	}
+
+	history, err := ms.LoadAfterID(context.Background(), network, "#soju", "upstream-one", time.Time{}, 10, false)
+	if err != nil {
+		t.Fatalf("failed to load messages after upstream ID: %v", err)
+	}
+	if len(history) != 2 || history[0].Params[1] != "two" || history[1].Params[1] != "three" {
+		t.Fatalf("invalid messages after upstream ID: %v", history)
+	}
+	// The upstream message ID is kept
+	if history[0].Tags["msgid"] != "upstream-two" {
+		t.Errorf("invalid msgid: want %q, got %q", "upstream-two", history[0].Tags["msgid"])
+	}
+
+	if _, err := ms.LoadAfterID(context.Background(), network, "#soju", "unknown", time.Time{}, 10, false); err == nil {
+		t.Errorf("expected an error for an unknown message ID")
+	}
+}
+
+func TestFSMessageStoreRenameTargetMerge(t *testing.T) {
+	user := &User{Username: "soju"}
+	network := &Network{ID: 1, Name: "testnet", Nick: "soju"}
+	ms := newFSMessageStore(t.TempDir(), user)
+	defer ms.Close()
+
+	now := time.Now()
+	ids := make(map[string]string)
+	for i, text := range []string{"old1", "new1", "old2", "new2"} {
+		entity := "#new"
+		if strings.HasPrefix(text, "old") {
+			entity = "#old"
+		}
+		msg := &irc.Message{
+			Tags:    irc.Tags{"time": irc.TagValue(formatServerTime(now.Add(time.Duration(i-4) * time.Second)))},
+			Prefix:  &irc.Prefix{Name: "alice"},
+			Command: "PRIVMSG",
+			Params:  []string{entity, text},
+		}
+		id, err := ms.Append(network, entity, msg)
+		if err != nil {
+			t.Fatalf("failed to append message: %v", err)
+		}
+		ids[text] = id
+	}
+
+	mapMsgID, err := ms.RenameTarget(network, "#old", "#new", true)
+	if err != nil {
+		t.Fatalf("failed to merge logs: %v", err)
+	}
+
+	for _, tc := range []struct {
+		id   string
+		want []string
+	}{
+		{"old1", []string{"new1", "old2", "new2"}},
+		{"new1", []string{"old2", "new2"}},
+		{"old2", []string{"new2"}},
+		{"new2", nil},
+	} {
+		history, err := ms.LoadAfterID(context.Background(), network, "#new", mapMsgID(ids[tc.id]), time.Time{}, 10, false)
+		if err != nil {
+			t.Fatalf("failed to load messages after %q: %v", tc.id, err)
+		}
+		var got []string
+		for _, msg := range history {
+			got = append(got, msg.Params[1])
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("messages after %q: want %v, got %v", tc.id, tc.want, got)
+		}
+	}
+}
+
+func TestFSMessageStoreCompress(t *testing.T) {
+	root := t.TempDir()
+	user := &User{Username: "soju"}
+	network := &Network{ID: 1, Name: "testnet", Nick: "soju"}
+
+	day := time.Now().Add(-48 * time.Hour)
+	appendMessage := func(ms *fsMessageStore, msgTime time.Time, text string) {
+		msg := &irc.Message{
+			Tags:    irc.Tags{"time": irc.TagValue(formatServerTime(msgTime))},
+			Prefix:  &irc.Prefix{Name: "alice"},
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", text},
+		}
+		if _, err := ms.Append(network, "#soju", msg); err != nil {
+			t.Fatalf("failed to append message: %v", err)
+		}
+	}
+
+	ms := newFSMessageStore(root, user)
+	appendMessage(ms, day, "one")
+	path := ms.logPath(network, "#soju", day)
+
+	later := time.Now().Add(2 * fsMessageStoreCompressDelay)
+	if n, err := compressFSMessageStore(context.Background(), root, later); err != nil {
+		t.Fatalf("failed to compress logs: %v", err)
+	} else if n != 0 {
+		t.Errorf("compressed %v files opened for appending", n)
+	}
+
+	ms.Close()
+	if n, err := compressFSMessageStore(context.Background(), root, later); err != nil {
+		t.Fatalf("failed to compress logs: %v", err)
+	} else if n != 1 {
+		t.Errorf("compressed files: want 1, got %v", n)
+	}
+	if _, err := os.Stat(path + fsMessageStoreCompressedExt); err != nil {
+		t.Fatalf("compressed log file not found: %v", err)
+	}
+
+	// Appending to a compressed day restores the uncompressed file
+	ms = newFSMessageStore(root, user)
+	defer ms.Close()
+	appendMessage(ms, day.Add(time.Second), "two")
+	if _, err := os.Stat(path + fsMessageStoreCompressedExt); !os.IsNotExist(err) {
+		t.Errorf("compressed log file still exists: %v", err)
+	}
+	lines, err := readLogLines(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "one") || !strings.HasSuffix(lines[1], "two") {
+		t.Errorf("invalid log file: %q", lines)
+	}
+}
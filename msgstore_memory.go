@@ -94,6 +94,44 @@ func (ms *memoryMessageStore) Append(network *Network, entity string, msg *irc.M
 	return formatMemoryMsgID(network.ID, entity, seq), nil
 }
 
+func (ms *memoryMessageStore) Stats() (*messageStoreStats, error) {
+	var stats messageStoreStats
+	for _, rb := range ms.buffers {
+		n := rb.cur - 1
+		if n > rb.cap() {
+			n = rb.cap()
+		}
+		if n == 0 {
+			continue
+		}
+		stats.Messages += int64(n)
+
+		oldest := rb.buf[(rb.cur-n)%rb.cap()]
+		tag, ok := oldest.Tags["time"]
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(serverTimeLayout, string(tag))
+		if err == nil && (stats.Oldest.IsZero() || t.Before(stats.Oldest)) {
+			stats.Oldest = t
+		}
+	}
+	return &stats, nil
+}
+
+func (ms *memoryMessageStore) Purge(network *Network, entity string) error {
+	for k := range ms.buffers {
+		if network != nil && k.networkID != network.ID {
+			continue
+		}
+		if entity != "" && k.entity != entity {
+			continue
+		}
+		delete(ms.buffers, k)
+	}
+	return nil
+}
+
 func (ms *memoryMessageStore) LoadLatestID(ctx context.Context, network *Network, entity, id string, limit int) ([]*irc.Message, error) {
 	_, _, seq, err := parseMemoryMsgID(id)
 	if err != nil {
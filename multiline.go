@@ -0,0 +1,436 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// Limits of the draft/multiline batches accepted from downstream connections
+const (
+	downstreamMultilineMaxBytes = 4096
+	downstreamMultilineMaxLines = 100
+)
+
+var downstreamMultilineCap = fmt.Sprintf("max-bytes=%v,max-lines=%v", downstreamMultilineMaxBytes, downstreamMultilineMaxLines)
+
+// multilineBatch is a draft/multiline batch being received from a downstream
+// or upstream connection.
+type multilineBatch struct {
+	ref    string
+	target string
+	// Tags and prefix of the opening BATCH message
+	tags    irc.Tags
+	prefix  *irc.Prefix
+	command string
+	lines   []multilineLine
+	bytes   int
+	// Whether the batch has been rejected, in which case the remaining lines
+	// are ignored until the batch ends
+	discarded bool
+}
+
+type multilineLine struct {
+	text string
+	// Whether the line is concatenated to the previous one, instead of being
+	// separated by a line break
+	concat bool
+}
+
+// logicalLines returns the text of the batch split on line breaks, i.e. with
+// the concatenated lines merged together.
+func (mb *multilineBatch) logicalLines() []string {
+	var lines []string
+	for _, l := range mb.lines {
+		if l.concat && len(lines) > 0 {
+			lines[len(lines)-1] += l.text
+		} else {
+			lines = append(lines, l.text)
+		}
+	}
+	return lines
+}
+
+// appendUpstream adds a line received from an upstream connection. Unlike
+// downstream batches, the server is trusted to honor the limits.
+func (mb *multilineBatch) appendUpstream(msg *irc.Message) {
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" || len(msg.Params) < 2 {
+		return
+	}
+	if mb.command == "" {
+		mb.command = msg.Command
+		mb.prefix = msg.Prefix
+	}
+	_, concat := msg.Tags["draft/multiline-concat"]
+	mb.lines = append(mb.lines, multilineLine{text: msg.Params[1], concat: concat})
+}
+
+// message returns the batch as a single message, its lines being separated
+// by line breaks (see isMultilineMessage). It returns nil if the batch is
+// empty.
+func (mb *multilineBatch) message() *irc.Message {
+	if len(mb.lines) == 0 {
+		return nil
+	}
+	return &irc.Message{
+		Tags:    mb.tags,
+		Prefix:  mb.prefix,
+		Command: mb.command,
+		Params:  []string{mb.target, strings.Join(mb.logicalLines(), "\n")},
+	}
+}
+
+// isMultilineMessage checks whether a PRIVMSG or NOTICE message is the
+// reassembled form of a draft/multiline batch, i.e. whether its text contains
+// line breaks. Such messages are stored as a single message, and are split
+// again when sent to downstream connections.
+func isMultilineMessage(msg *irc.Message) bool {
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" || len(msg.Params) < 2 {
+		return false
+	}
+	return strings.Contains(msg.Params[1], "\n")
+}
+
+// parseMultilineLimits parses the value of the draft/multiline capability. A
+// zero limit means no limit.
+func parseMultilineLimits(value string) (maxBytes, maxLines int) {
+	for _, kv := range strings.Split(value, ",") {
+		k, v := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch k {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines
+}
+
+// labeledMessage returns the message whose label applies to the replies to
+// msg. The label of a draft/multiline batch is carried by the opening BATCH
+// message, but applies to the replies sent once the batch ends.
+func (dc *downstreamConn) labeledMessage(msg *irc.Message) *irc.Message {
+	if msg.Command != "BATCH" || len(msg.Params) == 0 {
+		return msg
+	}
+	ref := msg.Params[0]
+	if strings.HasPrefix(ref, "+") && len(msg.Params) > 1 && msg.Params[1] == "draft/multiline" {
+		return &irc.Message{Command: msg.Command}
+	}
+	if mb := dc.multiline; mb != nil && ref == "-"+mb.ref {
+		return &irc.Message{Tags: mb.tags, Command: msg.Command}
+	}
+	return msg
+}
+
+func (dc *downstreamConn) handleBatch(ctx context.Context, msg *irc.Message) error {
+	var ref string
+	if err := parseMessageParams(msg, &ref); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasPrefix(ref, "+"):
+		var batchType, target string
+		if err := parseMessageParams(msg, nil, &batchType); err != nil {
+			return err
+		}
+		if batchType != "draft/multiline" || !dc.caps.IsEnabled("draft/multiline") {
+			return newFailError("BATCH", "UNKNOWN_TYPE", batchType, "Unsupported batch type")
+		}
+		if err := parseMessageParams(msg, nil, nil, &target); err != nil {
+			return err
+		}
+		if dc.multiline != nil {
+			return newFailError("BATCH", "MULTILINE_INVALID", "Nested or concurrent multiline batches are not supported")
+		}
+		dc.multiline = &multilineBatch{
+			ref:    ref[1:],
+			target: target,
+			tags:   msg.Tags.Copy(),
+		}
+		return nil
+	case strings.HasPrefix(ref, "-"):
+		mb := dc.multiline
+		if mb == nil || ref[1:] != mb.ref {
+			return newFailError("BATCH", "MULTILINE_INVALID", "Unknown batch reference")
+		}
+		dc.multiline = nil
+		if mb.discarded {
+			return nil
+		}
+		return dc.handleMultiline(ctx, mb)
+	default:
+		return newFailError("BATCH", "MULTILINE_INVALID", "Invalid batch reference")
+	}
+}
+
+// appendMultiline adds a message to the pending draft/multiline batch. On
+// error, the batch is discarded.
+func (dc *downstreamConn) appendMultiline(msg *irc.Message) error {
+	mb := dc.multiline
+	if mb.discarded {
+		return nil
+	}
+
+	var target, text string
+	if err := parseMessageParams(msg, &target, &text); err != nil {
+		mb.discarded = true
+		return err
+	}
+
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_INVALID", fmt.Sprintf("Unexpected %v command in multiline batch", msg.Command))
+	}
+	if mb.command != "" && msg.Command != mb.command {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_INVALID", "Cannot mix PRIVMSG and NOTICE in multiline batch")
+	}
+	if target != mb.target {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_INVALID_TARGET", mb.target, target, "Mismatched target in multiline batch")
+	}
+
+	_, concat := msg.Tags["draft/multiline-concat"]
+	if concat && text == "" {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_INVALID", "Cannot concatenate a blank line")
+	}
+
+	n := len(text)
+	if !concat && len(mb.lines) > 0 {
+		n++ // line break
+	}
+	if mb.bytes+n > downstreamMultilineMaxBytes {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_MAX_BYTES", strconv.Itoa(downstreamMultilineMaxBytes), "Multiline batch max-bytes exceeded")
+	}
+	if len(mb.lines)+1 > downstreamMultilineMaxLines {
+		mb.discarded = true
+		return newFailError("BATCH", "MULTILINE_MAX_LINES", strconv.Itoa(downstreamMultilineMaxLines), "Multiline batch max-lines exceeded")
+	}
+
+	mb.command = msg.Command
+	mb.bytes += n
+	mb.lines = append(mb.lines, multilineLine{text: text, concat: concat})
+	return nil
+}
+
+// handleMultiline forwards a complete draft/multiline batch. The batch is
+// relayed as-is to upstreams supporting multiline messages. Otherwise, each
+// line is sent as a separate message, concatenated lines being merged (and
+// split again if too long for the upstream).
+func (dc *downstreamConn) handleMultiline(ctx context.Context, mb *multilineBatch) error {
+	if len(mb.lines) == 0 {
+		return newFailError("BATCH", "MULTILINE_INVALID", "Empty multiline batch")
+	}
+
+	if casemapASCII(mb.target) != serviceNickCM && !strings.HasPrefix(mb.target, "$") {
+		if uc, upstreamName, err := dc.unmarshalEntity(mb.target); err == nil {
+			dc.sendMultilineUpstream(ctx, uc, upstreamName, mb)
+			return nil
+		}
+	}
+
+	// Other targets (the service, broadcasts, local channels, etc.) handle
+	// each line as a separate command
+	tags := copyClientTags(mb.tags)
+	for _, text := range mb.logicalLines() {
+		if text == "" {
+			continue
+		}
+		err := dc.handleMessageRegistered(ctx, &irc.Message{
+			Tags:    tags.Copy(),
+			Command: mb.command,
+			Params:  []string{mb.target, text},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dc *downstreamConn) sendMultilineUpstream(ctx context.Context, uc *upstreamConn, upstreamName string, mb *multilineBatch) {
+	tags := copyClientTags(mb.tags)
+	defer uc.updateChannelAutoDetach(upstreamName)
+
+	if uc.supportsMultiline(mb) {
+		if !dc.user.allowUpstreamMessage() {
+			if dc.srv.Config().UserMessagePolicy == userMessagePolicyNotice {
+				sendServiceNOTICE(dc, fmt.Sprintf("message to %q dropped: message rate limit exceeded", mb.target))
+			}
+			return
+		}
+
+		// The batch is stored and relayed to downstream connections when
+		// echoed by the upstream server
+		uc.lastBatchRef++
+		ref := fmt.Sprintf("%v", uc.lastBatchRef)
+		uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
+			Tags:    tags,
+			Command: "BATCH",
+			Params:  []string{"+" + ref, "draft/multiline", upstreamName},
+		})
+		for _, l := range mb.lines {
+			text := l.text
+			if uc.isChannel(upstreamName) {
+				text = dc.unmarshalText(uc, text)
+			}
+			lineTags := irc.Tags{"batch": irc.TagValue(ref)}
+			if l.concat {
+				lineTags["draft/multiline-concat"] = ""
+			}
+			uc.SendMessage(ctx, &irc.Message{
+				Tags:    lineTags,
+				Command: mb.command,
+				Params:  []string{upstreamName, text},
+			})
+		}
+		uc.SendMessage(ctx, &irc.Message{
+			Command: "BATCH",
+			Params:  []string{"-" + ref},
+		})
+		return
+	}
+
+	lines := mb.logicalLines()
+	for _, text := range lines {
+		if text == "" {
+			// Blank lines can't be sent as separate messages
+			continue
+		}
+		if uc.isChannel(upstreamName) {
+			text = dc.unmarshalText(uc, text)
+		}
+		texts := []string{text}
+		if uc.network.SplitLongMessages {
+			texts = splitText(text, uc.maxTextLength(mb.command, upstreamName))
+		}
+		for _, upstreamText := range texts {
+			if !dc.user.allowUpstreamMessage() {
+				if dc.srv.Config().UserMessagePolicy == userMessagePolicyNotice {
+					sendServiceNOTICE(dc, fmt.Sprintf("message to %q dropped: message rate limit exceeded", mb.target))
+				}
+				continue
+			}
+			uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
+				Tags:    tags.Copy(),
+				Command: mb.command,
+				Params:  []string{upstreamName, upstreamText},
+			})
+		}
+	}
+
+	// With echo-message, each line is echoed with its own upstream message
+	// ID, and stored as such. Otherwise, the whole message is produced here,
+	// blank lines included.
+	if uc.caps.IsEnabled("echo-message") {
+		return
+	}
+	echoTags := tags.Copy()
+	echoTags["time"] = irc.TagValue(formatServerTime(time.Now()))
+	if uc.account != "" {
+		echoTags["account"] = irc.TagValue(uc.account)
+	}
+	uc.produce(upstreamName, &irc.Message{
+		Tags: echoTags,
+		Prefix: &irc.Prefix{
+			Name: uc.nick,
+			User: uc.username,
+			Host: uc.hostname,
+		},
+		Command: mb.command,
+		Params:  []string{upstreamName, strings.Join(lines, "\n")},
+	}, dc.id)
+}
+
+// supportsMultiline checks whether a draft/multiline batch can be relayed
+// as-is to the upstream server. Echoed messages are required, so that the
+// batch is stored and relayed to other downstream connections when the
+// upstream server sends it back.
+func (uc *upstreamConn) supportsMultiline(mb *multilineBatch) bool {
+	if !uc.caps.IsEnabled("draft/multiline") || !uc.caps.IsEnabled("echo-message") || !uc.caps.IsEnabled("batch") {
+		return false
+	}
+	maxBytes, maxLines := parseMultilineLimits(uc.caps.Available["draft/multiline"])
+	if maxBytes > 0 && mb.bytes > maxBytes {
+		return false
+	}
+	if maxLines > 0 && len(mb.lines) > maxLines {
+		return false
+	}
+	return true
+}
+
+// sendMultiline sends a message spanning multiple lines (see
+// isMultilineMessage) as a draft/multiline batch. If the downstream connection
+// doesn't support multiline messages, each line is sent as a separate message
+// instead, blank lines being skipped.
+func (dc *downstreamConn) sendMultiline(msg *irc.Message) {
+	target := msg.Params[0]
+	lines := strings.Split(msg.Params[1], "\n")
+
+	if dc.caps.IsEnabled("draft/multiline") && dc.caps.IsEnabled("batch") {
+		dc.lastBatchRef++
+		ref := fmt.Sprintf("%v", dc.lastBatchRef)
+
+		endTags := irc.Tags{}
+		if outer, ok := msg.Tags["batch"]; ok {
+			endTags["batch"] = outer
+		}
+
+		dc.SendMessage(&irc.Message{
+			Tags:    msg.Tags,
+			Prefix:  msg.Prefix,
+			Command: "BATCH",
+			Params:  []string{"+" + ref, "draft/multiline", target},
+		})
+		for _, line := range lines {
+			dc.SendMessage(&irc.Message{
+				Tags:    irc.Tags{"batch": irc.TagValue(ref)},
+				Prefix:  msg.Prefix,
+				Command: msg.Command,
+				Params:  []string{target, line},
+			})
+		}
+		dc.SendMessage(&irc.Message{
+			Tags:    endTags,
+			Prefix:  msg.Prefix,
+			Command: "BATCH",
+			Params:  []string{"-" + ref},
+		})
+		return
+	}
+
+	first := true
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		tags := msg.Tags.Copy()
+		if !first {
+			// Message IDs are unique
+			delete(tags, "msgid")
+		}
+		first = false
+		dc.SendMessage(&irc.Message{
+			Tags:    tags,
+			Prefix:  msg.Prefix,
+			Command: msg.Command,
+			Params:  []string{target, line},
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package soju
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of REGISTER and VERIFY attempts per IP address in
+	// registrationRateWindow
+	registrationRateLimit  = 5
+	registrationRateWindow = time.Hour
+	// Time after which a pending registration awaiting verification is
+	// dropped
+	registrationVerifyTimeout = 24 * time.Hour
+	// Minimum length of passwords for registered accounts
+	registrationMinPasswordLen = 8
+)
+
+// illegalUsernameChars is the set of characters which can't be used in
+// usernames. '/' and '@' are used to select a network and a client name when
+// authenticating, see unmarshalUsername.
+const illegalUsernameChars = " /@"
+
+// checkUsername checks whether a username is valid for a new user.
+func checkUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if strings.HasPrefix(username, "#") {
+		return fmt.Errorf("username must not start with %q", "#")
+	}
+	if strings.ContainsAny(username, illegalUsernameChars) {
+		return fmt.Errorf("username must not contain any of %q", illegalUsernameChars)
+	}
+	return nil
+}
+
+// EmailVerifier sends verification codes to the e-mail address given by users
+// registering an account.
+type EmailVerifier interface {
+	SendVerificationCode(ctx context.Context, username, email, code string) error
+}
+
+type pendingRegistration struct {
+	user    *User
+	code    string
+	expires time.Time
+}
+
+// registrationState keeps track of accounts registered via the
+// draft/account-registration extension.
+type registrationState struct {
+	lock     sync.Mutex
+	pending  map[string]*pendingRegistration
+	attempts map[string][]time.Time // by IP address
+}
+
+func newRegistrationState() *registrationState {
+	return &registrationState{
+		pending:  make(map[string]*pendingRegistration),
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// allow records an attempt from the IP address ip and checks whether the rate
+// limit has been exceeded.
+func (rs *registrationState) allow(ip string, now time.Time) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	for k, l := range rs.attempts {
+		i := 0
+		for i < len(l) && now.Sub(l[i]) >= registrationRateWindow {
+			i++
+		}
+		if i == len(l) {
+			delete(rs.attempts, k)
+		} else {
+			rs.attempts[k] = l[i:]
+		}
+	}
+
+	l := rs.attempts[ip]
+	if len(l) >= registrationRateLimit {
+		return false
+	}
+	rs.attempts[ip] = append(l, now)
+	return true
+}
+
+// isPending checks whether a registration is waiting for verification for the
+// specified username.
+func (rs *registrationState) isPending(username string, now time.Time) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	p, ok := rs.pending[username]
+	if ok && now.After(p.expires) {
+		delete(rs.pending, username)
+		ok = false
+	}
+	return ok
+}
+
+func (rs *registrationState) addPending(record *User, code string, now time.Time) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rs.pending[record.Username] = &pendingRegistration{
+		user:    record,
+		code:    code,
+		expires: now.Add(registrationVerifyTimeout),
+	}
+}
+
+// verify checks a verification code. On success, the pending registration is
+// removed and its user record is returned.
+func (rs *registrationState) verify(username, code string, now time.Time) *User {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	p, ok := rs.pending[username]
+	if !ok {
+		return nil
+	}
+	if now.After(p.expires) {
+		delete(rs.pending, username)
+		return nil
+	}
+	if p.code != code {
+		return nil
+	}
+	delete(rs.pending, username)
+	return p.user
+}
+
+// generateVerificationCode returns a random 8-digit code.
+func generateVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08d", n.Int64()), nil
+}
@@ -0,0 +1,179 @@
+package soju
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxDNSMessageSize is the maximum size of a DNS message sent over a stream.
+const maxDNSMessageSize = 65535
+
+// NewUpstreamResolver creates a resolver sending DNS queries to the server
+// described by uri:
+//
+//   - udp://host[:port] and tcp://host[:port] for plain DNS
+//   - https://host[:port]/path for DNS-over-HTTPS (RFC 8484)
+//
+// A nil resolver is returned if uri is empty, meaning that the system resolver
+// should be used.
+func NewUpstreamResolver(uri string) (*net.Resolver, error) {
+	if uri == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS server URI: %v", err)
+	}
+
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	switch u.Scheme {
+	case "udp", "tcp":
+		addr := u.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		scheme := u.Scheme
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			// The resolver falls back to TCP when a UDP response is truncated
+			if scheme == "tcp" {
+				network = "tcp"
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	case "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, url: u.String()}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DNS server URI scheme %q", u.Scheme)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     dial,
+	}, nil
+}
+
+// dohConn is a fake stream connection performing a DNS-over-HTTPS request for
+// each DNS message written. Messages are prefixed with their length, like DNS
+// over TCP.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+
+	wbuf, rbuf bytes.Buffer
+}
+
+var _ net.Conn = (*dohConn)(nil)
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+size {
+			break
+		}
+		c.wbuf.Next(2)
+		resp, err := c.roundTrip(c.wbuf.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(resp)))
+		c.rbuf.Write(prefix[:])
+		c.rbuf.Write(resp)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) roundTrip(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS request failed: HTTP status %v", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS-over-HTTPS response: %v", err)
+	}
+	if len(b) > maxDNSMessageSize {
+		return nil, fmt.Errorf("DNS-over-HTTPS response too large")
+	}
+	return b, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type dohAddr string
+
+func (addr dohAddr) Network() string {
+	return "https"
+}
+
+func (addr dohAddr) String() string {
+	return string(addr)
+}
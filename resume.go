@@ -0,0 +1,237 @@
+package soju
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Time during which the session of a closed downstream connection can be
+// resumed with the soju.im/resume extension
+var downstreamResumeTimeout = 5 * time.Minute
+
+// resumeState maps the session resumption tokens issued to downstream
+// connections to their user, so that they can be looked up before the
+// connection is authenticated.
+type resumeState struct {
+	lock   sync.Mutex
+	tokens map[string]*user
+}
+
+func newResumeState() *resumeState {
+	return &resumeState{tokens: make(map[string]*user)}
+}
+
+func (rs *resumeState) issue(u *user) (string, error) {
+	var b [18]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rs.tokens[token] = u
+	return token, nil
+}
+
+// claim removes a token and returns its user, or nil if the token is unknown.
+// A token can only be claimed once.
+func (rs *resumeState) claim(token string) *user {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	u := rs.tokens[token]
+	delete(rs.tokens, token)
+	return u
+}
+
+func (rs *resumeState) remove(token string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	delete(rs.tokens, token)
+}
+
+// forget removes all of the tokens of a user.
+func (rs *resumeState) forget(u *user) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	for token, v := range rs.tokens {
+		if v == u {
+			delete(rs.tokens, token)
+		}
+	}
+}
+
+// suspendedSession is the state of a closed downstream connection, kept until
+// the connection is resumed or downstreamResumeTimeout elapses.
+type suspendedSession struct {
+	clientName      string
+	networkID       int64 // zero if not bound to a network
+	isMultiUpstream bool
+
+	// Channels sent to the downstream connection, by network ID (zero for
+	// local channels)
+	channels map[int64]*casemapMap
+
+	monitored             casemapMap
+	targetFilter          map[int64]*casemapMap
+	requestedBacklogLimit *int
+
+	timer *time.Timer
+}
+
+// hasChannel checks whether a channel had been sent to the downstream
+// connection before it was suspended.
+func (s *suspendedSession) hasChannel(netID int64, name string) bool {
+	m := s.channels[netID]
+	return m != nil && m.Has(name)
+}
+
+// attachedChannels returns the channels of a network sent to downstream
+// connections upon registration, in the order set by the user.
+func (net *network) attachedChannels() []string {
+	var names []string
+	if uc := net.conn; uc != nil {
+		for _, entry := range uc.channels.innerMap {
+			ch := entry.value.(*upstreamChannel)
+			if !ch.complete {
+				continue
+			}
+			if record := net.channels.Value(ch.Name); record != nil && record.Detached {
+				continue
+			}
+			names = append(names, ch.Name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return net.channelLess(names[i], names[j])
+		})
+	} else if net.Enabled {
+		for _, ch := range net.sortedChannels() {
+			if !ch.Detached {
+				names = append(names, ch.Name)
+			}
+		}
+	}
+	return names
+}
+
+// suspendDownstream saves the state of a downstream connection which can be
+// resumed later.
+func (u *user) suspendDownstream(dc *downstreamConn) {
+	token := dc.resumeToken
+	dc.resumeToken = ""
+
+	s := &suspendedSession{
+		clientName:            dc.clientName,
+		isMultiUpstream:       dc.isMultiUpstream,
+		channels:              make(map[int64]*casemapMap),
+		monitored:             dc.monitored,
+		targetFilter:          dc.targetFilter,
+		requestedBacklogLimit: dc.requestedBacklogLimit,
+	}
+	if dc.network != nil {
+		s.networkID = dc.network.ID
+	}
+	dc.forEachNetwork(func(net *network) {
+		m := newCasemapMap(0)
+		m.SetCasemapping(net.casemap)
+		for _, name := range net.attachedChannels() {
+			m.SetValue(name, nil)
+		}
+		s.channels[net.ID] = &m
+	})
+	if dc.isMultiUpstream {
+		m := newCasemapMap(0)
+		m.SetCasemapping(casemapASCII)
+		for _, ch := range u.localChannels {
+			m.SetValue(ch.Name, nil)
+		}
+		s.channels[0] = &m
+	}
+
+	s.timer = time.AfterFunc(downstreamResumeTimeout, func() {
+		select {
+		case u.events <- eventSessionExpired{token}:
+		case <-u.done:
+		}
+	})
+	u.suspendedSessions[token] = s
+}
+
+// resumeSession returns the suspended session associated with a token and
+// removes it. If the downstream connection which received the token is still
+// open, e.g. because it hasn't timed out yet, it's closed and its state is
+// taken over. Nil is returned if there is no such session.
+func (u *user) resumeSession(token string) *suspendedSession {
+	for i, dc := range u.downstreamConns {
+		if dc.resumeToken == token {
+			dc.logger.Printf("connection taken over by resumed session")
+			u.suspendDownstream(dc)
+			u.downstreamConns = append(u.downstreamConns[:i], u.downstreamConns[i+1:]...)
+			u.numDownstreams.Add(-1)
+			dc.Close()
+			// The connection is no longer known when its disconnection is
+			// handled, drop its pending commands now
+			u.forEachUpstream(func(uc *upstreamConn) {
+				uc.cancelPendingCommandsByDownstreamID(dc.id)
+			})
+			break
+		}
+	}
+
+	s := u.suspendedSessions[token]
+	if s == nil {
+		return nil
+	}
+	s.timer.Stop()
+	delete(u.suspendedSessions, token)
+	return s
+}
+
+// revokeSessions closes all downstream connections except the provided one
+// (which can be nil) and discards suspended sessions, so that clients cannot
+// resume them without authenticating again.
+func (u *user) revokeSessions(except *downstreamConn) {
+	for _, dc := range u.downstreamConns {
+		if dc == except {
+			continue
+		}
+		if dc.resumeToken != "" {
+			u.srv.resume.remove(dc.resumeToken)
+			dc.resumeToken = ""
+		}
+		dc.Close()
+	}
+
+	if len(u.suspendedSessions) == 0 {
+		return
+	}
+	for token, s := range u.suspendedSessions {
+		s.timer.Stop()
+		u.srv.resume.remove(token)
+		delete(u.suspendedSessions, token)
+	}
+	u.forEachUpstream(func(uc *upstreamConn) {
+		uc.updateAway()
+	})
+	for _, net := range u.networks {
+		net.updateDemand()
+	}
+}
+
+// hasSuspendedSession checks whether a suspended session is bound to a
+// network.
+func (u *user) hasSuspendedSession(net *network) bool {
+	for _, s := range u.suspendedSessions {
+		if s.isMultiUpstream || s.networkID == net.ID {
+			return true
+		}
+	}
+	return false
+}
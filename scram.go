@@ -0,0 +1,142 @@
+package soju
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramSHA256 is the name of the SASL SCRAM-SHA-256 mechanism.
+const scramSHA256 = "SCRAM-SHA-256"
+
+// scramMaxIterations is the maximum iteration count accepted from servers, to
+// prevent them from making us burn CPU time.
+const scramMaxIterations = 100000
+
+// scramClient implements the client side of the SASL SCRAM-SHA-256 mechanism,
+// defined in RFC 5802 and RFC 7677. Channel binding isn't supported.
+type scramClient struct {
+	username, password string
+
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+var _ sasl.Client = (*scramClient)(nil)
+
+func newSCRAMClient(username, password string) *scramClient {
+	return &scramClient{username: username, password: password}
+}
+
+func (c *scramClient) Start() (mech string, ir []byte, err error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", nil, err
+	}
+	c.nonce = base64.RawStdEncoding.EncodeToString(b[:])
+
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	c.clientFirstBare = "n=" + username + ",r=" + c.nonce
+	return scramSHA256, []byte("n,," + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.handleServerFirst(string(challenge))
+	case 2:
+		return nil, c.handleServerFinal(string(challenge))
+	default:
+		return nil, fmt.Errorf("SCRAM: unexpected server challenge")
+	}
+}
+
+func (c *scramClient) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs, err := parseSCRAMAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs['m']; ok {
+		return nil, fmt.Errorf("SCRAM: unsupported mandatory extension")
+	}
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, fmt.Errorf("SCRAM: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("SCRAM: invalid salt")
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("SCRAM: invalid iteration count")
+	} else if iterations > scramMaxIterations {
+		return nil, fmt.Errorf("SCRAM: iteration count %v exceeds the maximum of %v", iterations, scramMaxIterations)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, "Server Key")
+
+	// "biws" is the base64-encoded GS2 header "n,,"
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) handleServerFinal(serverFinal string) error {
+	attrs, err := parseSCRAMAttrs(serverFinal)
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("SCRAM: server error: %v", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil {
+		return fmt.Errorf("SCRAM: invalid server signature")
+	}
+	if subtle.ConstantTimeCompare(sig, c.serverSignature) != 1 {
+		return fmt.Errorf("SCRAM: server signature mismatch")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// parseSCRAMAttrs parses a comma-separated list of SCRAM attributes.
+func parseSCRAMAttrs(s string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, fmt.Errorf("SCRAM: malformed attribute %q", attr)
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs, nil
+}
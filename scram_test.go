@@ -0,0 +1,51 @@
+package soju
+
+import (
+	"testing"
+)
+
+// Test vector from RFC 7677 section 3
+func TestSCRAMClient(t *testing.T) {
+	c := newSCRAMClient("user", "pencil")
+	if _, _, err := c.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=user,r=" + c.nonce
+
+	resp, err := c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatalf("Next(server-first) = %v", err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(resp) != want {
+		t.Errorf("client-final = %q, want %q", resp, want)
+	}
+
+	if _, err := c.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("Next(server-final) = %v", err)
+	}
+}
+
+func TestSCRAMClientBadServerSignature(t *testing.T) {
+	c := newSCRAMClient("user", "pencil")
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=user,r=" + c.nonce
+
+	if _, err := c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err != nil {
+		t.Fatalf("Next(server-first) = %v", err)
+	}
+	if _, err := c.Next([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Errorf("Next(server-final) succeeded with an invalid server signature")
+	}
+}
+
+func TestSCRAMClientTooManyIterations(t *testing.T) {
+	c := newSCRAMClient("user", "pencil")
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=user,r=" + c.nonce
+
+	if _, err := c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1000000000")); err == nil {
+		t.Errorf("Next(server-first) succeeded with an excessive iteration count")
+	}
+}
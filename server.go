@@ -2,6 +2,9 @@ package soju
 
 import (
 	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,15 +30,35 @@ import (
 var retryConnectMinDelay = time.Minute
 var retryConnectMaxDelay = 10 * time.Minute
 var retryConnectJitter = time.Minute
-var connectTimeout = 15 * time.Second
 var writeTimeout = 10 * time.Second
-var upstreamMessageDelay = 2 * time.Second
-var upstreamMessageBurst = 10
 var backlogTimeout = 10 * time.Second
 var handleDownstreamMessageTimeout = 10 * time.Second
 var downstreamRegisterTimeout = 30 * time.Second
 var chatHistoryLimit = 1000
-var backlogLimit = 4000
+var maintenanceInterval = time.Hour
+var defaultOnDemandGrace = 10 * time.Minute
+
+// Bounds for the upstream flood protection parameters
+const (
+	minUpstreamMessageDelay = config.MinUpstreamMessageDelay
+	maxUpstreamMessageDelay = config.MaxUpstreamMessageDelay
+	minUpstreamMessageBurst = config.MinUpstreamMessageBurst
+	maxUpstreamMessageBurst = config.MaxUpstreamMessageBurst
+)
+
+// Policies applied to the messages exceeding the per-user rate limit
+const (
+	// Messages are delayed until they can be sent
+	userMessagePolicyQueue = "queue"
+	// Messages are silently dropped
+	userMessagePolicyDrop = "drop"
+	// Messages are dropped and the client is notified
+	userMessagePolicyNotice = "notice"
+)
+
+// Time during which a user is reported as throttled after a message has been
+// delayed or dropped
+const userThrottledWindow = time.Minute
 
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -53,13 +77,102 @@ func (l logger) Debugf(format string, v ...interface{}) {
 	l.Logger.Printf(format, v...)
 }
 
+func (l logger) forceDebugf(format string, v ...interface{}) {
+	l.Logger.Printf(format, v...)
+}
+
 func NewLogger(out io.Writer, debug bool) Logger {
 	return logger{
-		Logger: log.New(log.Writer(), "", log.LstdFlags),
+		Logger: log.New(out, "", log.LstdFlags),
 		debug:  debug,
 	}
 }
 
+// debugLogger is a Logger which can print debug messages regardless of its
+// debug setting.
+type debugLogger interface {
+	Logger
+	forceDebugf(format string, v ...interface{})
+}
+
+// fieldLogger is a Logger which can attach structured fields to messages.
+type fieldLogger interface {
+	Logger
+	withField(key, value string) Logger
+}
+
+// jsonLogger writes one JSON object per message, with the fields attached via
+// newPrefixLogger as separate keys.
+type jsonLogger struct {
+	out    io.Writer
+	lock   *sync.Mutex // shared by all loggers writing to out
+	debug  bool
+	fields map[string]string
+}
+
+var _ fieldLogger = (*jsonLogger)(nil)
+
+// NewJSONLogger creates a logger emitting JSON objects with "time", "level"
+// and "message" keys, in addition to the user, network, upstream and
+// downstream the message is about.
+func NewJSONLogger(out io.Writer, debug bool) Logger {
+	return &jsonLogger{out: out, lock: new(sync.Mutex), debug: debug}
+}
+
+func (l *jsonLogger) log(level, format string, v ...interface{}) {
+	entry := make(map[string]string, len(l.fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["message"] = fmt.Sprintf(format, v...)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		panic(err) // a map of strings can always be marshaled
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(b)
+}
+
+func (l *jsonLogger) Printf(format string, v ...interface{}) {
+	l.log("info", format, v...)
+}
+
+func (l *jsonLogger) Debugf(format string, v ...interface{}) {
+	if !l.debug {
+		return
+	}
+	l.log("debug", format, v...)
+}
+
+func (l *jsonLogger) forceDebugf(format string, v ...interface{}) {
+	l.log("debug", format, v...)
+}
+
+func (l *jsonLogger) withField(key, value string) Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &jsonLogger{out: l.out, lock: l.lock, debug: l.debug, fields: fields}
+}
+
+// newPrefixLogger returns a logger annotating messages with a key and a
+// value, e.g. the user a message is about. The key-value pair is attached as
+// a structured field if the logger supports it, or as a prefix otherwise.
+func newPrefixLogger(logger Logger, key, value string) Logger {
+	if fl, ok := logger.(fieldLogger); ok {
+		return fl.withField(key, value)
+	}
+	return &prefixLogger{logger, fmt.Sprintf("%v %q: ", key, value)}
+}
+
 type prefixLogger struct {
 	logger Logger
 	prefix string
@@ -77,6 +190,42 @@ func (l *prefixLogger) Debugf(format string, v ...interface{}) {
 	l.logger.Debugf("%v"+format, v...)
 }
 
+func (l *prefixLogger) forceDebugf(format string, v ...interface{}) {
+	v = append([]interface{}{l.prefix}, v...)
+	if dl, ok := l.logger.(debugLogger); ok {
+		dl.forceDebugf("%v"+format, v...)
+	} else {
+		l.logger.Printf("%v"+format, v...)
+	}
+}
+
+// userLogger is the logger of a user and of its networks and connections.
+// Debug messages can be enabled for a single user at runtime, regardless of
+// the server-wide setting.
+type userLogger struct {
+	Logger
+	debug *int32 // atomic, shared by the loggers derived from this one
+}
+
+var _ fieldLogger = (*userLogger)(nil)
+
+func (l *userLogger) Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(l.debug) == 0 {
+		l.Logger.Debugf(format, v...)
+	} else if dl, ok := l.Logger.(debugLogger); ok {
+		dl.forceDebugf(format, v...)
+	} else {
+		l.Logger.Printf(format, v...)
+	}
+}
+
+func (l *userLogger) withField(key, value string) Logger {
+	return &userLogger{
+		Logger: newPrefixLogger(l.Logger, key, value),
+		debug:  l.debug,
+	}
+}
+
 type int64Gauge struct {
 	v int64 // atomic
 }
@@ -124,54 +273,163 @@ func (ln *retryListener) Accept() (net.Conn, error) {
 }
 
 type Config struct {
-	Hostname        string
-	Title           string
-	LogPath         string
-	HTTPOrigins     []string
-	AcceptProxyIPs  config.IPSet
-	MaxUserNetworks int
-	MultiUpstream   bool
-	MOTD            string
-	UpstreamUserIPs []*net.IPNet
+	Hostname           string
+	Title              string
+	LogPath            string
+	LogCompress        bool
+	LogQuota           int64
+	HTTPOrigins        []string
+	AcceptProxyIPs     config.IPSet
+	MaxUserNetworks    int
+	MaxUserDownstreams int
+	MultiUpstream      bool
+	MOTD               string
+	UpstreamUserIPs    []*net.IPNet
+	// Either "linear" or "hash", see userIPOffset
+	UpstreamUserIPStrategy string
+	// Resolver for upstream hostnames, nil for the system resolver
+	UpstreamResolver *net.Resolver
+	// Templates for the username and realname sent to upstream networks when
+	// they are left unset, see expandIdentityTemplate
+	DefaultUsername string
+	DefaultRealname string
+	// Template for the ident returned by the ident server, see getIdent.
+	// Empty for a hash of the user ID.
+	IdentTemplate string
+	// Operating system token of ident responses, empty for "OTHER"
+	IdentOS string
+	// Maximum number of messages replayed per target to clients without
+	// chathistory support, overridden by User.BacklogLimit
+	BacklogLimit int
+	// Upstream flood protection: at most UpstreamMessageBurst messages are
+	// sent at once, then one message every UpstreamMessageDelay
+	UpstreamMessageDelay time.Duration
+	UpstreamMessageBurst int
+	// Per-user flood protection across all networks: at most
+	// UserMessageBurst PRIVMSG, NOTICE and TAGMSG messages are sent by
+	// clients at once, then one message every UserMessageDelay; zero
+	// disables the limit. UserMessagePolicy is applied to the messages
+	// exceeding the rate, see userMessagePolicyQueue and friends.
+	UserMessageDelay  time.Duration
+	UserMessageBurst  int
+	UserMessagePolicy string
+	// Per-user limit on network creations and deletions: at most
+	// NetworkChangeBurst changes at once, then one every NetworkChangeDelay;
+	// zero disables the limit. The delay is overridden by
+	// User.NetworkChangeDelay.
+	NetworkChangeDelay time.Duration
+	NetworkChangeBurst int
+	// Capacity of the event queue of each user, which absorbs bursts of
+	// upstream and downstream activity while the user goroutine is busy.
+	UserEventQueueSize int
+	// Interval at which the delivery receipts modified since they were last
+	// saved are written to the database. This bounds the receipts lost on
+	// crash, the receipts of a client being saved anyways when it
+	// disconnects.
+	ReceiptsFlushInterval time.Duration
+	// Timeout for connecting to upstream networks, overridden by
+	// Network.ConnectTimeout
+	UpstreamConnectTimeout time.Duration
+	// TLS policy for upstream connections: minimum protocol version,
+	// overridden by Network.TLSMinVersion, and cipher suites allowed for TLS
+	// 1.2 and below (nil for Go's defaults)
+	UpstreamTLSMinVersion   uint16
+	UpstreamTLSCipherSuites []uint16
+	// Number of consecutive upstream SASL authentication failures after
+	// which reconnecting to a network is stopped; zero disables the limit
+	MaxUpstreamAuthFailures int
+	// Number of consecutive failed downstream logins for a username or from
+	// an IP address after which logins are rejected for LoginLockout,
+	// doubled for each subsequent failure; zero disables the limit
+	MaxLoginFailures int
+	LoginLockout     time.Duration
+	// Time after which an idle downstream is sent a PING, and then closed if
+	// it stays idle; zero disables the timeout
+	DownstreamIdleTimeout time.Duration
+	// Interval between WebSocket pings sent to WebSocket clients, which are
+	// closed if they don't reply in time; zero disables pings
+	WebSocketPingInterval time.Duration
+	// Whether anyone can create an account with the
+	// draft/account-registration extension
+	OpenRegistration bool
+}
+
+// ListenerOptions contains per-listener settings for downstream connections.
+type ListenerOptions struct {
+	// Timeout for writing a message, zero for the default
+	WriteTimeout time.Duration
 }
 
 type Server struct {
 	Logger          Logger
 	Identd          *Identd               // can be nil
 	MetricsRegistry prometheus.Registerer // can be nil
+	Authenticator   Authenticator
+	EmailVerifier   EmailVerifier // can be nil
 
 	config atomic.Value // *Config
 	db     Database
 	stopWG sync.WaitGroup
+	// Stops receiving database events and running maintenance, set by Start
+	cancelBackground context.CancelFunc
+	ready            int32 // atomic, 1 once Start has completed and until Shutdown
 
 	lock      sync.Mutex
 	listeners map[net.Listener]struct{}
 	users     map[string]*user
 
+	registration *registrationState
+	logins       *loginLimiter
+	resume       *resumeState
+
 	metrics struct {
 		downstreams int64Gauge
 		upstreams   int64Gauge
 
+		networks *prometheus.GaugeVec
+
 		upstreamOutMessagesTotal   prometheus.Counter
 		upstreamInMessagesTotal    prometheus.Counter
 		downstreamOutMessagesTotal prometheus.Counter
 		downstreamInMessagesTotal  prometheus.Counter
 
 		upstreamConnectErrorsTotal prometheus.Counter
+		downstreamsRejectedTotal   prometheus.Counter
+		userMessagesThrottledTotal prometheus.Counter
+		deliveryReceiptWritesTotal prometheus.Counter
 	}
 }
 
 func NewServer(db Database) *Server {
 	srv := &Server{
-		Logger:    NewLogger(log.Writer(), true),
-		db:        db,
-		listeners: make(map[net.Listener]struct{}),
-		users:     make(map[string]*user),
+		Logger:        NewLogger(log.Writer(), true),
+		Authenticator: NewDBAuthenticator(db),
+		db:            db,
+		listeners:     make(map[net.Listener]struct{}),
+		users:         make(map[string]*user),
+		registration:  newRegistrationState(),
+		logins:        newLoginLimiter(),
+		resume:        newResumeState(),
 	}
 	srv.config.Store(&Config{
-		Hostname:        "localhost",
-		MaxUserNetworks: -1,
-		MultiUpstream:   true,
+		Hostname:               "localhost",
+		BacklogLimit:           4000,
+		MaxUserNetworks:        -1,
+		MaxUserDownstreams:     -1,
+		MultiUpstream:          true,
+		UpstreamUserIPStrategy: "linear",
+		UpstreamMessageDelay:   config.DefaultUpstreamMessageDelay,
+		UpstreamMessageBurst:   config.DefaultUpstreamMessageBurst,
+		UpstreamConnectTimeout: 15 * time.Second,
+		UpstreamTLSMinVersion:  tls.VersionTLS12,
+		UserMessageBurst:       10,
+		UserMessagePolicy:      userMessagePolicyQueue,
+		NetworkChangeBurst:     5,
+		UserEventQueueSize:     64,
+		ReceiptsFlushInterval:  time.Minute,
+
+		MaxUpstreamAuthFailures: 5,
+		LoginLockout:            time.Minute,
 	})
 	return srv
 }
@@ -180,6 +438,63 @@ func (s *Server) prefix() *irc.Prefix {
 	return &irc.Prefix{Name: s.Config().Hostname}
 }
 
+// expandIdentityTemplate replaces the "{username}", "{nick}" and "{network}"
+// placeholders in a username or realname template.
+func expandIdentityTemplate(tmpl string, user *User, net *Network) string {
+	var netName string
+	if net != nil {
+		netName = net.GetName()
+	}
+	r := strings.NewReplacer(
+		"{username}", user.Username,
+		"{nick}", GetNick(user, net),
+		"{network}", netName,
+	)
+	return r.Replace(tmpl)
+}
+
+// getUsername is like GetUsername, but applies the server-wide username
+// template if the network doesn't set a username.
+func (s *Server) getUsername(user *User, net *Network) string {
+	tmpl := s.Config().DefaultUsername
+	if tmpl != "" && (net == nil || net.Username == "") {
+		// The username is a single word in the USER command
+		username := strings.ReplaceAll(expandIdentityTemplate(tmpl, user, net), " ", "")
+		if username != "" {
+			return username
+		}
+	}
+	return GetUsername(user, net)
+}
+
+// getIdent returns the ident of a user connected to a network. By default,
+// it's a hash of the user ID which doesn't expose any user metadata, see
+// userIdent. The server-wide template replaces it if set: on top of the
+// expandIdentityTemplate placeholders, "{hash}" is replaced with the default
+// ident.
+func (s *Server) getIdent(user *User, net *Network) string {
+	tmpl := s.Config().IdentTemplate
+	if tmpl != "" {
+		tmpl = strings.ReplaceAll(tmpl, "{hash}", userIdent(user))
+		if ident := strings.ReplaceAll(expandIdentityTemplate(tmpl, user, net), " ", ""); ident != "" {
+			return ident
+		}
+	}
+	return userIdent(user)
+}
+
+// getRealname is like GetRealname, but applies the server-wide realname
+// template if neither the network nor the user set a realname.
+func (s *Server) getRealname(user *User, net *Network) string {
+	tmpl := s.Config().DefaultRealname
+	if tmpl != "" && (net == nil || net.Realname == "") && user.Realname == "" {
+		if realname := expandIdentityTemplate(tmpl, user, net); realname != "" {
+			return realname
+		}
+	}
+	return GetRealname(user, net)
+}
+
 func (s *Server) Config() *Config {
 	return s.config.Load().(*Config)
 }
@@ -196,15 +511,123 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	dbEvents, err := s.db.Subscribe(ctx, s.Logger)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to subscribe to database events: %v", err)
+	}
+	s.cancelBackground = cancel
+
 	s.lock.Lock()
 	for i := range users {
 		s.addUserLocked(&users[i])
 	}
 	s.lock.Unlock()
 
+	atomic.StoreInt32(&s.ready, 1)
+
+	s.stopWG.Add(1)
+	go func() {
+		defer s.stopWG.Done()
+		for ev := range dbEvents {
+			s.handleDatabaseEvent(ev)
+		}
+	}()
+
+	s.stopWG.Add(1)
+	go func() {
+		defer s.stopWG.Done()
+		s.runMaintenance(ctx)
+	}()
+
 	return nil
 }
 
+// runMaintenance periodically performs housekeeping tasks until the context
+// is cancelled.
+func (s *Server) runMaintenance(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		cfg := s.Config()
+		if cfg.LogPath != "" && cfg.LogCompress {
+			n, err := compressFSMessageStore(ctx, cfg.LogPath, time.Now())
+			if err != nil && ctx.Err() == nil {
+				s.Logger.Printf("failed to compress message logs: %v", err)
+			} else if n > 0 {
+				s.Logger.Printf("compressed %v message log files", n)
+			}
+		}
+
+		s.logins.prune(time.Now())
+
+		s.forEachUser(func(u *user) {
+			select {
+			case u.events <- eventMsgStoreStats{}:
+			default:
+				// The user is busy, its statistics will be refreshed on the
+				// next run
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleDatabaseEvent reloads a record changed by another soju instance.
+func (s *Server) handleDatabaseEvent(ev DatabaseEvent) {
+	if ev.NetworkID != 0 {
+		if u := s.getUserByID(ev.UserID); u != nil {
+			select {
+			case u.events <- eventNetworkReload{ev.NetworkID}:
+			case <-u.done:
+			}
+		}
+		return
+	}
+
+	var record *User
+	if ev.Username != "" {
+		var err error
+		record, err = s.db.GetUser(context.TODO(), ev.Username)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && record.ID != ev.UserID) {
+			// Deleted or renamed again in the meantime
+			record = nil
+		} else if err != nil {
+			s.Logger.Printf("failed to reload user %v: %v", ev.UserID, err)
+			return
+		}
+	}
+
+	u := s.getUserByID(ev.UserID)
+	if u != nil && record != nil && u.Username == record.Username {
+		select {
+		case u.events <- eventUserReload{record}:
+		case <-u.done:
+		}
+		return
+	}
+
+	// The user has been created, renamed or deleted
+	if u != nil {
+		s.Logger.Printf("stopping bouncer for user %q changed by another instance", u.Username)
+		u.stop()
+	}
+	if record != nil {
+		s.lock.Lock()
+		if atomic.LoadInt32(&s.ready) != 0 && s.users[record.Username] == nil {
+			s.addUserLocked(record)
+		}
+		s.lock.Unlock()
+	}
+}
+
 func (s *Server) registerMetrics() {
 	factory := promauto.With(s.MetricsRegistry)
 
@@ -223,11 +646,54 @@ func (s *Server) registerMetrics() {
 		Help: "Current number of downstream connections",
 	}, s.metrics.downstreams.Float64)
 
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_user_downstreams_max",
+		Help: "Highest number of downstream connections of a single user",
+	}, func() float64 {
+		var max int64
+		s.forEachUser(func(u *user) {
+			if n := u.numDownstreams.Value(); n > max {
+				max = n
+			}
+		})
+		return float64(max)
+	})
+
 	factory.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "soju_upstreams_active",
 		Help: "Current number of upstream connections",
 	}, s.metrics.upstreams.Float64)
 
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_messages_stored",
+		Help: "Number of messages in the message stores",
+	}, func() float64 {
+		return float64(s.Stats().Messages)
+	})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_message_logs_size_bytes",
+		Help: "Size of the message logs on disk",
+	}, func() float64 {
+		return float64(s.Stats().MessageLogSize)
+	})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_message_oldest_age_seconds",
+		Help: "Age of the oldest stored message",
+	}, func() float64 {
+		oldest := s.Stats().OldestMessage
+		if oldest.IsZero() {
+			return 0
+		}
+		return time.Since(oldest).Seconds()
+	})
+
+	s.metrics.networks = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "soju_networks_total",
+		Help: "Current number of networks, by upstream connection state",
+	}, []string{"state"})
+
 	s.metrics.upstreamOutMessagesTotal = factory.NewCounter(prometheus.CounterOpts{
 		Name: "soju_upstream_out_messages_total",
 		Help: "Total number of outgoing messages sent to upstream servers",
@@ -252,25 +718,89 @@ func (s *Server) registerMetrics() {
 		Name: "soju_upstream_connect_errors_total",
 		Help: "Total number of upstream connection errors",
 	})
+
+	s.metrics.downstreamsRejectedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "soju_downstreams_rejected_total",
+		Help: "Total number of downstream connections rejected because of the per-user limit",
+	})
+
+	s.metrics.userMessagesThrottledTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "soju_user_messages_throttled_total",
+		Help: "Total number of messages delayed or dropped because of the per-user rate limit",
+	})
+
+	s.metrics.deliveryReceiptWritesTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "soju_delivery_receipt_writes_total",
+		Help: "Total number of delivery receipt writes to the database, one per client and network",
+	})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_users_throttled",
+		Help: "Current number of users whose messages are throttled",
+	}, func() float64 {
+		return float64(s.Stats().ThrottledUsers)
+	})
 }
 
 func (s *Server) Shutdown() {
+	s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext is like Shutdown, but gives up waiting for users to stop
+// once the context is done. The users which are still running are logged,
+// then abandoned: the caller is expected to exit shortly afterwards. The
+// context's error is returned in that case.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	atomic.StoreInt32(&s.ready, 0)
+	if s.cancelBackground != nil {
+		s.cancelBackground()
+	}
+
 	s.lock.Lock()
 	for ln := range s.listeners {
 		if err := ln.Close(); err != nil {
 			s.Logger.Printf("failed to stop listener: %v", err)
 		}
 	}
+	users := make([]*user, 0, len(s.users))
 	for _, u := range s.users {
-		u.events <- eventStop{}
+		users = append(users, u)
 	}
 	s.lock.Unlock()
 
-	s.stopWG.Wait()
+	for _, u := range users {
+		select {
+		case u.events <- eventStop{}:
+		case <-u.done:
+		case <-ctx.Done():
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stopWG.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.Logger.Printf("shutdown timed out: %v", err)
+		for _, u := range users {
+			select {
+			case <-u.done:
+			default:
+				s.Logger.Printf("user %q still running with %v downstream connections", u.Username, u.numDownstreams.Value())
+			}
+		}
+	}
 
 	if err := s.db.Close(); err != nil {
 		s.Logger.Printf("failed to close DB: %v", err)
 	}
+	return err
 }
 
 func (s *Server) createUser(ctx context.Context, user *User) (*user, error) {
@@ -289,6 +819,131 @@ func (s *Server) createUser(ctx context.Context, user *User) (*user, error) {
 	return s.addUserLocked(user), nil
 }
 
+// renameUser changes the username of a user. The user is stopped, which
+// closes all of its connections, and started again under its new name.
+//
+// This must not be called from the user's goroutine.
+func (s *Server) renameUser(ctx context.Context, u *user, username string) (*user, error) {
+	u.stop()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldRecord := u.User
+	if _, ok := s.users[username]; ok {
+		s.addUserLocked(&oldRecord)
+		return nil, fmt.Errorf("user %q already exists", username)
+	}
+
+	record := u.User // copy the user record because we'll mutate it
+	record.Username = username
+
+	logPath := s.Config().LogPath
+	if logPath != "" {
+		if err := renameFSMessageStoreUser(logPath, &oldRecord, &record); err != nil {
+			s.addUserLocked(&oldRecord)
+			return nil, fmt.Errorf("could not rename message logs: %v", err)
+		}
+	}
+
+	if err := s.db.StoreUser(ctx, &record); err != nil {
+		if logPath != "" {
+			if err := renameFSMessageStoreUser(logPath, &record, &oldRecord); err != nil {
+				s.Logger.Printf("failed to restore message logs of user %q: %v", oldRecord.Username, err)
+			}
+		}
+		s.addUserLocked(&oldRecord)
+		return nil, fmt.Errorf("could not rename user in db: %v", err)
+	}
+
+	return s.addUserLocked(&record), nil
+}
+
+// PostLocalMessage posts a message to a local channel of a user, for instance
+// to deliver notifications from a webhook. Local channel names start with "&"
+// and are only visible to multi-upstream clients. The message is sent by a
+// fake user named sender. If username is empty, the message is posted for all
+// users.
+func (s *Server) PostLocalMessage(ctx context.Context, username, channel, sender, text string) error {
+	return s.postLocalMessage(ctx, nil, username, channel, sender, text)
+}
+
+// postLocalMessage is like PostLocalMessage. If the caller runs in the
+// goroutine of a user, self must be set to that user: its messages are
+// delivered directly instead of going through its events channel.
+func (s *Server) postLocalMessage(ctx context.Context, self *user, username, channel, sender, text string) error {
+	if !isLocalChannel(channel) {
+		return fmt.Errorf("invalid local channel name %q", channel)
+	}
+	if sender == "" || strings.ContainsAny(sender, illegalNickChars) {
+		return fmt.Errorf("invalid sender nickname %q", sender)
+	}
+
+	var events []eventLocalMessage
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		events = append(events, eventLocalMessage{
+			channel: channel,
+			msg: &irc.Message{
+				Tags: irc.Tags{
+					"time": irc.TagValue(formatServerTime(time.Now())),
+				},
+				Prefix: &irc.Prefix{
+					Name: sender,
+					User: sender,
+					Host: s.Config().Hostname,
+				},
+				Command: "PRIVMSG",
+				Params:  []string{channel, line},
+			},
+		})
+	}
+
+	post := func(u *user) error {
+		for _, ev := range events {
+			if u == self {
+				u.postLocalMessage(ev.channel, ev.msg)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-u.done:
+				// The user has been stopped
+				return nil
+			case u.events <- ev:
+			}
+		}
+		return nil
+	}
+
+	if username != "" {
+		u := s.getUser(username)
+		if u == nil {
+			return fmt.Errorf("unknown user %q", username)
+		}
+		return post(u)
+	}
+
+	// Don't block on the events channels while holding the lock
+	s.lock.Lock()
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.lock.Unlock()
+
+	for _, u := range users {
+		if err := post(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Server) forEachUser(f func(*user)) {
 	s.lock.Lock()
 	for _, u := range s.users {
@@ -304,6 +959,17 @@ func (s *Server) getUser(name string) *user {
 	return u
 }
 
+func (s *Server) getUserByID(id int64) *user {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, u := range s.users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
 func (s *Server) addUserLocked(user *User) *user {
 	s.Logger.Printf("starting bouncer for user %q", user.Username)
 	u := newUser(s, user)
@@ -318,7 +984,10 @@ func (s *Server) addUserLocked(user *User) *user {
 			}
 
 			s.lock.Lock()
-			delete(s.users, u.Username)
+			// The entry may have been replaced if the user was renamed
+			if s.users[u.Username] == u {
+				delete(s.users, u.Username)
+			}
 			s.lock.Unlock()
 
 			s.stopWG.Done()
@@ -332,7 +1001,7 @@ func (s *Server) addUserLocked(user *User) *user {
 
 var lastDownstreamID uint64
 
-func (s *Server) handle(ic ircConn) {
+func (s *Server) handle(ic ircConn, options *ListenerOptions) {
 	defer func() {
 		if err := recover(); err != nil {
 			s.Logger.Printf("panic serving downstream %q: %v\n%v", ic.RemoteAddr(), err, debug.Stack())
@@ -341,7 +1010,7 @@ func (s *Server) handle(ic ircConn) {
 
 	s.metrics.downstreams.Add(1)
 	id := atomic.AddUint64(&lastDownstreamID, 1)
-	dc := newDownstreamConn(s, ic, id)
+	dc := newDownstreamConn(s, ic, id, options)
 	if err := dc.runUntilRegistered(); err != nil {
 		if !errors.Is(err, io.EOF) {
 			dc.logger.Printf("%v", err)
@@ -358,9 +1027,15 @@ func (s *Server) handle(ic ircConn) {
 }
 
 func (s *Server) Serve(ln net.Listener) error {
+	return s.ServeWithOptions(ln, nil)
+}
+
+// ServeWithOptions is like Serve, but applies the specified per-listener
+// options to downstream connections. options may be nil.
+func (s *Server) ServeWithOptions(ln net.Listener, options *ListenerOptions) error {
 	ln = &retryListener{
 		Listener: ln,
-		Logger:   &prefixLogger{logger: s.Logger, prefix: fmt.Sprintf("listener %v: ", ln.Addr())},
+		Logger:   newPrefixLogger(s.Logger, "listener", ln.Addr().String()),
 	}
 
 	s.lock.Lock()
@@ -385,13 +1060,34 @@ func (s *Server) Serve(ln net.Listener) error {
 			return fmt.Errorf("failed to accept connection: %v", err)
 		}
 
-		go s.handle(newNetIRCConn(conn))
+		go s.handle(newNetIRCConn(conn), options)
 	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.serveHTTP(w, req, nil)
+}
+
+// HTTPHandler returns an HTTP handler like ServeHTTP, but which applies the
+// specified per-listener options to WebSocket connections. options may be nil.
+func (s *Server) HTTPHandler(options *ListenerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.serveHTTP(w, req, options)
+	})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request, options *ListenerOptions) {
+	switch req.URL.Path {
+	case "/healthz":
+		s.serveHealth(w, req)
+		return
+	case "/readyz":
+		s.serveReady(w, req)
+		return
+	}
+
 	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
-		Subprotocols:   []string{"text.ircv3.net"}, // non-compliant, fight me
+		Subprotocols:   websocketSubprotocols,
 		OriginPatterns: s.Config().HTTPOrigins,
 	})
 	if err != nil {
@@ -416,7 +1112,34 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	s.handle(newWebsocketIRCConn(conn, remoteAddr))
+	wic := newWebsocketIRCConn(conn, remoteAddr)
+	if interval := s.Config().WebSocketPingInterval; interval > 0 {
+		go wic.pingLoop(interval)
+	}
+	s.handle(wic, options)
+}
+
+// serveHealth reports whether the server is able to reach the database.
+func (s *Server) serveHealth(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.db.Stats(ctx); err != nil {
+		s.Logger.Printf("health check failed: %v", err)
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReady reports whether the server is accepting users, i.e. whether
+// Start has completed and Shutdown hasn't been called yet.
+func (s *Server) serveReady(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
 }
 
 func parseForwarded(h http.Header) map[string]string {
@@ -437,12 +1160,35 @@ type ServerStats struct {
 	Users       int
 	Downstreams int64
 	Upstreams   int64
+	// Number of users whose messages are currently throttled because of the
+	// per-user rate limit
+	ThrottledUsers int
+
+	// Message store statistics, refreshed periodically
+	Messages       int64
+	MessageLogSize int64     // in bytes
+	OldestMessage  time.Time // zero if no message is stored
 }
 
 func (s *Server) Stats() *ServerStats {
 	var stats ServerStats
 	s.lock.Lock()
 	stats.Users = len(s.users)
+	for _, u := range s.users {
+		if u.isThrottled() {
+			stats.ThrottledUsers++
+		}
+		msgStoreStats, _ := u.msgStoreStats.Load().(*messageStoreStats)
+		if msgStoreStats == nil {
+			continue
+		}
+		stats.Messages += msgStoreStats.Messages
+		stats.MessageLogSize += msgStoreStats.Size
+		oldest := msgStoreStats.Oldest
+		if !oldest.IsZero() && (stats.OldestMessage.IsZero() || oldest.Before(stats.OldestMessage)) {
+			stats.OldestMessage = oldest
+		}
+	}
 	s.lock.Unlock()
 	stats.Downstreams = s.metrics.downstreams.Value()
 	stats.Upstreams = s.metrics.upstreams.Value()
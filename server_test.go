@@ -2,8 +2,13 @@ package soju
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/irc.v3"
@@ -53,7 +58,7 @@ func createTestUser(t *testing.T, db Database) *User {
 
 func createTestDownstream(t *testing.T, srv *Server) ircConn {
 	c1, c2 := net.Pipe()
-	go srv.handle(newNetIRCConn(c1))
+	go srv.handle(newNetIRCConn(c1), nil)
 	return newNetIRCConn(c2)
 }
 
@@ -95,6 +100,45 @@ func expectMessage(t *testing.T, c ircConn, cmd string) *irc.Message {
 	return msg
 }
 
+// readUntil reads messages until one matches f.
+func readUntil(t *testing.T, c ircConn, f func(msg *irc.Message) bool) *irc.Message {
+	t.Helper()
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if f(msg) {
+			return msg
+		}
+	}
+}
+
+// readUntilCommand reads messages until one has the command cmd.
+func readUntilCommand(t *testing.T, c ircConn, cmd string) *irc.Message {
+	t.Helper()
+	return readUntil(t, c, func(msg *irc.Message) bool {
+		return msg.Command == cmd
+	})
+}
+
+// sendServiceCommand sends a command to BouncerServ.
+func sendServiceCommand(c ircConn, text string) {
+	c.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, text},
+	})
+}
+
+// readServiceReply reads messages until a reply from BouncerServ.
+func readServiceReply(t *testing.T, c ircConn) string {
+	t.Helper()
+	msg := readUntil(t, c, func(msg *irc.Message) bool {
+		return msg.Command == "PRIVMSG" && msg.Prefix.Name == serviceNick
+	})
+	return msg.Params[1]
+}
+
 func registerDownstreamConn(t *testing.T, c ircConn, network *Network) {
 	c.WriteMessage(&irc.Message{
 		Command: "PASS",
@@ -205,3 +249,1297 @@ func TestServer(t *testing.T) {
 		testServer(t, db)
 	})
 }
+
+func TestServerHealthEndpoints(t *testing.T) {
+	db := createTempSqliteDB(t)
+	srv := NewServer(db)
+
+	expectStatus := func(path string, want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %v: want status %v, got %v", path, want, w.Code)
+		}
+	}
+
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	expectStatus("/healthz", http.StatusOK)
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	expectStatus("/readyz", http.StatusOK)
+
+	srv.Shutdown()
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	expectStatus("/healthz", http.StatusServiceUnavailable)
+}
+
+func TestServerDownstreamIdleTimeout(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	cfg := *srv.Config()
+	cfg.DownstreamIdleTimeout = 50 * time.Millisecond
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	pinged := false
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			break
+		}
+		if msg.Command == "PING" {
+			pinged = true
+		}
+	}
+	if !pinged {
+		t.Errorf("idle connection was closed without being sent a PING")
+	}
+}
+
+func TestServerLabeledResponse(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	network.SplitLongMessages = true
+	if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+		t.Fatalf("failed to store test network: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", "batch labeled-response echo-message"},
+	})
+	expectMessage(t, dc, "CAP")
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+	registerDownstreamConn(t, dc, network)
+
+	dc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"label": "ping"},
+		Command: "PING",
+		Params:  []string{"hello"},
+	})
+	if msg := readUntilCommand(t, dc, "PONG"); msg.Tags["label"] != "ping" {
+		t.Errorf("invalid PONG label: want %q, got: %v", "ping", msg)
+	}
+
+	// The export is sent as multiple replies
+	dc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"label": "export"},
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "user export"},
+	})
+	msg := readUntilCommand(t, dc, "BATCH")
+	if msg.Tags["label"] != "export" || len(msg.Params) < 2 || msg.Params[1] != "labeled-response" {
+		t.Fatalf("invalid labeled BATCH: %v", msg)
+	}
+	ref := strings.TrimPrefix(msg.Params[0], "+")
+	n := 0
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command == "BATCH" && msg.Params[0] == "-"+ref {
+			break
+		}
+		if msg.Tags["batch"] != irc.TagValue(ref) {
+			t.Fatalf("reply outside of the labeled batch: %v", msg)
+		}
+		n++
+	}
+	if n < 2 {
+		t.Errorf("labeled batch has %v replies, want at least 2", n)
+	}
+
+	// A long message is split into multiple upstream messages, their echoes
+	// are sent in a single labeled batch
+	dc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"label": "split"},
+		Command: "PRIVMSG",
+		Params:  []string{"someone", strings.Repeat("split ", 100)},
+	})
+	readUntilCommand(t, uc, "PRIVMSG")
+	readUntilCommand(t, uc, "PRIVMSG")
+	msg = readUntil(t, dc, func(msg *irc.Message) bool {
+		if msg.Command == "PRIVMSG" {
+			t.Fatalf("echo outside of the labeled batch: %v", msg)
+		}
+		return msg.Command == "BATCH"
+	})
+	if msg.Tags["label"] != "split" {
+		t.Fatalf("invalid labeled BATCH: %v", msg)
+	}
+	ref = strings.TrimPrefix(msg.Params[0], "+")
+	n = 0
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command == "BATCH" && msg.Params[0] == "-"+ref {
+			break
+		}
+		if msg.Tags["label"] != "" || msg.Tags["batch"] != irc.TagValue(ref) {
+			t.Fatalf("reply outside of the labeled batch: %v", msg)
+		}
+		if msg.Command == "PRIVMSG" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("labeled batch has %v echoes, want 2", n)
+	}
+
+	// The upstream doesn't support labeled-response: the replies to a
+	// forwarded command can't be labeled, but mustn't be acknowledged as
+	// empty either
+	dc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"label": "forwarded"},
+		Command: "VERSION",
+	})
+	readUntilCommand(t, uc, "VERSION")
+	dc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"label": "sync"},
+		Command: "PING",
+		Params:  []string{"sync"},
+	})
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		if msg.Tags["label"] == "forwarded" {
+			t.Errorf("unexpected labeled reply to a forwarded command: %v", msg)
+		}
+		return msg.Command == "PONG"
+	})
+}
+
+func TestServerResume(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: testUsername, User: testUsername, Host: "localhost"},
+		Command: "JOIN",
+		Params:  []string{"#soju"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_ENDOFNAMES,
+		Params:  []string{testUsername, "#soju", "End of /NAMES list"},
+	})
+
+	connect := func(token string) ircConn {
+		dc := createTestDownstream(t, srv)
+		dc.WriteMessage(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"REQ", "soju.im/resume"},
+		})
+		expectMessage(t, dc, "CAP")
+		if token != "" {
+			dc.WriteMessage(&irc.Message{
+				Command: "RESUME",
+				Params:  []string{token},
+			})
+		}
+		dc.WriteMessage(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"END"},
+		})
+		if token == "" {
+			registerDownstreamConn(t, dc, network)
+		} else {
+			dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+			dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername, "0", "*", testUsername}})
+		}
+		return dc
+	}
+
+	dc := connect("")
+	msg := readUntilCommand(t, dc, "RESUME")
+	if len(msg.Params) != 2 || msg.Params[0] != "TOKEN" {
+		t.Fatalf("invalid RESUME TOKEN: %v", msg)
+	}
+	token := msg.Params[1]
+	readUntilCommand(t, dc, "JOIN")
+	dc.Close()
+
+	dc = connect(token)
+	defer dc.Close()
+	if msg := expectMessage(t, dc, "RESUME"); msg.Params[0] != "SUCCESS" {
+		t.Fatalf("invalid RESUME reply: want SUCCESS, got: %v", msg)
+	}
+	if msg := readUntilCommand(t, dc, "RESUME"); msg.Params[0] != "TOKEN" || msg.Params[1] == token {
+		t.Errorf("invalid new RESUME TOKEN: %v", msg)
+	}
+	dc.WriteMessage(&irc.Message{
+		Command: "PING",
+		Params:  []string{"sentinel"},
+	})
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		if msg.Command == "JOIN" {
+			t.Errorf("unexpected JOIN after resuming: %v", msg)
+		}
+		return msg.Command == "PONG"
+	})
+
+	// Tokens can only be used once
+	other := createTestDownstream(t, srv)
+	defer other.Close()
+	other.WriteMessage(&irc.Message{
+		Command: "RESUME",
+		Params:  []string{token},
+	})
+	if msg := expectMessage(t, other, "FAIL"); msg.Params[1] != "INVALID_TOKEN" {
+		t.Errorf("invalid RESUME reply: want INVALID_TOKEN, got: %v", msg)
+	}
+}
+
+type testEmailVerifier struct {
+	codes chan string
+}
+
+func (v *testEmailVerifier) SendVerificationCode(ctx context.Context, username, email, code string) error {
+	v.codes <- code
+	return nil
+}
+
+func TestServerOnDemand(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	network.OnDemand = true
+	network.OnDemandGrace = 100 * time.Millisecond
+	if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+		t.Fatalf("failed to store test network: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	upstream.(*net.TCPListener).SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if c, err := upstream.Accept(); err == nil {
+		c.Close()
+		t.Fatalf("connected to on-demand network without any client")
+	}
+	upstream.(*net.TCPListener).SetDeadline(time.Time{})
+
+	dc := createTestDownstream(t, srv)
+	registerDownstreamConn(t, dc, network)
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc.Close()
+
+	for {
+		if _, err := uc.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestServerAccountRegistration(t *testing.T) {
+	db := createTempSqliteDB(t)
+	verifier := &testEmailVerifier{codes: make(chan string, 1)}
+
+	srv := NewServer(db)
+	srv.EmailVerifier = verifier
+	cfg := *srv.Config()
+	cfg.OpenRegistration = true
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+
+	dc.WriteMessage(&irc.Message{
+		Command: "REGISTER",
+		Params:  []string{testUsername, "*", testPassword},
+	})
+	if msg := expectMessage(t, dc, "FAIL"); msg.Params[1] != "INVALID_EMAIL" {
+		t.Fatalf("invalid REGISTER reply: want INVALID_EMAIL, got: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "REGISTER",
+		Params:  []string{testUsername, "user@example.org", testPassword},
+	})
+	if msg := expectMessage(t, dc, "REGISTER"); msg.Params[0] != "VERIFICATION_REQUIRED" {
+		t.Fatalf("invalid REGISTER reply: want VERIFICATION_REQUIRED, got: %v", msg)
+	}
+	code := <-verifier.codes
+
+	dc.WriteMessage(&irc.Message{
+		Command: "VERIFY",
+		Params:  []string{testUsername, "invalid"},
+	})
+	if msg := expectMessage(t, dc, "FAIL"); msg.Params[1] != "INVALID_CODE" {
+		t.Fatalf("invalid VERIFY reply: want INVALID_CODE, got: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "VERIFY",
+		Params:  []string{testUsername, code},
+	})
+	if msg := expectMessage(t, dc, "VERIFY"); msg.Params[0] != "SUCCESS" {
+		t.Fatalf("invalid VERIFY reply: want SUCCESS, got: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "NICK",
+		Params:  []string{testUsername},
+	})
+	dc.WriteMessage(&irc.Message{
+		Command: "USER",
+		Params:  []string{testUsername, "0", "*", testUsername},
+	})
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	if _, err := db.GetUser(context.Background(), testUsername); err != nil {
+		t.Errorf("registered user not found in database: %v", err)
+	}
+}
+
+func TestServerBacklogDeduplication(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	// Two instances sharing the database and the logs: the delivery receipts
+	// of the second one are only updated from the database
+	logPath := t.TempDir()
+	startServer := func() (*Server, ircConn) {
+		srv := NewServer(db)
+		cfg := *srv.Config()
+		cfg.LogPath = logPath
+		srv.SetConfig(&cfg)
+		if err := srv.Start(); err != nil {
+			t.Fatalf("failed to start server: %v", err)
+		}
+		uc := mustAccept(t, upstream)
+		registerUpstreamConn(t, uc)
+		return srv, uc
+	}
+	srv, uc := startServer()
+	defer srv.Shutdown()
+	defer uc.Close()
+
+	const clientName = "laptop"
+	connect := func(srv *Server) ircConn {
+		dc := createTestDownstream(t, srv)
+		dc.WriteMessage(&irc.Message{
+			Command: "PASS",
+			Params:  []string{testPassword},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "NICK",
+			Params:  []string{testUsername},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "USER",
+			Params:  []string{testUsername + "@" + clientName + "/" + network.Name, "0", "*", testUsername},
+		})
+		expectMessage(t, dc, irc.RPL_WELCOME)
+		return dc
+	}
+	// readPRIVMSGs returns the text of the PRIVMSG messages received until
+	// the PONG reply to a sentinel PING, acknowledging the messages.
+	readPRIVMSGs := func(dc ircConn) []string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PING",
+			Params:  []string{"sentinel"},
+		})
+		var texts []string
+		for {
+			msg, err := dc.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read IRC message: %v", err)
+			}
+			switch msg.Command {
+			case "PRIVMSG":
+				texts = append(texts, msg.Params[1])
+			case "PING":
+				dc.WriteMessage(&irc.Message{
+					Command: "PONG",
+					Params:  msg.Params,
+				})
+			case "PONG":
+				if msg.Params[len(msg.Params)-1] == "sentinel" {
+					return texts
+				}
+			}
+		}
+	}
+	sendPRIVMSG := func(text string) {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "alice", User: "alice", Host: "localhost"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+	}
+
+	logs := newFSMessageStore(logPath, user)
+	defer logs.Close()
+	lastID := func() string {
+		id, err := logs.LastMsgID(network, "alice", time.Now())
+		if err != nil {
+			t.Fatalf("failed to get last message ID: %v", err)
+		}
+		return id
+	}
+	waitLogged := func(prevID string) string {
+		for i := 0; i < 100; i++ {
+			if id := lastID(); id != prevID {
+				return id
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for message to be logged")
+		return ""
+	}
+	// waitReceipt waits for the delivery receipt to be stored in the
+	// database, past the message ID prevID
+	waitReceipt := func(prevID string) {
+		for i := 0; i < 100; i++ {
+			receipts, err := db.ListDeliveryReceipts(context.Background(), network.ID)
+			if err != nil {
+				t.Fatalf("failed to list delivery receipts: %v", err)
+			}
+			for _, rcpt := range receipts {
+				if rcpt.Client != clientName || rcpt.Target != "alice" {
+					continue
+				}
+				if cmp, err := compareFSMsgIDs(rcpt.InternalMsgID, prevID); err == nil && cmp > 0 {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for delivery receipt to be stored")
+	}
+
+	dc := connect(srv)
+	readPRIVMSGs(dc)
+	prevID := lastID()
+	sendPRIVMSG("first")
+	firstID := waitLogged(prevID)
+	if texts := readPRIVMSGs(dc); len(texts) != 1 || texts[0] != "first" {
+		t.Fatalf("invalid messages received: want [first], got %q", texts)
+	}
+	dc.Close()
+	waitReceipt(prevID)
+
+	other, otherUC := startServer()
+	defer other.Shutdown()
+	defer otherUC.Close()
+
+	// Disconnect in the middle of the backlog
+	var beforeLastID string
+	prevID = firstID
+	for _, text := range []string{"second", "third", "fourth"} {
+		sendPRIVMSG(text)
+		beforeLastID = prevID
+		prevID = waitLogged(prevID)
+	}
+	dc = connect(srv)
+	dc.Close()
+	waitReceipt(beforeLastID)
+
+	// The backlog has already been sent by the first instance
+	dc = connect(other)
+	defer dc.Close()
+	if texts := readPRIVMSGs(dc); len(texts) != 0 {
+		t.Errorf("already delivered messages replayed: %q", texts)
+	}
+}
+
+func TestServerLimitedAdmin(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	user.LimitedAdmin = true
+	if err := db.StoreUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to store test user: %v", err)
+	}
+	other := &User{Username: "other"}
+	if err := db.StoreUser(context.Background(), other); err != nil {
+		t.Fatalf("failed to store other user: %v", err)
+	}
+	ownedAdmin := &User{Username: "owned-admin", Admin: true, Owner: user.ID}
+	if err := db.StoreUser(context.Background(), ownedAdmin); err != nil {
+		t.Fatalf("failed to store owned admin user: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+	dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+	dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername, "0", "*", testUsername}})
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	sendCommand := func(text string) string {
+		t.Helper()
+		sendServiceCommand(dc, text)
+		return readServiceReply(t, dc)
+	}
+
+	if reply := sendCommand("user create -username owned -password hunter22"); !strings.HasPrefix(reply, "created user") {
+		t.Errorf("user create: want success, got %q", reply)
+	}
+	if reply := sendCommand("user create -username evil -password hunter22 -admin"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("user create -admin: want error, got %q", reply)
+	}
+	if reply := sendCommand("user update other -password hunter22"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("user update of unowned user: want error, got %q", reply)
+	}
+	if reply := sendCommand("user delete other"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("user delete of unowned user: want error, got %q", reply)
+	}
+	if reply := sendCommand("user update owned -password hunter23"); !strings.HasPrefix(reply, "updated user") {
+		t.Errorf("user update of owned user: want success, got %q", reply)
+	}
+	if reply := sendCommand("user delete owned"); !strings.HasPrefix(reply, "deleted user") {
+		t.Errorf("user delete of owned user: want success, got %q", reply)
+	}
+	for _, cmd := range []string{
+		"user update owned-admin -password hunter22",
+		"user rename owned-admin renamed",
+		"user delete owned-admin",
+		"user export owned-admin",
+	} {
+		if reply := sendCommand(cmd); !strings.HasPrefix(reply, "error:") {
+			t.Errorf("%v: want error for an owned admin, got %q", cmd, reply)
+		}
+	}
+	if reply := sendCommand("user update -password hunter24"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("user update -password of own user: want error, got %q", reply)
+	}
+	if reply := sendCommand("server status"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("server status: want error, got %q", reply)
+	}
+}
+
+func TestServerPostLocalMessage(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	user.Admin = true
+	if err := db.StoreUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to store test user: %v", err)
+	}
+
+	srv := NewServer(db)
+	// An unbuffered events channel makes the service command block if it
+	// tries to post to its own user through the channel
+	cfg := *srv.Config()
+	cfg.UserEventQueueSize = 0
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+	dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+	dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername + "/*", "0", "*", testUsername}})
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "server post &notify hello"},
+	})
+
+	posted := false
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command != "PRIVMSG" {
+			continue
+		}
+		if msg.Params[0] == "&notify" {
+			if msg.Params[1] != "hello" {
+				t.Errorf("invalid local message: got %v", msg)
+			}
+			posted = true
+		} else if msg.Prefix.Name == serviceNick {
+			if !strings.HasPrefix(msg.Params[1], "posted message") {
+				t.Fatalf("server post: want success, got %q", msg.Params[1])
+			}
+			break
+		}
+	}
+	if !posted {
+		t.Errorf("local message not delivered")
+	}
+}
+
+func TestServerMultiline(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", "batch labeled-response draft/multiline"},
+	})
+	if msg := expectMessage(t, dc, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("draft/multiline not acknowledged: %v", msg)
+	}
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+	registerDownstreamConn(t, dc, network)
+
+	// Another client, receiving the messages sent by the first one
+	other := createTestDownstream(t, srv)
+	defer other.Close()
+	other.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", "batch draft/multiline"},
+	})
+	expectMessage(t, other, "CAP")
+	other.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+	registerDownstreamConn(t, other, network)
+
+	sendBatch := func(ref string, tags irc.Tags, lines ...*irc.Message) {
+		dc.WriteMessage(&irc.Message{
+			Tags:    tags,
+			Command: "BATCH",
+			Params:  []string{"+" + ref, "draft/multiline", "#test"},
+		})
+		for _, msg := range lines {
+			if msg.Tags == nil {
+				msg.Tags = irc.Tags{}
+			}
+			msg.Tags["batch"] = irc.TagValue(ref)
+			dc.WriteMessage(msg)
+		}
+		dc.WriteMessage(&irc.Message{
+			Command: "BATCH",
+			Params:  []string{"-" + ref},
+		})
+	}
+	line := func(text string, concat bool) *irc.Message {
+		msg := &irc.Message{Command: "PRIVMSG", Params: []string{"#test", text}}
+		if concat {
+			msg.Tags = irc.Tags{"draft/multiline-concat": ""}
+		}
+		return msg
+	}
+
+	// The upstream doesn't support multiline messages: each line is sent
+	// separately, concatenated lines being merged and blank lines skipped
+	sendBatch("a", irc.Tags{"label": "multiline"},
+		line("hello", false),
+		line("wor", false),
+		line("ld", true),
+		line("", false),
+		line("bye", false),
+	)
+	for _, want := range []string{"hello", "world", "bye"} {
+		msg := readUntil(t, uc, func(msg *irc.Message) bool { return msg.Command == "PRIVMSG" })
+		if msg.Params[0] != "#test" || msg.Params[1] != want {
+			t.Errorf("invalid upstream PRIVMSG: want %q, got: %v", want, msg)
+		}
+		if _, ok := msg.Tags["batch"]; ok {
+			t.Errorf("batch tag leaked upstream: %v", msg)
+		}
+	}
+
+	// The label of the opening BATCH applies to the whole batch
+	msg := readUntil(t, dc, func(msg *irc.Message) bool { return msg.Tags["label"] != "" })
+	if msg.Tags["label"] != "multiline" {
+		t.Errorf("invalid label: want %q, got: %v", "multiline", msg)
+	}
+
+	// Other clients receive the message as a whole, blank lines included
+	msg = readUntil(t, other, func(msg *irc.Message) bool { return msg.Command == "BATCH" })
+	if len(msg.Params) < 3 || msg.Params[1] != "draft/multiline" || msg.Params[2] != "#test" {
+		t.Fatalf("invalid multiline BATCH: %v", msg)
+	}
+	for _, want := range []string{"hello", "world", "", "bye"} {
+		msg := expectMessage(t, other, "PRIVMSG")
+		if msg.Params[1] != want {
+			t.Errorf("invalid multiline PRIVMSG: want %q, got: %v", want, msg)
+		}
+	}
+	expectMessage(t, other, "BATCH")
+
+	// Batches exceeding the limits are rejected as a whole
+	var lines []*irc.Message
+	for i := 0; i <= downstreamMultilineMaxLines; i++ {
+		lines = append(lines, line("spam", false))
+	}
+	sendBatch("b", nil, lines...)
+	msg = readUntil(t, dc, func(msg *irc.Message) bool { return msg.Command == "FAIL" })
+	if msg.Params[1] != "MULTILINE_MAX_LINES" {
+		t.Errorf("invalid FAIL: want MULTILINE_MAX_LINES, got: %v", msg)
+	}
+
+	lines = nil
+	long := strings.Repeat("a", 400)
+	for i := 0; i <= downstreamMultilineMaxBytes/len(long); i++ {
+		lines = append(lines, line(long, false))
+	}
+	sendBatch("c", nil, lines...)
+	msg = readUntil(t, dc, func(msg *irc.Message) bool { return msg.Command == "FAIL" })
+	if msg.Params[1] != "MULTILINE_MAX_BYTES" {
+		t.Errorf("invalid FAIL: want MULTILINE_MAX_BYTES, got: %v", msg)
+	}
+
+	// None of the lines of the rejected batches are sent upstream
+	dc.WriteMessage(&irc.Message{Command: "PRIVMSG", Params: []string{"#test", "done"}})
+	msg = readUntil(t, uc, func(msg *irc.Message) bool { return msg.Command == "PRIVMSG" })
+	if msg.Params[1] != "done" {
+		t.Errorf("line of rejected batch sent upstream: %v", msg)
+	}
+}
+
+func TestServerUserExportImport(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network := &Network{
+		Name:        "testnet",
+		Addr:        "irc+insecure://localhost:6667",
+		Realname:    strings.Repeat("r", 100),
+		AwayMessage: strings.Repeat("a", 200),
+		CTCPVersion: strings.Repeat(`v'\`, 100),
+	}
+	if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+		t.Fatalf("failed to store test network: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+	dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+	dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername, "0", "*", testUsername}})
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	// Collects the BouncerServ replies to the commands sent before
+	readReplies := func() []string {
+		t.Helper()
+		dc.WriteMessage(&irc.Message{Command: "PING", Params: []string{"sync"}})
+		var replies []string
+		for {
+			msg, err := dc.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read IRC message: %v", err)
+			}
+			if msg.Command == "PONG" {
+				return replies
+			}
+			if msg.Command == "PRIVMSG" && msg.Prefix.Name == serviceNick {
+				replies = append(replies, msg.Params[1])
+			}
+		}
+	}
+
+	sendServiceCommand(dc, "user export")
+	lines := readReplies()
+	if len(lines) < 3 {
+		t.Fatalf("user export: want the network record to be split, got %q", lines)
+	}
+	for _, line := range lines {
+		msg := &irc.Message{Command: "PRIVMSG", Params: []string{serviceNick, line}}
+		if n := len(msg.String()); n > maxMessageLength-len("\r\n") {
+			t.Errorf("user export: %v bytes line: %q", n, line)
+		}
+	}
+
+	sendServiceCommand(dc, "network delete testnet")
+	readReplies()
+
+	for _, line := range lines {
+		sendServiceCommand(dc, line)
+	}
+	replies := readReplies()
+	if len(replies) != 2 || !strings.HasPrefix(replies[1], "imported network") {
+		t.Fatalf("user import: got %q", replies)
+	}
+
+	networks, err := db.ListNetworks(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+	if len(networks) != 1 || networks[0].CTCPVersion != network.CTCPVersion || networks[0].AwayMessage != network.AwayMessage {
+		t.Errorf("user import: network not restored: %+v", networks)
+	}
+
+	// Imported records are checked like "network update" flags
+	for _, field := range []string{`"message_burst":1000`, `"message_delay":"1ns"`, `"connect_timeout":"-1s"`} {
+		sendServiceCommand(dc, "user import "+quoteServiceWord(`{"type":"network","name":"other","addr":"irc+insecure://localhost:6667",`+field+`}`))
+		if replies := readReplies(); len(replies) != 1 || !strings.HasPrefix(replies[0], "error:") {
+			t.Errorf("user import with %v: want error, got %q", field, replies)
+		}
+	}
+
+	// Each imported network counts against the network change rate
+	cfg := *srv.Config()
+	cfg.NetworkChangeDelay = time.Hour
+	cfg.NetworkChangeBurst = 1
+	srv.SetConfig(&cfg)
+	for i, name := range []string{"first", "second"} {
+		sendServiceCommand(dc, "user import "+quoteServiceWord(`{"type":"network","name":"`+name+`","addr":"irc+insecure://localhost:6667"}`))
+		replies := readReplies()
+		if i == 0 && (len(replies) != 1 || !strings.HasPrefix(replies[0], "imported network")) {
+			t.Errorf("user import of %v: want success, got %q", name, replies)
+		} else if i > 0 && (len(replies) != 1 || !strings.HasPrefix(replies[0], "error:")) {
+			t.Errorf("user import of %v: want error, got %q", name, replies)
+		}
+	}
+}
+
+func TestServerMaxDownstreams(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	user.MaxDownstreams = 1
+	if err := db.StoreUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to store test user: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	register := func() ircConn {
+		dc := createTestDownstream(t, srv)
+		dc.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+		dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+		dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername, "0", "*", testUsername}})
+		return dc
+	}
+
+	dc := register()
+	defer dc.Close()
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	rejected := register()
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntilCommand(t, rejected, "ERROR")
+}
+
+func TestServerMultipleNetworks(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	otherUpstream, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	defer otherUpstream.Close()
+	otherNetwork := &Network{
+		Name:    "othernet",
+		Addr:    "irc+insecure://" + otherUpstream.Addr().String(),
+		Nick:    user.Username,
+		Enabled: true,
+	}
+	if err := db.StoreNetwork(context.Background(), user.ID, otherNetwork); err != nil {
+		t.Fatalf("failed to store test network: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	otherUC := mustAccept(t, otherUpstream)
+	defer otherUC.Close()
+	registerUpstreamConn(t, otherUC)
+
+	// The first downstream connection is bound to another network, it must
+	// not prevent the second one from receiving messages
+	otherDC := createTestDownstream(t, srv)
+	defer otherDC.Close()
+	registerDownstreamConn(t, otherDC, otherNetwork)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	noticeText := "This is a very important server notice."
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "NOTICE",
+		Params:  []string{testUsername, noticeText},
+	})
+
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		return msg.Command == "NOTICE" && msg.Params[1] == noticeText
+	})
+}
+
+func TestServerRestoredChannels(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreChannel(context.Background(), network.ID, &Channel{Name: "#soju"}); err != nil {
+		t.Fatalf("failed to store test channel: %v", err)
+	}
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+
+	// The upstream connection isn't registered yet, the saved channel is
+	// restored
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		return msg.Command == "JOIN" && msg.Params[0] == "#soju"
+	})
+
+	registerUpstreamConn(t, uc)
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntilCommand(t, uc, "JOIN")
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: testUsername, User: "soju", Host: "soju.example"},
+		Command: "JOIN",
+		Params:  []string{"#soju"},
+	})
+	noticeText := "Joined."
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "NOTICE",
+		Params:  []string{testUsername, noticeText},
+	})
+
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		if msg.Command == "JOIN" {
+			t.Fatalf("unexpected duplicate JOIN: %v", msg)
+		}
+		return msg.Command == "NOTICE" && msg.Params[1] == noticeText
+	})
+}
+
+func TestServerMultilineUpstream(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	expectMessage(t, uc, "CAP")
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "CAP",
+		Params:  []string{"*", "LS", "batch echo-message labeled-response message-tags draft/multiline=max-bytes=4096,max-lines=10"},
+	})
+	msg := readUntil(t, uc, func(msg *irc.Message) bool {
+		return msg.Command == "CAP" && msg.Params[0] == "REQ"
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "CAP",
+		Params:  []string{"*", "ACK", msg.Params[1]},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_WELCOME,
+		Params:  []string{testUsername, "Welcome!"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.ERR_NOMOTD,
+		Params:  []string{testUsername, "No MOTD"},
+	})
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", "batch echo-message draft/multiline"},
+	})
+	expectMessage(t, dc, "CAP")
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+	registerDownstreamConn(t, dc, network)
+
+	// message-tags depends on the upstream, it's only available once
+	// registered
+	dc.WriteMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", "message-tags"},
+	})
+	if msg := readUntilCommand(t, dc, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("message-tags not acknowledged: %v", msg)
+	}
+
+	// The batch is relayed as-is to the upstream
+	dc.WriteMessage(&irc.Message{
+		Command: "BATCH",
+		Params:  []string{"+a", "draft/multiline", "#test"},
+	})
+	for _, text := range []string{"hello", "", "world"} {
+		dc.WriteMessage(&irc.Message{
+			Tags:    irc.Tags{"batch": "a"},
+			Command: "PRIVMSG",
+			Params:  []string{"#test", text},
+		})
+	}
+	dc.WriteMessage(&irc.Message{
+		Command: "BATCH",
+		Params:  []string{"-a"},
+	})
+
+	start := readUntil(t, uc, func(msg *irc.Message) bool { return msg.Command == "BATCH" })
+	if len(start.Params) < 3 || start.Params[1] != "draft/multiline" || start.Params[2] != "#test" {
+		t.Fatalf("invalid upstream BATCH: %v", start)
+	}
+	ref := strings.TrimPrefix(start.Params[0], "+")
+	var lines []*irc.Message
+	for {
+		msg := readUntil(t, uc, func(*irc.Message) bool { return true })
+		if msg.Command == "BATCH" {
+			break
+		}
+		if msg.Tags["batch"] != irc.TagValue(ref) {
+			t.Errorf("line not in the upstream batch: %v", msg)
+		}
+		lines = append(lines, msg)
+	}
+	if len(lines) != 3 || lines[1].Params[1] != "" {
+		t.Fatalf("invalid upstream batch lines: %v", lines)
+	}
+
+	// The echoed batch is relayed to the client as a single message, with
+	// the upstream message ID
+	prefix := &irc.Prefix{Name: testUsername, User: testUsername, Host: "localhost"}
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"msgid": "upstream-id", "label": start.Tags["label"]},
+		Prefix:  prefix,
+		Command: "BATCH",
+		Params:  []string{"+echo", "draft/multiline", "#test"},
+	})
+	for _, l := range lines {
+		uc.WriteMessage(&irc.Message{
+			Tags:    irc.Tags{"batch": "echo"},
+			Prefix:  prefix,
+			Command: l.Command,
+			Params:  l.Params,
+		})
+	}
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "BATCH",
+		Params:  []string{"-echo"},
+	})
+
+	msg = readUntil(t, dc, func(msg *irc.Message) bool { return msg.Command == "BATCH" })
+	if len(msg.Params) < 3 || msg.Params[1] != "draft/multiline" {
+		t.Fatalf("invalid multiline BATCH: %v", msg)
+	}
+	if msg.Tags["msgid"] != "upstream-id" {
+		t.Errorf("invalid msgid: want %q, got: %v", "upstream-id", msg)
+	}
+	for _, want := range []string{"hello", "", "world"} {
+		msg := expectMessage(t, dc, "PRIVMSG")
+		if msg.Params[1] != want {
+			t.Errorf("invalid multiline PRIVMSG: want %q, got: %v", want, msg)
+		}
+	}
+	expectMessage(t, dc, "BATCH")
+}
+
+func TestServerNetworkUpdateInPlace(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	// Metadata changes are applied without re-connecting to the upstream
+	// server
+	sendServiceCommand(dc, "network update testnet -group work -order 2")
+	if reply := readServiceReply(t, dc); !strings.HasPrefix(reply, "updated network") {
+		t.Fatalf("network update: want success, got %q", reply)
+	}
+
+	dc.WriteMessage(&irc.Message{Command: "PRIVMSG", Params: []string{"#test", "still here"}})
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := readUntil(t, uc, func(msg *irc.Message) bool {
+		return msg.Command == "PRIVMSG" || msg.Command == "QUIT"
+	})
+	if msg.Command != "PRIVMSG" {
+		t.Fatalf("upstream connection closed by the network update: %v", msg)
+	}
+
+	networks, err := db.ListNetworks(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+	if len(networks) != 1 || networks[0].Group != "work" || networks[0].SortOrder != 2 {
+		t.Errorf("network update: record not stored: %+v", networks)
+	}
+}
+
+func TestServerSlowDownstream(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	// This client stops reading once registered
+	slow := createTestDownstream(t, srv)
+	defer slow.Close()
+	registerDownstreamConn(t, slow, network)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	const n = 500
+	go func() {
+		for i := 0; i < n; i++ {
+			uc.WriteMessage(&irc.Message{
+				Prefix:  &irc.Prefix{Name: "alice", User: "alice", Host: "localhost"},
+				Command: "PRIVMSG",
+				Params:  []string{testUsername, fmt.Sprintf("message %v", i)},
+			})
+		}
+	}()
+
+	// The other client isn't delayed until the slow one times out
+	last := fmt.Sprintf("message %v", n-1)
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntil(t, dc, func(msg *irc.Message) bool {
+		return msg.Command == "PRIVMSG" && msg.Params[1] == last
+	})
+}
@@ -6,19 +6,26 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/irc.v3"
+
+	"git.sr.ht/~emersion/soju/config"
 )
 
 const serviceNick = "BouncerServ"
@@ -43,6 +50,13 @@ type serviceCommand struct {
 	handle   func(ctx context.Context, dc *downstreamConn, params []string) error
 	children serviceCommandSet
 	admin    bool
+	// Whether limited admins can use the command, on the users they own
+	limitedAdmin bool
+}
+
+// allowed checks whether a user has the privileges required by a command.
+func (cmd *serviceCommand) allowed(u *User) bool {
+	return !cmd.admin || u.Admin || (cmd.limitedAdmin && u.LimitedAdmin)
 }
 
 func sendServiceNOTICE(dc *downstreamConn, text string) {
@@ -61,6 +75,19 @@ func sendServicePRIVMSG(dc *downstreamConn, text string) {
 	})
 }
 
+// sendServiceError reports a failed BouncerServ command. Clients which
+// support standard replies receive a machine-readable FAIL message, others
+// a regular PRIVMSG.
+func sendServiceError(dc *downstreamConn, code, text string) {
+	if dc.caps.IsEnabled("standard-replies") {
+		msg := newStandardReply("FAIL", "PRIVMSG", code, serviceNick, text)
+		msg.Prefix = dc.srv.prefix()
+		dc.SendMessage(msg)
+		return
+	}
+	sendServicePRIVMSG(dc, "error: "+text)
+}
+
 func splitWords(s string) ([]string, error) {
 	var words []string
 	var lastWord strings.Builder
@@ -117,24 +144,24 @@ func splitWords(s string) ([]string, error) {
 func handleServicePRIVMSG(ctx context.Context, dc *downstreamConn, text string) {
 	words, err := splitWords(text)
 	if err != nil {
-		sendServicePRIVMSG(dc, fmt.Sprintf(`error: failed to parse command: %v`, err))
+		sendServiceError(dc, "INVALID_COMMAND", fmt.Sprintf("failed to parse command: %v", err))
 		return
 	}
 
 	cmd, params, err := serviceCommands.Get(words)
 	if err != nil {
-		sendServicePRIVMSG(dc, fmt.Sprintf(`error: %v (type "help" for a list of commands)`, err))
+		sendServiceError(dc, "UNKNOWN_COMMAND", fmt.Sprintf(`%v (type "help" for a list of commands)`, err))
 		return
 	}
-	if cmd.admin && !dc.user.Admin {
-		sendServicePRIVMSG(dc, "error: you must be an admin to use this command")
+	if !cmd.allowed(&dc.user.User) {
+		sendServiceError(dc, "ADMIN_REQUIRED", "you must be an admin to use this command")
 		return
 	}
 
 	if cmd.handle == nil {
 		if len(cmd.children) > 0 {
 			var l []string
-			appendServiceCommandSetHelp(cmd.children, words, dc.user.Admin, &l)
+			appendServiceCommandSetHelp(cmd.children, words, &dc.user.User, &l)
 			sendServicePRIVMSG(dc, "available commands: "+strings.Join(l, ", "))
 		} else {
 			// Pretend the command does not exist if it has neither children nor handler.
@@ -146,7 +173,7 @@ func handleServicePRIVMSG(ctx context.Context, dc *downstreamConn, text string)
 	}
 
 	if err := cmd.handle(ctx, dc, params); err != nil {
-		sendServicePRIVMSG(dc, fmt.Sprintf("error: %v", err))
+		sendServiceError(dc, "COMMAND_FAILED", err.Error())
 	}
 }
 
@@ -206,16 +233,21 @@ func init() {
 		"network": {
 			children: serviceCommandSet{
 				"create": {
-					usage:  "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-connect-command command]...",
+					usage:  "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-no-logging no-logging] [-sasl-passthrough sasl-passthrough] [-message-delay delay] [-connect-timeout timeout] [-message-burst burst] [-charset charset] [-group group] [-order order] [-tls-fingerprint fingerprint] [-split-long-messages split-long-messages] [-ctcp-auto-reply ctcp-auto-reply] [-ctcp-version version] [-ctcp-source source] [-passthrough passthrough] [-no-auto-detach no-auto-detach] [-no-auto-away no-auto-away] [-away-message message] [-connect-command command]... [-fallback-nick nick]... [-motd motd] [-server-notices relay|drop|redirect] [-server-notice-allow pattern]... [-server-notice-deny pattern]... [-on-demand on-demand] [-on-demand-grace duration] [-webirc-password password] [-webirc-gateway gateway] [-join-delay delay] [-join-batch count] [-tls-min-version version] [-correct-server-time correct-server-time]",
 					desc:   "add a new network",
 					handle: handleServiceNetworkCreate,
 				},
+				"test": {
+					usage:  "[name] [-addr addr] [options...]",
+					desc:   "check connecting to a network without saving it",
+					handle: handleServiceNetworkTest,
+				},
 				"status": {
 					desc:   "show a list of saved networks and their current status",
 					handle: handleServiceNetworkStatus,
 				},
 				"update": {
-					usage:  "[name] [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-connect-command command]...",
+					usage:  "[name] [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-nick nick] [-enabled enabled] [-no-logging no-logging] [-sasl-passthrough sasl-passthrough] [-message-delay delay] [-connect-timeout timeout] [-message-burst burst] [-charset charset] [-group group] [-order order] [-tls-fingerprint fingerprint] [-split-long-messages split-long-messages] [-ctcp-auto-reply ctcp-auto-reply] [-ctcp-version version] [-ctcp-source source] [-passthrough passthrough] [-no-auto-detach no-auto-detach] [-no-auto-away no-auto-away] [-away-message message] [-connect-command command]... [-fallback-nick nick]... [-motd motd] [-server-notices relay|drop|redirect] [-server-notice-allow pattern]... [-server-notice-deny pattern]... [-on-demand on-demand] [-on-demand-grace duration] [-webirc-password password] [-webirc-gateway gateway] [-join-delay delay] [-join-batch count] [-tls-min-version version] [-correct-server-time correct-server-time]",
 					desc:   "update a network",
 					handle: handleServiceNetworkUpdate,
 				},
@@ -224,11 +256,45 @@ func init() {
 					desc:   "delete a network",
 					handle: handleServiceNetworkDelete,
 				},
+				"reconnect": {
+					usage:  "[name]",
+					desc:   "connect to a network right away, resetting the reconnection delay",
+					handle: handleServiceNetworkReconnect,
+				},
+				"disconnect": {
+					usage:  "[name]",
+					desc:   "disconnect from a network until the next reconnect",
+					handle: handleServiceNetworkDisconnect,
+				},
 				"quote": {
 					usage:  "[name] <command>",
 					desc:   "send a raw line to a network",
 					handle: handleServiceNetworkQuote,
 				},
+				"features": {
+					usage:  "[name]",
+					desc:   "show the ISUPPORT tokens and capabilities advertised by a network",
+					handle: handleServiceNetworkFeatures,
+				},
+			},
+		},
+		"autojoin": {
+			children: serviceCommandSet{
+				"list": {
+					usage:  "[-network name]",
+					desc:   "show the list of channels joined on connect",
+					handle: handleServiceAutoJoinList,
+				},
+				"add": {
+					usage:  "[-network name] <channel> [key]",
+					desc:   "join a channel each time the network is connected",
+					handle: handleServiceAutoJoinAdd,
+				},
+				"remove": {
+					usage:  "[-network name] <channel>",
+					desc:   "stop joining a channel on connect",
+					handle: handleServiceAutoJoinRemove,
+				},
 			},
 		},
 		"certfp": {
@@ -253,10 +319,20 @@ func init() {
 					handle: handleServiceSASLStatus,
 				},
 				"set-plain": {
-					usage:  "[-network name] <username> <password>",
+					usage:  "[-network name] [-authzid identity] <username> <password>",
 					desc:   "set SASL PLAIN credentials",
 					handle: handleServiceSASLSetPlain,
 				},
+				"set-scram": {
+					usage:  "[-network name] <username> <password>",
+					desc:   "set SASL SCRAM-SHA-256 credentials",
+					handle: handleServiceSASLSetSCRAM,
+				},
+				"set-priority": {
+					usage:  "[-network name] [mechanism...]",
+					desc:   "set the ordered list of SASL mechanisms to attempt",
+					handle: handleServiceSASLSetPriority,
+				},
 				"reset": {
 					usage:  "[-network name]",
 					desc:   "disable SASL authentication and remove stored credentials",
@@ -264,25 +340,115 @@ func init() {
 				},
 			},
 		},
+		"nickserv": {
+			children: serviceCommandSet{
+				"status": {
+					usage:  "[-network name]",
+					desc:   "show NickServ identification status",
+					handle: handleServiceNickServStatus,
+				},
+				"set": {
+					usage:  "[-network name] [-nick nick] [-command template] <password>",
+					desc:   "set credentials to identify with NickServ when SASL isn't available",
+					handle: handleServiceNickServSet,
+				},
+				"reset": {
+					usage:  "[-network name]",
+					desc:   "disable NickServ identification and remove stored credentials",
+					handle: handleServiceNickServReset,
+				},
+			},
+		},
 		"user": {
 			children: serviceCommandSet{
 				"create": {
-					usage:  "-username <username> -password <password> [-realname <realname>] [-admin]",
-					desc:   "create a new soju user",
-					handle: handleUserCreate,
-					admin:  true,
+					usage:        "-username <username> -password <password> [-realname <realname>] [-timezone <timezone>] [-motd <motd>] [-log-ignored <true|false>] [-max-downstreams <limit>] [-upstream-ip <ips>] [-log-quota <size>] [-backlog-limit <count>] [-msg-store <store>] [-network-change-delay <delay>] [-admin] [-limited-admin] [-owner <username|#id>]",
+					desc:         "create a new soju user",
+					handle:       handleUserCreate,
+					admin:        true,
+					limitedAdmin: true,
 				},
 				"update": {
-					usage:  "[-password <password>] [-realname <realname>]",
+					usage:  "[-password <password>] [-realname <realname>] [-timezone <timezone>] [-motd <motd>] [-log-ignored <true|false>] [-max-downstreams <limit>] [-upstream-ip <ips>] [-log-quota <size>] [-backlog-limit <count>] [-msg-store <store>] [-network-change-delay <delay>]",
 					desc:   "update the current user",
 					handle: handleUserUpdate,
 				},
+				"password": {
+					usage:  "[-keep-session <true|false>] <old password> <new password>",
+					desc:   "change the password of the current user",
+					handle: handleUserPassword,
+				},
 				"delete": {
-					usage:  "<username>",
-					desc:   "delete a user",
-					handle: handleUserDelete,
+					usage:        "<username|#id>",
+					desc:         "delete a user",
+					handle:       handleUserDelete,
+					admin:        true,
+					limitedAdmin: true,
+				},
+				"rename": {
+					usage:        "<username|#id> <new username>",
+					desc:         "change the username of a user",
+					handle:       handleUserRename,
+					admin:        true,
+					limitedAdmin: true,
+				},
+				"debug": {
+					usage:  "<username|#id> <true|false>",
+					desc:   "toggle debug logging for a user",
+					handle: handleUserDebug,
 					admin:  true,
 				},
+				"purge-logs": {
+					usage:  "[-network name] [-target name] [confirmation token]",
+					desc:   "permanently delete the stored messages of the current user",
+					handle: handleUserPurgeLogs,
+				},
+				"export": {
+					usage:  "[username|#id] [-secrets]",
+					desc:   "export user settings, networks and channels as import commands",
+					handle: handleUserExport,
+				},
+				"import": {
+					usage:  "[-part] <record>",
+					desc:   "import a record produced by user export",
+					handle: handleUserImport,
+				},
+				"certfp": {
+					children: serviceCommandSet{
+						"list": {
+							desc:   "show the client certificate fingerprints accepted for SASL EXTERNAL",
+							handle: handleUserCertFPList,
+						},
+						"add": {
+							usage:  "[fingerprint]",
+							desc:   "accept a client certificate for SASL EXTERNAL, defaults to the current one",
+							handle: handleUserCertFPAdd,
+						},
+						"remove": {
+							usage:  "<fingerprint>",
+							desc:   "stop accepting a client certificate",
+							handle: handleUserCertFPRemove,
+						},
+					},
+				},
+			},
+		},
+		"ignore": {
+			children: serviceCommandSet{
+				"list": {
+					desc:   "show the list of ignored users",
+					handle: handleServiceIgnoreList,
+				},
+				"add": {
+					usage:  "<mask>",
+					desc:   "ignore messages from users matching a nick or hostmask",
+					handle: handleServiceIgnoreAdd,
+				},
+				"remove": {
+					usage:  "<mask>",
+					desc:   "stop ignoring messages from users matching a mask",
+					handle: handleServiceIgnoreRemove,
+				},
 			},
 		},
 		"channel": {
@@ -292,8 +458,18 @@ func init() {
 					desc:   "show a list of saved channels and their current status",
 					handle: handleServiceChannelStatus,
 				},
+				"move-logs": {
+					usage:  "[-network name] [-merge] <old name> <new name>",
+					desc:   "move the logs of a channel or user to another name",
+					handle: handleServiceChannelMoveLogs,
+				},
+				"reorder": {
+					usage:  "[-network name] <channel>...",
+					desc:   "set the order of saved channels",
+					handle: handleServiceChannelReorder,
+				},
 				"update": {
-					usage:  "<name> [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>]",
+					usage:  "<name> [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>] [-no-logging <true|false>] [-relay-detached-membership <true|false>] [-muted <true|false>]",
 					desc:   "update a channel",
 					handle: handleServiceChannelUpdate,
 				},
@@ -311,6 +487,18 @@ func init() {
 					handle: handleServiceServerNotice,
 					admin:  true,
 				},
+				"post": {
+					usage:  "[-user username] [-sender nick] <channel> <text>",
+					desc:   "post a message to a local channel",
+					handle: handleServiceServerPost,
+					admin:  true,
+				},
+				"unlock": {
+					usage:  "<username|address>",
+					desc:   "clear the failed login attempts of a user or an IP address",
+					handle: handleServiceServerUnlock,
+					admin:  true,
+				},
 			},
 			admin: true,
 		},
@@ -325,7 +513,12 @@ func handleServiceRollback(ctx context.Context, dc *downstreamConn, params []str
 
 	var receipts []DeliveryReceipt
 
-	entries, err := os.ReadDir(dc.user.msgStore.(*fsMessageStore).root + "/" + dc.network.Name)
+	store, ok := dc.user.msgStore.(*fsMessageStore)
+	if !ok {
+		sendServicePRIVMSG(dc, "error: messages aren't logged to disk")
+		return nil
+	}
+	entries, err := os.ReadDir(store.root + "/" + dc.network.Name)
 	if err != nil {
 		sendServicePRIVMSG(dc, "error readdir: " + err.Error())
 		return err
@@ -353,10 +546,10 @@ func handleServiceRollback(ctx context.Context, dc *downstreamConn, params []str
 	return nil
 }
 
-func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, admin bool, l *[]string) {
+func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, u *User, l *[]string) {
 	for _, name := range cmds.Names() {
 		cmd := cmds[name]
-		if cmd.admin && !admin {
+		if !cmd.allowed(u) {
 			continue
 		}
 		words := append(prefix, name)
@@ -364,7 +557,7 @@ func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, admin
 			s := strings.Join(words, " ")
 			*l = append(*l, s)
 		} else {
-			appendServiceCommandSetHelp(cmd.children, words, admin, l)
+			appendServiceCommandSetHelp(cmd.children, words, u, l)
 		}
 	}
 }
@@ -379,7 +572,7 @@ func handleServiceHelp(ctx context.Context, dc *downstreamConn, params []string)
 
 		if len(cmd.children) > 0 {
 			var l []string
-			appendServiceCommandSetHelp(cmd.children, words, dc.user.Admin, &l)
+			appendServiceCommandSetHelp(cmd.children, words, &dc.user.User, &l)
 			sendServicePRIVMSG(dc, "available commands: "+strings.Join(l, ", "))
 		} else {
 			text := strings.Join(words, " ")
@@ -392,7 +585,7 @@ func handleServiceHelp(ctx context.Context, dc *downstreamConn, params []string)
 		}
 	} else {
 		var l []string
-		appendServiceCommandSetHelp(serviceCommands, nil, dc.user.Admin, &l)
+		appendServiceCommandSetHelp(serviceCommands, nil, &dc.user.User, &l)
 		sendServicePRIVMSG(dc, "available commands: "+strings.Join(l, ", "))
 	}
 	return nil
@@ -454,6 +647,26 @@ func (f boolPtrFlag) Set(s string) error {
 	return nil
 }
 
+type intPtrFlag struct {
+	ptr **int
+}
+
+func (f intPtrFlag) String() string {
+	if f.ptr == nil || *f.ptr == nil {
+		return "<nil>"
+	}
+	return strconv.Itoa(**f.ptr)
+}
+
+func (f intPtrFlag) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*f.ptr = &v
+	return nil
+}
+
 func getNetworkFromArg(dc *downstreamConn, params []string) (*network, []string, error) {
 	name, params := popArg(params)
 	if name == "" {
@@ -472,9 +685,18 @@ func getNetworkFromArg(dc *downstreamConn, params []string) (*network, []string,
 
 type networkFlagSet struct {
 	*flag.FlagSet
-	Addr, Name, Nick, Username, Pass, Realname *string
-	Enabled                                    *bool
-	ConnectCommands                            []string
+	Addr, Name, Nick, Username, Pass, Realname, MOTD *string
+	Charset, AwayMessage, Group                      *string
+	CTCPVersion, CTCPSource, TLSFingerprint          *string
+	ServerNotices, WebIRCPassword, WebIRCGateway     *string
+	Enabled, NoLogging, SASLPassthrough, NoAutoAway  *bool
+	SplitLongMessages, CTCPAutoReply, Passthrough    *bool
+	NoAutoDetach, OnDemand, CorrectServerTime        *bool
+	MessageDelay, ConnectTimeout, OnDemandGrace      *string
+	JoinDelay, TLSMinVersion                         *string
+	MessageBurst, SortOrder, JoinBatch               *int
+	ConnectCommands, FallbackNicks                   []string
+	ServerNoticeAllow, ServerNoticeDeny              []string
 }
 
 func newNetworkFlagSet() *networkFlagSet {
@@ -485,21 +707,82 @@ func newNetworkFlagSet() *networkFlagSet {
 	fs.Var(stringPtrFlag{&fs.Username}, "username", "")
 	fs.Var(stringPtrFlag{&fs.Pass}, "pass", "")
 	fs.Var(stringPtrFlag{&fs.Realname}, "realname", "")
+	fs.Var(stringPtrFlag{&fs.MOTD}, "motd", "")
+	fs.Var(stringPtrFlag{&fs.Charset}, "charset", "")
+	fs.Var(stringPtrFlag{&fs.Group}, "group", "")
+	fs.Var(intPtrFlag{&fs.SortOrder}, "order", "")
+	fs.Var(stringPtrFlag{&fs.TLSFingerprint}, "tls-fingerprint", "")
+	fs.Var(boolPtrFlag{&fs.SplitLongMessages}, "split-long-messages", "")
+	fs.Var(boolPtrFlag{&fs.CTCPAutoReply}, "ctcp-auto-reply", "")
+	fs.Var(stringPtrFlag{&fs.CTCPVersion}, "ctcp-version", "")
+	fs.Var(stringPtrFlag{&fs.CTCPSource}, "ctcp-source", "")
+	fs.Var(boolPtrFlag{&fs.Passthrough}, "passthrough", "")
+	fs.Var(boolPtrFlag{&fs.NoAutoDetach}, "no-auto-detach", "")
 	fs.Var(boolPtrFlag{&fs.Enabled}, "enabled", "")
+	fs.Var(boolPtrFlag{&fs.NoLogging}, "no-logging", "")
+	fs.Var(boolPtrFlag{&fs.SASLPassthrough}, "sasl-passthrough", "")
+	fs.Var(boolPtrFlag{&fs.NoAutoAway}, "no-auto-away", "")
+	fs.Var(stringPtrFlag{&fs.AwayMessage}, "away-message", "")
+	fs.Var(stringPtrFlag{&fs.MessageDelay}, "message-delay", "")
+	fs.Var(stringPtrFlag{&fs.ConnectTimeout}, "connect-timeout", "")
+	fs.Var(intPtrFlag{&fs.MessageBurst}, "message-burst", "")
 	fs.Var((*stringSliceFlag)(&fs.ConnectCommands), "connect-command", "")
+	fs.Var((*stringSliceFlag)(&fs.FallbackNicks), "fallback-nick", "")
+	fs.Var(stringPtrFlag{&fs.ServerNotices}, "server-notices", "")
+	fs.Var((*stringSliceFlag)(&fs.ServerNoticeAllow), "server-notice-allow", "")
+	fs.Var((*stringSliceFlag)(&fs.ServerNoticeDeny), "server-notice-deny", "")
+	fs.Var(boolPtrFlag{&fs.OnDemand}, "on-demand", "")
+	fs.Var(stringPtrFlag{&fs.OnDemandGrace}, "on-demand-grace", "")
+	fs.Var(stringPtrFlag{&fs.WebIRCPassword}, "webirc-password", "")
+	fs.Var(stringPtrFlag{&fs.WebIRCGateway}, "webirc-gateway", "")
+	fs.Var(stringPtrFlag{&fs.JoinDelay}, "join-delay", "")
+	fs.Var(intPtrFlag{&fs.JoinBatch}, "join-batch", "")
+	fs.Var(stringPtrFlag{&fs.TLSMinVersion}, "tls-min-version", "")
+	fs.Var(boolPtrFlag{&fs.CorrectServerTime}, "correct-server-time", "")
 	return fs
 }
 
+// checkMessageDelay checks the bounds of a network message delay. Zero
+// isn't allowed, the default is represented by an unset value.
+func checkMessageDelay(delay time.Duration) error {
+	if delay < minUpstreamMessageDelay || delay > maxUpstreamMessageDelay {
+		return fmt.Errorf("message delay must be between %v and %v", minUpstreamMessageDelay, maxUpstreamMessageDelay)
+	}
+	return nil
+}
+
+// checkMessageBurst checks the bounds of a network message burst, zero
+// meaning the default.
+func checkMessageBurst(burst int) error {
+	if burst != 0 && (burst < minUpstreamMessageBurst || burst > maxUpstreamMessageBurst) {
+		return fmt.Errorf("message burst must be between %v and %v", minUpstreamMessageBurst, maxUpstreamMessageBurst)
+	}
+	return nil
+}
+
+// checkConnectTimeout checks that a network connect timeout is positive.
+func checkConnectTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("connect timeout must be positive")
+	}
+	return nil
+}
+
 func (fs *networkFlagSet) update(network *Network) error {
 	if fs.Addr != nil {
 		if addrParts := strings.SplitN(*fs.Addr, "://", 2); len(addrParts) == 2 {
 			scheme := addrParts[0]
 			switch scheme {
-			case "ircs", "irc+insecure", "unix":
+			case "ircs", "irc+insecure", "irc+unix", "unix", "irc+wss", "irc+ws":
 			default:
-				return fmt.Errorf("unknown scheme %q (supported schemes: ircs, irc+insecure, unix)", scheme)
+				return fmt.Errorf("unknown scheme %q (supported schemes: ircs, irc+insecure, irc+unix, irc+wss, irc+ws)", scheme)
 			}
 		}
+		if *fs.Addr != network.Addr {
+			// The STS policy only applies to the previous host
+			network.STSPort = 0
+			network.STSExpiresAt = time.Time{}
+		}
 		network.Addr = *fs.Addr
 	}
 	if fs.Name != nil {
@@ -520,9 +803,99 @@ func (fs *networkFlagSet) update(network *Network) error {
 	if fs.Realname != nil {
 		network.Realname = *fs.Realname
 	}
+	if fs.MOTD != nil {
+		network.MOTD = *fs.MOTD
+	}
+	if fs.Charset != nil {
+		if _, err := lookupCharset(*fs.Charset); err != nil {
+			return err
+		}
+		network.Charset = *fs.Charset
+	}
+	if fs.Group != nil {
+		network.Group = *fs.Group
+	}
+	if fs.SortOrder != nil {
+		network.SortOrder = *fs.SortOrder
+	}
+	if fs.TLSFingerprint != nil {
+		network.TLSFingerprint = ""
+		if *fs.TLSFingerprint != "" {
+			fp, err := parseTLSFingerprint(*fs.TLSFingerprint)
+			if err != nil {
+				return err
+			}
+			network.TLSFingerprint = fp
+		}
+	}
+	if fs.SplitLongMessages != nil {
+		network.SplitLongMessages = *fs.SplitLongMessages
+	}
+	if fs.CTCPAutoReply != nil {
+		network.CTCPAutoReply = *fs.CTCPAutoReply
+	}
+	if fs.CTCPVersion != nil {
+		network.CTCPVersion = *fs.CTCPVersion
+	}
+	if fs.CTCPSource != nil {
+		network.CTCPSource = *fs.CTCPSource
+	}
+	if fs.Passthrough != nil {
+		network.Passthrough = *fs.Passthrough
+	}
+	if fs.NoAutoDetach != nil {
+		network.NoAutoDetach = *fs.NoAutoDetach
+	}
 	if fs.Enabled != nil {
 		network.Enabled = *fs.Enabled
 	}
+	if fs.NoLogging != nil {
+		network.NoLogging = *fs.NoLogging
+	}
+	if fs.SASLPassthrough != nil {
+		network.SASLPassthrough = *fs.SASLPassthrough
+	}
+	if fs.NoAutoAway != nil {
+		network.NoAutoAway = *fs.NoAutoAway
+	}
+	if fs.AwayMessage != nil {
+		network.AwayMessage = *fs.AwayMessage
+	}
+	if fs.MessageDelay != nil {
+		var delay time.Duration
+		if *fs.MessageDelay != "" && *fs.MessageDelay != "default" {
+			var err error
+			delay, err = time.ParseDuration(*fs.MessageDelay)
+			if err != nil {
+				return fmt.Errorf("invalid message delay: %v", err)
+			}
+			if err := checkMessageDelay(delay); err != nil {
+				return err
+			}
+		}
+		network.MessageDelay = delay
+	}
+	if fs.ConnectTimeout != nil {
+		var timeout time.Duration
+		if *fs.ConnectTimeout != "" && *fs.ConnectTimeout != "default" {
+			var err error
+			timeout, err = time.ParseDuration(*fs.ConnectTimeout)
+			if err != nil {
+				return fmt.Errorf("invalid connect timeout: %v", err)
+			}
+			if err := checkConnectTimeout(timeout); err != nil {
+				return err
+			}
+		}
+		network.ConnectTimeout = timeout
+	}
+	if fs.MessageBurst != nil {
+		burst := *fs.MessageBurst
+		if err := checkMessageBurst(burst); err != nil {
+			return err
+		}
+		network.MessageBurst = burst
+	}
 	if fs.ConnectCommands != nil {
 		if len(fs.ConnectCommands) == 1 && fs.ConnectCommands[0] == "" {
 			network.ConnectCommands = nil
@@ -539,9 +912,120 @@ func (fs *networkFlagSet) update(network *Network) error {
 			network.ConnectCommands = fs.ConnectCommands
 		}
 	}
+	if fs.FallbackNicks != nil {
+		if len(fs.FallbackNicks) == 1 && fs.FallbackNicks[0] == "" {
+			network.FallbackNicks = nil
+		} else {
+			if len(fs.FallbackNicks) > 10 {
+				return fmt.Errorf("too many -fallback-nick flags supplied")
+			}
+			for _, nick := range fs.FallbackNicks {
+				if nick == "" || strings.ContainsAny(nick, illegalNickChars) {
+					return fmt.Errorf("flag -fallback-nick must be a valid nickname: %q", nick)
+				}
+			}
+			network.FallbackNicks = fs.FallbackNicks
+		}
+	}
+	if fs.ServerNotices != nil {
+		switch *fs.ServerNotices {
+		case "relay":
+			network.ServerNotices = serverNoticesRelay
+		case serverNoticesDrop, serverNoticesRedirect:
+			network.ServerNotices = *fs.ServerNotices
+		default:
+			return fmt.Errorf("unknown server notices policy %q (supported: relay, drop, redirect)", *fs.ServerNotices)
+		}
+	}
+	if fs.ServerNoticeAllow != nil {
+		patterns, err := parseServerNoticePatterns("-server-notice-allow", fs.ServerNoticeAllow)
+		if err != nil {
+			return err
+		}
+		network.ServerNoticeAllow = patterns
+	}
+	if fs.ServerNoticeDeny != nil {
+		patterns, err := parseServerNoticePatterns("-server-notice-deny", fs.ServerNoticeDeny)
+		if err != nil {
+			return err
+		}
+		network.ServerNoticeDeny = patterns
+	}
+	if fs.OnDemand != nil {
+		network.OnDemand = *fs.OnDemand
+	}
+	if fs.OnDemandGrace != nil {
+		var grace time.Duration
+		if *fs.OnDemandGrace != "" && *fs.OnDemandGrace != "default" {
+			var err error
+			grace, err = time.ParseDuration(*fs.OnDemandGrace)
+			if err != nil {
+				return fmt.Errorf("invalid on-demand grace period: %v", err)
+			}
+			if grace <= 0 {
+				return fmt.Errorf("on-demand grace period must be positive")
+			}
+		}
+		network.OnDemandGrace = grace
+	}
+	if fs.WebIRCPassword != nil {
+		network.WebIRCPassword = *fs.WebIRCPassword
+	}
+	if fs.WebIRCGateway != nil {
+		network.WebIRCGateway = *fs.WebIRCGateway
+	}
+	if fs.JoinDelay != nil {
+		var delay time.Duration
+		if *fs.JoinDelay != "" && *fs.JoinDelay != "default" {
+			var err error
+			delay, err = time.ParseDuration(*fs.JoinDelay)
+			if err != nil {
+				return fmt.Errorf("invalid join delay: %v", err)
+			}
+			if delay < minUpstreamMessageDelay || delay > maxUpstreamMessageDelay {
+				return fmt.Errorf("join delay must be between %v and %v", minUpstreamMessageDelay, maxUpstreamMessageDelay)
+			}
+		}
+		network.JoinDelay = delay
+	}
+	if fs.JoinBatch != nil {
+		if *fs.JoinBatch < 0 {
+			return fmt.Errorf("join batch must not be negative")
+		}
+		network.JoinBatch = *fs.JoinBatch
+	}
+	if fs.TLSMinVersion != nil {
+		var version uint16
+		if *fs.TLSMinVersion != "" && *fs.TLSMinVersion != "default" {
+			var err error
+			version, err = config.ParseTLSVersion(*fs.TLSMinVersion)
+			if err != nil {
+				return err
+			}
+		}
+		network.TLSMinVersion = version
+	}
+	if fs.CorrectServerTime != nil {
+		network.CorrectServerTime = *fs.CorrectServerTime
+	}
 	return nil
 }
 
+func parseServerNoticePatterns(flag string, patterns []string) ([]string, error) {
+	if len(patterns) == 1 && patterns[0] == "" {
+		return nil, nil
+	}
+	if len(patterns) > 20 {
+		return nil, fmt.Errorf("too many %v flags supplied", flag)
+	}
+	for _, pattern := range patterns {
+		if pattern == "" || strings.ContainsAny(pattern, "\r\n") {
+			return nil, fmt.Errorf("flag %v must be a non-empty single-line pattern: %q", flag, pattern)
+		}
+	}
+	return patterns, nil
+}
+
 func handleServiceNetworkCreate(ctx context.Context, dc *downstreamConn, params []string) error {
 	fs := newNetworkFlagSet()
 	if err := fs.Parse(params); err != nil {
@@ -568,6 +1052,39 @@ func handleServiceNetworkCreate(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
+func handleServiceNetworkTest(ctx context.Context, dc *downstreamConn, params []string) error {
+	name, rest := popArg(params)
+
+	fs := newNetworkFlagSet()
+	if err := fs.Parse(rest); err != nil {
+		return err
+	}
+
+	var record Network
+	if name == "" && fs.Addr != nil {
+		record = Network{
+			Addr:    *fs.Addr,
+			Enabled: true,
+		}
+	} else {
+		net, _, err := getNetworkFromArg(dc, params)
+		if err != nil {
+			return err
+		}
+		record = net.Network // copy network record because we'll mutate it
+	}
+	if err := fs.update(&record); err != nil {
+		return err
+	}
+
+	if err := dc.user.testNetwork(dc, &record); err != nil {
+		return fmt.Errorf("invalid network: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("testing network %q...", record.GetName()))
+	return nil
+}
+
 func handleServiceNetworkStatus(ctx context.Context, dc *downstreamConn, params []string) error {
 	n := 0
 	for _, net := range dc.user.networks {
@@ -580,12 +1097,25 @@ func handleServiceNetworkStatus(ctx context.Context, dc *downstreamConn, params
 				statuses = append(statuses, "connected")
 			}
 			details = fmt.Sprintf("%v channels", uc.channels.Len())
+			if !net.lastConnected.IsZero() {
+				details += ", connected since " + net.lastConnected.Format(time.RFC3339)
+			}
 		} else if !net.Enabled {
 			statuses = append(statuses, "disabled")
+		} else if net.disconnected {
+			statuses = append(statuses, "disconnected manually")
+		} else if net.isIdle() {
+			statuses = append(statuses, "idle (on demand)")
 		} else {
 			statuses = append(statuses, "disconnected")
 			if net.lastError != nil {
-				details = net.lastError.Error()
+				details = fmt.Sprintf("%v (at %v)", net.lastError, net.lastErrorTime.Format(time.RFC3339))
+			}
+			if !net.lastConnected.IsZero() {
+				if details != "" {
+					details += ", "
+				}
+				details += "last connected " + net.lastConnected.Format(time.RFC3339)
 			}
 		}
 
@@ -653,6 +1183,38 @@ func handleServiceNetworkDelete(ctx context.Context, dc *downstreamConn, params
 	return nil
 }
 
+func handleServiceNetworkReconnect(ctx context.Context, dc *downstreamConn, params []string) error {
+	net, _, err := getNetworkFromArg(dc, params)
+	if err != nil {
+		return err
+	}
+
+	if !net.Enabled {
+		return fmt.Errorf("network %q is disabled", net.GetName())
+	}
+
+	dc.user.reconnectNetwork(net)
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("reconnecting to network %q", net.GetName()))
+	return nil
+}
+
+func handleServiceNetworkDisconnect(ctx context.Context, dc *downstreamConn, params []string) error {
+	net, _, err := getNetworkFromArg(dc, params)
+	if err != nil {
+		return err
+	}
+
+	if net.disconnected {
+		return fmt.Errorf("network %q is already disconnected", net.GetName())
+	}
+
+	dc.user.disconnectNetwork(net)
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("disconnected from network %q", net.GetName()))
+	return nil
+}
+
 func handleServiceNetworkQuote(ctx context.Context, dc *downstreamConn, params []string) error {
 	if len(params) != 1 && len(params) != 2 {
 		return fmt.Errorf("expected one or two arguments")
@@ -681,6 +1243,73 @@ func handleServiceNetworkQuote(ctx context.Context, dc *downstreamConn, params [
 	return nil
 }
 
+func handleServiceNetworkFeatures(ctx context.Context, dc *downstreamConn, params []string) error {
+	net, params, err := getNetworkFromArg(dc, params)
+	if err != nil {
+		return err
+	}
+	if len(params) != 0 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	uc := net.conn
+	if uc == nil {
+		return fmt.Errorf("network %q is not currently connected", net.GetName())
+	}
+
+	var tokens []string
+	for k, v := range uc.isupport {
+		if v == nil {
+			tokens = append(tokens, k)
+		} else {
+			tokens = append(tokens, k+"="+*v)
+		}
+	}
+	sort.Strings(tokens)
+	sendServiceList(dc, "ISUPPORT", tokens)
+
+	var enabled, available []string
+	for name, value := range uc.caps.Available {
+		s := name
+		if value != "" {
+			s += "=" + value
+		}
+		if uc.caps.IsEnabled(name) {
+			enabled = append(enabled, s)
+		} else {
+			available = append(available, s)
+		}
+	}
+	sort.Strings(enabled)
+	sort.Strings(available)
+	sendServiceList(dc, "enabled caps", enabled)
+	sendServiceList(dc, "available caps", available)
+	return nil
+}
+
+// sendServiceList sends a list of items, split over multiple messages if
+// necessary.
+func sendServiceList(dc *downstreamConn, name string, items []string) {
+	if len(items) == 0 {
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v: none", name))
+		return
+	}
+
+	const maxLen = 350
+	var line string
+	for _, item := range items {
+		if line != "" && len(line)+1+len(item) > maxLen {
+			sendServicePRIVMSG(dc, fmt.Sprintf("%v: %v", name, line))
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += item
+	}
+	sendServicePRIVMSG(dc, fmt.Sprintf("%v: %v", name, line))
+}
+
 func sendCertfpFingerprints(dc *downstreamConn, cert []byte) {
 	sha1Sum := sha1.Sum(cert)
 	sendServicePRIVMSG(dc, "SHA-1 fingerprint: "+hex.EncodeToString(sha1Sum[:]))
@@ -755,7 +1384,7 @@ func handleServiceCertFPFingerprints(ctx context.Context, dc *downstreamConn, pa
 		return err
 	}
 
-	if net.SASL.Mechanism != "EXTERNAL" {
+	if net.SASL.External.CertBlob == nil {
 		return fmt.Errorf("CertFP not set up")
 	}
 
@@ -763,63 +1392,353 @@ func handleServiceCertFPFingerprints(ctx context.Context, dc *downstreamConn, pa
 	return nil
 }
 
-func handleServiceSASLStatus(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceAutoJoinList(ctx context.Context, dc *downstreamConn, params []string) error {
 	fs := newFlagSet()
-	netName := fs.String("network", "", "select a network")
+	netName := fs.String("network", "", "")
 
 	if err := fs.Parse(params); err != nil {
 		return err
 	}
+	if len(fs.Args()) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
 
 	net, err := getNetworkFromFlag(dc, *netName)
 	if err != nil {
 		return err
 	}
 
-	switch net.SASL.Mechanism {
-	case "PLAIN":
-		sendServicePRIVMSG(dc, fmt.Sprintf("SASL PLAIN enabled with username %q", net.SASL.Plain.Username))
-	case "EXTERNAL":
-		sendServicePRIVMSG(dc, "SASL EXTERNAL (CertFP) enabled")
-	case "":
-		sendServicePRIVMSG(dc, "SASL is disabled")
+	if len(net.AutoJoin) == 0 {
+		sendServicePRIVMSG(dc, "No auto-join channels")
+		return nil
 	}
-
-	if uc := net.conn; uc != nil {
-		if uc.account != "" {
-			sendServicePRIVMSG(dc, fmt.Sprintf("Authenticated on upstream network with account %q", uc.account))
+	for _, ch := range net.AutoJoin {
+		if ch.Key != "" {
+			sendServicePRIVMSG(dc, fmt.Sprintf("%v (key: %v)", ch.Name, ch.Key))
 		} else {
-			sendServicePRIVMSG(dc, "Unauthenticated on upstream network")
+			sendServicePRIVMSG(dc, ch.Name)
 		}
-	} else {
-		sendServicePRIVMSG(dc, "Disconnected from upstream network")
 	}
-
 	return nil
 }
 
-func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params []string) error {
+func handleServiceAutoJoinAdd(ctx context.Context, dc *downstreamConn, params []string) error {
 	fs := newFlagSet()
-	netName := fs.String("network", "", "select a network")
+	netName := fs.String("network", "", "")
 
 	if err := fs.Parse(params); err != nil {
 		return err
 	}
-
-	if len(fs.Args()) != 2 {
-		return fmt.Errorf("expected exactly 2 arguments")
+	if len(fs.Args()) != 1 && len(fs.Args()) != 2 {
+		return fmt.Errorf("expected one or two arguments")
+	}
+	ch := AutoJoinChannel{Name: fs.Arg(0), Key: fs.Arg(1)}
+	if ch.Name == "" || strings.ContainsAny(ch.Name, " ,") {
+		return fmt.Errorf("invalid channel name %q", ch.Name)
+	}
+	if strings.ContainsAny(ch.Key, " ,") {
+		return fmt.Errorf("invalid channel key")
 	}
 
 	net, err := getNetworkFromFlag(dc, *netName)
 	if err != nil {
 		return err
 	}
+	if uc := net.conn; uc != nil && !uc.isChannel(ch.Name) {
+		return fmt.Errorf("%q is not a channel", ch.Name)
+	}
 
-	net.SASL.Plain.Username = fs.Arg(0)
-	net.SASL.Plain.Password = fs.Arg(1)
-	net.SASL.Mechanism = "PLAIN"
+	chCM := net.casemap(ch.Name)
+	channels := make([]AutoJoinChannel, 0, len(net.AutoJoin)+1)
+	for _, c := range net.AutoJoin {
+		if net.casemap(c.Name) != chCM {
+			channels = append(channels, c)
+		}
+	}
+	if len(channels) >= 100 {
+		return fmt.Errorf("too many auto-join channels")
+	}
+	channels = append(channels, ch)
 
-	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+	if err := net.updateAutoJoin(ctx, channels); err != nil {
+		return err
+	}
+
+	if uc := net.conn; uc != nil && uc.channels.Value(ch.Name) == nil {
+		for _, msg := range join([]string{ch.Name}, []string{ch.Key}, 0) {
+			uc.SendMessage(ctx, msg)
+		}
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("added %q to the auto-join channels of network %q", ch.Name, net.GetName()))
+	return nil
+}
+
+func handleServiceAutoJoinRemove(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	name := fs.Arg(0)
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	nameCM := net.casemap(name)
+	var channels []AutoJoinChannel
+	for _, c := range net.AutoJoin {
+		if net.casemap(c.Name) != nameCM {
+			channels = append(channels, c)
+		}
+	}
+	if len(channels) == len(net.AutoJoin) {
+		return fmt.Errorf("%q is not an auto-join channel", name)
+	}
+
+	if err := net.updateAutoJoin(ctx, channels); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("removed %q from the auto-join channels of network %q", name, net.GetName()))
+	return nil
+}
+
+func handleServiceSASLStatus(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	switch net.SASL.Mechanism {
+	case "PLAIN":
+		if net.SASL.Plain.Authzid != "" {
+			sendServicePRIVMSG(dc, fmt.Sprintf("SASL PLAIN enabled with username %q, authorized as %q", net.SASL.Plain.Username, net.SASL.Plain.Authzid))
+		} else {
+			sendServicePRIVMSG(dc, fmt.Sprintf("SASL PLAIN enabled with username %q", net.SASL.Plain.Username))
+		}
+	case scramSHA256:
+		sendServicePRIVMSG(dc, fmt.Sprintf("SASL SCRAM-SHA-256 enabled with username %q", net.SASL.Plain.Username))
+	case "EXTERNAL":
+		sendServicePRIVMSG(dc, "SASL EXTERNAL (CertFP) enabled")
+	case "":
+		sendServicePRIVMSG(dc, "SASL is disabled")
+	}
+	if len(net.SASL.Mechanisms) > 0 {
+		sendServicePRIVMSG(dc, fmt.Sprintf("SASL mechanisms attempted in order: %v", strings.Join(net.SASL.Mechanisms, ", ")))
+	}
+
+	if uc := net.conn; uc != nil {
+		if uc.account != "" {
+			sendServicePRIVMSG(dc, fmt.Sprintf("Authenticated on upstream network with account %q", uc.account))
+		} else {
+			sendServicePRIVMSG(dc, "Unauthenticated on upstream network")
+		}
+	} else {
+		sendServicePRIVMSG(dc, "Disconnected from upstream network")
+	}
+
+	return nil
+}
+
+func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params []string) error {
+	return setServiceSASLPassword(ctx, dc, params, "PLAIN")
+}
+
+func handleServiceSASLSetSCRAM(ctx context.Context, dc *downstreamConn, params []string) error {
+	return setServiceSASLPassword(ctx, dc, params, scramSHA256)
+}
+
+// setServiceSASLPassword stores username and password credentials, which are
+// shared by the PLAIN and SCRAM-SHA-256 mechanisms.
+func setServiceSASLPassword(ctx context.Context, dc *downstreamConn, params []string, mech string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+	var authzid *string
+	if mech == "PLAIN" {
+		authzid = fs.String("authzid", "", "authorization identity")
+	}
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	if len(fs.Args()) != 2 {
+		return fmt.Errorf("expected exactly 2 arguments")
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	net.SASL.Plain.Username = fs.Arg(0)
+	net.SASL.Plain.Password = fs.Arg(1)
+	if authzid != nil {
+		net.SASL.Plain.Authzid = *authzid
+	}
+	net.SASL.Mechanism = mech
+
+	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, "credentials saved")
+	return nil
+}
+
+func handleServiceSASLSetPriority(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	var mechanisms []string
+	for _, mech := range fs.Args() {
+		mech = strings.ToUpper(mech)
+		switch mech {
+		case "PLAIN", scramSHA256:
+			if net.SASL.Plain.Username == "" {
+				return fmt.Errorf("SASL %v credentials not set up", mech)
+			}
+		case "EXTERNAL":
+			if net.SASL.External.CertBlob == nil {
+				return fmt.Errorf("CertFP not set up")
+			}
+		default:
+			return fmt.Errorf("unsupported SASL mechanism %q", mech)
+		}
+		for _, m := range mechanisms {
+			if m == mech {
+				return fmt.Errorf("duplicate SASL mechanism %q", mech)
+			}
+		}
+		mechanisms = append(mechanisms, mech)
+	}
+
+	net.SASL.Mechanisms = mechanisms
+
+	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+		return err
+	}
+
+	if len(mechanisms) == 0 {
+		sendServicePRIVMSG(dc, "SASL mechanism priority reset")
+	} else {
+		sendServicePRIVMSG(dc, fmt.Sprintf("SASL mechanisms will be attempted in order: %v", strings.Join(mechanisms, ", ")))
+	}
+	return nil
+}
+
+func handleServiceSASLReset(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	net.SASL.Plain.Username = ""
+	net.SASL.Plain.Password = ""
+	net.SASL.Plain.Authzid = ""
+	net.SASL.External.CertBlob = nil
+	net.SASL.External.PrivKeyBlob = nil
+	net.SASL.Mechanism = ""
+	net.SASL.Mechanisms = nil
+
+	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, "credentials reset")
+	return nil
+}
+
+func handleServiceNickServStatus(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	if net.NickServ.Password == "" {
+		sendServicePRIVMSG(dc, "NickServ identification is disabled")
+		return nil
+	}
+
+	nick := net.NickServ.Nick
+	if nick == "" {
+		nick = "NickServ"
+	}
+	command := net.NickServ.Command
+	if command == "" {
+		command = defaultNickServCommand
+	}
+	sendServicePRIVMSG(dc, fmt.Sprintf("NickServ identification enabled with %v, sending %q", nick, command))
+	return nil
+}
+
+func handleServiceNickServSet(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+	nick := fs.String("nick", "", "")
+	command := fs.String("command", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	if len(fs.Args()) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	if strings.ContainsAny(*nick, illegalNickChars) {
+		return fmt.Errorf("invalid NickServ nickname %q", *nick)
+	}
+	if *command != "" && !strings.Contains(*command, "{password}") {
+		return fmt.Errorf("command template must contain the {password} placeholder")
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	net.NickServ.Nick = *nick
+	net.NickServ.Command = *command
+	net.NickServ.Password = fs.Arg(0)
+
+	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
 		return err
 	}
 
@@ -827,174 +1746,1484 @@ func handleServiceSASLSetPlain(ctx context.Context, dc *downstreamConn, params [
 	return nil
 }
 
-func handleServiceSASLReset(ctx context.Context, dc *downstreamConn, params []string) error {
-	fs := newFlagSet()
-	netName := fs.String("network", "", "select a network")
+func handleServiceNickServReset(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "select a network")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	net.NickServ = NickServ{}
+
+	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, "credentials reset")
+	return nil
+}
+
+func handleUserCreate(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	username := fs.String("username", "", "")
+	password := fs.String("password", "", "")
+	realname := fs.String("realname", "", "")
+	timezone := fs.String("timezone", "", "")
+	motd := fs.String("motd", "", "")
+	logIgnored := fs.Bool("log-ignored", false, "")
+	maxDownstreams := fs.Int("max-downstreams", 0, "")
+	upstreamIP := fs.String("upstream-ip", "", "")
+	logQuotaStr := fs.String("log-quota", "0", "")
+	backlogLimit := fs.Int("backlog-limit", 0, "")
+	msgStoreStr := fs.String("msg-store", "", "")
+	networkChangeDelayStr := fs.String("network-change-delay", "0", "")
+	admin := fs.Bool("admin", false, "")
+	limitedAdmin := fs.Bool("limited-admin", false, "")
+	owner := fs.String("owner", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if *username == "" {
+		return fmt.Errorf("flag -username is required")
+	}
+	if err := checkUsername(*username); err != nil {
+		return err
+	}
+	if *password == "" {
+		return fmt.Errorf("flag -password is required")
+	}
+
+	if _, err := time.LoadLocation(*timezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", *timezone)
+	}
+
+	upstreamIPs, err := parseUpstreamIPs(*upstreamIP)
+	if err != nil {
+		return err
+	}
+	logQuota, err := config.ParseSize(*logQuotaStr)
+	if err != nil {
+		return err
+	}
+	if *backlogLimit < 0 {
+		return fmt.Errorf("backlog limit must not be negative")
+	}
+	msgStore, err := parseMsgStore(dc.srv, *msgStoreStr)
+	if err != nil {
+		return err
+	}
+	networkChangeDelay, err := parseNetworkChangeDelay(*networkChangeDelayStr)
+	if err != nil {
+		return err
+	}
+
+	var ownerID int64
+	if !dc.user.Admin {
+		// Limited admins can only create regular users, owned by them
+		if *admin || *limitedAdmin || *owner != "" {
+			return fmt.Errorf("you must be an admin to create privileged users")
+		}
+		if *motd != "" || *maxDownstreams != 0 || upstreamIPs != nil || logQuota != 0 || *backlogLimit != 0 || networkChangeDelay != 0 {
+			return fmt.Errorf("you must be an admin to set the MOTD or resource limits")
+		}
+		ownerID = dc.user.ID
+	} else if *owner != "" {
+		u, err := getUserFromSelector(dc.srv, *owner)
+		if err != nil {
+			return err
+		}
+		ownerID = u.ID
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user := &User{
+		Username: *username,
+		Password: string(hashed),
+		Realname: *realname,
+		Admin:    *admin,
+		Timezone: *timezone,
+		MOTD:     *motd,
+
+		LogIgnored:         *logIgnored,
+		MaxDownstreams:     *maxDownstreams,
+		UpstreamIPs:        upstreamIPs,
+		LogQuota:           logQuota,
+		LimitedAdmin:       *limitedAdmin,
+		Owner:              ownerID,
+		BacklogLimit:       *backlogLimit,
+		MsgStore:           msgStore,
+		NetworkChangeDelay: networkChangeDelay,
+	}
+	if _, err := dc.srv.createUser(ctx, user); err != nil {
+		return fmt.Errorf("could not create user: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("created user %q (ID #%v)", *username, user.ID))
+	return nil
+}
+
+// getUserFromSelector looks up a user by username, or by ID if the selector
+// has the form "#<id>".
+func getUserFromSelector(srv *Server, selector string) (*user, error) {
+	if strings.HasPrefix(selector, "#") {
+		id, err := strconv.ParseInt(selector[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID %q", selector[1:])
+		}
+		u := srv.getUserByID(id)
+		if u == nil {
+			return nil, fmt.Errorf("unknown user ID %v", id)
+		}
+		return u, nil
+	}
+
+	u := srv.getUser(selector)
+	if u == nil {
+		return nil, fmt.Errorf("unknown username %q", selector)
+	}
+	return u, nil
+}
+
+// checkUserScope checks whether the current user is allowed to manage another
+// user with admin commands.
+func checkUserScope(ctx context.Context, dc *downstreamConn, u *user) error {
+	if dc.user.Admin {
+		return nil
+	}
+	if dc.user.LimitedAdmin {
+		// Read the record from the database, the in-memory state belongs to
+		// the other user's goroutine
+		record, err := dc.srv.db.GetUser(ctx, u.Username)
+		if err != nil {
+			return fmt.Errorf("failed to load user: %v", err)
+		}
+		// Limited admins can't manage full admins, even the ones they own
+		if record.Owner == dc.user.ID && !record.Admin {
+			return nil
+		}
+	}
+	return fmt.Errorf("you must be an admin to manage user %q", u.Username)
+}
+
+// parseMsgStore parses the message store selected for a user. An empty string
+// is returned for the server default.
+func parseMsgStore(srv *Server, s string) (string, error) {
+	switch s {
+	case "", "default":
+		return "", nil
+	case msgStorePersistent:
+		if srv.Config().LogPath == "" {
+			return "", fmt.Errorf("message logging to disk is disabled on this server")
+		}
+		return s, nil
+	case msgStoreMemory, msgStoreNone:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid message store %q, must be one of: default, %v, %v, %v", s, msgStorePersistent, msgStoreMemory, msgStoreNone)
+	}
+}
+
+// parseNetworkChangeDelay parses the delay between network changes of a user:
+// zero means the server default, a negative value means no limit.
+func parseNetworkChangeDelay(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d != 0 && d > -time.Millisecond && d < time.Second {
+		return 0, fmt.Errorf("network change delay must be 0, negative or at least 1s")
+	}
+	return d, nil
+}
+
+// parseUpstreamIPs parses a comma-separated list of source IP addresses, with
+// at most one IPv4 and one IPv6 address.
+func parseUpstreamIPs(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ips []string
+	var hasIPv4, hasIPv6 bool
+	for _, str := range strings.Split(s, ",") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", str)
+		}
+		if ip.To4() == nil {
+			if hasIPv6 {
+				return nil, fmt.Errorf("found two IPv6 addresses")
+			}
+			hasIPv6 = true
+		} else {
+			if hasIPv4 {
+				return nil, fmt.Errorf("found two IPv4 addresses")
+			}
+			hasIPv4 = true
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+func popArg(params []string) (string, []string) {
+	if len(params) > 0 && !strings.HasPrefix(params[0], "-") {
+		return params[0], params[1:]
+	}
+	return "", params
+}
+
+func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string) error {
+	var password, realname, timezone, motd, upstreamIP, logQuotaStr, owner, msgStoreStr *string
+	var networkChangeDelayStr *string
+	var admin, limitedAdmin, logIgnored *bool
+	var maxDownstreams, backlogLimit *int
+	fs := newFlagSet()
+	fs.Var(stringPtrFlag{&password}, "password", "")
+	fs.Var(stringPtrFlag{&realname}, "realname", "")
+	fs.Var(stringPtrFlag{&timezone}, "timezone", "")
+	fs.Var(stringPtrFlag{&motd}, "motd", "")
+	fs.Var(boolPtrFlag{&logIgnored}, "log-ignored", "")
+	fs.Var(boolPtrFlag{&admin}, "admin", "")
+	fs.Var(boolPtrFlag{&limitedAdmin}, "limited-admin", "")
+	fs.Var(stringPtrFlag{&owner}, "owner", "")
+	fs.Var(intPtrFlag{&maxDownstreams}, "max-downstreams", "")
+	fs.Var(stringPtrFlag{&upstreamIP}, "upstream-ip", "")
+	fs.Var(stringPtrFlag{&logQuotaStr}, "log-quota", "")
+	fs.Var(intPtrFlag{&backlogLimit}, "backlog-limit", "")
+	fs.Var(stringPtrFlag{&msgStoreStr}, "msg-store", "")
+	fs.Var(stringPtrFlag{&networkChangeDelayStr}, "network-change-delay", "")
+
+	username, params := popArg(params)
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+
+	if timezone != nil {
+		if _, err := time.LoadLocation(*timezone); err != nil {
+			return fmt.Errorf("unknown time zone %q", *timezone)
+		}
+	}
+	if motd != nil && !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to update the MOTD")
+	}
+	if (admin != nil || limitedAdmin != nil || owner != nil) && !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to update user privileges")
+	}
+	var ownerID *int64
+	if owner != nil {
+		var id int64
+		if *owner != "" {
+			u, err := getUserFromSelector(dc.srv, *owner)
+			if err != nil {
+				return err
+			}
+			id = u.ID
+		}
+		ownerID = &id
+	}
+	if maxDownstreams != nil && !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to update the connection limit")
+	}
+	var upstreamIPs *[]string
+	if upstreamIP != nil {
+		if !dc.user.Admin {
+			return fmt.Errorf("you must be an admin to update the upstream IP addresses")
+		}
+		ips, err := parseUpstreamIPs(*upstreamIP)
+		if err != nil {
+			return err
+		}
+		upstreamIPs = &ips
+	}
+	var logQuota *int64
+	if logQuotaStr != nil {
+		if !dc.user.Admin {
+			return fmt.Errorf("you must be an admin to update the message log quota")
+		}
+		v, err := config.ParseSize(*logQuotaStr)
+		if err != nil {
+			return err
+		}
+		logQuota = &v
+	}
+	if backlogLimit != nil {
+		if !dc.user.Admin {
+			return fmt.Errorf("you must be an admin to update the backlog limit")
+		}
+		if *backlogLimit < 0 {
+			return fmt.Errorf("backlog limit must not be negative")
+		}
+	}
+	var msgStore *string
+	if msgStoreStr != nil {
+		v, err := parseMsgStore(dc.srv, *msgStoreStr)
+		if err != nil {
+			return err
+		}
+		msgStore = &v
+	}
+	var networkChangeDelay *time.Duration
+	if networkChangeDelayStr != nil {
+		if !dc.user.Admin {
+			return fmt.Errorf("you must be an admin to update the network change delay")
+		}
+		v, err := parseNetworkChangeDelay(*networkChangeDelayStr)
+		if err != nil {
+			return err
+		}
+		networkChangeDelay = &v
+	}
+
+	var hashed *string
+	if password != nil {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %v", err)
+		}
+		hashedStr := string(hashedBytes)
+		hashed = &hashedStr
+	}
+
+	if username != "" && username != dc.user.Username && username != fmt.Sprintf("#%v", dc.user.ID) {
+		if !dc.user.Admin && !dc.user.LimitedAdmin {
+			return fmt.Errorf("you must be an admin to update other users")
+		}
+		if realname != nil {
+			return fmt.Errorf("cannot update -realname of other user")
+		}
+		if timezone != nil {
+			return fmt.Errorf("cannot update -timezone of other user")
+		}
+		if logIgnored != nil {
+			return fmt.Errorf("cannot update -log-ignored of other user")
+		}
+
+		u, err := getUserFromSelector(dc.srv, username)
+		if err != nil {
+			return err
+		}
+
+		// Limited admins can only update the users they own, this is checked
+		// by the user's goroutine
+		var scope int64
+		if !dc.user.Admin {
+			scope = dc.user.ID
+		}
+
+		done := make(chan error, 1)
+		event := eventUserUpdate{
+			password:           hashed,
+			admin:              admin,
+			limitedAdmin:       limitedAdmin,
+			owner:              ownerID,
+			motd:               motd,
+			maxDownstreams:     maxDownstreams,
+			upstreamIPs:        upstreamIPs,
+			logQuota:           logQuota,
+			backlogLimit:       backlogLimit,
+			msgStore:           msgStore,
+			networkChangeDelay: networkChangeDelay,
+			scope:              scope,
+			done:               done,
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u.events <- event:
+		}
+		// TODO: send context to the other side
+		if err := <-done; err != nil {
+			return err
+		}
+
+		sendServicePRIVMSG(dc, fmt.Sprintf("updated user %q", u.Username))
+	} else {
+		// copy the user record because we'll mutate it
+		record := dc.user.User
+
+		if hashed != nil {
+			record.Password = *hashed
+		}
+		if realname != nil {
+			record.Realname = *realname
+		}
+		if timezone != nil {
+			record.Timezone = *timezone
+		}
+		if motd != nil {
+			record.MOTD = *motd
+		}
+		if logIgnored != nil {
+			record.LogIgnored = *logIgnored
+		}
+		if maxDownstreams != nil {
+			record.MaxDownstreams = *maxDownstreams
+		}
+		if upstreamIPs != nil {
+			record.UpstreamIPs = *upstreamIPs
+		}
+		if logQuota != nil {
+			record.LogQuota = *logQuota
+		}
+		if backlogLimit != nil {
+			record.BacklogLimit = *backlogLimit
+		}
+		if msgStore != nil {
+			record.MsgStore = *msgStore
+		}
+		if networkChangeDelay != nil {
+			record.NetworkChangeDelay = *networkChangeDelay
+		}
+		if hashed != nil && !dc.user.Admin {
+			return fmt.Errorf("cannot update -password of own user, use the user password command")
+		}
+		if admin != nil {
+			return fmt.Errorf("cannot update -admin of own user")
+		}
+		if limitedAdmin != nil {
+			return fmt.Errorf("cannot update -limited-admin of own user")
+		}
+		if owner != nil {
+			return fmt.Errorf("cannot update -owner of own user")
+		}
+
+		if err := dc.user.updateUser(ctx, &record); err != nil {
+			return err
+		}
+		if hashed != nil {
+			// Other connections and suspended sessions must re-authenticate
+			// with the new password
+			dc.user.revokeSessions(dc)
+		}
+
+		sendServicePRIVMSG(dc, fmt.Sprintf("updated user %q", dc.user.Username))
+	}
+
+	return nil
+}
+
+func handleServiceIgnoreList(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+
+	if len(dc.user.IgnoreMasks) == 0 {
+		sendServicePRIVMSG(dc, "No ignored users")
+		return nil
+	}
+	for _, mask := range dc.user.IgnoreMasks {
+		sendServicePRIVMSG(dc, mask)
+	}
+	return nil
+}
+
+func handleServiceIgnoreAdd(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	mask := normalizeMask(params[0])
+	if strings.ContainsAny(mask, " ,") {
+		return fmt.Errorf("invalid mask %q", params[0])
+	}
+
+	for _, m := range dc.user.IgnoreMasks {
+		if m == mask {
+			return fmt.Errorf("mask %q is already ignored", mask)
+		}
+	}
+	if len(dc.user.IgnoreMasks) >= 100 {
+		return fmt.Errorf("too many ignored masks")
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	record.IgnoreMasks = append(append([]string(nil), record.IgnoreMasks...), mask)
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("ignoring %q", mask))
+	return nil
+}
+
+func handleServiceIgnoreRemove(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	mask := normalizeMask(params[0])
+
+	var masks []string
+	for _, m := range dc.user.IgnoreMasks {
+		if m != mask {
+			masks = append(masks, m)
+		}
+	}
+	if len(masks) == len(dc.user.IgnoreMasks) {
+		return fmt.Errorf("mask %q is not ignored", mask)
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	record.IgnoreMasks = masks
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("stopped ignoring %q", mask))
+	return nil
+}
+
+// parseCertFingerprint normalizes a SHA-256 certificate fingerprint, which may
+// contain colons.
+func parseCertFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return fp, nil
+}
+
+func handleUserCertFPList(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+
+	if len(dc.user.CertFingerprints) == 0 {
+		sendServicePRIVMSG(dc, "No client certificate")
+		return nil
+	}
+	for _, fp := range dc.user.CertFingerprints {
+		sendServicePRIVMSG(dc, fp)
+	}
+	return nil
+}
+
+func handleUserCertFPAdd(ctx context.Context, dc *downstreamConn, params []string) error {
+	var fp string
+	switch len(params) {
+	case 0:
+		state := tlsConnectionState(dc.conn.conn)
+		if state == nil || len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("no client certificate used by the current connection, a fingerprint is required")
+		}
+		fp = certFingerprint(state.PeerCertificates[0].Raw)
+	case 1:
+		var err error
+		if fp, err = parseCertFingerprint(params[0]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("expected at most one argument")
+	}
+
+	for _, f := range dc.user.CertFingerprints {
+		if f == fp {
+			return fmt.Errorf("certificate %v is already accepted", fp)
+		}
+	}
+	if len(dc.user.CertFingerprints) >= 100 {
+		return fmt.Errorf("too many client certificates")
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	record.CertFingerprints = append(append([]string(nil), record.CertFingerprints...), fp)
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("accepting client certificate %v", fp))
+	return nil
+}
+
+func handleUserCertFPRemove(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	fp, err := parseCertFingerprint(params[0])
+	if err != nil {
+		return err
+	}
+
+	var fps []string
+	for _, f := range dc.user.CertFingerprints {
+		if f != fp {
+			fps = append(fps, f)
+		}
+	}
+	if len(fps) == len(dc.user.CertFingerprints) {
+		return fmt.Errorf("certificate %v is not accepted", fp)
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	record.CertFingerprints = fps
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("stopped accepting client certificate %v", fp))
+	return nil
+}
+
+// userExport, networkExport and channelExport are the records produced by
+// "user export" and consumed by "user import".
+type userExport struct {
+	Type             string   `json:"type"`
+	Password         string   `json:"password,omitempty"` // hashed
+	Realname         string   `json:"realname,omitempty"`
+	Timezone         string   `json:"timezone,omitempty"`
+	IgnoreMasks      []string `json:"ignore_masks,omitempty"`
+	LogIgnored       bool     `json:"log_ignored,omitempty"`
+	CertFingerprints []string `json:"cert_fingerprints,omitempty"`
+	MsgStore         string   `json:"msg_store,omitempty"`
+}
+
+type networkExport struct {
+	Type              string           `json:"type"`
+	Name              string           `json:"name,omitempty"`
+	Addr              string           `json:"addr"`
+	Nick              string           `json:"nick,omitempty"`
+	Username          string           `json:"username,omitempty"`
+	Realname          string           `json:"realname,omitempty"`
+	Pass              string           `json:"pass,omitempty"`
+	ConnectCommands   []string         `json:"connect_commands,omitempty"`
+	SASLMechanism     string           `json:"sasl_mechanism,omitempty"`
+	SASLMechanisms    []string         `json:"sasl_mechanisms,omitempty"`
+	SASLPlainUsername string           `json:"sasl_plain_username,omitempty"`
+	SASLPlainPassword string           `json:"sasl_plain_password,omitempty"`
+	SASLPlainAuthzid  string           `json:"sasl_plain_authzid,omitempty"`
+	NickServNick      string           `json:"nickserv_nick,omitempty"`
+	NickServCommand   string           `json:"nickserv_command,omitempty"`
+	NickServPassword  string           `json:"nickserv_password,omitempty"`
+	Enabled           bool             `json:"enabled"`
+	NoLogging         bool             `json:"no_logging,omitempty"`
+	FallbackNicks     []string         `json:"fallback_nicks,omitempty"`
+	AutoJoin          []autoJoinExport `json:"auto_join,omitempty"`
+	SASLPassthrough   bool             `json:"sasl_passthrough,omitempty"`
+	MessageDelay      string           `json:"message_delay,omitempty"`
+	MessageBurst      int              `json:"message_burst,omitempty"`
+	Charset           string           `json:"charset,omitempty"`
+	NoAutoAway        bool             `json:"no_auto_away,omitempty"`
+	AwayMessage       string           `json:"away_message,omitempty"`
+	Group             string           `json:"group,omitempty"`
+	SplitLongMessages bool             `json:"split_long_messages,omitempty"`
+	CTCPAutoReply     bool             `json:"ctcp_auto_reply,omitempty"`
+	CTCPVersion       string           `json:"ctcp_version,omitempty"`
+	CTCPSource        string           `json:"ctcp_source,omitempty"`
+	Passthrough       bool             `json:"passthrough,omitempty"`
+	ConnectTimeout    string           `json:"connect_timeout,omitempty"`
+	NoAutoDetach      bool             `json:"no_auto_detach,omitempty"`
+	SortOrder         int              `json:"sort_order,omitempty"`
+	TLSFingerprint    string           `json:"tls_fingerprint,omitempty"`
+	ServerNotices     string           `json:"server_notices,omitempty"`
+	ServerNoticeAllow []string         `json:"server_notice_allow,omitempty"`
+	ServerNoticeDeny  []string         `json:"server_notice_deny,omitempty"`
+	OnDemand          bool             `json:"on_demand,omitempty"`
+	OnDemandGrace     string           `json:"on_demand_grace,omitempty"`
+	WebIRCPassword    string           `json:"webirc_password,omitempty"`
+	WebIRCGateway     string           `json:"webirc_gateway,omitempty"`
+	JoinDelay         string           `json:"join_delay,omitempty"`
+	JoinBatch         int              `json:"join_batch,omitempty"`
+	TLSMinVersion     string           `json:"tls_min_version,omitempty"`
+	CorrectServerTime bool             `json:"correct_server_time,omitempty"`
+}
+
+type autoJoinExport struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+}
+
+type channelExport struct {
+	Type                    string `json:"type"`
+	Network                 string `json:"network"`
+	Name                    string `json:"name"`
+	Key                     string `json:"key,omitempty"`
+	Detached                bool   `json:"detached,omitempty"`
+	RelayDetached           string `json:"relay_detached,omitempty"`
+	ReattachOn              string `json:"reattach_on,omitempty"`
+	DetachAfter             string `json:"detach_after,omitempty"`
+	DetachOn                string `json:"detach_on,omitempty"`
+	NoLogging               bool   `json:"no_logging,omitempty"`
+	SortOrder               int    `json:"sort_order,omitempty"`
+	RelayDetachedMembership bool   `json:"relay_detached_membership,omitempty"`
+	Muted                   bool   `json:"muted,omitempty"`
+}
+
+func exportFilter(filter MessageFilter) string {
+	if filter == FilterDefault {
+		return ""
+	}
+	return filter.String()
+}
+
+func importFilter(s string) (MessageFilter, error) {
+	if s == "" {
+		return FilterDefault, nil
+	}
+	return parseFilter(s)
+}
+
+// quoteServiceWord quotes s so that splitWords parses it back as a single
+// word.
+func quoteServiceWord(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+const (
+	// Maximum length of the quoted record of a "user import" command, so
+	// that the command fits in an IRC line when sent back to BouncerServ
+	maxServiceImportWordLen = 380
+	// Maximum length of a record split across "user import -part" commands
+	maxServiceImportRecordLen = 64 * 1024
+)
+
+// sendServiceImportCommand sends a record as a "user import" command. Records
+// too long for a single IRC line are split across "user import -part"
+// commands.
+func sendServiceImportCommand(dc *downstreamConn, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var parts []string
+	var part strings.Builder
+	n := 2 // quotes
+	for _, r := range string(b) {
+		l := utf8.RuneLen(r)
+		if r == '\\' || r == '\'' {
+			l++
+		}
+		if n+l > maxServiceImportWordLen {
+			parts = append(parts, part.String())
+			part.Reset()
+			n = 2
+		}
+		part.WriteRune(r)
+		n += l
+	}
+	parts = append(parts, part.String())
+
+	for i, part := range parts {
+		if i < len(parts)-1 {
+			sendServicePRIVMSG(dc, "user import -part "+quoteServiceWord(part))
+		} else {
+			sendServicePRIVMSG(dc, "user import "+quoteServiceWord(part))
+		}
+	}
+	return nil
+}
+
+func handleUserExport(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	secrets := fs.Bool("secrets", false, "")
+
+	username, params := popArg(params)
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unexpected argument")
+	}
+
+	if *secrets && !dc.user.Admin {
+		return fmt.Errorf("you must be an admin to export secrets")
+	}
+
+	record := &dc.user.User
+	if username != "" && username != dc.user.Username && username != fmt.Sprintf("#%v", dc.user.ID) {
+		if !dc.user.Admin && !dc.user.LimitedAdmin {
+			return fmt.Errorf("you must be an admin to export other users")
+		}
+
+		u, err := getUserFromSelector(dc.srv, username)
+		if err != nil {
+			return err
+		}
+		// Read the record from the database, the in-memory state belongs to
+		// the other user's goroutine
+		record, err = dc.srv.db.GetUser(ctx, u.Username)
+		if err != nil {
+			return fmt.Errorf("failed to load user: %v", err)
+		}
+		if !dc.user.Admin && (record.Owner != dc.user.ID || record.Admin) {
+			return fmt.Errorf("you must be an admin to export user %q", u.Username)
+		}
+	}
+
+	networks, err := dc.srv.db.ListNetworks(ctx, record.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	ue := userExport{
+		Type:             "user",
+		Realname:         record.Realname,
+		Timezone:         record.Timezone,
+		IgnoreMasks:      record.IgnoreMasks,
+		LogIgnored:       record.LogIgnored,
+		CertFingerprints: record.CertFingerprints,
+		MsgStore:         record.MsgStore,
+	}
+	if *secrets {
+		ue.Password = record.Password
+	}
+	if err := sendServiceImportCommand(dc, &ue); err != nil {
+		return err
+	}
+
+	for _, net := range networks {
+		ne := networkExport{
+			Type:              "network",
+			Name:              net.Name,
+			Addr:              net.Addr,
+			Nick:              net.Nick,
+			Username:          net.Username,
+			Realname:          net.Realname,
+			SASLMechanism:     net.SASL.Mechanism,
+			SASLMechanisms:    net.SASL.Mechanisms,
+			SASLPlainUsername: net.SASL.Plain.Username,
+			SASLPlainAuthzid:  net.SASL.Plain.Authzid,
+			NickServNick:      net.NickServ.Nick,
+			NickServCommand:   net.NickServ.Command,
+			Enabled:           net.Enabled,
+			NoLogging:         net.NoLogging,
+			FallbackNicks:     net.FallbackNicks,
+			SASLPassthrough:   net.SASLPassthrough,
+			MessageBurst:      net.MessageBurst,
+			Charset:           net.Charset,
+			NoAutoAway:        net.NoAutoAway,
+			AwayMessage:       net.AwayMessage,
+			Group:             net.Group,
+			SplitLongMessages: net.SplitLongMessages,
+			CTCPAutoReply:     net.CTCPAutoReply,
+			CTCPVersion:       net.CTCPVersion,
+			CTCPSource:        net.CTCPSource,
+			Passthrough:       net.Passthrough,
+			NoAutoDetach:      net.NoAutoDetach,
+			SortOrder:         net.SortOrder,
+			TLSFingerprint:    net.TLSFingerprint,
+			ServerNotices:     net.ServerNotices,
+			ServerNoticeAllow: net.ServerNoticeAllow,
+			ServerNoticeDeny:  net.ServerNoticeDeny,
+			OnDemand:          net.OnDemand,
+			JoinBatch:         net.JoinBatch,
+			CorrectServerTime: net.CorrectServerTime,
+		}
+		if net.MessageDelay != 0 {
+			ne.MessageDelay = net.MessageDelay.String()
+		}
+		if net.ConnectTimeout != 0 {
+			ne.ConnectTimeout = net.ConnectTimeout.String()
+		}
+		if net.OnDemandGrace != 0 {
+			ne.OnDemandGrace = net.OnDemandGrace.String()
+		}
+		if net.JoinDelay != 0 {
+			ne.JoinDelay = net.JoinDelay.String()
+		}
+		if net.TLSMinVersion != 0 {
+			ne.TLSMinVersion = config.FormatTLSVersion(net.TLSMinVersion)
+		}
+		for _, ch := range net.AutoJoin {
+			aj := autoJoinExport{Name: ch.Name}
+			if *secrets {
+				aj.Key = ch.Key
+			}
+			ne.AutoJoin = append(ne.AutoJoin, aj)
+		}
+		if *secrets {
+			ne.Pass = net.Pass
+			ne.ConnectCommands = net.ConnectCommands
+			ne.SASLPlainPassword = net.SASL.Plain.Password
+			ne.NickServPassword = net.NickServ.Password
+			// The gateway is useless without the password
+			ne.WebIRCPassword = net.WebIRCPassword
+			ne.WebIRCGateway = net.WebIRCGateway
+		}
+		if err := sendServiceImportCommand(dc, &ne); err != nil {
+			return err
+		}
+
+		channels, err := dc.srv.db.ListChannels(ctx, net.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list channels: %v", err)
+		}
+		for _, ch := range channels {
+			ce := channelExport{
+				Type:                    "channel",
+				Network:                 net.GetName(),
+				Name:                    ch.Name,
+				Detached:                ch.Detached,
+				RelayDetached:           exportFilter(ch.RelayDetached),
+				ReattachOn:              exportFilter(ch.ReattachOn),
+				DetachOn:                exportFilter(ch.DetachOn),
+				NoLogging:               ch.NoLogging,
+				SortOrder:               ch.SortOrder,
+				RelayDetachedMembership: ch.RelayDetachedMembership,
+				Muted:                   ch.Muted,
+			}
+			if ch.DetachAfter != 0 {
+				ce.DetachAfter = ch.DetachAfter.String()
+			}
+			if *secrets {
+				ce.Key = ch.Key
+			}
+			if err := sendServiceImportCommand(dc, &ce); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func handleUserImport(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) == 2 && params[0] == "-part" {
+		if len(dc.importPart)+len(params[1]) > maxServiceImportRecordLen {
+			dc.importPart = ""
+			return fmt.Errorf("record too long")
+		}
+		dc.importPart += params[1]
+		return nil
+	}
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	data := []byte(dc.importPart + params[0])
+	dc.importPart = ""
+
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("invalid record: %v", err)
+	}
+
+	switch header.Type {
+	case "user":
+		var ue userExport
+		if err := json.Unmarshal(data, &ue); err != nil {
+			return fmt.Errorf("invalid user record: %v", err)
+		}
+		return importUser(ctx, dc, &ue)
+	case "network":
+		var ne networkExport
+		if err := json.Unmarshal(data, &ne); err != nil {
+			return fmt.Errorf("invalid network record: %v", err)
+		}
+		return importNetwork(ctx, dc, &ne)
+	case "channel":
+		var ce channelExport
+		if err := json.Unmarshal(data, &ce); err != nil {
+			return fmt.Errorf("invalid channel record: %v", err)
+		}
+		return importChannel(ctx, dc, &ce)
+	default:
+		return fmt.Errorf("unknown record type %q", header.Type)
+	}
+}
+
+func importUser(ctx context.Context, dc *downstreamConn, ue *userExport) error {
+	if ue.Timezone != "" {
+		if _, err := time.LoadLocation(ue.Timezone); err != nil {
+			return fmt.Errorf("unknown time zone %q", ue.Timezone)
+		}
+	}
+
+	masks := make([]string, 0, len(ue.IgnoreMasks))
+	for _, m := range ue.IgnoreMasks {
+		mask := normalizeMask(m)
+		if strings.ContainsAny(mask, " ,") {
+			return fmt.Errorf("invalid mask %q", m)
+		}
+		masks = append(masks, mask)
+	}
+
+	msgStore, err := parseMsgStore(dc.srv, ue.MsgStore)
+	if err != nil {
+		return err
+	}
+
+	fps := make([]string, 0, len(ue.CertFingerprints))
+	for _, s := range ue.CertFingerprints {
+		fp, err := parseCertFingerprint(s)
+		if err != nil {
+			return err
+		}
+		fps = append(fps, fp)
+	}
+
+	// copy the user record because we'll mutate it
+	record := dc.user.User
+	if ue.Password != "" {
+		if _, err := bcrypt.Cost([]byte(ue.Password)); err != nil {
+			return fmt.Errorf("invalid password hash")
+		}
+		record.Password = ue.Password
+	}
+	record.Realname = ue.Realname
+	record.Timezone = ue.Timezone
+	record.IgnoreMasks = masks
+	record.LogIgnored = ue.LogIgnored
+	record.CertFingerprints = fps
+	record.MsgStore = msgStore
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("imported user settings for %q", dc.user.Username))
+	return nil
+}
+
+func importNetwork(ctx context.Context, dc *downstreamConn, ne *networkExport) error {
+	record := &Network{
+		Name:              ne.Name,
+		Addr:              ne.Addr,
+		Nick:              ne.Nick,
+		Username:          ne.Username,
+		Realname:          ne.Realname,
+		Pass:              ne.Pass,
+		ConnectCommands:   ne.ConnectCommands,
+		Enabled:           ne.Enabled,
+		NoLogging:         ne.NoLogging,
+		FallbackNicks:     ne.FallbackNicks,
+		SASLPassthrough:   ne.SASLPassthrough,
+		MessageBurst:      ne.MessageBurst,
+		Charset:           ne.Charset,
+		NoAutoAway:        ne.NoAutoAway,
+		AwayMessage:       ne.AwayMessage,
+		Group:             ne.Group,
+		SplitLongMessages: ne.SplitLongMessages,
+		CTCPAutoReply:     ne.CTCPAutoReply,
+		CTCPVersion:       ne.CTCPVersion,
+		CTCPSource:        ne.CTCPSource,
+		Passthrough:       ne.Passthrough,
+		NoAutoDetach:      ne.NoAutoDetach,
+		SortOrder:         ne.SortOrder,
+		OnDemand:          ne.OnDemand,
+		WebIRCPassword:    ne.WebIRCPassword,
+		WebIRCGateway:     ne.WebIRCGateway,
+		JoinBatch:         ne.JoinBatch,
+		CorrectServerTime: ne.CorrectServerTime,
+	}
+	for _, aj := range ne.AutoJoin {
+		record.AutoJoin = append(record.AutoJoin, AutoJoinChannel{Name: aj.Name, Key: aj.Key})
+	}
+	record.SASL.Mechanism = ne.SASLMechanism
+	record.SASL.Mechanisms = ne.SASLMechanisms
+	record.SASL.Plain.Username = ne.SASLPlainUsername
+	record.SASL.Plain.Password = ne.SASLPlainPassword
+	record.SASL.Plain.Authzid = ne.SASLPlainAuthzid
+	record.NickServ.Nick = ne.NickServNick
+	record.NickServ.Command = ne.NickServCommand
+	record.NickServ.Password = ne.NickServPassword
+	if err := checkMessageBurst(ne.MessageBurst); err != nil {
+		return err
+	}
+	if ne.MessageDelay != "" {
+		d, err := time.ParseDuration(ne.MessageDelay)
+		if err != nil {
+			return fmt.Errorf("invalid message delay %q", ne.MessageDelay)
+		}
+		if err := checkMessageDelay(d); err != nil {
+			return err
+		}
+		record.MessageDelay = d
+	}
+	if ne.ConnectTimeout != "" {
+		d, err := time.ParseDuration(ne.ConnectTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid connect timeout %q", ne.ConnectTimeout)
+		}
+		if err := checkConnectTimeout(d); err != nil {
+			return err
+		}
+		record.ConnectTimeout = d
+	}
+	if ne.OnDemandGrace != "" {
+		d, err := time.ParseDuration(ne.OnDemandGrace)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid on-demand grace period %q", ne.OnDemandGrace)
+		}
+		record.OnDemandGrace = d
+	}
+	if ne.JoinDelay != "" {
+		d, err := time.ParseDuration(ne.JoinDelay)
+		if err != nil || d < minUpstreamMessageDelay || d > maxUpstreamMessageDelay {
+			return fmt.Errorf("invalid join delay %q", ne.JoinDelay)
+		}
+		record.JoinDelay = d
+	}
+	if ne.JoinBatch < 0 {
+		return fmt.Errorf("invalid join batch %v", ne.JoinBatch)
+	}
+	if ne.TLSMinVersion != "" {
+		v, err := config.ParseTLSVersion(ne.TLSMinVersion)
+		if err != nil {
+			return err
+		}
+		record.TLSMinVersion = v
+	}
+	if ne.TLSFingerprint != "" {
+		fp, err := parseTLSFingerprint(ne.TLSFingerprint)
+		if err != nil {
+			return err
+		}
+		record.TLSFingerprint = fp
+	}
+	switch ne.ServerNotices {
+	case serverNoticesRelay, serverNoticesDrop, serverNoticesRedirect:
+		record.ServerNotices = ne.ServerNotices
+	default:
+		return fmt.Errorf("unknown server notices policy %q", ne.ServerNotices)
+	}
+	if ne.ServerNoticeAllow != nil {
+		patterns, err := parseServerNoticePatterns("server_notice_allow", ne.ServerNoticeAllow)
+		if err != nil {
+			return err
+		}
+		record.ServerNoticeAllow = patterns
+	}
+	if ne.ServerNoticeDeny != nil {
+		patterns, err := parseServerNoticePatterns("server_notice_deny", ne.ServerNoticeDeny)
+		if err != nil {
+			return err
+		}
+		record.ServerNoticeDeny = patterns
+	}
+
+	if dc.user.getNetwork(record.GetName()) != nil {
+		return fmt.Errorf("network %q already exists", record.GetName())
+	}
+
+	network, err := dc.user.createNetwork(ctx, record)
+	if err != nil {
+		return fmt.Errorf("could not create network: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("imported network %q", network.GetName()))
+	return nil
+}
+
+func importChannel(ctx context.Context, dc *downstreamConn, ce *channelExport) error {
+	net := dc.user.getNetwork(ce.Network)
+	if net == nil {
+		return fmt.Errorf("unknown network %q", ce.Network)
+	}
+	if ce.Name == "" {
+		return fmt.Errorf("missing channel name")
+	}
 
-	if err := fs.Parse(params); err != nil {
+	relayDetached, err := importFilter(ce.RelayDetached)
+	if err != nil {
 		return err
 	}
-
-	net, err := getNetworkFromFlag(dc, *netName)
+	reattachOn, err := importFilter(ce.ReattachOn)
 	if err != nil {
 		return err
 	}
+	detachOn, err := importFilter(ce.DetachOn)
+	if err != nil {
+		return err
+	}
+	var detachAfter time.Duration
+	if ce.DetachAfter != "" {
+		detachAfter, err = time.ParseDuration(ce.DetachAfter)
+		if err != nil || detachAfter < 0 {
+			return fmt.Errorf("invalid detach-after value %q", ce.DetachAfter)
+		}
+	}
 
-	net.SASL.Plain.Username = ""
-	net.SASL.Plain.Password = ""
-	net.SASL.External.CertBlob = nil
-	net.SASL.External.PrivKeyBlob = nil
-	net.SASL.Mechanism = ""
+	ch := net.channels.Value(ce.Name)
+	isNew := ch == nil
+	if isNew {
+		ch = &Channel{Name: ce.Name, Detached: ce.Detached}
+		net.channels.SetValue(ce.Name, ch)
+	} else if ce.Detached {
+		net.detach(ch)
+	} else {
+		net.attach(ctx, ch)
+	}
+	if ce.Key != "" {
+		ch.Key = ce.Key
+	}
+	ch.RelayDetached = relayDetached
+	ch.ReattachOn = reattachOn
+	ch.DetachAfter = detachAfter
+	ch.DetachOn = detachOn
+	ch.NoLogging = ce.NoLogging
+	ch.RelayDetachedMembership = ce.RelayDetachedMembership
+	ch.Muted = ce.Muted
+	ch.SortOrder = ce.SortOrder
 
-	if err := dc.srv.db.StoreNetwork(ctx, dc.user.ID, &net.Network); err != nil {
-		return err
+	if uc := net.conn; uc != nil {
+		if isNew {
+			params := []string{ch.Name}
+			if ch.Key != "" {
+				params = append(params, ch.Key)
+			}
+			uc.SendMessage(ctx, &irc.Message{
+				Command: "JOIN",
+				Params:  params,
+			})
+		}
+		uc.updateChannelAutoDetach(ch.Name)
 	}
 
-	sendServicePRIVMSG(dc, "credentials reset")
+	if err := dc.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+		return fmt.Errorf("failed to store channel: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("imported channel %q on network %q", ch.Name, net.GetName()))
 	return nil
 }
 
-func handleUserCreate(ctx context.Context, dc *downstreamConn, params []string) error {
+// Minimum length of the passwords set with the user password command
+const minPasswordLength = 8
+
+// checkPasswordStrength checks that a password is long enough and mixes
+// different kinds of characters.
+func checkPasswordStrength(username, password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("password must be at least %v characters long", minPasswordLength)
+	}
+	if strings.EqualFold(password, username) {
+		return fmt.Errorf("password must not be the username")
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return fmt.Errorf("password must contain at least two of: lowercase letters, uppercase letters, digits, other characters")
+	}
+	return nil
+}
+
+func handleUserPassword(ctx context.Context, dc *downstreamConn, params []string) error {
+	var keepSession *bool
 	fs := newFlagSet()
-	username := fs.String("username", "", "")
-	password := fs.String("password", "", "")
-	realname := fs.String("realname", "", "")
-	admin := fs.Bool("admin", false, "")
+	fs.Var(boolPtrFlag{&keepSession}, "keep-session", "")
 
 	if err := fs.Parse(params); err != nil {
 		return err
 	}
-	if *username == "" {
-		return fmt.Errorf("flag -username is required")
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected exactly two arguments")
 	}
-	if *password == "" {
-		return fmt.Errorf("flag -password is required")
+	oldPassword, newPassword := fs.Arg(0), fs.Arg(1)
+
+	if _, ok := dc.srv.Authenticator.(*dbAuthenticator); !ok {
+		return fmt.Errorf("passwords are managed by an external authentication provider")
+	}
+	if dc.user.Password == "" {
+		return fmt.Errorf("password authentication is disabled for this user")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(dc.user.Password), []byte(oldPassword)); err != nil {
+		return fmt.Errorf("old password doesn't match")
+	}
+	if newPassword == oldPassword {
+		return fmt.Errorf("new password must differ from the old password")
+	}
+	if err := checkPasswordStrength(dc.user.Username, newPassword); err != nil {
+		return err
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %v", err)
 	}
 
-	user := &User{
-		Username: *username,
-		Password: string(hashed),
-		Realname: *realname,
-		Admin:    *admin,
-	}
-	if _, err := dc.srv.createUser(ctx, user); err != nil {
-		return fmt.Errorf("could not create user: %v", err)
+	record := dc.user.User
+	record.Password = string(hashed)
+	if err := dc.user.updateUser(ctx, &record); err != nil {
+		return err
 	}
 
-	sendServicePRIVMSG(dc, fmt.Sprintf("created user %q", *username))
+	// Other connections and suspended sessions must re-authenticate with the
+	// new password
+	if keepSession == nil || *keepSession {
+		dc.user.revokeSessions(dc)
+		sendServicePRIVMSG(dc, "password changed, other connections have been closed")
+	} else {
+		sendServicePRIVMSG(dc, "password changed, all connections are being closed")
+		dc.user.revokeSessions(nil)
+	}
 	return nil
 }
 
-func popArg(params []string) (string, []string) {
-	if len(params) > 0 && !strings.HasPrefix(params[0], "-") {
-		return params[0], params[1:]
+func handleUserDelete(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
 	}
-	return "", params
+	u, err := getUserFromSelector(dc.srv, params[0])
+	if err != nil {
+		return err
+	}
+	if err := checkUserScope(ctx, dc, u); err != nil {
+		return err
+	}
+
+	u.stop()
+
+	if err := dc.srv.db.DeleteUser(ctx, u.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("deleted user %q", u.Username))
+	return nil
 }
 
-func handleUserUpdate(ctx context.Context, dc *downstreamConn, params []string) error {
-	var password, realname *string
-	var admin *bool
+func handleUserPurgeLogs(ctx context.Context, dc *downstreamConn, params []string) error {
 	fs := newFlagSet()
-	fs.Var(stringPtrFlag{&password}, "password", "")
-	fs.Var(stringPtrFlag{&realname}, "realname", "")
-	fs.Var(boolPtrFlag{&admin}, "admin", "")
+	netName := fs.String("network", "", "")
+	target := fs.String("target", "", "")
 
-	username, params := popArg(params)
 	if err := fs.Parse(params); err != nil {
 		return err
 	}
-	if len(fs.Args()) > 0 {
-		return fmt.Errorf("unexpected argument")
+	if fs.NArg() > 1 {
+		return fmt.Errorf("expected at most one argument")
 	}
 
-	var hashed *string
-	if password != nil {
-		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	var net *network
+	if *netName != "" || *target != "" {
+		var err error
+		net, err = getNetworkFromFlag(dc, *netName)
 		if err != nil {
-			return fmt.Errorf("failed to hash password: %v", err)
+			return err
 		}
-		hashedStr := string(hashedBytes)
-		hashed = &hashedStr
 	}
 
-	if username != "" && username != dc.user.Username {
-		if !dc.user.Admin {
-			return fmt.Errorf("you must be an admin to update other users")
-		}
-		if realname != nil {
-			return fmt.Errorf("cannot update -realname of other user")
-		}
-
-		u := dc.srv.getUser(username)
-		if u == nil {
-			return fmt.Errorf("unknown username %q", username)
-		}
+	cmd := "user purge-logs"
+	scope := "all your stored messages"
+	if net != nil {
+		cmd += " -network " + quoteServiceWord(net.GetName())
+		scope = fmt.Sprintf("your stored messages on network %q", net.GetName())
+	}
+	if *target != "" {
+		cmd += " -target " + quoteServiceWord(*target)
+		scope = fmt.Sprintf("your stored messages with %q on network %q", *target, net.GetName())
+	}
 
-		done := make(chan error, 1)
-		event := eventUserUpdate{
-			password: hashed,
-			admin:    admin,
-			done:     done,
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case u.events <- event:
-		}
-		// TODO: send context to the other side
-		if err := <-done; err != nil {
-			return err
-		}
+	// The token covers the scope of the deletion, so that a confirmation
+	// for a single target cannot be replayed to delete everything
+	hash := sha1.Sum([]byte(dc.user.Username + "\x00" + cmd))
+	token := hex.EncodeToString(hash[:3])
+	if fs.NArg() == 0 {
+		sendServicePRIVMSG(dc, fmt.Sprintf("This will permanently delete %v. To confirm, send: %v %v", scope, cmd, token))
+		return nil
+	}
+	if fs.Arg(0) != token {
+		return fmt.Errorf("confirmation token doesn't match")
+	}
 
-		sendServicePRIVMSG(dc, fmt.Sprintf("updated user %q", username))
+	var err error
+	if net == nil {
+		err = dc.user.purgeLogs(ctx)
 	} else {
-		// copy the user record because we'll mutate it
-		record := dc.user.User
+		err = net.purgeLogs(ctx, *target)
+	}
+	dc.user.updateMsgStoreStats()
+	if err != nil {
+		return fmt.Errorf("failed to delete messages: %v", err)
+	}
 
-		if hashed != nil {
-			record.Password = *hashed
-		}
-		if realname != nil {
-			record.Realname = *realname
-		}
-		if admin != nil {
-			return fmt.Errorf("cannot update -admin of own user")
-		}
+	sendServicePRIVMSG(dc, fmt.Sprintf("deleted %v", scope))
+	return nil
+}
 
-		if err := dc.user.updateUser(ctx, &record); err != nil {
-			return err
-		}
+func handleUserRename(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+	newUsername := params[1]
+	if err := checkUsername(newUsername); err != nil {
+		return err
+	}
 
-		sendServicePRIVMSG(dc, fmt.Sprintf("updated user %q", dc.user.Username))
+	u, err := getUserFromSelector(dc.srv, params[0])
+	if err != nil {
+		return err
+	}
+	if u == dc.user {
+		return fmt.Errorf("cannot rename the current user")
+	}
+	if err := checkUserScope(ctx, dc, u); err != nil {
+		return err
+	}
+	oldUsername := u.Username
+	if oldUsername == newUsername {
+		return fmt.Errorf("user %q already has this username", oldUsername)
+	}
+
+	if _, err := dc.srv.renameUser(ctx, u, newUsername); err != nil {
+		return err
 	}
 
+	sendServicePRIVMSG(dc, fmt.Sprintf("renamed user %q to %q", oldUsername, newUsername))
 	return nil
 }
 
-func handleUserDelete(ctx context.Context, dc *downstreamConn, params []string) error {
-	if len(params) != 1 {
-		return fmt.Errorf("expected exactly one argument")
+func handleUserDebug(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
 	}
-	username := params[0]
 
-	u := dc.srv.getUser(username)
-	if u == nil {
-		return fmt.Errorf("unknown username %q", username)
+	u, err := getUserFromSelector(dc.srv, params[0])
+	if err != nil {
+		return err
+	}
+	enabled, err := strconv.ParseBool(params[1])
+	if err != nil {
+		return fmt.Errorf("invalid value %q: %v", params[1], err)
 	}
 
-	u.stop()
-
-	if err := dc.srv.db.DeleteUser(ctx, u.ID); err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
+	var v int32
+	if enabled {
+		v = 1
 	}
+	atomic.StoreInt32(&u.debugLogging, v)
 
-	sendServicePRIVMSG(dc, fmt.Sprintf("deleted user %q", username))
+	if enabled {
+		u.logger.Printf("debug logging enabled by %q", dc.user.Username)
+		sendServicePRIVMSG(dc, fmt.Sprintf("enabled debug logging for user %q", u.Username))
+	} else {
+		u.logger.Printf("debug logging disabled by %q", dc.user.Username)
+		sendServicePRIVMSG(dc, fmt.Sprintf("disabled debug logging for user %q", u.Username))
+	}
 	return nil
 }
 
@@ -1013,18 +3242,23 @@ func handleServiceChannelStatus(ctx context.Context, dc *downstreamConn, params
 
 	n := 0
 
-	sendNetwork := func(net *network) {
-		var channels []*Channel
-		for _, entry := range net.channels.innerMap {
-			channels = append(channels, entry.value.(*Channel))
-		}
+	store, _ := dc.user.msgStore.(chatHistoryMessageStore)
 
-		sort.Slice(channels, func(i, j int) bool {
-			return strings.ReplaceAll(channels[i].Name, "#", "") <
-				strings.ReplaceAll(channels[j].Name, "#", "")
-		})
+	sendNetwork := func(net *network) error {
+		// Fetch the last activity of all targets at once, reading each
+		// channel's history would be too expensive
+		lastActivity := make(map[string]time.Time)
+		if store != nil {
+			targets, err := store.ListTargets(ctx, &net.Network, time.Now(), time.Time{}, math.MaxInt32, false)
+			if err != nil {
+				return fmt.Errorf("failed to list targets of network %q: %v", net.GetName(), err)
+			}
+			for _, target := range targets {
+				lastActivity[target.Name] = target.LatestMessage
+			}
+		}
 
-		for _, ch := range channels {
+		for _, ch := range net.sortedChannels() {
 			var uch *upstreamChannel
 			if net.conn != nil {
 				uch = net.conn.channels.Value(ch.Name)
@@ -1037,7 +3271,7 @@ func handleServiceChannelStatus(ctx context.Context, dc *downstreamConn, params
 
 			var status string
 			if uch != nil {
-				status = "joined"
+				status = fmt.Sprintf("joined, %v members", uch.Members.Len())
 			} else if net.conn != nil {
 				status = "parted"
 			} else {
@@ -1047,24 +3281,35 @@ func handleServiceChannelStatus(ctx context.Context, dc *downstreamConn, params
 			if ch.Detached {
 				status += ", detached"
 			}
+			if ch.NoLogging {
+				status += ", not logged"
+			}
+			if t, ok := lastActivity[net.casemap(ch.Name)]; ok {
+				status += ", last activity " + t.Format(time.RFC3339)
+			}
 
 			s := fmt.Sprintf("%v [%v]", name, status)
 			sendServicePRIVMSG(dc, s)
 
 			n++
 		}
+		return nil
 	}
 
 	if *networkName == "" {
 		for _, net := range dc.user.networks {
-			sendNetwork(net)
+			if err := sendNetwork(net); err != nil {
+				return err
+			}
 		}
 	} else {
 		net := dc.user.getNetwork(*networkName)
 		if net == nil {
 			return fmt.Errorf("unknown network %q", *networkName)
 		}
-		sendNetwork(net)
+		if err := sendNetwork(net); err != nil {
+			return err
+		}
 	}
 
 	if n == 0 {
@@ -1077,6 +3322,7 @@ func handleServiceChannelStatus(ctx context.Context, dc *downstreamConn, params
 type channelFlagSet struct {
 	*flag.FlagSet
 	RelayDetached, ReattachOn, DetachAfter, DetachOn *string
+	NoLogging, RelayDetachedMembership, Muted        *bool
 }
 
 func newChannelFlagSet() *channelFlagSet {
@@ -1085,6 +3331,9 @@ func newChannelFlagSet() *channelFlagSet {
 	fs.Var(stringPtrFlag{&fs.ReattachOn}, "reattach-on", "")
 	fs.Var(stringPtrFlag{&fs.DetachAfter}, "detach-after", "")
 	fs.Var(stringPtrFlag{&fs.DetachOn}, "detach-on", "")
+	fs.Var(boolPtrFlag{&fs.NoLogging}, "no-logging", "")
+	fs.Var(boolPtrFlag{&fs.RelayDetachedMembership}, "relay-detached-membership", "")
+	fs.Var(boolPtrFlag{&fs.Muted}, "muted", "")
 	return fs
 }
 
@@ -1117,6 +3366,15 @@ func (fs *channelFlagSet) update(channel *Channel) error {
 		}
 		channel.DetachOn = filter
 	}
+	if fs.NoLogging != nil {
+		channel.NoLogging = *fs.NoLogging
+	}
+	if fs.RelayDetachedMembership != nil {
+		channel.RelayDetachedMembership = *fs.RelayDetachedMembership
+	}
+	if fs.Muted != nil {
+		channel.Muted = *fs.Muted
+	}
 	return nil
 }
 
@@ -1150,11 +3408,62 @@ func handleServiceChannelUpdate(ctx context.Context, dc *downstreamConn, params
 	if err := dc.srv.db.StoreChannel(ctx, uc.network.ID, ch); err != nil {
 		return fmt.Errorf("failed to update channel: %v", err)
 	}
+	dc.user.notifyBouncerChannelState(uc.network, ch)
 
 	sendServicePRIVMSG(dc, fmt.Sprintf("updated channel %q", name))
 	return nil
 }
 
+func handleServiceChannelReorder(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) == 0 {
+		return fmt.Errorf("expected at least one channel")
+	}
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	if err := net.reorderChannels(ctx, fs.Args()); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("reordered channels for network %q", net.GetName()))
+	return nil
+}
+
+func handleServiceChannelMoveLogs(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	netName := fs.String("network", "", "")
+	merge := fs.Bool("merge", false, "")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+	oldName, newName := fs.Arg(0), fs.Arg(1)
+
+	net, err := getNetworkFromFlag(dc, *netName)
+	if err != nil {
+		return err
+	}
+
+	if err := net.renameTarget(ctx, oldName, newName, *merge); err != nil {
+		return fmt.Errorf("failed to move logs: %v", err)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("moved logs of %q to %q", oldName, newName))
+	return nil
+}
+
 func handleServiceServerStatus(ctx context.Context, dc *downstreamConn, params []string) error {
 	dbStats, err := dc.user.srv.db.Stats(ctx)
 	if err != nil {
@@ -1162,6 +3471,49 @@ func handleServiceServerStatus(ctx context.Context, dc *downstreamConn, params [
 	}
 	serverStats := dc.user.srv.Stats()
 	sendServicePRIVMSG(dc, fmt.Sprintf("%v/%v users, %v downstreams, %v upstreams, %v networks, %v channels", serverStats.Users, dbStats.Users, serverStats.Downstreams, serverStats.Upstreams, dbStats.Networks, dbStats.Channels))
+	if dc.srv.Config().UserMessageDelay != 0 {
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v throttled users", serverStats.ThrottledUsers))
+	}
+	if serverStats.OldestMessage.IsZero() {
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v stored messages, %v bytes of message logs", serverStats.Messages, serverStats.MessageLogSize))
+	} else {
+		sendServicePRIVMSG(dc, fmt.Sprintf("%v stored messages, %v bytes of message logs, oldest message from %v", serverStats.Messages, serverStats.MessageLogSize, serverStats.OldestMessage.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+func handleServiceServerPost(ctx context.Context, dc *downstreamConn, params []string) error {
+	fs := newFlagSet()
+	username := fs.String("user", "", "post for a single user")
+	sender := fs.String("sender", serviceNick, "nickname of the sender")
+
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+	channel, text := fs.Arg(0), fs.Arg(1)
+
+	if err := dc.srv.postLocalMessage(ctx, dc.user, *username, channel, *sender, text); err != nil {
+		return err
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("posted message to %q", channel))
+	return nil
+}
+
+func handleServiceServerUnlock(ctx context.Context, dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	name := params[0]
+
+	if !dc.srv.logins.clear(name) {
+		return fmt.Errorf("no failed login attempts recorded for %q", name)
+	}
+
+	sendServicePRIVMSG(dc, fmt.Sprintf("cleared failed login attempts for %q", name))
 	return nil
 }
 
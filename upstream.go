@@ -7,16 +7,20 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-sasl"
+	"golang.org/x/text/encoding"
 	"gopkg.in/irc.v3"
+	"nhooyr.io/websocket"
 )
 
 // permanentUpstreamCaps is the static list of upstream capabilities always
@@ -36,10 +40,22 @@ var permanentUpstreamCaps = map[string]bool{
 	"server-time":      true,
 	"setname":          true,
 
+	"extended-monitor": true,
+
 	"draft/account-registration": true,
 	"draft/extended-monitor":     true,
+	"draft/multiline":            true,
 }
 
+const (
+	// Minimum offset between the clock of an upstream server and ours for
+	// the server-time tags it sends to be considered skewed
+	maxServerTimeSkew = time.Minute
+	// Number of live messages the clock offset of an upstream server is
+	// estimated from
+	serverTimeSamples = 8
+)
+
 type registrationError struct {
 	*irc.Message
 }
@@ -68,6 +84,57 @@ func (err registrationError) Temporary() bool {
 	}
 }
 
+// fatalServerError is returned when the server sends an ERROR message, right
+// before closing the connection.
+type fatalServerError struct {
+	text string
+}
+
+func (err fatalServerError) Error() string {
+	return fmt.Sprintf("fatal server error: %v", err.text)
+}
+
+// upstreamErrorDetails extracts the numeric or reply code and the reason sent
+// by the upstream server from an error. Empty strings are returned if the
+// error didn't originate from the server.
+func upstreamErrorDetails(err error) (code, reason string) {
+	var regErr registrationError
+	var fatalErr fatalServerError
+	switch {
+	case errors.As(err, &regErr):
+		code = regErr.Command
+		if regErr.Command == "FAIL" && len(regErr.Params) > 1 {
+			code = regErr.Params[1]
+		}
+		return code, regErr.Reason()
+	case errors.As(err, &fatalErr):
+		return "ERROR", fatalErr.text
+	default:
+		return "", ""
+	}
+}
+
+// authFailureError is returned when SASL authentication has failed too many
+// times in a row. Reconnecting would likely fail again and could get the
+// account locked.
+type authFailureError struct {
+	failures int
+}
+
+func (err authFailureError) Error() string {
+	return fmt.Sprintf("SASL authentication failed %v times in a row, not reconnecting anymore (fix the credentials and update the network to retry)", err.failures)
+}
+
+// stsUpgradeError is returned when the server requires clients to upgrade the
+// plain-text connection to TLS via an STS policy.
+type stsUpgradeError struct {
+	port int
+}
+
+func (err stsUpgradeError) Error() string {
+	return fmt.Sprintf("STS policy requires upgrading to TLS on port %v", err.port)
+}
+
 type upstreamChannel struct {
 	Name         string
 	conn         *upstreamConn
@@ -103,6 +170,7 @@ func (uc *upstreamChannel) updateAutoDetach(dur time.Duration) {
 type pendingUpstreamCommand struct {
 	downstreamID uint64
 	msg          *irc.Message
+	labeled      *labeledResponse // nil if the downstream command has no label
 }
 
 type upstreamConn struct {
@@ -110,6 +178,7 @@ type upstreamConn struct {
 
 	network *network
 	user    *user
+	charset encoding.Encoding // nil for UTF-8
 
 	serverPrefix          *irc.Prefix
 	serverName            string
@@ -133,27 +202,66 @@ type upstreamConn struct {
 	account     string
 	nextLabelID uint64
 	monitored   monitorCasemapMap
+	// Reference of the last batch sent
+	lastBatchRef uint64
 
 	saslClient  sasl.Client
 	saslStarted bool
+	// SASL mechanism attempted or used during registration, and mechanisms
+	// left to attempt if it fails
+	saslMechanism string
+	saslFallbacks []string
+	// ID of the downstream whose SASL exchange is relayed as-is, zero if none
+	saslPassthroughID uint64
 
 	casemapIsSet bool
 
+	// Number of fallback nicks tried during registration
+	fallbackNicks int
+
+	// TLS port used because of an STS policy, zero if the connection wasn't
+	// upgraded
+	stsPort int
+	// STS policy advertised by the server over the upgraded connection
+	stsPolicy *stsPolicy
+
 	// Queue of commands in progress, indexed by type. The first entry has been
 	// sent to the server and is awaiting reply. The following entries have not
 	// been sent yet.
 	pendingCmds map[string][]pendingUpstreamCommand
+	// Labeled downstream commands awaiting replies, indexed by the label
+	// sent to the server
+	labeledResponses map[string]*labeledResponse
 
 	gotMotd bool
+
+	// Time of the last automatic reply to a CTCP query
+	lastCTCPReply time.Time
+
+	// JOIN messages sent upon connection which are waiting for JoinDelay
+	pendingJoins []*irc.Message
+
+	// Whether we're waiting for NickServ to prompt us to identify
+	nickServPending bool
+	// Text of the message sent to identify with NickServ, until the server
+	// echoes it
+	nickServEcho string
+
+	// Offsets between our clock and the server-time tags of the last live
+	// messages, and the resulting skew of the server clock (zero if below
+	// maxServerTimeSkew)
+	timeOffsets  []time.Duration
+	timeSkew     time.Duration
+	timeSkewSeen bool
 }
 
 func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, error) {
-	logger := &prefixLogger{network.user.logger, fmt.Sprintf("upstream %q: ", network.GetName())}
+	logger := newPrefixLogger(network.user.logger, "upstream", network.GetName())
 
-	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	ctx, cancel := context.WithTimeout(ctx, network.connectTimeout())
 	defer cancel()
 
-	var dialer net.Dialer
+	dialer := net.Dialer{Resolver: network.user.srv.Config().UpstreamResolver}
 
 	u, err := network.URL()
 	if err != nil {
@@ -161,6 +269,8 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 	}
 
 	var netConn net.Conn
+	var ircConn ircConn
+	var stsPort int
 	switch u.Scheme {
 	case "ircs":
 		addr := u.Host
@@ -177,26 +287,12 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 
 		logger.Printf("connecting to TLS server at address %q", addr)
 
-		tlsConfig := &tls.Config{ServerName: host, NextProtos: []string{"irc"}}
-		if network.SASL.Mechanism == "EXTERNAL" {
-			if network.SASL.External.CertBlob == nil {
-				return nil, fmt.Errorf("missing certificate for authentication")
-			}
-			if network.SASL.External.PrivKeyBlob == nil {
-				return nil, fmt.Errorf("missing private key for authentication")
-			}
-			key, err := x509.ParsePKCS8PrivateKey(network.SASL.External.PrivKeyBlob)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse private key: %v", err)
-			}
-			tlsConfig.Certificates = []tls.Certificate{
-				{
-					Certificate: [][]byte{network.SASL.External.CertBlob},
-					PrivateKey:  key.(crypto.PrivateKey),
-				},
-			}
-			logger.Printf("using TLS client certificate %x", sha256.Sum256(network.SASL.External.CertBlob))
+		tlsConfig, err := upstreamTLSConfig(network, logger)
+		if err != nil {
+			return nil, err
 		}
+		tlsConfig.ServerName = host
+		tlsConfig.NextProtos = []string{"irc"}
 
 		netConn, err = dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
@@ -220,31 +316,103 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 			return nil, fmt.Errorf("failed to pick local IP for remote host %q: %v", host, err)
 		}
 
-		logger.Printf("connecting to plain-text server at address %q", addr)
+		stsPort = network.stsPort()
+		if stsPort == 0 {
+			logger.Printf("connecting to plain-text server at address %q", addr)
+			netConn, err = dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to dial %q: %v", addr, err)
+			}
+			break
+		}
+
+		// Never downgrade to plain-text while an STS policy is in effect
+		addr = net.JoinHostPort(host, strconv.Itoa(stsPort))
+		logger.Printf("connecting to TLS server at address %q as required by STS policy", addr)
+
+		tlsConfig, err := upstreamTLSConfig(network, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+		tlsConfig.NextProtos = []string{"irc"}
+
 		netConn, err = dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
-			return nil, fmt.Errorf("failed to dial %q: %v", addr, err)
+			return nil, fmt.Errorf("failed to dial %q as required by STS policy: %v", addr, err)
 		}
+		netConn = tls.Client(netConn, tlsConfig)
 	case "irc+unix", "unix":
 		logger.Printf("connecting to Unix socket at path %q", u.Path)
 		netConn, err = dialer.DialContext(ctx, "unix", u.Path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to Unix socket %q: %v", u.Path, err)
 		}
+	case "irc+wss", "irc+ws":
+		wsURL := *u
+		wsURL.Scheme = strings.TrimPrefix(u.Scheme, "irc+")
+
+		dialer.LocalAddr, err = network.user.localTCPAddrForHost(ctx, u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick local IP for remote host %q: %v", u.Hostname(), err)
+		}
+
+		transport := &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: dialer.DialContext,
+		}
+		if wsURL.Scheme == "wss" {
+			transport.TLSClientConfig, err = upstreamTLSConfig(network, logger)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		logger.Printf("connecting to WebSocket server at URL %q", wsURL.String())
+		wsConn, _, err := websocket.Dial(ctx, wsURL.String(), &websocket.DialOptions{
+			HTTPClient:   &http.Client{Transport: transport},
+			Subprotocols: websocketSubprotocols,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial %q: %v", wsURL.String(), err)
+		}
+		ircConn = newWebsocketIRCConn(wsConn, u.Host)
 	default:
 		return nil, fmt.Errorf("failed to dial %q: unknown scheme: %v", network.Addr, u.Scheme)
 	}
 
+	if ircConn == nil {
+		ircConn = newNetIRCConn(netConn)
+	}
+
+	charset, err := lookupCharset(network.Charset)
+	if err != nil {
+		ircConn.Close()
+		return nil, err
+	}
+
+	// Messages sent to NickServ may contain passwords
+	nickServCM := casemapASCII(network.nickServNick())
+
 	options := connOptions{
 		Logger:         logger,
-		RateLimitDelay: upstreamMessageDelay,
-		RateLimitBurst: upstreamMessageBurst,
+		RateLimitDelay: network.messageDelay(),
+		RateLimitBurst: network.messageBurst(),
+		WaitMessage:    network.user.waitMessageRate,
+		Redact: func(msg *irc.Message) bool {
+			if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) == 0 {
+				return false
+			}
+			target := casemapASCII(msg.Params[0])
+			return target == nickServCM || target == "nickserv"
+		},
 	}
 
 	uc := &upstreamConn{
-		conn:                  *newConn(network.user.srv, newNetIRCConn(netConn), &options),
+		conn:                  *newConn(network.user.srv, ircConn, &options),
 		network:               network,
 		user:                  network.user,
+		charset:               charset,
 		channels:              upstreamChannelCasemapMap{newCasemapMap(0)},
 		caps:                  newCapRegistry(),
 		batches:               make(map[string]batch),
@@ -254,15 +422,106 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 		availableMemberships:  stdMemberships,
 		isupport:              make(map[string]*string),
 		pendingCmds:           make(map[string][]pendingUpstreamCommand),
+		labeledResponses:      make(map[string]*labeledResponse),
 		monitored:             monitorCasemapMap{newCasemapMap(0)},
+		stsPort:               stsPort,
 	}
 	return uc, nil
 }
 
+// upstreamTLSConfig returns the TLS configuration used to connect to a
+// network, including the client certificate used for SASL EXTERNAL.
+func upstreamTLSConfig(network *network, logger Logger) (*tls.Config, error) {
+	cfg := network.user.srv.Config()
+	tlsConfig := &tls.Config{
+		MinVersion:   cfg.UpstreamTLSMinVersion,
+		CipherSuites: cfg.UpstreamTLSCipherSuites,
+	}
+	if network.TLSMinVersion != 0 {
+		tlsConfig.MinVersion = network.TLSMinVersion
+	}
+	if network.SASL.uses("EXTERNAL") {
+		if network.SASL.External.CertBlob == nil {
+			return nil, fmt.Errorf("missing certificate for authentication")
+		}
+		if network.SASL.External.PrivKeyBlob == nil {
+			return nil, fmt.Errorf("missing private key for authentication")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(network.SASL.External.PrivKeyBlob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{
+			{
+				Certificate: [][]byte{network.SASL.External.CertBlob},
+				PrivateKey:  key.(crypto.PrivateKey),
+			},
+		}
+		logger.Printf("using TLS client certificate %x", sha256.Sum256(network.SASL.External.CertBlob))
+	}
+	if network.TLSFingerprint != "" {
+		// The pinned fingerprint replaces the CA and hostname validation
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyTLSFingerprint(network.TLSFingerprint)
+	}
+	return tlsConfig, nil
+}
+
+// verifyTLSFingerprint returns a function checking that the leaf certificate
+// or its public key matches the hex-encoded SHA-256 fingerprint.
+func verifyTLSFingerprint(fingerprint string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no TLS certificate provided by the server")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+		certFP := certFingerprint(cert.Raw)
+		spkiFP := certFingerprint(cert.RawSubjectPublicKeyInfo)
+		if fingerprint != certFP && fingerprint != spkiFP {
+			return fmt.Errorf("TLS certificate fingerprint mismatch: expected %v, got certificate %v and public key %v", fingerprint, certFP, spkiFP)
+		}
+		return nil
+	}
+}
+
+// parseTLSFingerprint normalizes a hex-encoded SHA-256 fingerprint, possibly
+// separated with colons.
+func parseTLSFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid TLS fingerprint %q: expected a hex-encoded SHA-256 hash", s)
+	}
+	return fp, nil
+}
+
 func (uc *upstreamConn) forEachDownstream(f func(*downstreamConn)) {
 	uc.network.forEachDownstream(f)
 }
 
+// forEachDownstreamNotifiedOf calls f for each downstream connection which
+// should receive metadata updates (AWAY, ACCOUNT, CHGHOST, SETNAME) about a
+// user: downstreams sharing a channel with the user, and downstreams
+// monitoring the user with extended-monitor enabled.
+func (uc *upstreamConn) forEachDownstreamNotifiedOf(nick string, f func(*downstreamConn)) {
+	shared := false
+	for _, entry := range uc.channels.innerMap {
+		uch := entry.value.(*upstreamChannel)
+		if uch.Members.Has(nick) {
+			shared = true
+			break
+		}
+	}
+
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		if shared || (dc.supportsExtendedMonitor() && dc.monitored.Has(nick)) {
+			f(dc)
+		}
+	})
+}
+
 func (uc *upstreamConn) forEachDownstreamByID(id uint64, f func(*downstreamConn)) {
 	uc.forEachDownstream(func(dc *downstreamConn) {
 		if id != 0 && id != dc.id {
@@ -299,12 +558,13 @@ func (uc *upstreamConn) isOurNick(nick string) bool {
 
 func (uc *upstreamConn) abortPendingCommands() {
 	for _, l := range uc.pendingCmds {
-		for _, pendingCmd := range l {
+		for i, pendingCmd := range l {
 			dc := uc.downstreamByID(pendingCmd.downstreamID)
 			if dc == nil {
 				continue
 			}
 
+			dc.labeled = pendingCmd.labeled
 			switch pendingCmd.msg.Command {
 			case "LIST":
 				dc.SendMessage(&irc.Message{
@@ -337,10 +597,35 @@ func (uc *upstreamConn) abortPendingCommands() {
 			default:
 				panic(fmt.Errorf("Unsupported pending command %q", pendingCmd.msg.Command))
 			}
+			dc.labeled = nil
+
+			// The first command has already been sent, its labeled response
+			// is released by abortLabeledResponses
+			if pendingCmd.labeled != nil && i > 0 {
+				pendingCmd.labeled.release()
+			}
 		}
 	}
 
 	uc.pendingCmds = make(map[string][]pendingUpstreamCommand)
+
+	if dc := uc.downstreamByID(uc.saslPassthroughID); dc != nil {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.ERR_SASLABORTED,
+			Params:  []string{dc.nick, "SASL authentication aborted"},
+		})
+	}
+	uc.saslPassthroughID = 0
+}
+
+// abortLabeledResponses sends the replies collected so far to the downstreams
+// waiting for labeled responses from the server.
+func (uc *upstreamConn) abortLabeledResponses() {
+	for label, lr := range uc.labeledResponses {
+		delete(uc.labeledResponses, label)
+		lr.release()
+	}
 }
 
 func (uc *upstreamConn) sendNextPendingCommand(cmd string) {
@@ -348,7 +633,20 @@ func (uc *upstreamConn) sendNextPendingCommand(cmd string) {
 		return
 	}
 	pendingCmd := uc.pendingCmds[cmd][0]
-	uc.SendMessageLabeled(context.TODO(), pendingCmd.downstreamID, pendingCmd.msg)
+	msg := pendingCmd.msg
+	if _, ok := uc.isupport["WHOX"]; !ok && msg.Command == "WHO" && len(msg.Params) > 1 {
+		// Send a regular WHO query, replies will be converted to the WHOX
+		// format requested by the downstream connection
+		params := []string{msg.Params[0]}
+		if flags, _, _ := parseWHOXOptions(msg.Params[1]); flags != "" {
+			params = append(params, flags)
+		}
+		msg = &irc.Message{Command: "WHO", Params: params}
+	}
+	uc.sendMessageLabeled(context.TODO(), pendingCmd.downstreamID, pendingCmd.labeled, msg)
+	if pendingCmd.labeled != nil {
+		pendingCmd.labeled.release()
+	}
 }
 
 func (uc *upstreamConn) enqueueCommand(dc *downstreamConn, msg *irc.Message) {
@@ -359,9 +657,15 @@ func (uc *upstreamConn) enqueueCommand(dc *downstreamConn, msg *irc.Message) {
 		panic(fmt.Errorf("Unsupported pending command %q", msg.Command))
 	}
 
+	// Keep the labeled response open until the command is sent
+	if dc.labeled != nil {
+		dc.labeled.pending++
+	}
+
 	uc.pendingCmds[msg.Command] = append(uc.pendingCmds[msg.Command], pendingUpstreamCommand{
 		downstreamID: dc.id,
 		msg:          msg,
+		labeled:      dc.labeled,
 	})
 
 	if len(uc.pendingCmds[msg.Command]) == 1 {
@@ -401,6 +705,14 @@ func (uc *upstreamConn) cancelPendingCommandsByDownstreamID(downstreamID uint64)
 			}
 		}
 	}
+
+	if uc.saslPassthroughID == downstreamID {
+		uc.SendMessage(context.TODO(), &irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{"*"},
+		})
+		uc.saslPassthroughID = 0
+	}
 }
 
 func (uc *upstreamConn) parseMembershipPrefix(s string) (ms *memberships, nick string) {
@@ -419,6 +731,8 @@ func (uc *upstreamConn) parseMembershipPrefix(s string) (ms *memberships, nick s
 }
 
 func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) error {
+	msg = decodeMessage(uc.charset, msg)
+
 	var label string
 	if l, ok := msg.GetTag("label"); ok {
 		label = l
@@ -437,6 +751,12 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		}
 		delete(msg.Tags, "batch")
 	}
+	if label == "" && msg.Command == "BATCH" && len(msg.Params) > 0 && strings.HasPrefix(msg.Params[0], "-") {
+		// The end of a batch is attributed to the command which started it
+		if b, ok := uc.batches[msg.Params[0][1:]]; ok {
+			label = b.Label
+		}
+	}
 
 	var downstreamID uint64
 	if label != "" {
@@ -450,14 +770,53 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		}
 	}
 
+	// Collect the replies to labeled downstream commands, until the end of
+	// the labeled batch if any
+	startBatch, endBatch := false, false
+	if msg.Command == "BATCH" && len(msg.Params) > 0 {
+		startBatch = strings.HasPrefix(msg.Params[0], "+")
+		endBatch = strings.HasPrefix(msg.Params[0], "-")
+	}
+	if lr := uc.labeledResponses[label]; lr != nil && label != "" {
+		done := msgBatch == nil && !startBatch
+		if endBatch {
+			// Nested batches end within the labeled batch
+			done = uc.batches[strings.TrimPrefix(msg.Params[0], "-")].Outer == nil
+		}
+		lr.dc.labeled = lr
+		defer func() {
+			lr.dc.labeled = nil
+			if done {
+				delete(uc.labeledResponses, label)
+				lr.release()
+			}
+		}()
+	}
+
 	if msg.Prefix == nil {
 		msg.Prefix = uc.serverPrefix
 	}
 
-	if _, ok := msg.Tags["time"]; !ok && !isNumeric(msg.Command) {
+	if _, ok := msg.Tags["time"]; ok {
+		uc.handleServerTime(msg, msgBatch == nil)
+	} else if !isNumeric(msg.Command) {
 		msg.Tags["time"] = irc.TagValue(formatServerTime(time.Now()))
 	}
 
+	if msgBatch != nil && msgBatch.Multiline != nil {
+		// The message is handled as a whole once the batch ends
+		msgBatch.Multiline.appendUpstream(msg)
+		return nil
+	}
+	if endBatch {
+		if b := uc.batches[msg.Params[0][1:]]; b.Multiline != nil {
+			delete(uc.batches, msg.Params[0][1:])
+			if msg = b.Multiline.message(); msg == nil {
+				return nil
+			}
+		}
+	}
+
 	switch msg.Command {
 	case "PING":
 		uc.SendMessage(ctx, &irc.Message{
@@ -486,8 +845,29 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			break
 		}
 
+		if msg.Command == "NOTICE" && uc.isNickServPrompt(msg.Prefix, entity, text) {
+			uc.identifyNickServ(ctx)
+		}
+
 		if msg.Prefix.User == "" && msg.Prefix.Host == "" { // server message
-			uc.produce("", msg, 0)
+			policy := serverNoticesRelay
+			if msg.Command == "NOTICE" && uc.registered {
+				policy = uc.network.serverNoticePolicy(text)
+			}
+			switch policy {
+			case serverNoticesDrop:
+				// Don't relay nor log the notice
+			case serverNoticesRedirect:
+				// Make the notice look like a private message from the
+				// server, so that clients show it in a dedicated buffer
+				target := msg.Prefix.Name
+				msg = msg.Copy()
+				msg.Prefix = &irc.Prefix{Name: target, User: "server", Host: target}
+				msg.Params[0] = uc.nick
+				uc.produce(target, msg, 0)
+			default:
+				uc.produce("", msg, 0)
+			}
 		} else { // regular user message
 			target := entity
 			if uc.isOurNick(target) {
@@ -496,6 +876,26 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 
 			self := uc.isOurNick(msg.Prefix.Name)
 
+			if self && msg.Command == "PRIVMSG" && uc.nickServEcho != "" && text == uc.nickServEcho && uc.network.casemap(entity) == uc.network.casemap(uc.network.nickServNick()) {
+				// Don't relay our credentials to clients
+				uc.nickServEcho = ""
+				break
+			}
+
+			if !self && uc.network.isIgnored(msg.Prefix) {
+				if uc.user.LogIgnored {
+					msgID := uc.appendLog(target, msg)
+					uc.forEachDownstream(func(dc *downstreamConn) {
+						dc.advanceMessageWithID(msg, msgID)
+					})
+				}
+				break
+			}
+
+			if msg.Command == "PRIVMSG" && !self && uc.isOurNick(entity) {
+				uc.handleCTCPQuery(ctx, msg)
+			}
+
 			ch := uc.network.channels.Value(target)
 			if ch != nil && msg.Command != "TAGMSG" && !self {
 				if ch.Detached {
@@ -531,6 +931,12 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				break // wait to receive all capabilities
 			}
 
+			if v, ok := uc.caps.Available["sts"]; ok {
+				if err := uc.handleSTS(v); err != nil {
+					return err
+				}
+			}
+
 			uc.updateCaps(ctx)
 
 			if uc.requestSASL() {
@@ -567,18 +973,46 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			if len(subParams) < 1 {
 				return newNeedMoreParamsError(msg.Command)
 			}
-			uc.handleSupportedCaps(subParams[0])
+			caps := uc.handleSupportedCaps(subParams[0])
+			uc.logger.Debugf("server advertised new capabilities: %v", strings.Join(caps, " "))
+
+			for _, c := range caps {
+				if c != "sts" {
+					continue
+				}
+				err := uc.handleSTS(uc.caps.Available["sts"])
+				if _, ok := err.(stsUpgradeError); ok && uc.registered {
+					uc.logger.Printf("ignoring STS upgrade policy advertised after registration")
+				} else if err != nil {
+					return err
+				} else if uc.registered && uc.stsPolicy != nil {
+					uc.network.updateSTSPolicy(ctx, uc.stsPort, uc.stsPolicy)
+				}
+			}
+
+			// Request the new caps we want, downstreams are updated when
+			// they're acknowledged. Caps we already use may have had their
+			// value changed, e.g. the list of SASL mechanisms.
 			uc.updateCaps(ctx)
+			if uc.registered {
+				uc.forEachDownstream(func(dc *downstreamConn) {
+					dc.updateSupportedCaps()
+				})
+			}
 		case "DEL":
 			if len(subParams) < 1 {
 				return newNeedMoreParamsError(msg.Command)
 			}
 			caps := strings.Fields(subParams[0])
+			uc.logger.Debugf("server removed capabilities: %v", strings.Join(caps, " "))
 
 			for _, c := range caps {
-				uc.caps.Del(c)
+				uc.caps.Del(strings.ToLower(c))
 			}
 
+			// Caps we enabled may depend on the removed ones, e.g.
+			// echo-message on labeled-response
+			uc.updateCaps(ctx)
 			if uc.registered {
 				uc.forEachDownstream(func(dc *downstreamConn) {
 					dc.updateSupportedCaps()
@@ -588,6 +1022,16 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			uc.logger.Printf("unhandled message: %v", msg)
 		}
 	case "AUTHENTICATE":
+		if uc.saslPassthroughID != 0 {
+			if dc := uc.downstreamByID(uc.saslPassthroughID); dc != nil {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: "AUTHENTICATE",
+					Params:  msg.Params,
+				})
+			}
+			break
+		}
 		if uc.saslClient == nil {
 			return fmt.Errorf("received unexpected AUTHENTICATE message")
 		}
@@ -662,6 +1106,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		uc.hostname = prefix.Host
 
 		uc.logger.Printf("logged in with account %q", uc.account)
+		uc.nickServPending = false
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			dc.updateAccount()
 			dc.updateHost()
@@ -699,11 +1144,23 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			dc.updateHost()
 		})
-	case irc.ERR_NICKLOCKED, irc.RPL_SASLSUCCESS, irc.ERR_SASLFAIL, irc.ERR_SASLTOOLONG, irc.ERR_SASLABORTED:
+	case irc.ERR_NICKLOCKED, irc.RPL_SASLSUCCESS, irc.ERR_SASLFAIL, irc.ERR_SASLTOOLONG, irc.ERR_SASLABORTED, irc.ERR_SASLALREADY:
 		var info string
 		if err := parseMessageParams(msg, nil, &info); err != nil {
 			return err
 		}
+
+		if uc.saslPassthroughID != 0 {
+			if dc := uc.downstreamByID(uc.saslPassthroughID); dc != nil {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: msg.Command,
+					Params:  []string{dc.nick, info},
+				})
+			}
+			uc.saslPassthroughID = 0
+			break
+		}
 		switch msg.Command {
 		case irc.ERR_NICKLOCKED:
 			uc.logger.Printf("invalid nick used with SASL authentication: %v", info)
@@ -722,6 +1179,21 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			}
 
 			dc.endSASL(msg)
+		} else if !uc.registered && uc.saslMechanism != "" {
+			if msg.Command == irc.RPL_SASLSUCCESS {
+				uc.logger.Printf("SASL %v authentication succeeded", uc.saslMechanism)
+				uc.network.authFailures = 0
+			} else {
+				uc.saslMechanism = ""
+				if len(uc.saslFallbacks) > 0 && uc.startSASL(ctx) {
+					break
+				}
+
+				uc.network.authFailures++
+				if max := uc.srv.Config().MaxUpstreamAuthFailures; max > 0 && uc.network.authFailures >= max {
+					return authFailureError{uc.network.authFailures}
+				}
+			}
 		}
 
 		if !uc.registered {
@@ -730,6 +1202,19 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				Params:  []string{"END"},
 			})
 		}
+	case irc.RPL_SASLMECHS:
+		var mechs string
+		if err := parseMessageParams(msg, nil, &mechs); err != nil {
+			return err
+		}
+
+		if dc := uc.downstreamByID(uc.saslPassthroughID); dc != nil {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_SASLMECHS,
+				Params:  []string{dc.nick, mechs, "are available SASL mechanisms"},
+			})
+		}
 	case "REGISTER", "VERIFY":
 		if dc, cmd := uc.dequeueCommand(msg.Command); dc != nil {
 			if msg.Command == "REGISTER" {
@@ -754,19 +1239,6 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		uc.serverPrefix = msg.Prefix
 		uc.nickCM = uc.network.casemap(uc.nick)
 		uc.logger.Printf("connection registered with nick %q", uc.nick)
-
-		if uc.network.channels.Len() > 0 {
-			var channels, keys []string
-			for _, entry := range uc.network.channels.innerMap {
-				ch := entry.value.(*Channel)
-				channels = append(channels, ch.Name)
-				keys = append(keys, ch.Key)
-			}
-
-			for _, msg := range join(channels, keys) {
-				uc.SendMessage(ctx, msg)
-			}
-		}
 	case irc.RPL_MYINFO:
 		if err := parseMessageParams(msg, nil, &uc.serverName, nil, &uc.availableUserModes, nil); err != nil {
 			return err
@@ -783,13 +1255,20 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			var value string
 			if strings.HasPrefix(token, "-") {
 				negate = true
-				token = token[1:]
+				parameter = token[1:]
 			} else if i := strings.IndexByte(token, '='); i >= 0 {
 				parameter = token[:i]
 				value = token[i+1:]
 				hasValue = true
 			}
 
+			// Only forward tokens which have changed to downstreams
+			prev, hadPrev := uc.isupport[parameter]
+			changed := hadPrev == negate
+			if hadPrev && !negate {
+				changed = (prev != nil) != hasValue || (prev != nil && *prev != value)
+			}
+
 			if hasValue {
 				uc.isupport[parameter] = &value
 			} else if !negate {
@@ -831,13 +1310,16 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				return err
 			}
 
-			if passthroughIsupport[parameter] {
+			if passthroughIsupport[parameter] && changed {
 				downstreamIsupport = append(downstreamIsupport, token)
 			}
 		}
 
 		uc.updateMonitor()
 
+		if len(downstreamIsupport) == 0 {
+			break
+		}
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			if dc.network == nil {
 				return
@@ -860,6 +1342,8 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			// Ignore the initial MOTD upon connection, but forward
 			// subsequent MOTD messages downstream
 			uc.gotMotd = true
+			// The server's limits have been advertised by now
+			uc.joinSavedChannels(ctx)
 			return nil
 		}
 
@@ -889,12 +1373,21 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			if label == "" && msgBatch != nil {
 				label = msgBatch.Label
 			}
-			uc.batches[tag] = batch{
+			b := batch{
 				Type:   batchType,
 				Params: msg.Params[2:],
 				Outer:  msgBatch,
 				Label:  label,
 			}
+			if batchType == "draft/multiline" && len(msg.Params) > 2 {
+				b.Multiline = &multilineBatch{
+					ref:    tag,
+					target: msg.Params[2],
+					tags:   msg.Tags.Copy(),
+					prefix: msg.Prefix,
+				}
+			}
+			uc.batches[tag] = b
 		} else if strings.HasPrefix(tag, "-") {
 			tag = tag[1:]
 			if _, ok := uc.batches[tag]; !ok {
@@ -954,7 +1447,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				dc.updateRealname()
 			})
 		} else {
-			uc.forEachDownstream(func(dc *downstreamConn) {
+			uc.forEachDownstreamNotifiedOf(msg.Prefix.Name, func(dc *downstreamConn) {
 				dc.SendMessage(dc.marshalMessage(msg, uc.network))
 			})
 		}
@@ -979,7 +1472,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				dc.updateHost()
 			})
 		} else {
-			uc.forEachDownstream(func(dc *downstreamConn) {
+			uc.forEachDownstreamNotifiedOf(msg.Prefix.Name, func(dc *downstreamConn) {
 				// TODO: add fallback with QUIT/JOIN/MODE messages
 				dc.SendMessage(dc.marshalMessage(msg, uc.network))
 			})
@@ -1073,6 +1566,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				ch.Members.Delete(msg.Prefix.Name)
 
 				uc.appendLog(ch.Name, msg)
+				uc.relayDetachedMembership(ch.Name, msg)
 			}
 		}
 
@@ -1111,6 +1605,9 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		} else {
 			ch.Topic = ""
 		}
+		if ch.complete {
+			uc.saveChannelTopic(ctx, ch)
+		}
 		uc.produce(ch.Name, msg, 0)
 	case "MODE":
 		var name, modeStr string
@@ -1378,6 +1875,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			return fmt.Errorf("received unexpected RPL_ENDOFNAMES")
 		}
 		ch.complete = true
+		uc.saveChannelTopic(ctx, ch)
 
 		c := uc.network.channels.Value(name)
 		if c == nil || !c.Detached {
@@ -1402,6 +1900,32 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			channel = dc.marshalEntity(uc.network, channel)
 		}
 		nick = dc.marshalEntity(uc.network, nick)
+
+		var fields, whoxToken string
+		if len(cmd.Params) > 1 {
+			_, fields, whoxToken = parseWHOXOptions(cmd.Params[1])
+		}
+		if fields != "" {
+			// The upstream doesn't support WHOX, convert the reply
+			trailingParts := strings.SplitN(trailing, " ", 2)
+			var realname string
+			if len(trailingParts) == 2 {
+				realname = trailingParts[1]
+			}
+			info := whoxInfo{
+				Token:    whoxToken,
+				Channel:  channel,
+				Username: username,
+				Hostname: host,
+				Server:   server,
+				Nickname: nick,
+				Flags:    flags,
+				Realname: realname,
+			}
+			dc.SendMessage(generateWHOXReply(dc.srv.prefix(), dc.nick, fields, &info))
+			return nil
+		}
+
 		dc.SendMessage(&irc.Message{
 			Prefix:  dc.srv.prefix(),
 			Command: irc.RPL_WHOREPLY,
@@ -1415,8 +1939,41 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			return nil
 		}
 
-		// Only supported in single-upstream mode, so forward as-is
-		dc.SendMessage(msg)
+		var fields string
+		if len(cmd.Params) > 1 {
+			_, fields, _ = parseWHOXOptions(cmd.Params[1])
+		}
+
+		// Replies contain the requested fields in a fixed order, find the
+		// channel and nickname ones to translate them
+		params := []string{dc.nick}
+		values := msg.Params[1:]
+		for _, field := range whoxFields {
+			if !strings.ContainsRune(fields, rune(field)) {
+				continue
+			}
+			if len(values) == 0 {
+				break
+			}
+			v := values[0]
+			values = values[1:]
+			switch field {
+			case 'c':
+				if v != "*" {
+					v = dc.marshalEntity(uc.network, v)
+				}
+			case 'n':
+				v = dc.marshalEntity(uc.network, v)
+			}
+			params = append(params, v)
+		}
+		params = append(params, values...)
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_whospcrpl,
+			Params:  params,
+		})
 	case irc.RPL_ENDOFWHO:
 		var name string
 		if err := parseMessageParams(msg, nil, &name); err != nil {
@@ -1610,7 +2167,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			})
 		})
 	case "AWAY", "ACCOUNT":
-		uc.forEachDownstream(func(dc *downstreamConn) {
+		uc.forEachDownstreamNotifiedOf(msg.Prefix.Name, func(dc *downstreamConn) {
 			dc.SendMessage(&irc.Message{
 				Prefix:  dc.marshalUserPrefix(uc.network, msg.Prefix),
 				Command: msg.Command,
@@ -1745,8 +2302,20 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		if err := parseMessageParams(msg, &text); err != nil {
 			return err
 		}
-		return fmt.Errorf("fatal server error: %v", text)
+		return fatalServerError{text}
 	case irc.ERR_NICKNAMEINUSE:
+		// Try the user-configured fallback nicks first
+		if !uc.registered && uc.fallbackNicks < len(uc.network.FallbackNicks) {
+			uc.nick = uc.network.FallbackNicks[uc.fallbackNicks]
+			uc.fallbackNicks++
+			uc.nickCM = uc.network.casemap(uc.nick)
+			uc.logger.Printf("desired nick is not available, falling back to %q", uc.nick)
+			uc.SendMessage(ctx, &irc.Message{
+				Command: "NICK",
+				Params:  []string{uc.nick},
+			})
+			return nil
+		}
 		// At this point, we haven't received ISUPPORT so we don't know the
 		// maximum nickname length or whether the server supports MONITOR. Many
 		// servers have NICKLEN=30 so let's just use that.
@@ -1789,10 +2358,38 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 	return nil
 }
 
+// saveChannelTopic updates the topic stored in the channel record, so that it
+// can be sent to downstream connections while the upstream connection is down.
+func (uc *upstreamConn) saveChannelTopic(ctx context.Context, ch *upstreamChannel) {
+	c := uc.network.channels.Value(ch.Name)
+	if c == nil {
+		return
+	}
+
+	var topicWho string
+	if ch.Topic != "" && ch.TopicWho != nil {
+		topicWho = ch.TopicWho.String()
+	}
+	var topicTime time.Time
+	if topicWho != "" {
+		topicTime = time.Unix(ch.TopicTime.Unix(), 0)
+	}
+	if c.Topic == ch.Topic && c.TopicWho == topicWho && c.TopicTime.Equal(topicTime) {
+		return
+	}
+
+	c.Topic = ch.Topic
+	c.TopicWho = topicWho
+	c.TopicTime = topicTime
+	if err := uc.srv.db.StoreChannel(ctx, uc.network.ID, c); err != nil {
+		uc.logger.Printf("failed to update topic of channel %q: %v", ch.Name, err)
+	}
+}
+
 func (uc *upstreamConn) handleDetachedMessage(ctx context.Context, ch *Channel, msg *irc.Message) {
 	if uc.network.detachedMessageNeedsRelay(ch, msg) {
 		uc.forEachDownstream(func(dc *downstreamConn) {
-			dc.relayDetachedMessage(uc.network, msg)
+			dc.relayDetachedMessage(uc.network, ch.Name, msg)
 		})
 	}
 	if ch.ReattachOn == FilterMessage || (ch.ReattachOn == FilterHighlight && uc.network.isHighlight(msg)) {
@@ -1803,6 +2400,119 @@ func (uc *upstreamConn) handleDetachedMessage(ctx context.Context, ch *Channel,
 	}
 }
 
+// ctcpReplyInterval is the minimum interval between two automatic replies to
+// CTCP queries, to avoid being flooded off the network.
+const ctcpReplyInterval = 2 * time.Second
+
+const defaultNickServCommand = "IDENTIFY {password}"
+
+// Time after registration during which we wait for NickServ to prompt us
+// before identifying anyways
+const nickServPromptTimeout = 15 * time.Second
+
+func (net *network) nickServNick() string {
+	if nick := net.NickServ.Nick; nick != "" {
+		return nick
+	}
+	return "NickServ"
+}
+
+// isNickServPrompt checks whether a NOTICE is NickServ asking us to identify.
+func (uc *upstreamConn) isNickServPrompt(prefix *irc.Prefix, target, text string) bool {
+	if !uc.nickServPending || !uc.isOurNick(target) {
+		return false
+	}
+	if uc.network.casemap(prefix.Name) != uc.network.casemap(uc.network.nickServNick()) {
+		return false
+	}
+	text = strings.ToLower(text)
+	return strings.Contains(text, "identify") || strings.Contains(text, "registered")
+}
+
+// identifyNickServ sends our credentials to NickServ, for networks without
+// SASL support.
+func (uc *upstreamConn) identifyNickServ(ctx context.Context) {
+	uc.nickServPending = false
+
+	tmpl := uc.network.NickServ.Command
+	if tmpl == "" {
+		tmpl = defaultNickServCommand
+	}
+	r := strings.NewReplacer(
+		"{nick}", uc.nick,
+		"{password}", uc.network.NickServ.Password,
+	)
+
+	nick := uc.network.nickServNick()
+	text := r.Replace(tmpl)
+	if uc.caps.IsEnabled("echo-message") {
+		uc.nickServEcho = text
+	}
+	uc.logger.Printf("identifying with %v", nick)
+	uc.SendMessage(ctx, &irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{nick, text},
+	})
+}
+
+// handleCTCPQuery replies to CTCP queries on behalf of the user, if enabled
+// for the network and no client is attached. Otherwise, the query is left to
+// the clients.
+func (uc *upstreamConn) handleCTCPQuery(ctx context.Context, msg *irc.Message) {
+	if !uc.network.CTCPAutoReply {
+		return
+	}
+	cmd, params, ok := parseCTCPMessage(msg)
+	if !ok {
+		return
+	}
+
+	attached := false
+	uc.forEachDownstream(func(*downstreamConn) {
+		attached = true
+	})
+	if attached {
+		return
+	}
+
+	var reply string
+	switch cmd {
+	case "VERSION":
+		reply = uc.network.CTCPVersion
+		if reply == "" {
+			reply = "soju"
+		}
+	case "SOURCE":
+		reply = uc.network.CTCPSource
+		if reply == "" {
+			reply = "https://soju.im"
+		}
+	case "PING":
+		reply = params
+	case "CLIENTINFO":
+		reply = "CLIENTINFO PING SOURCE VERSION"
+	default:
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(uc.lastCTCPReply) < ctcpReplyInterval {
+		uc.logger.Printf("ignoring CTCP %v query from %q: too many queries", cmd, msg.Prefix.Name)
+		return
+	}
+	uc.lastCTCPReply = now
+
+	text := "\x01" + cmd
+	if reply != "" {
+		text += " " + reply
+	}
+	text += "\x01"
+	uc.SendMessage(ctx, &irc.Message{
+		Command: "NOTICE",
+		Params:  []string{msg.Prefix.Name, text},
+	})
+}
+
 func (uc *upstreamConn) handleChanModes(s string) error {
 	parts := strings.SplitN(s, ",", 5)
 	if len(parts) < 4 {
@@ -1843,8 +2553,11 @@ func (uc *upstreamConn) handleMemberships(s string) error {
 	return nil
 }
 
-func (uc *upstreamConn) handleSupportedCaps(capsStr string) {
+// handleSupportedCaps records the caps advertised by the server, and returns
+// their names.
+func (uc *upstreamConn) handleSupportedCaps(capsStr string) []string {
 	caps := strings.Fields(capsStr)
+	names := make([]string, 0, len(caps))
 	for _, s := range caps {
 		kv := strings.SplitN(s, "=", 2)
 		k := strings.ToLower(kv[0])
@@ -1853,7 +2566,37 @@ func (uc *upstreamConn) handleSupportedCaps(capsStr string) {
 			v = kv[1]
 		}
 		uc.caps.Available[k] = v
+		names = append(names, k)
 	}
+	return names
+}
+
+// handleSTS processes an STS policy advertised by the server.
+func (uc *upstreamConn) handleSTS(value string) error {
+	u, err := uc.network.URL()
+	if err != nil || u.Scheme != "irc+insecure" {
+		// Other schemes either already use TLS or can't be upgraded
+		return nil
+	}
+
+	policy, err := parseSTSPolicy(value)
+	if err != nil {
+		uc.logger.Printf("ignoring invalid STS policy %q: %v", value, err)
+		return nil
+	}
+
+	if uc.stsPort == 0 {
+		if policy.Port == 0 {
+			uc.logger.Printf("ignoring STS policy without port over plain-text connection")
+			return nil
+		}
+		return stsUpgradeError{policy.Port}
+	}
+
+	if policy.Duration != nil {
+		uc.stsPolicy = policy
+	}
+	return nil
 }
 
 func (uc *upstreamConn) updateCaps(ctx context.Context) {
@@ -1892,8 +2635,8 @@ func (uc *upstreamConn) supportsSASL(mech string) bool {
 	}
 
 	mechanisms := strings.Split(v, ",")
-	for _, mech := range mechanisms {
-		if strings.EqualFold(mech, mech) {
+	for _, m := range mechanisms {
+		if strings.EqualFold(m, mech) {
 			return true
 		}
 	}
@@ -1901,10 +2644,52 @@ func (uc *upstreamConn) supportsSASL(mech string) bool {
 }
 
 func (uc *upstreamConn) requestSASL() bool {
-	if uc.network.SASL.Mechanism == "" {
-		return false
+	for _, mech := range uc.network.SASL.mechanisms() {
+		if uc.supportsSASL(mech) {
+			return true
+		}
 	}
-	return uc.supportsSASL(uc.network.SASL.Mechanism)
+	return false
+}
+
+// startSASL starts authenticating with the next configured SASL mechanism
+// supported by the server. It returns false if there is none left.
+func (uc *upstreamConn) startSASL(ctx context.Context) bool {
+	auth := &uc.network.SASL
+	for len(uc.saslFallbacks) > 0 {
+		mech := uc.saslFallbacks[0]
+		uc.saslFallbacks = uc.saslFallbacks[1:]
+		if !uc.supportsSASL(mech) {
+			continue
+		}
+
+		switch mech {
+		case "PLAIN":
+			if auth.Plain.Authzid != "" {
+				uc.logger.Printf("starting SASL PLAIN authentication with username %q as %q", auth.Plain.Username, auth.Plain.Authzid)
+			} else {
+				uc.logger.Printf("starting SASL PLAIN authentication with username %q", auth.Plain.Username)
+			}
+			uc.saslClient = sasl.NewPlainClient(auth.Plain.Authzid, auth.Plain.Username, auth.Plain.Password)
+		case "EXTERNAL":
+			uc.logger.Printf("starting SASL EXTERNAL authentication")
+			uc.saslClient = sasl.NewExternalClient("")
+		case scramSHA256:
+			uc.logger.Printf("starting SASL %v authentication with username %q", mech, auth.Plain.Username)
+			uc.saslClient = newSCRAMClient(auth.Plain.Username, auth.Plain.Password)
+		default:
+			uc.logger.Printf("skipping unsupported SASL mechanism %q", mech)
+			continue
+		}
+
+		uc.saslMechanism = mech
+		uc.SendMessage(ctx, &irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{mech},
+		})
+		return true
+	}
+	return false
 }
 
 func (uc *upstreamConn) handleCapAck(ctx context.Context, name string, ok bool) error {
@@ -1912,6 +2697,12 @@ func (uc *upstreamConn) handleCapAck(ctx context.Context, name string, ok bool)
 
 	switch name {
 	case "sasl":
+		if uc.registered {
+			// The cap can be acknowledged after registration when
+			// advertised with CAP NEW. It's only used for SASL passthrough
+			// then, we don't authenticate ourselves.
+			break
+		}
 		if !uc.requestSASL() {
 			return nil
 		}
@@ -1920,22 +2711,13 @@ func (uc *upstreamConn) handleCapAck(ctx context.Context, name string, ok bool)
 			return nil
 		}
 
-		auth := &uc.network.SASL
-		switch auth.Mechanism {
-		case "PLAIN":
-			uc.logger.Printf("starting SASL PLAIN authentication with username %q", auth.Plain.Username)
-			uc.saslClient = sasl.NewPlainClient("", auth.Plain.Username, auth.Plain.Password)
-		case "EXTERNAL":
-			uc.logger.Printf("starting SASL EXTERNAL authentication")
-			uc.saslClient = sasl.NewExternalClient("")
-		default:
-			return fmt.Errorf("unsupported SASL mechanism %q", name)
+		uc.saslFallbacks = uc.network.SASL.mechanisms()
+		if !uc.startSASL(ctx) {
+			uc.SendMessage(ctx, &irc.Message{
+				Command: "CAP",
+				Params:  []string{"END"},
+			})
 		}
-
-		uc.SendMessage(ctx, &irc.Message{
-			Command: "AUTHENTICATE",
-			Params:  []string{auth.Mechanism},
-		})
 	case "echo-message":
 	default:
 		if permanentUpstreamCaps[name] {
@@ -1955,14 +2737,21 @@ func splitSpace(s string) []string {
 func (uc *upstreamConn) register(ctx context.Context) {
 	uc.nick = GetNick(&uc.user.User, &uc.network.Network)
 	uc.nickCM = uc.network.casemap(uc.nick)
-	uc.username = GetUsername(&uc.user.User, &uc.network.Network)
-	uc.realname = GetRealname(&uc.user.User, &uc.network.Network)
+	uc.username = uc.srv.getUsername(&uc.user.User, &uc.network.Network)
+	uc.realname = uc.srv.getRealname(&uc.user.User, &uc.network.Network)
 
 	uc.SendMessage(ctx, &irc.Message{
 		Command: "CAP",
 		Params:  []string{"LS", "302"},
 	})
 
+	if uc.network.WebIRCPassword != "" {
+		uc.SendMessage(ctx, &irc.Message{
+			Command: "WEBIRC",
+			Params:  []string{uc.network.WebIRCPassword, uc.network.WebIRCGateway, uc.webIRCHostname(), uc.webIRCAddr()},
+		})
+	}
+
 	if uc.network.Pass != "" {
 		uc.SendMessage(ctx, &irc.Message{
 			Command: "PASS",
@@ -1980,6 +2769,39 @@ func (uc *upstreamConn) register(ctx context.Context) {
 	})
 }
 
+// webIRCHostname returns the hostname sent in WEBIRC: the IP address of the
+// user's last client if known, otherwise the user's ident under the server
+// hostname, so that each user gets a distinct host.
+func (uc *upstreamConn) webIRCHostname() string {
+	if ip, _ := uc.user.clientIP.Load().(string); ip != "" {
+		return webIRCParam(ip)
+	}
+	return userIdent(&uc.user.User) + "." + uc.srv.Config().Hostname
+}
+
+// webIRCAddr returns the IP address sent in WEBIRC: the IP address of the
+// user's last client if known, otherwise the local address of the connection
+// for TCP, or the loopback address for Unix sockets.
+func (uc *upstreamConn) webIRCAddr() string {
+	if ip, _ := uc.user.clientIP.Load().(string); ip != "" {
+		return webIRCParam(ip)
+	}
+	ip := "127.0.0.1"
+	if addr, ok := uc.conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+	return webIRCParam(ip)
+}
+
+// webIRCParam formats an IP address as a WEBIRC parameter, which can't start
+// with a colon, e.g. for "::1".
+func webIRCParam(ip string) string {
+	if strings.HasPrefix(ip, ":") {
+		ip = "0" + ip
+	}
+	return ip
+}
+
 func (uc *upstreamConn) ReadMessage() (*irc.Message, error) {
 	msg, err := uc.conn.ReadMessage()
 	if err != nil {
@@ -1997,15 +2819,27 @@ func (uc *upstreamConn) runUntilRegistered(ctx context.Context) error {
 		}
 
 		if err := uc.handleMessage(ctx, msg); err != nil {
-			if _, ok := err.(registrationError); ok {
+			switch err.(type) {
+			case registrationError, stsUpgradeError, authFailureError, fatalServerError:
 				return err
-			} else {
+			default:
 				msg.Tags = nil // prevent message tags from cluttering logs
 				return fmt.Errorf("failed to handle message %q: %v", msg, err)
 			}
 		}
 	}
 
+	if uc.network.NickServ.Password != "" && uc.account == "" {
+		uc.nickServPending = true
+		u := uc.user
+		time.AfterFunc(nickServPromptTimeout, func() {
+			select {
+			case u.events <- eventNickServTimeout{uc}:
+			case <-u.done:
+			}
+		})
+	}
+
 	for _, command := range uc.network.ConnectCommands {
 		m, err := irc.ParseMessage(command)
 		if err != nil {
@@ -2039,27 +2873,235 @@ func (uc *upstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
 		msg.Tags = nil
 	}
 
+	msg = encodeMessage(uc.charset, msg)
+
 	uc.srv.metrics.upstreamOutMessagesTotal.Inc()
 	uc.conn.SendMessage(ctx, msg)
 }
 
+// targetLimit returns the maximum number of targets of a command advertised
+// by the server with TARGMAX, or zero if unlimited.
+func (uc *upstreamConn) targetLimit(cmd string) int {
+	v := uc.isupport["TARGMAX"]
+	if v == nil {
+		return 0
+	}
+	for _, kv := range strings.Split(*v, ",") {
+		k, limit := kv, ""
+		if i := strings.IndexByte(kv, ':'); i >= 0 {
+			k, limit = kv[:i], kv[i+1:]
+		}
+		if !strings.EqualFold(k, cmd) {
+			continue
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// joinSavedChannels joins the saved and auto-join channels of the network.
+// The channels are spread across JOIN messages according to the network's
+// JoinBatch and the server's TARGMAX limit. If the network has a JoinDelay,
+// the messages are sent one at a time by sendPendingJoin.
+func (uc *upstreamConn) joinSavedChannels(ctx context.Context) {
+	var channels, keys []string
+	for _, ch := range uc.network.sortedChannels() {
+		channels = append(channels, ch.Name)
+		keys = append(keys, ch.Key)
+	}
+	// The auto-join list may have been saved with another casemapping
+	seen := newCasemapMap(0)
+	seen.SetCasemapping(uc.network.casemap)
+	for _, ch := range uc.network.AutoJoin {
+		if uc.network.channels.Value(ch.Name) == nil && !seen.Has(ch.Name) {
+			seen.SetValue(ch.Name, nil)
+			channels = append(channels, ch.Name)
+			keys = append(keys, ch.Key)
+		}
+	}
+	if len(channels) == 0 {
+		return
+	}
+
+	maxTargets := uc.targetLimit("JOIN")
+	if n := uc.network.JoinBatch; n > 0 && (maxTargets == 0 || n < maxTargets) {
+		maxTargets = n
+	}
+	msgs := join(channels, keys, maxTargets)
+	if uc.network.JoinDelay == 0 {
+		for _, msg := range msgs {
+			uc.SendMessage(ctx, msg)
+		}
+		return
+	}
+
+	uc.pendingJoins = msgs
+	uc.sendPendingJoin(ctx)
+}
+
+// sendPendingJoin sends the next JOIN message queued by joinSavedChannels,
+// and schedules the following one after the network's JoinDelay. Delaying
+// the messages here rather than in the connection writer leaves other
+// messages unaffected.
+func (uc *upstreamConn) sendPendingJoin(ctx context.Context) {
+	if len(uc.pendingJoins) == 0 {
+		return
+	}
+
+	uc.SendMessage(ctx, uc.pendingJoins[0])
+	uc.pendingJoins = uc.pendingJoins[1:]
+	if len(uc.pendingJoins) == 0 {
+		return
+	}
+
+	u := uc.user
+	time.AfterFunc(uc.network.JoinDelay, func() {
+		select {
+		case u.events <- eventPendingJoin{uc}:
+		case <-u.done:
+		}
+	})
+}
+
+// maxTextLength returns the maximum length of the text of a PRIVMSG or NOTICE
+// message sent to target, so that the message relayed by the server to the
+// recipients doesn't exceed the server's line length limit.
+func (uc *upstreamConn) maxTextLength(cmd, target string) int {
+	lineLen := maxMessageLength
+	if v := uc.isupport["LINELEN"]; v != nil {
+		if n, err := strconv.Atoi(*v); err == nil && n > 0 {
+			lineLen = n
+		}
+	}
+
+	userLen, hostLen := len(uc.username), len(uc.hostname)
+	if uc.hostname == "" {
+		// Our prefix isn't known yet: assume the longest hostname, and a "~"
+		// added to the username by the server
+		userLen++
+		hostLen = 63
+	}
+
+	// ":<nick>!<user>@<host> <cmd> <target> :<text>\r\n"
+	overhead := len(":"+uc.nick+"!") + userLen + len("@") + hostLen + len(" "+cmd+" "+target+" :\r\n")
+	return lineLen - overhead
+}
+
 func (uc *upstreamConn) SendMessageLabeled(ctx context.Context, downstreamID uint64, msg *irc.Message) {
+	var lr *labeledResponse
+	if dc := uc.downstreamByID(downstreamID); dc != nil {
+		lr = dc.labeled
+	}
+	uc.sendMessageLabeled(ctx, downstreamID, lr, msg)
+}
+
+// sendMessageLabeled sends a message on behalf of a downstream. If lr isn't
+// nil, the server replies are added to this labeled response.
+func (uc *upstreamConn) sendMessageLabeled(ctx context.Context, downstreamID uint64, lr *labeledResponse, msg *irc.Message) {
 	if uc.caps.IsEnabled("labeled-response") {
 		if msg.Tags == nil {
 			msg.Tags = make(map[string]irc.TagValue)
 		}
-		msg.Tags["label"] = irc.TagValue(fmt.Sprintf("sd-%d-%d", downstreamID, uc.nextLabelID))
+		label := fmt.Sprintf("sd-%d-%d", downstreamID, uc.nextLabelID)
+		msg.Tags["label"] = irc.TagValue(label)
 		uc.nextLabelID++
+		// Tags are stripped unless message-tags is enabled
+		if lr != nil && uc.caps.IsEnabled("message-tags") {
+			lr.pending++
+			uc.labeledResponses[label] = lr
+			lr = nil
+		}
+	}
+	if lr != nil {
+		lr.untracked = true
 	}
 	uc.SendMessage(ctx, msg)
 }
 
+// handleServerTime estimates the clock skew of the server from the server-time
+// tag of a message, and corrects the tag if enabled for the network.
+//
+// Messages sent in batches (e.g. history) are expected to be old, so only live
+// messages are used for the estimation. The registration burst may replay old
+// messages too, so messages received before the end of the MOTD are ignored.
+// Live messages can still be delayed, so the offset closest to zero among the
+// last serverTimeSamples messages is picked, and only if all of them agree.
+func (uc *upstreamConn) handleServerTime(msg *irc.Message, live bool) {
+	t, err := time.Parse(serverTimeLayout, string(msg.Tags["time"]))
+	if err != nil {
+		return
+	}
+
+	if live && uc.gotMotd {
+		uc.timeOffsets = append(uc.timeOffsets, time.Since(t))
+		if len(uc.timeOffsets) > serverTimeSamples {
+			uc.timeOffsets = uc.timeOffsets[1:]
+		}
+		if len(uc.timeOffsets) == serverTimeSamples {
+			uc.updateTimeSkew()
+		}
+	}
+
+	if uc.timeSkew != 0 && uc.network.CorrectServerTime {
+		msg.Tags["time"] = irc.TagValue(formatServerTime(t.Add(uc.timeSkew)))
+	}
+}
+
+func (uc *upstreamConn) updateTimeSkew() {
+	offset := uc.timeOffsets[0]
+	for _, o := range uc.timeOffsets[1:] {
+		if absDuration(o) < absDuration(offset) {
+			offset = o
+		}
+	}
+
+	// Samples which disagree are likely delayed or replayed messages, keep
+	// the previous estimate until the offset settles
+	for _, o := range uc.timeOffsets {
+		if absDuration(o-offset) >= maxServerTimeSkew {
+			return
+		}
+	}
+
+	if absDuration(offset) < maxServerTimeSkew {
+		uc.timeSkew = 0
+		return
+	}
+	uc.timeSkew = offset
+	if uc.timeSkewSeen {
+		return
+	}
+	uc.timeSkewSeen = true
+
+	uc.logger.Printf("server clock is off by %v", -offset.Round(time.Second))
+	text := fmt.Sprintf("the clock of network %q is off by %v", uc.network.GetName(), -offset.Round(time.Second))
+	if uc.network.CorrectServerTime {
+		text += ", message timestamps are corrected"
+	} else {
+		text += ", message timestamps may be wrong (see the -correct-server-time network flag)"
+	}
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		sendServiceNOTICE(dc, text)
+	})
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
 // appendLog appends a message to the log file.
 //
 // The internal message ID is returned. If the message isn't recorded in the
 // log file, an empty string is returned.
 func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string) {
-	if uc.user.msgStore == nil {
+	if uc.user.msgStore == nil || uc.network.Passthrough {
 		return ""
 	}
 
@@ -2068,13 +3110,23 @@ func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string
 		return ""
 	}
 
+	// TAGMSG mostly carries ephemeral client tags (e.g. +typing), which
+	// shouldn't end up in the message store: only keep replies and reactions
+	if msg.Command == "TAGMSG" && len(filterStoredClientTags(msg.Tags)) == 0 {
+		return ""
+	}
+
 	entityCM := uc.network.casemap(entity)
-	if entityCM == "nickserv" {
+	if entityCM == "nickserv" || entityCM == uc.network.casemap(uc.network.nickServNick()) {
 		// The messages sent/received from NickServ may contain
 		// security-related information (like passwords). Don't store these.
 		return ""
 	}
 
+	if uc.network.isLoggingDisabled(entity) {
+		return ""
+	}
+
 	if !uc.network.delivered.HasTarget(entity) {
 		// This is the first message we receive from this target. Save the last
 		// message ID in delivery receipts, so that we can send the new message
@@ -2091,10 +3143,20 @@ func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string
 	}
 
 	msgID, err := uc.user.msgStore.Append(&uc.network.Network, entityCM, msg)
-	if err != nil {
+	if err == errFSMessageStoreQuotaExceeded {
+		if !uc.user.logQuotaExceeded {
+			uc.logger.Printf("message log quota exceeded, messages are no longer logged")
+			for _, dc := range uc.user.downstreamConns {
+				sendServiceNOTICE(dc, logQuotaExceededNotice)
+			}
+		}
+		uc.user.logQuotaExceeded = true
+		return ""
+	} else if err != nil {
 		uc.logger.Printf("failed to append message to store: %v", err)
 		return ""
 	}
+	uc.user.logQuotaExceeded = false
 
 	return msgID
 }
@@ -2115,29 +3177,76 @@ func (uc *upstreamConn) produce(target string, msg *irc.Message, originID uint64
 	ch := uc.network.channels.Value(target)
 	detached := ch != nil && ch.Detached
 
+	var filterable bool
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		filterable = target != ""
+	}
+
 	uc.forEachDownstream(func(dc *downstreamConn) {
+		// Messages for targets filtered out by the downstream are only
+		// logged, they can still be fetched from the history
+		if filterable && dc.isTargetFiltered(uc.network, target) {
+			return
+		}
+
+		// Our JOIN for saved channels was already sent to clients which
+		// connected while the upstream connection was down
+		if msg.Command == "JOIN" && uc.isOurNick(msg.Prefix.Name) && dc.isChannelRestored(uc.network, target) {
+			return
+		}
+
 		if !detached && (dc.id != originID || dc.caps.IsEnabled("echo-message")) {
 			dc.sendMessageWithID(dc.marshalMessage(msg, uc.network), msgID)
 		} else {
 			dc.advanceMessageWithID(msg, msgID)
 		}
 	})
+
+	switch msg.Command {
+	case "JOIN", "PART", "KICK":
+		uc.relayDetachedMembership(target, msg)
+	}
+}
+
+// relayDetachedMembership relays a JOIN, PART, KICK or QUIT message to
+// downstreams if the channel is detached and configured to relay membership
+// changes. Our own membership changes are never relayed.
+func (uc *upstreamConn) relayDetachedMembership(channel string, msg *irc.Message) {
+	ch := uc.network.channels.Value(channel)
+	if ch == nil || !ch.Detached || uc.isOurNick(msg.Prefix.Name) {
+		return
+	}
+	if !uc.network.detachedMessageNeedsRelay(ch, msg) {
+		return
+	}
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		dc.relayDetachedMessage(uc.network, channel, msg)
+	})
 }
 
 func (uc *upstreamConn) updateAway() {
 	ctx := context.TODO()
 
-	away := true
+	away := !uc.network.NoAutoAway
 	uc.forEachDownstream(func(*downstreamConn) {
 		away = false
 	})
+	if uc.user.hasSuspendedSession(uc.network) {
+		// The client is expected to resume its session shortly
+		away = false
+	}
 	if away == uc.away {
 		return
 	}
 	if away {
+		text := uc.network.AwayMessage
+		if text == "" {
+			text = "Auto away"
+		}
 		uc.SendMessage(ctx, &irc.Message{
 			Command: "AWAY",
-			Params:  []string{"Auto away"},
+			Params:  []string{text},
 		})
 	} else {
 		uc.SendMessage(ctx, &irc.Message{
@@ -2156,6 +3265,10 @@ func (uc *upstreamConn) updateChannelAutoDetach(name string) {
 	if ch == nil || ch.Detached {
 		return
 	}
+	if uc.network.Passthrough || uc.network.NoAutoDetach {
+		uch.updateAutoDetach(0)
+		return
+	}
 	uch.updateAutoDetach(ch.DetachAfter)
 }
 
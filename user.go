@@ -9,11 +9,17 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/time/rate"
 	"gopkg.in/irc.v3"
+
+	"git.sr.ht/~emersion/soju/config"
 )
 
 type event interface{}
@@ -54,6 +60,31 @@ type eventDownstreamDisconnected struct {
 	dc *downstreamConn
 }
 
+// eventNetworkIdle is sent when the grace period of an on-demand network has
+// elapsed after the last client has left.
+type eventNetworkIdle struct {
+	net *network
+	gen int
+}
+
+// eventSessionExpired is sent when a suspended downstream session can no
+// longer be resumed.
+type eventSessionExpired struct {
+	token string
+}
+
+// eventNickServTimeout is sent when NickServ hasn't prompted an upstream
+// connection to identify in time after registration.
+type eventNickServTimeout struct {
+	uc *upstreamConn
+}
+
+// eventPendingJoin is sent when the next JOIN message queued upon connection
+// can be sent to an upstream connection.
+type eventPendingJoin struct {
+	uc *upstreamConn
+}
+
 type eventChannelDetach struct {
 	uc   *upstreamConn
 	name string
@@ -63,22 +94,72 @@ type eventBroadcast struct {
 	msg *irc.Message
 }
 
+// eventLocalMessage is like eventBroadcast, but the message is posted to a
+// local channel.
+type eventLocalMessage struct {
+	channel string
+	msg     *irc.Message
+}
+
 type eventStop struct{}
 
+// eventFlushDeliveryReceipts is sent periodically to save the delivery
+// receipts modified since they were last saved.
+type eventFlushDeliveryReceipts struct{}
+
+// eventMsgStoreStats asks the user to refresh its message store statistics.
+type eventMsgStoreStats struct{}
+
+// eventUserReload is sent when the user record has been updated by another
+// soju instance.
+type eventUserReload struct {
+	record *User
+}
+
+// eventNetworkReload is sent when a network record has been created, updated
+// or deleted by another soju instance.
+type eventNetworkReload struct {
+	id int64
+}
+
+type eventNetworkTestResult struct {
+	dc     *downstreamConn
+	name   string
+	result *networkTestResult
+	err    error
+}
+
 type eventUserUpdate struct {
-	password *string
-	admin    *bool
-	done     chan error
+	password           *string
+	admin              *bool
+	limitedAdmin       *bool
+	owner              *int64
+	motd               *string
+	maxDownstreams     *int
+	upstreamIPs        *[]string
+	logQuota           *int64
+	backlogLimit       *int
+	msgStore           *string
+	networkChangeDelay *time.Duration
+	// If non-zero, ID of the limited admin requesting the update: the update
+	// is rejected unless the user is owned by them
+	scope int64
+	done  chan error
 }
 
 type deliveredClientMap map[string]string // client name -> msg ID
 
 type deliveredStore struct {
 	m deliveredCasemapMap
+	// Clients whose receipts changed since they were last saved
+	dirty map[string]struct{}
 }
 
 func newDeliveredStore() deliveredStore {
-	return deliveredStore{deliveredCasemapMap{newCasemapMap(0)}}
+	return deliveredStore{
+		m:     deliveredCasemapMap{newCasemapMap(0)},
+		dirty: make(map[string]struct{}),
+	}
 }
 
 func (ds deliveredStore) HasTarget(target string) bool {
@@ -99,9 +180,40 @@ func (ds deliveredStore) StoreID(target, clientName, msgID string) {
 		clients = make(deliveredClientMap)
 		ds.m.SetValue(target, clients)
 	}
+	if clients[clientName] != msgID {
+		ds.dirty[clientName] = struct{}{}
+	}
 	clients[clientName] = msgID
 }
 
+func (ds deliveredStore) DeleteTarget(target string) {
+	for clientName := range ds.m.Value(target) {
+		ds.dirty[clientName] = struct{}{}
+	}
+	ds.m.Delete(target)
+}
+
+// IsDirty reports whether the receipts of a client changed since
+// MarkClean was last called.
+func (ds deliveredStore) IsDirty(clientName string) bool {
+	_, ok := ds.dirty[clientName]
+	return ok
+}
+
+func (ds deliveredStore) MarkClean(clientName string) {
+	delete(ds.dirty, clientName)
+}
+
+func (ds deliveredStore) ForEachDirtyClient(f func(clientName string)) {
+	clients := make([]string, 0, len(ds.dirty))
+	for clientName := range ds.dirty {
+		clients = append(clients, clientName)
+	}
+	for _, clientName := range clients {
+		f(clientName)
+	}
+}
+
 func (ds deliveredStore) ForEachTarget(f func(target string)) {
 	for _, entry := range ds.m.innerMap {
 		f(entry.originalKey)
@@ -133,10 +245,49 @@ type network struct {
 	delivered deliveredStore
 	lastError error
 	casemap   casemapping
+	// Numeric or reply code and reason of the last error sent by the
+	// upstream server, see upstreamErrorDetails
+	lastErrorCode   string
+	lastErrorReason string
+
+	// Time of the last successful registration and of the last error, zero
+	// if none since soju started
+	lastConnected time.Time
+	lastErrorTime time.Time
+
+	// Whether the user has manually disconnected the network. Unlike
+	// Network.Enabled, this isn't persisted.
+	disconnected bool
+
+	// TLS port requested by the server via STS, until a connection to it is
+	// registered. Protected by stsLock.
+	stsUpgradePort int
+	// Copy of Network.STSPort and Network.STSExpiresAt, which are updated by
+	// the user goroutine, for the network goroutine. Protected by stsLock.
+	stsLock            sync.Mutex
+	stsPolicyPort      int
+	stsPolicyExpiresAt time.Time
+	// Number of consecutive SASL authentication failures during
+	// registration, only accessed from the network goroutine
+	authFailures int
+	// State reported by the soju_networks_total metric, empty if the
+	// network isn't accounted for
+	metricsState string
+
+	// For on-demand networks, whether a client needs the upstream
+	// connection, accessed atomically
+	demanded int32
+	// Wakes up the network goroutine waiting for a client, see demand
+	wake chan struct{}
+	// Disconnects an on-demand network after the last client has left, nil
+	// if not pending. idleGen identifies the last timer, to ignore expired
+	// timers which have been replaced.
+	idleTimer *time.Timer
+	idleGen   int
 }
 
 func newNetwork(user *user, record *Network, channels []Channel) *network {
-	logger := &prefixLogger{user.logger, fmt.Sprintf("network %q: ", record.GetName())}
+	logger := newPrefixLogger(user.logger, "network", record.GetName())
 
 	m := channelCasemapMap{newCasemapMap(0)}
 	for _, ch := range channels {
@@ -145,23 +296,49 @@ func newNetwork(user *user, record *Network, channels []Channel) *network {
 	}
 
 	return &network{
-		Network:   *record,
-		user:      user,
-		logger:    logger,
-		stopped:   make(chan struct{}),
-		channels:  m,
-		delivered: newDeliveredStore(),
-		casemap:   casemapRFC1459,
+		Network:            *record,
+		user:               user,
+		logger:             logger,
+		stopped:            make(chan struct{}),
+		wake:               make(chan struct{}, 1),
+		channels:           m,
+		delivered:          newDeliveredStore(),
+		casemap:            casemapRFC1459,
+		stsPolicyPort:      record.STSPort,
+		stsPolicyExpiresAt: record.STSExpiresAt,
+	}
+}
+
+// Network states reported by the soju_networks_total metric
+const (
+	networkStateConnected    = "connected"
+	networkStateDisconnected = "disconnected"
+	networkStateError        = "error"
+)
+
+// setMetricsState updates the state of the network reported by the
+// soju_networks_total metric. An empty state stops accounting for the network.
+func (net *network) setMetricsState(state string) {
+	if net.metricsState == state {
+		return
+	}
+	gauge := net.user.srv.metrics.networks
+	if net.metricsState != "" {
+		gauge.WithLabelValues(net.metricsState).Dec()
+	}
+	if state != "" {
+		gauge.WithLabelValues(state).Inc()
 	}
+	net.metricsState = state
 }
 
 func (net *network) forEachDownstream(f func(*downstreamConn)) {
 	for _, dc := range net.user.downstreamConns {
 		if dc.network == nil && !dc.isMultiUpstream {
-			return
+			continue
 		}
 		if dc.network != nil && dc.network != net {
-			return
+			continue
 		}
 		f(dc)
 	}
@@ -187,6 +364,21 @@ func userIdent(u *User) string {
 	return hex.EncodeToString(h[:16])
 }
 
+// downstreamIP returns the IP address of a downstream connection, taking
+// trusted proxies into account, or an empty string if it isn't an IP
+// connection (e.g. for Unix sockets).
+func downstreamIP(dc *downstreamConn) string {
+	host := dc.conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
 func (net *network) runConn(ctx context.Context) error {
 	net.user.srv.metrics.upstreams.Add(1)
 	defer net.user.srv.metrics.upstreams.Add(-1)
@@ -201,7 +393,9 @@ func (net *network) runConn(ctx context.Context) error {
 	defer uc.Close()
 
 	if net.user.srv.Identd != nil {
-		net.user.srv.Identd.Store(uc.RemoteAddr().String(), uc.LocalAddr().String(), userIdent(&net.user.User))
+		cfg := net.user.srv.Config()
+		ident := net.user.srv.getIdent(&net.user.User, &net.Network)
+		net.user.srv.Identd.StoreWithOS(uc.RemoteAddr().String(), uc.LocalAddr().String(), cfg.IdentOS, ident)
 		defer net.user.srv.Identd.Delete(uc.RemoteAddr().String(), uc.LocalAddr().String())
 	}
 
@@ -209,9 +403,18 @@ func (net *network) runConn(ctx context.Context) error {
 	// uc.register accesses user/network DB records
 	uc.register(ctx)
 	if err := uc.runUntilRegistered(ctx); err != nil {
+		if uc.stsPort != 0 {
+			return fmt.Errorf("failed to register over TLS connection required by STS policy: %w", err)
+		}
 		return fmt.Errorf("failed to register: %w", err)
 	}
 
+	// The upgraded connection works: from now on, the STS policy advertised
+	// over it applies
+	net.stsLock.Lock()
+	net.stsUpgradePort = 0
+	net.stsLock.Unlock()
+
 	// TODO: this is racy with net.stopped. If the network is stopped
 	// before the user goroutine receives eventUpstreamConnected, the
 	// connection won't be closed.
@@ -227,8 +430,74 @@ func (net *network) runConn(ctx context.Context) error {
 	return nil
 }
 
+type networkTestResult struct {
+	nick          string
+	welcome       string
+	account       string
+	saslMechanism string
+	// Reason of the last SASL authentication failure, if any
+	saslError string
+}
+
+// test connects and registers to the network, then disconnects.
+func (net *network) test(ctx context.Context) (*networkTestResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	uc, err := connectToUpstream(ctx, net)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer uc.Close()
+
+	if net.user.srv.Identd != nil {
+		cfg := net.user.srv.Config()
+		ident := net.user.srv.getIdent(&net.user.User, &net.Network)
+		net.user.srv.Identd.StoreWithOS(uc.RemoteAddr().String(), uc.LocalAddr().String(), cfg.IdentOS, ident)
+		defer net.user.srv.Identd.Delete(uc.RemoteAddr().String(), uc.LocalAddr().String())
+	}
+
+	uc.register(ctx)
+
+	var welcome, saslError string
+	for !uc.registered {
+		msg, err := uc.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to register: failed to read message: %v", err)
+		}
+
+		switch msg.Command {
+		case irc.RPL_WELCOME:
+			if len(msg.Params) > 1 {
+				welcome = msg.Params[len(msg.Params)-1]
+			}
+		case irc.ERR_NICKLOCKED, irc.ERR_SASLFAIL, irc.ERR_SASLTOOLONG, irc.ERR_SASLABORTED:
+			saslError = msg.Command
+			if len(msg.Params) > 1 {
+				saslError = msg.Params[len(msg.Params)-1]
+			}
+		}
+
+		if err := uc.handleMessage(ctx, msg); err != nil {
+			var regErr registrationError
+			if errors.As(err, &regErr) {
+				return nil, fmt.Errorf("failed to register: %v", regErr.Reason())
+			}
+			return nil, fmt.Errorf("failed to register: %v", err)
+		}
+	}
+
+	return &networkTestResult{
+		nick:          uc.nick,
+		welcome:       welcome,
+		account:       uc.account,
+		saslMechanism: uc.saslMechanism,
+		saslError:     saslError,
+	}, nil
+}
+
 func (net *network) run() {
-	if !net.Enabled {
+	if !net.Enabled || net.disconnected {
 		return
 	}
 
@@ -239,6 +508,18 @@ func (net *network) run() {
 			return
 		}
 
+		if net.isIdle() {
+			// Stay disconnected until a client needs the network
+			select {
+			case <-net.stopped:
+				return
+			case <-net.wake:
+			}
+			backoff.Reset()
+			lastTry = time.Time{}
+			continue
+		}
+
 		delay := backoff.Next() - time.Now().Sub(lastTry)
 		if delay > 0 {
 			net.logger.Printf("waiting %v before trying to reconnect to %q", delay.Truncate(time.Second), net.Addr)
@@ -246,17 +527,37 @@ func (net *network) run() {
 		}
 		lastTry = time.Now()
 
-		if err := net.runConn(context.TODO()); err != nil {
+		err := net.runConn(context.TODO())
+		if net.isIdle() {
+			// The connection has been closed because the last client left
+			continue
+		}
+		if err != nil {
+			var stsErr stsUpgradeError
+			if errors.As(err, &stsErr) {
+				net.logger.Printf("upgrading connection to %q to TLS as required by STS policy", net.Addr)
+				net.stsLock.Lock()
+				net.stsUpgradePort = stsErr.port
+				net.stsLock.Unlock()
+				backoff.Reset()
+				lastTry = time.Time{}
+				continue
+			}
+
 			text := err.Error()
 			temp := true
 			var regErr registrationError
+			var authErr authFailureError
 			if errors.As(err, &regErr) {
 				text = "failed to register: " + regErr.Reason()
 				temp = regErr.Temporary()
+			} else if errors.As(err, &authErr) {
+				text = authErr.Error()
+				temp = false
 			}
 
 			net.logger.Printf("connection error to %q: %v", net.Addr, text)
-			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("connection error: %v", err)}
+			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("connection error: %w", err)}
 			net.user.srv.metrics.upstreamConnectErrorsTotal.Inc()
 
 			if !temp {
@@ -268,6 +569,152 @@ func (net *network) run() {
 	}
 }
 
+// stsPort returns the TLS port to connect to as required by an STS policy, or
+// zero if there is no policy in effect. It must be called from the network
+// goroutine.
+func (net *network) stsPort() int {
+	net.stsLock.Lock()
+	defer net.stsLock.Unlock()
+	if net.stsUpgradePort != 0 {
+		return net.stsUpgradePort
+	}
+	if net.stsPolicyPort != 0 && time.Now().Before(net.stsPolicyExpiresAt) {
+		return net.stsPolicyPort
+	}
+	return 0
+}
+
+// messageDelay returns the delay between two messages sent to the upstream
+// server once the burst is exhausted.
+func (net *network) messageDelay() time.Duration {
+	if net.MessageDelay != 0 {
+		return net.MessageDelay
+	}
+	return net.user.srv.Config().UpstreamMessageDelay
+}
+
+// connectTimeout returns the timeout for connecting to the upstream server.
+func (net *network) connectTimeout() time.Duration {
+	if net.ConnectTimeout != 0 {
+		return net.ConnectTimeout
+	}
+	return net.user.srv.Config().UpstreamConnectTimeout
+}
+
+// messageBurst returns the number of messages which can be sent to the
+// upstream server at once.
+func (net *network) messageBurst() int {
+	if net.MessageBurst != 0 {
+		return net.MessageBurst
+	}
+	return net.user.srv.Config().UpstreamMessageBurst
+}
+
+// updateSTSPolicy persists the STS policy advertised by the server over the
+// upgraded TLS connection.
+func (net *network) updateSTSPolicy(ctx context.Context, port int, policy *stsPolicy) {
+	if *policy.Duration == 0 {
+		if net.STSPort == 0 {
+			return
+		}
+		net.logger.Printf("removing STS policy")
+		net.STSPort = 0
+		net.STSExpiresAt = time.Time{}
+	} else {
+		// The policy is advertised on every connection: only refresh the
+		// stored expiry once half of the duration has elapsed, to avoid
+		// writing to the database (and reloading the network on other
+		// instances) each time
+		now := time.Now()
+		if net.STSPort == port && net.STSExpiresAt.After(now.Add(*policy.Duration/2)) {
+			return
+		}
+		net.STSPort = port
+		net.STSExpiresAt = now.Add(*policy.Duration)
+	}
+
+	net.stsLock.Lock()
+	net.stsPolicyPort = net.STSPort
+	net.stsPolicyExpiresAt = net.STSExpiresAt
+	net.stsLock.Unlock()
+
+	if err := net.user.srv.db.StoreNetwork(ctx, net.user.ID, &net.Network); err != nil {
+		net.logger.Printf("failed to store STS policy: %v", err)
+	}
+}
+
+// updateAutoJoin replaces the network's auto-join list. Unlike updateNetwork,
+// this doesn't require re-connecting to the upstream server.
+func (net *network) updateAutoJoin(ctx context.Context, channels []AutoJoinChannel) error {
+	record := net.Network // copy network record because we'll mutate it
+	record.AutoJoin = channels
+	if err := net.user.srv.db.StoreNetwork(ctx, net.user.ID, &record); err != nil {
+		return fmt.Errorf("failed to update auto-join channels: %v", err)
+	}
+	net.AutoJoin = channels
+	return nil
+}
+
+// isIdle checks whether the network only connects on demand and no client
+// needs it. It's safe to call from any goroutine.
+func (net *network) isIdle() bool {
+	return net.OnDemand && atomic.LoadInt32(&net.demanded) == 0
+}
+
+// onDemandGrace returns the time during which an on-demand network stays
+// connected after the last client has left.
+func (net *network) onDemandGrace() time.Duration {
+	if net.OnDemandGrace != 0 {
+		return net.OnDemandGrace
+	}
+	return defaultOnDemandGrace
+}
+
+// demand connects to an on-demand network, and cancels any pending idle
+// disconnection.
+func (net *network) demand() {
+	if net.idleTimer != nil {
+		net.idleTimer.Stop()
+		net.idleTimer = nil
+	}
+	if atomic.SwapInt32(&net.demanded, 1) == 0 {
+		select {
+		case net.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// updateDemand connects to an on-demand network if a client needs it, or
+// schedules a disconnection after the grace period otherwise.
+func (net *network) updateDemand() {
+	if !net.OnDemand {
+		return
+	}
+
+	inUse := net.user.hasSuspendedSession(net)
+	net.forEachDownstream(func(*downstreamConn) {
+		inUse = true
+	})
+	if inUse {
+		net.demand()
+		return
+	}
+	if atomic.LoadInt32(&net.demanded) == 0 || net.idleTimer != nil {
+		return
+	}
+
+	net.idleGen++
+	gen := net.idleGen
+	u := net.user
+	net.idleTimer = time.AfterFunc(net.onDemandGrace(), func() {
+		select {
+		case u.events <- eventNetworkIdle{net, gen}:
+		case <-u.done:
+		}
+	})
+}
+
 func (net *network) stop() {
 	if !net.isStopped() {
 		close(net.stopped)
@@ -366,6 +813,78 @@ func (net *network) deleteChannel(ctx context.Context, name string) error {
 	return nil
 }
 
+// channelSortOrder returns the sort order of a saved channel, or zero if the
+// target isn't a saved channel or has no explicit order.
+func (net *network) channelSortOrder(name string) int {
+	if ch := net.channels.Value(name); ch != nil {
+		return ch.SortOrder
+	}
+	return 0
+}
+
+// sortOrderLess reports whether a target with the sort order a should be
+// listed before one with the sort order b. Targets without an explicit sort
+// order are listed last.
+func sortOrderLess(a, b int) bool {
+	if a == 0 || b == 0 {
+		return a != 0 && b == 0
+	}
+	return a < b
+}
+
+// channelLess reports whether the channel a should be listed before b.
+// Channels without an explicit sort order are sorted by name.
+func (net *network) channelLess(a, b string) bool {
+	orderA, orderB := net.channelSortOrder(a), net.channelSortOrder(b)
+	if orderA != orderB {
+		return sortOrderLess(orderA, orderB)
+	}
+	return strings.ReplaceAll(a, "#", "") < strings.ReplaceAll(b, "#", "")
+}
+
+// sortedChannels returns the saved channels in the order set by the user.
+func (net *network) sortedChannels() []*Channel {
+	channels := make([]*Channel, 0, net.channels.Len())
+	for _, entry := range net.channels.innerMap {
+		channels = append(channels, entry.value.(*Channel))
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return net.channelLess(channels[i].Name, channels[j].Name)
+	})
+	return channels
+}
+
+// reorderChannels sets the sort order of the saved channels. The given
+// channels are listed first, in order. The other channels lose their explicit
+// order.
+func (net *network) reorderChannels(ctx context.Context, names []string) error {
+	order := make(map[*Channel]int, len(names))
+	for i, name := range names {
+		ch := net.channels.Value(name)
+		if ch == nil {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+		if _, ok := order[ch]; ok {
+			return fmt.Errorf("duplicate channel %q", name)
+		}
+		order[ch] = i + 1
+	}
+
+	for _, entry := range net.channels.innerMap {
+		ch := entry.value.(*Channel)
+		sortOrder := order[ch]
+		if ch.SortOrder == sortOrder {
+			continue
+		}
+		ch.SortOrder = sortOrder
+		if err := net.user.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+			return fmt.Errorf("failed to update channel %q: %v", ch.Name, err)
+		}
+	}
+
+	return nil
+}
+
 func (net *network) updateCasemapping(newCasemap casemapping) {
 	net.casemap = newCasemap
 	net.channels.SetCasemapping(newCasemap)
@@ -380,11 +899,16 @@ func (net *network) updateCasemapping(newCasemap casemapping) {
 	}
 	net.forEachDownstream(func(dc *downstreamConn) {
 		dc.monitored.SetCasemapping(newCasemap)
+		if m := dc.targetFilter[net.ID]; m != nil {
+			m.SetCasemapping(newCasemap)
+		}
 	})
 }
 
+// storeClientDeliveryReceipts saves the delivery receipts of a client, if they
+// changed since they were last saved.
 func (net *network) storeClientDeliveryReceipts(ctx context.Context, clientName string) {
-	if !net.user.hasPersistentMsgStore() {
+	if !net.user.hasPersistentMsgStore() || !net.delivered.IsDirty(clientName) {
 		return
 	}
 
@@ -402,7 +926,162 @@ func (net *network) storeClientDeliveryReceipts(ctx context.Context, clientName
 
 	if err := net.user.srv.db.StoreClientDeliveryReceipts(ctx, net.ID, clientName, receipts); err != nil {
 		net.logger.Printf("failed to store delivery receipts for client %q: %v", clientName, err)
+		return
+	}
+	net.delivered.MarkClean(clientName)
+	net.user.srv.metrics.deliveryReceiptWritesTotal.Inc()
+}
+
+// flushDeliveryReceipts saves the delivery receipts which changed since they
+// were last saved.
+func (net *network) flushDeliveryReceipts(ctx context.Context) {
+	net.delivered.ForEachDirtyClient(func(clientName string) {
+		net.storeClientDeliveryReceipts(ctx, clientName)
+	})
+}
+
+// reconcileDeliveryReceipts merges the delivery receipts of a client persisted
+// in the database into the in-memory store, keeping the most recent message
+// ID for each target. This prevents replaying messages which have already been
+// delivered when the in-memory receipts are lagging behind, e.g. because they
+// haven't been flushed before a restart.
+func (net *network) reconcileDeliveryReceipts(ctx context.Context, clientName string) {
+	if _, ok := net.user.msgStore.(*fsMessageStore); !ok {
+		return
+	}
+
+	receipts, err := net.user.srv.db.ListDeliveryReceipts(ctx, net.ID)
+	if err != nil {
+		net.logger.Printf("failed to load delivery receipts for client %q: %v", clientName, err)
+		return
+	}
+
+	for _, rcpt := range receipts {
+		if rcpt.Client != clientName || rcpt.InternalMsgID == "" {
+			continue
+		}
+		if id := net.delivered.LoadID(rcpt.Target, clientName); id != "" {
+			cmp, err := compareFSMsgIDs(rcpt.InternalMsgID, id)
+			if err != nil {
+				net.logger.Printf("failed to compare delivery receipts for client %q, target %q: %v", clientName, rcpt.Target, err)
+				continue
+			} else if cmp <= 0 {
+				continue
+			}
+		}
+		net.delivered.StoreID(rcpt.Target, clientName, rcpt.InternalMsgID)
+	}
+}
+
+// renameTarget moves the stored logs of a target to another target, and
+// updates the message IDs referring to these logs.
+func (net *network) renameTarget(ctx context.Context, oldName, newName string, merge bool) error {
+	store, ok := net.user.msgStore.(*fsMessageStore)
+	if !ok {
+		return fmt.Errorf("the message store doesn't support moving logs")
 	}
+
+	oldCM := net.casemap(oldName)
+	newCM := net.casemap(newName)
+	mapMsgID, err := store.RenameTarget(&net.Network, oldCM, newCM, merge)
+	if err != nil {
+		return err
+	}
+
+	// Message IDs contain the target name, and the offsets of merged logs
+	// changed too
+	updateID := func(id string) string {
+		if id == "" {
+			return ""
+		}
+		return mapMsgID(id)
+	}
+
+	net.delivered.ForEachClient(func(clientName string) {
+		id := updateID(net.delivered.LoadID(newName, clientName))
+		oldID := updateID(net.delivered.LoadID(oldName, clientName))
+		// Keep the older receipt, so that the messages of the other target
+		// which haven't been delivered yet aren't skipped
+		if id == "" {
+			id = oldID
+		} else if oldID != "" {
+			if cmp, err := compareFSMsgIDs(oldID, id); err == nil && cmp < 0 {
+				id = oldID
+			}
+		}
+		if id != "" {
+			net.delivered.StoreID(newName, clientName, id)
+		}
+	})
+	net.delivered.DeleteTarget(oldName)
+	net.delivered.ForEachClient(func(clientName string) {
+		net.storeClientDeliveryReceipts(ctx, clientName)
+	})
+
+	for _, entry := range net.channels.innerMap {
+		ch := entry.value.(*Channel)
+		id := updateID(ch.DetachedInternalMsgID)
+		if id == ch.DetachedInternalMsgID {
+			continue
+		}
+		ch.DetachedInternalMsgID = id
+		if err := net.user.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+			return fmt.Errorf("failed to update channel %q: %v", ch.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// purgeLogs deletes the stored messages of a target, or of all targets if
+// target is empty.
+func (net *network) purgeLogs(ctx context.Context, target string) error {
+	var entity string
+	if target != "" {
+		entity = net.casemap(target)
+	}
+	if net.user.msgStore != nil {
+		if err := net.user.msgStore.Purge(&net.Network, entity); err != nil {
+			return err
+		}
+	}
+	return net.forgetLogs(ctx, target)
+}
+
+// forgetLogs drops the delivery receipts and message IDs referring to the
+// logs of a target, or of all targets if target is empty, once these logs
+// have been deleted.
+func (net *network) forgetLogs(ctx context.Context, target string) error {
+	var clients, targets []string
+	net.delivered.ForEachClient(func(clientName string) {
+		clients = append(clients, clientName)
+	})
+	if target != "" {
+		targets = []string{target}
+	} else {
+		net.delivered.ForEachTarget(func(target string) {
+			targets = append(targets, target)
+		})
+	}
+	for _, target := range targets {
+		net.delivered.DeleteTarget(target)
+	}
+	for _, clientName := range clients {
+		net.storeClientDeliveryReceipts(ctx, clientName)
+	}
+
+	for _, entry := range net.channels.innerMap {
+		ch := entry.value.(*Channel)
+		if ch.DetachedInternalMsgID == "" || (target != "" && net.casemap(ch.Name) != net.casemap(target)) {
+			continue
+		}
+		ch.DetachedInternalMsgID = ""
+		if err := net.user.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+			return fmt.Errorf("failed to update channel %q: %v", ch.Name, err)
+		}
+	}
+
+	return nil
 }
 
 func (net *network) isHighlight(msg *irc.Message) bool {
@@ -422,10 +1101,82 @@ func (net *network) isHighlight(msg *irc.Message) bool {
 }
 
 func (net *network) detachedMessageNeedsRelay(ch *Channel, msg *irc.Message) bool {
+	if ch.Muted {
+		return false
+	}
+
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		// Handled below
+	case "JOIN", "PART", "KICK", "QUIT":
+		return ch.RelayDetachedMembership && ch.RelayDetached != FilterNone
+	default:
+		return false
+	}
+
 	highlight := net.isHighlight(msg)
 	return ch.RelayDetached == FilterMessage || ((ch.RelayDetached == FilterHighlight || ch.RelayDetached == FilterDefault) && highlight)
 }
 
+// isIgnored checks whether messages sent by the specified user should be
+// dropped, according to the user's ignore list.
+func (net *network) isIgnored(prefix *irc.Prefix) bool {
+	if len(net.user.IgnoreMasks) == 0 {
+		return false
+	}
+
+	s := net.casemap(prefix.Name + "!" + prefix.User + "@" + prefix.Host)
+	for _, mask := range net.user.IgnoreMasks {
+		if matchMask(net.casemap(normalizeMask(mask)), s) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	serverNoticesRelay    = ""
+	serverNoticesDrop     = "drop"
+	serverNoticesRedirect = "redirect"
+)
+
+// serverNoticePolicy returns how a NOTICE sent by the server itself must be
+// handled, given its text.
+func (net *network) serverNoticePolicy(text string) string {
+	if net.ServerNotices == serverNoticesRelay {
+		return serverNoticesRelay
+	}
+
+	text = strings.ToLower(text)
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matchMask(strings.ToLower(pattern), text) {
+				return true
+			}
+		}
+		return false
+	}
+	if match(net.ServerNoticeAllow) {
+		return serverNoticesRelay
+	}
+	if len(net.ServerNoticeDeny) > 0 && !match(net.ServerNoticeDeny) {
+		return serverNoticesRelay
+	}
+	return net.ServerNotices
+}
+
+// isLoggingDisabled checks whether messages for the specified target should be
+// kept out of the message store, be it in-memory or on-disk.
+func (net *network) isLoggingDisabled(target string) bool {
+	if net.NoLogging {
+		return true
+	}
+	if ch := net.channels.Value(target); ch != nil {
+		return ch.NoLogging
+	}
+	return false
+}
+
 func (net *network) autoSaveSASLPlain(ctx context.Context, username, password string) {
 	// User may have e.g. EXTERNAL mechanism configured. We do not want to
 	// automatically erase the key pair or any other credentials.
@@ -437,6 +1188,7 @@ func (net *network) autoSaveSASLPlain(ctx context.Context, username, password st
 	net.SASL.Mechanism = "PLAIN"
 	net.SASL.Plain.Username = username
 	net.SASL.Plain.Password = password
+	net.SASL.Plain.Authzid = ""
 	if err := net.user.srv.db.StoreNetwork(ctx, net.user.ID, &net.Network); err != nil {
 		net.logger.Printf("failed to save SASL PLAIN credentials: %v", err)
 	}
@@ -453,28 +1205,214 @@ type user struct {
 	networks        []*network
 	downstreamConns []*downstreamConn
 	msgStore        messageStore
+
+	// Whether the last message couldn't be logged because of the quota
+	logQuotaExceeded bool
+
+	// Cached result of location, loaded for the locName time zone
+	loc     *time.Location
+	locName string
+
+	// Local channels, by casemapped name
+	localChannels map[string]*localChannel
+
+	// Closed downstream connections which can be resumed, by token
+	suspendedSessions map[string]*suspendedSession
+
+	receiptsFlushTimer *time.Timer
+
+	// len(downstreamConns), readable from other goroutines
+	numDownstreams int64Gauge
+	// *messageStoreStats, readable from other goroutines
+	msgStoreStats atomic.Value
+	// IP address of the last registered downstream connection as a string,
+	// readable from other goroutines, forwarded to upstreams via WEBIRC
+	clientIP atomic.Value
+
+	// Limits the messages sent by clients across all upstream networks, see
+	// messageRateLimiter
+	msgRateLimiter *rate.Limiter
+	// Time of the last throttled message in Unix nanoseconds, accessed
+	// atomically
+	lastThrottled int64
+	// Limits the creations and deletions of networks, see
+	// allowNetworkChange
+	networkChangeLimiter *rate.Limiter
+	// Whether debug messages are logged for this user regardless of the
+	// server-wide setting, accessed atomically, see userLogger
+	debugLogging int32
 }
 
 func newUser(srv *Server, record *User) *user {
-	logger := &prefixLogger{srv.Logger, fmt.Sprintf("user %q: ", record.Username)}
+	u := &user{
+		User:   *record,
+		srv:    srv,
+		events: make(chan event, srv.Config().UserEventQueueSize),
+		done:   make(chan struct{}),
+
+		localChannels:        make(map[string]*localChannel),
+		suspendedSessions:    make(map[string]*suspendedSession),
+		msgRateLimiter:       rate.NewLimiter(rate.Inf, srv.Config().UserMessageBurst),
+		networkChangeLimiter: rate.NewLimiter(rate.Inf, srv.Config().NetworkChangeBurst),
+	}
+	u.logger = &userLogger{
+		Logger: newPrefixLogger(srv.Logger, "user", record.Username),
+		debug:  &u.debugLogging,
+	}
+
+	u.msgStore = u.newMsgStore()
+
+	return u
+}
+
+// newMsgStore creates the message store selected by the user, or the server
+// default. Messages are logged to disk when enabled on the server, unless the
+// user opted out. Nil is returned if messages shouldn't be stored at all.
+func (u *user) newMsgStore() messageStore {
+	switch u.MsgStore {
+	case msgStoreNone:
+		return nil
+	case msgStoreMemory:
+		return newMemoryMessageStore()
+	}
+
+	logPath := u.srv.Config().LogPath
+	if logPath == "" {
+		return newMemoryMessageStore()
+	}
+	fsMsgStore := newFSMessageStore(logPath, &u.User)
+	fsMsgStore.quota = u.logQuota
+	return fsMsgStore
+}
+
+// updateMsgStore replaces the message store after the user has selected a
+// different one. The delivery receipts refer to the previous store, so they
+// are saved if possible and reset.
+func (u *user) updateMsgStore(ctx context.Context) {
+	for _, net := range u.networks {
+		net.flushDeliveryReceipts(ctx)
+		net.delivered = newDeliveredStore()
+	}
+
+	if u.msgStore != nil {
+		if err := u.msgStore.Close(); err != nil {
+			u.logger.Printf("failed to close message store for user %q: %v", u.Username, err)
+		}
+	}
+	u.msgStore = u.newMsgStore()
+	u.updateMsgStoreStats()
+}
+
+// messageRateLimiter returns the limiter for the messages sent by the user's
+// clients across all upstream networks, updated with the current
+// configuration. nil is returned if the limit is disabled. It's safe to call
+// from any goroutine.
+func (u *user) messageRateLimiter() *rate.Limiter {
+	cfg := u.srv.Config()
+	if cfg.UserMessageDelay == 0 {
+		return nil
+	}
+	if limit := rate.Every(cfg.UserMessageDelay); u.msgRateLimiter.Limit() != limit {
+		u.msgRateLimiter.SetLimit(limit)
+	}
+	if u.msgRateLimiter.Burst() != cfg.UserMessageBurst {
+		u.msgRateLimiter.SetBurst(cfg.UserMessageBurst)
+	}
+	return u.msgRateLimiter
+}
+
+// allowNetworkChange reports whether the user can create or delete a network
+// without exceeding the network change rate, updated with the current
+// configuration. Admins aren't limited.
+func (u *user) allowNetworkChange() bool {
+	if u.Admin {
+		return true
+	}
+
+	cfg := u.srv.Config()
+	delay := u.NetworkChangeDelay
+	if delay == 0 {
+		delay = cfg.NetworkChangeDelay
+	}
+	if delay <= 0 {
+		return true
+	}
+	if limit := rate.Every(delay); u.networkChangeLimiter.Limit() != limit {
+		u.networkChangeLimiter.SetLimit(limit)
+	}
+	if u.networkChangeLimiter.Burst() != cfg.NetworkChangeBurst {
+		u.networkChangeLimiter.SetBurst(cfg.NetworkChangeBurst)
+	}
+	return u.networkChangeLimiter.Allow()
+}
+
+func isRateLimitedCommand(cmd string) bool {
+	switch cmd {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		return true
+	default:
+		return false
+	}
+}
+
+// allowUpstreamMessage checks whether a message sent by a client can be
+// relayed to an upstream network, given the user's message rate limit. With
+// the queue policy, messages are always allowed: they're delayed by
+// waitMessageRate instead.
+func (u *user) allowUpstreamMessage() bool {
+	lim := u.messageRateLimiter()
+	if lim == nil || u.srv.Config().UserMessagePolicy == userMessagePolicyQueue {
+		return true
+	}
+	if lim.Allow() {
+		return true
+	}
+	u.markThrottled()
+	return false
+}
+
+// waitMessageRate blocks until a message can be sent to an upstream network
+// with the queue policy of the user's message rate limit. It's called by the
+// upstream connection writers.
+func (u *user) waitMessageRate(ctx context.Context, msg *irc.Message) error {
+	if !isRateLimitedCommand(msg.Command) || u.srv.Config().UserMessagePolicy != userMessagePolicyQueue {
+		return nil
+	}
+	lim := u.messageRateLimiter()
+	if lim == nil {
+		return nil
+	}
 
-	var msgStore messageStore
-	if logPath := srv.Config().LogPath; logPath != "" {
-		msgStore = newFSMessageStore(logPath, record)
-	} else {
-		msgStore = newMemoryMessageStore()
+	r := lim.Reserve()
+	d := r.Delay()
+	if d == 0 {
+		return nil
 	}
+	u.markThrottled()
 
-	return &user{
-		User:     *record,
-		srv:      srv,
-		logger:   logger,
-		events:   make(chan event, 64),
-		done:     make(chan struct{}),
-		msgStore: msgStore,
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
 	}
 }
 
+func (u *user) markThrottled() {
+	atomic.StoreInt64(&u.lastThrottled, time.Now().UnixNano())
+	u.srv.metrics.userMessagesThrottledTotal.Inc()
+}
+
+// isThrottled returns whether a message of the user has been throttled
+// recently. It's safe to call from any goroutine.
+func (u *user) isThrottled() bool {
+	last := atomic.LoadInt64(&u.lastThrottled)
+	return last != 0 && time.Since(time.Unix(0, last)) < userThrottledWindow
+}
+
 func (u *user) forEachUpstream(f func(uc *upstreamConn)) {
 	for _, network := range u.networks {
 		if network.conn == nil {
@@ -522,7 +1460,7 @@ func (u *user) run() {
 	}
 
 	sort.Slice(networks, func(i, j int) bool {
-		return networks[i].ID < networks[j].ID
+		return networkLess(&networks[i], &networks[j])
 	})
 
 	for _, record := range networks {
@@ -535,6 +1473,7 @@ func (u *user) run() {
 
 		network := newNetwork(u, &record, channels)
 		u.networks = append(u.networks, network)
+		network.setMetricsState(networkStateDisconnected)
 
 		if u.hasPersistentMsgStore() {
 			receipts, err := u.srv.db.ListDeliveryReceipts(context.TODO(), record.ID)
@@ -545,12 +1484,15 @@ func (u *user) run() {
 
 			for _, rcpt := range receipts {
 				network.delivered.StoreID(rcpt.Target, rcpt.Client, rcpt.InternalMsgID)
+				network.delivered.MarkClean(rcpt.Client)
 			}
 		}
 
 		go network.run()
 	}
 
+	u.scheduleReceiptsFlush()
+
 	for e := range u.events {
 		switch e := e.(type) {
 		case eventUpstreamConnected:
@@ -558,6 +1500,15 @@ func (u *user) run() {
 
 			uc.network.conn = uc
 
+			if uc.network.isIdle() {
+				// The last client left while we were connecting
+				uc.Close()
+			}
+
+			if uc.stsPolicy != nil {
+				uc.network.updateSTSPolicy(context.TODO(), uc.stsPort, uc.stsPolicy)
+			}
+
 			uc.updateAway()
 			uc.updateMonitor()
 
@@ -565,7 +1516,11 @@ func (u *user) run() {
 				dc.updateSupportedCaps()
 
 				if !dc.caps.IsEnabled("soju.im/bouncer-networks") {
-					sendServiceNOTICE(dc, fmt.Sprintf("connected to %s", uc.network.GetName()))
+					if uc.saslMechanism != "" {
+						sendServiceNOTICE(dc, fmt.Sprintf("connected to %s (authenticated with SASL %s)", uc.network.GetName(), uc.saslMechanism))
+					} else {
+						sendServiceNOTICE(dc, fmt.Sprintf("connected to %s", uc.network.GetName()))
+					}
 				}
 
 				dc.updateNick()
@@ -573,11 +1528,18 @@ func (u *user) run() {
 				dc.updateRealname()
 				dc.updateAccount()
 			})
+			uc.network.lastError = nil
+			uc.network.lastErrorCode = ""
+			uc.network.lastErrorReason = ""
+			uc.network.lastConnected = time.Now()
 			u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{
-				"state": "connected",
-				"error": "",
+				"state":          "connected",
+				"error":          "",
+				"error-code":     "",
+				"error-reason":   "",
+				"last-connected": irc.TagValue(formatServerTime(uc.network.lastConnected)),
 			})
-			uc.network.lastError = nil
+			uc.network.setMetricsState(networkStateConnected)
 		case eventUpstreamDisconnected:
 			u.handleUpstreamDisconnected(e.uc)
 		case eventUpstreamConnectionError:
@@ -595,20 +1557,12 @@ func (u *user) run() {
 					sendServiceNOTICE(dc, fmt.Sprintf("failed connecting/registering to %s: %v", net.GetName(), e.err))
 				})
 			}
-			net.lastError = e.err
-			u.notifyBouncerNetworkState(net.ID, irc.Tags{
-				"error": irc.TagValue(net.lastError.Error()),
-			})
+			if !stopped {
+				net.setMetricsState(networkStateError)
+			}
+			net.setError(e.err)
 		case eventUpstreamError:
-			uc := e.uc
-
-			uc.forEachDownstream(func(dc *downstreamConn) {
-				sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s: %v", uc.network.GetName(), e.err))
-			})
-			uc.network.lastError = e.err
-			u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{
-				"error": irc.TagValue(uc.network.lastError.Error()),
-			})
+			u.handleUpstreamError(e.uc, e.err)
 		case eventUpstreamMessage:
 			msg, uc := e.msg, e.uc
 			if uc.isClosed() {
@@ -616,7 +1570,20 @@ func (u *user) run() {
 				break
 			}
 			if err := uc.handleMessage(context.TODO(), msg); err != nil {
-				uc.logger.Printf("failed to handle message %q: %v", msg, err)
+				var fatalErr fatalServerError
+				if errors.As(err, &fatalErr) {
+					u.handleUpstreamError(uc, err)
+				} else {
+					uc.logger.Printf("failed to handle message %q: %v", msg, err)
+				}
+			}
+		case eventNickServTimeout:
+			if e.uc.nickServPending && !e.uc.isClosed() {
+				e.uc.identifyNickServ(context.TODO())
+			}
+		case eventPendingJoin:
+			if !e.uc.isClosed() {
+				e.uc.sendPendingJoin(context.TODO())
 			}
 		case eventChannelDetach:
 			uc, name := e.uc, e.name
@@ -631,10 +1598,27 @@ func (u *user) run() {
 		case eventDownstreamConnected:
 			dc := e.dc
 
+			if max := u.maxDownstreams(); max >= 0 && len(u.downstreamConns) >= max {
+				dc.logger.Printf("rejecting connection: maximum number of connections (%v) reached", max)
+				u.srv.metrics.downstreamsRejectedTotal.Inc()
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: "ERROR",
+					Params:  []string{"Too many connections for this user"},
+				})
+				dc.Shutdown()
+				break
+			}
+
 			if dc.network != nil {
 				dc.monitored.SetCasemapping(dc.network.casemap)
 			}
 
+			// Before welcome, which may connect on-demand networks
+			if ip := downstreamIP(dc); ip != "" {
+				u.clientIP.Store(ip)
+			}
+
 			if err := dc.welcome(context.TODO()); err != nil {
 				if ircErr, ok := err.(ircError); ok {
 					msg := ircErr.Message.Copy()
@@ -652,41 +1636,92 @@ func (u *user) run() {
 			}
 
 			u.downstreamConns = append(u.downstreamConns, dc)
+			u.numDownstreams.Add(1)
 
 			dc.forEachNetwork(func(network *network) {
 				if network.lastError != nil {
 					sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s: %v", network.GetName(), network.lastError))
 				}
 			})
+			if u.logQuotaExceeded {
+				sendServiceNOTICE(dc, logQuotaExceededNotice)
+			}
 
 			u.forEachUpstream(func(uc *upstreamConn) {
 				uc.updateAway()
+				// Resumed connections restore their monitored nicks
+				if dc.monitored.Len() > 0 {
+					uc.updateMonitor()
+				}
 			})
+			for _, net := range u.networks {
+				net.updateDemand()
+			}
 		case eventDownstreamDisconnected:
 			dc := e.dc
 
+			found := false
 			for i := range u.downstreamConns {
 				if u.downstreamConns[i] == dc {
 					u.downstreamConns = append(u.downstreamConns[:i], u.downstreamConns[i+1:]...)
+					u.numDownstreams.Add(-1)
+					found = true
 					break
 				}
 			}
+			if !found {
+				// The connection has been rejected, e.g. because of the
+				// downstream connection limit
+				break
+			}
 
 			dc.forEachNetwork(func(net *network) {
 				net.storeClientDeliveryReceipts(context.TODO(), dc.clientName)
 			})
 
+			if dc.resumeToken != "" {
+				u.suspendDownstream(dc)
+			}
+
 			u.forEachUpstream(func(uc *upstreamConn) {
 				uc.cancelPendingCommandsByDownstreamID(dc.id)
 				uc.updateAway()
 				uc.updateMonitor()
 			})
+			for _, net := range u.networks {
+				net.updateDemand()
+			}
+		case eventSessionExpired:
+			if _, ok := u.suspendedSessions[e.token]; !ok {
+				break
+			}
+			delete(u.suspendedSessions, e.token)
+			u.srv.resume.remove(e.token)
+
+			u.forEachUpstream(func(uc *upstreamConn) {
+				uc.updateAway()
+			})
+			for _, net := range u.networks {
+				net.updateDemand()
+			}
+		case eventNetworkIdle:
+			net := e.net
+			if net.idleTimer == nil || e.gen != net.idleGen || u.getNetworkByID(net.ID) != net {
+				break
+			}
+			net.idleTimer = nil
+			atomic.StoreInt32(&net.demanded, 0)
+			if net.conn != nil {
+				net.logger.Printf("disconnecting from on-demand network: no client attached")
+				net.conn.Close()
+			}
 		case eventDownstreamMessage:
 			msg, dc := e.msg, e.dc
 			if dc.isClosed() {
 				dc.logger.Printf("ignoring message on closed connection: %v", msg)
 				break
 			}
+			lr := dc.beginLabeledResponse(dc.labeledMessage(msg))
 			err := dc.handleMessage(context.TODO(), msg)
 			if ircErr, ok := err.(ircError); ok {
 				ircErr.Message.Prefix = dc.srv.prefix()
@@ -695,12 +1730,29 @@ func (u *user) run() {
 				dc.logger.Printf("failed to handle message %q: %v", msg, err)
 				dc.Close()
 			}
+			dc.endLabeledResponse(lr)
 		case eventBroadcast:
 			msg := e.msg
 			for _, dc := range u.downstreamConns {
 				dc.SendMessage(msg)
 			}
+		case eventLocalMessage:
+			u.postLocalMessage(e.channel, e.msg)
 		case eventUserUpdate:
+			if e.scope != 0 {
+				// The in-memory owner may be stale, e.g. if the owner has
+				// been deleted: check against the database
+				record, err := u.srv.db.GetUser(context.TODO(), u.Username)
+				if err != nil {
+					e.done <- fmt.Errorf("failed to load user %q: %v", u.Username, err)
+					break
+				}
+				if record.Owner != e.scope || record.Admin {
+					e.done <- fmt.Errorf("user %q is not managed by you", u.Username)
+					break
+				}
+			}
+
 			// copy the user record because we'll mutate it
 			record := u.User
 
@@ -710,26 +1762,88 @@ func (u *user) run() {
 			if e.admin != nil {
 				record.Admin = *e.admin
 			}
+			if e.limitedAdmin != nil {
+				record.LimitedAdmin = *e.limitedAdmin
+			}
+			if e.owner != nil {
+				record.Owner = *e.owner
+			}
+			if e.motd != nil {
+				record.MOTD = *e.motd
+			}
+			if e.maxDownstreams != nil {
+				record.MaxDownstreams = *e.maxDownstreams
+			}
+			if e.upstreamIPs != nil {
+				record.UpstreamIPs = *e.upstreamIPs
+			}
+			if e.logQuota != nil {
+				record.LogQuota = *e.logQuota
+			}
+			if e.backlogLimit != nil {
+				record.BacklogLimit = *e.backlogLimit
+			}
+			if e.msgStore != nil {
+				record.MsgStore = *e.msgStore
+			}
+			if e.networkChangeDelay != nil {
+				record.NetworkChangeDelay = *e.networkChangeDelay
+			}
 
 			e.done <- u.updateUser(context.TODO(), &record)
 
 			// If the password was updated, kill all downstream connections to
 			// force them to re-authenticate with the new credentials.
 			if e.password != nil {
-				for _, dc := range u.downstreamConns {
-					dc.Close()
-				}
+				u.revokeSessions(nil)
+			}
+		case eventUserReload:
+			u.reloadUser(context.TODO(), e.record)
+		case eventNetworkReload:
+			if err := u.reloadNetwork(context.TODO(), e.id); err != nil {
+				u.logger.Printf("failed to reload network %v: %v", e.id, err)
+			}
+		case eventNetworkTestResult:
+			dc := e.dc
+			if dc.isClosed() {
+				break
+			}
+			if e.err != nil {
+				sendServicePRIVMSG(dc, fmt.Sprintf("test of network %q failed: %v", e.name, e.err))
+				break
+			}
+			sendServicePRIVMSG(dc, fmt.Sprintf("test of network %q succeeded: registered as %q", e.name, e.result.nick))
+			if e.result.welcome != "" {
+				sendServicePRIVMSG(dc, fmt.Sprintf("server greeting: %v", e.result.welcome))
+			}
+			if e.result.saslMechanism == "" && e.result.saslError != "" {
+				sendServicePRIVMSG(dc, fmt.Sprintf("SASL authentication failed: %v", e.result.saslError))
+			} else if e.result.account != "" {
+				sendServicePRIVMSG(dc, fmt.Sprintf("authenticated with SASL %v as account %q", e.result.saslMechanism, e.result.account))
+			} else if e.result.saslMechanism != "" {
+				sendServicePRIVMSG(dc, fmt.Sprintf("authenticated with SASL %v", e.result.saslMechanism))
+			}
+		case eventMsgStoreStats:
+			u.updateMsgStoreStats()
+		case eventFlushDeliveryReceipts:
+			for _, net := range u.networks {
+				net.flushDeliveryReceipts(context.TODO())
 			}
+			u.scheduleReceiptsFlush()
 		case eventStop:
 			for _, dc := range u.downstreamConns {
 				dc.Close()
 			}
+			for _, s := range u.suspendedSessions {
+				s.timer.Stop()
+			}
+			u.receiptsFlushTimer.Stop()
+			u.srv.resume.forget(u)
 			for _, n := range u.networks {
 				n.stop()
+				n.setMetricsState("")
 
-				n.delivered.ForEachClient(func(clientName string) {
-					n.storeClientDeliveryReceipts(context.TODO(), clientName)
-				})
+				n.flushDeliveryReceipts(context.TODO())
 			}
 			return
 		default:
@@ -738,10 +1852,20 @@ func (u *user) run() {
 	}
 }
 
+func (u *user) scheduleReceiptsFlush() {
+	u.receiptsFlushTimer = time.AfterFunc(u.srv.Config().ReceiptsFlushInterval, func() {
+		select {
+		case u.events <- eventFlushDeliveryReceipts{}:
+		case <-u.done:
+		}
+	})
+}
+
 func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 	uc.network.conn = nil
 
 	uc.abortPendingCommands()
+	uc.abortLabeledResponses()
 
 	for _, entry := range uc.channels.innerMap {
 		uch := entry.value.(*upstreamChannel)
@@ -767,14 +1891,41 @@ func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 	u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{"state": "disconnected"})
 
 	if uc.network.lastError == nil {
+		uc.network.setMetricsState(networkStateDisconnected)
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			if !dc.caps.IsEnabled("soju.im/bouncer-networks") {
 				sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s", uc.network.GetName()))
 			}
 		})
+	} else {
+		uc.network.setMetricsState(networkStateError)
 	}
 }
 
+// handleUpstreamError records an error which is about to close the
+// connection to an upstream server.
+func (u *user) handleUpstreamError(uc *upstreamConn, err error) {
+	uc.logger.Printf("upstream error: %v", err)
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s: %v", uc.network.GetName(), err))
+	})
+	uc.network.setError(err)
+}
+
+// setError records the last error of the network and notifies
+// bouncer-networks clients.
+func (net *network) setError(err error) {
+	net.lastError = err
+	net.lastErrorTime = time.Now()
+	net.lastErrorCode, net.lastErrorReason = upstreamErrorDetails(err)
+	net.user.notifyBouncerNetworkState(net.ID, irc.Tags{
+		"error":           irc.TagValue(err.Error()),
+		"error-code":      irc.TagValue(net.lastErrorCode),
+		"error-reason":    irc.TagValue(net.lastErrorReason),
+		"last-error-time": irc.TagValue(formatServerTime(net.lastErrorTime)),
+	})
+}
+
 func (u *user) notifyBouncerNetworkState(netID int64, attrs irc.Tags) {
 	netIDStr := fmt.Sprintf("%v", netID)
 	for _, dc := range u.downstreamConns {
@@ -788,18 +1939,51 @@ func (u *user) notifyBouncerNetworkState(netID int64, attrs irc.Tags) {
 	}
 }
 
+// notifyBouncerChannelState sends the attributes of a channel to the clients
+// which have enabled bouncer network notifications, so that changes made by
+// one client are synchronized to the others.
+func (u *user) notifyBouncerChannelState(net *network, ch *Channel) {
+	netIDStr := fmt.Sprintf("%v", net.ID)
+	attrs := getChannelAttrs(net, ch)
+	for _, dc := range u.downstreamConns {
+		if dc.caps.IsEnabled("soju.im/bouncer-networks-notify") {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BOUNCER",
+				Params:  []string{"CHANNEL", netIDStr, ch.Name, attrs.String()},
+			})
+		}
+	}
+}
+
+// networkLess reports whether a network is presented to clients before
+// another one. Networks without an explicit sort order are sorted by ID.
+func networkLess(a, b *Network) bool {
+	if a.SortOrder != b.SortOrder {
+		return sortOrderLess(a.SortOrder, b.SortOrder)
+	}
+	return a.ID < b.ID
+}
+
 func (u *user) addNetwork(network *network) {
 	u.networks = append(u.networks, network)
 
 	sort.Slice(u.networks, func(i, j int) bool {
-		return u.networks[i].ID < u.networks[j].ID
+		return networkLess(&u.networks[i].Network, &u.networks[j].Network)
 	})
 
+	network.setMetricsState(networkStateDisconnected)
+	network.updateDemand()
 	go network.run()
 }
 
 func (u *user) removeNetwork(network *network) {
 	network.stop()
+	if network.idleTimer != nil {
+		network.idleTimer.Stop()
+		network.idleTimer = nil
+	}
+	network.setMetricsState("")
 
 	for _, dc := range u.downstreamConns {
 		if dc.network != nil && dc.network == network {
@@ -817,6 +2001,35 @@ func (u *user) removeNetwork(network *network) {
 	panic("tried to remove a non-existing network")
 }
 
+// maxDownstreams returns the maximum number of concurrent downstream
+// connections for the user, or a negative value if there is no limit.
+func (u *user) maxDownstreams() int {
+	if u.MaxDownstreams != 0 {
+		return u.MaxDownstreams
+	}
+	return u.srv.Config().MaxUserDownstreams
+}
+
+// backlogLimit returns the maximum number of messages replayed per target to
+// the user's downstream connections without chathistory support.
+func (u *user) backlogLimit() int {
+	if u.BacklogLimit != 0 {
+		return u.BacklogLimit
+	}
+	return u.srv.Config().BacklogLimit
+}
+
+const logQuotaExceededNotice = "message log quota exceeded: new messages are still relayed but no longer saved to the history"
+
+// logQuota returns the maximum size in bytes of the user's message logs, or
+// zero or a negative value if there is no limit.
+func (u *user) logQuota() int64 {
+	if u.LogQuota != 0 {
+		return u.LogQuota
+	}
+	return u.srv.Config().LogQuota
+}
+
 func (u *user) checkNetwork(record *Network) error {
 	url, err := record.URL()
 	if err != nil {
@@ -839,6 +2052,10 @@ func (u *user) checkNetwork(record *Network) error {
 		if url.Path != "" {
 			return fmt.Errorf("%v:// URL must not have a path", url.Scheme)
 		}
+	case "irc+wss", "irc+ws":
+		if url.Host == "" {
+			return fmt.Errorf("%v:// URL must have a host", url.Scheme)
+		}
 	case "irc+unix", "unix":
 		if url.Host != "" {
 			return fmt.Errorf("%v:// URL must not have a host", url.Scheme)
@@ -850,6 +2067,26 @@ func (u *user) checkNetwork(record *Network) error {
 		return fmt.Errorf("unknown URL scheme %q", url.Scheme)
 	}
 
+	if _, err := lookupCharset(record.Charset); err != nil {
+		return err
+	}
+
+	// Lowering the TLS version weakens the server-wide policy, leave that
+	// decision to admins
+	if min := u.srv.Config().UpstreamTLSMinVersion; record.TLSMinVersion != 0 && record.TLSMinVersion < min && !u.Admin {
+		return fmt.Errorf("only admins can set a TLS minimum version lower than %v", config.FormatTLSVersion(min))
+	}
+
+	if (record.WebIRCPassword == "") != (record.WebIRCGateway == "") {
+		return fmt.Errorf("WEBIRC password and gateway must be set together")
+	}
+	if strings.ContainsAny(record.WebIRCPassword, " \r\n") || strings.HasPrefix(record.WebIRCPassword, ":") {
+		return fmt.Errorf("WEBIRC password cannot contain spaces or start with a colon")
+	}
+	if strings.ContainsAny(record.WebIRCGateway, " \r\n") || strings.HasPrefix(record.WebIRCGateway, ":") {
+		return fmt.Errorf("WEBIRC gateway cannot contain spaces or start with a colon")
+	}
+
 	if record.GetName() == "" {
 		return fmt.Errorf("network name cannot be empty")
 	}
@@ -867,6 +2104,39 @@ func (u *user) checkNetwork(record *Network) error {
 	return nil
 }
 
+// testNetwork checks a network record, then connects and registers to the
+// network in the background without storing anything. The result is sent to
+// the downstream connection as BouncerServ messages.
+func (u *user) testNetwork(dc *downstreamConn, record *Network) error {
+	if err := u.checkNetwork(record); err != nil {
+		return err
+	}
+
+	// Use a detached user, so that the temporary network isn't visible to
+	// downstream connections
+	tmpUser := &user{
+		User:   u.User,
+		srv:    u.srv,
+		logger: u.logger,
+		done:   u.done,
+	}
+	net := newNetwork(tmpUser, record, nil)
+	// Don't cause side effects on the upstream network
+	net.ConnectCommands = nil
+	net.AutoJoin = nil
+
+	go func() {
+		result, err := net.test(context.TODO())
+		select {
+		case u.events <- eventNetworkTestResult{dc, record.GetName(), result, err}:
+		case <-u.done:
+		}
+	}()
+	return nil
+}
+
+var errNetworkChangeRateExceeded = errors.New("too many networks created or deleted recently, try again later")
+
 func (u *user) createNetwork(ctx context.Context, record *Network) (*network, error) {
 	if record.ID != 0 {
 		panic("tried creating an already-existing network")
@@ -880,6 +2150,10 @@ func (u *user) createNetwork(ctx context.Context, record *Network) (*network, er
 		return nil, fmt.Errorf("maximum number of networks reached")
 	}
 
+	if !u.allowNetworkChange() {
+		return nil, errNetworkChangeRateExceeded
+	}
+
 	network := newNetwork(u, record, nil)
 	err := u.srv.db.StoreNetwork(ctx, u.ID, &network.Network)
 	if err != nil {
@@ -918,6 +2192,35 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 		return nil, err
 	}
 
+	if !networkNeedsReconnect(&network.Network, record) {
+		u.updateNetworkRecord(network, record)
+		return network, nil
+	}
+	return u.replaceNetwork(network, record), nil
+}
+
+// updateNetworkRecord applies changes which don't require re-connecting to
+// the upstream server (see networkNeedsReconnect) to a network, and notifies
+// clients if its attributes have changed.
+func (u *user) updateNetworkRecord(network *network, record *Network) {
+	oldAttrs := getNetworkAttrs(network)
+	stsUpdated := network.STSPort != record.STSPort || !network.STSExpiresAt.Equal(record.STSExpiresAt)
+	network.Network = *record
+	if stsUpdated {
+		// The policy may have been removed, e.g. by another instance
+		network.stsLock.Lock()
+		network.stsUpgradePort = 0
+		network.stsPolicyPort = record.STSPort
+		network.stsPolicyExpiresAt = record.STSExpiresAt
+		network.stsLock.Unlock()
+	}
+	if attrs := getNetworkAttrs(network); !reflect.DeepEqual(attrs, oldAttrs) {
+		u.notifyBouncerNetworkState(network.ID, attrs)
+	}
+}
+
+// replaceNetwork swaps a network with a new one using the updated record.
+func (u *user) replaceNetwork(network *network, record *Network) *network {
 	// Most network changes require us to re-connect to the upstream server
 
 	channels := make([]Channel, 0, network.channels.Len())
@@ -927,6 +2230,7 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 	}
 
 	updatedNetwork := newNetwork(u, record, channels)
+	updatedNetwork.disconnected = network.disconnected
 
 	// If we're currently connected, disconnect and perform the necessary
 	// bookkeeping
@@ -963,7 +2267,113 @@ func (u *user) updateNetwork(ctx context.Context, record *Network) (*network, er
 	attrs := getNetworkAttrs(updatedNetwork)
 	u.notifyBouncerNetworkState(updatedNetwork.ID, attrs)
 
-	return updatedNetwork, nil
+	return updatedNetwork
+}
+
+// reconnectNetwork re-connects to the upstream server right away, skipping
+// any pending reconnection delay. It also cancels disconnectNetwork.
+func (u *user) reconnectNetwork(network *network) *network {
+	network.disconnected = false
+	return u.replaceNetwork(network, &network.Network)
+}
+
+// disconnectNetwork disconnects from the upstream server until the next call
+// to reconnectNetwork, without disabling the network.
+func (u *user) disconnectNetwork(network *network) *network {
+	network.disconnected = true
+	return u.replaceNetwork(network, &network.Network)
+}
+
+// localChannelHistoryLimit is the maximum number of messages kept in the
+// history of a local channel.
+const localChannelHistoryLimit = 100
+
+// localChannel is a channel which doesn't belong to any network. The bouncer
+// posts messages to it, e.g. for notifications. Local channels are only
+// visible to multi-upstream clients, and their history is kept in memory.
+type localChannel struct {
+	Name string
+
+	history []*irc.Message
+	// Sequence number of the last message in history
+	seq int64
+	// Sequence number of the last message delivered, by client name
+	delivered map[string]int64
+}
+
+// isLocalChannel checks whether a name is a valid local channel name.
+func isLocalChannel(name string) bool {
+	return len(name) > 1 && name[0] == '&' && !strings.ContainsAny(name, " ,\x07")
+}
+
+// members returns the nicknames of the senders in the history.
+func (ch *localChannel) members() []string {
+	seen := make(map[string]bool)
+	var members []string
+	for _, msg := range ch.history {
+		if msg.Prefix == nil || seen[msg.Prefix.Name] {
+			continue
+		}
+		seen[msg.Prefix.Name] = true
+		members = append(members, msg.Prefix.Name)
+	}
+	return members
+}
+
+// pendingMessages returns the messages which haven't been delivered to a
+// client yet, and marks them as delivered.
+func (ch *localChannel) pendingMessages(clientName string) []*irc.Message {
+	n := int(ch.seq - ch.delivered[clientName])
+	if n > len(ch.history) {
+		n = len(ch.history)
+	}
+	ch.delivered[clientName] = ch.seq
+	return ch.history[len(ch.history)-n:]
+}
+
+func (u *user) sortedLocalChannels() []*localChannel {
+	l := make([]*localChannel, 0, len(u.localChannels))
+	for _, ch := range u.localChannels {
+		l = append(l, ch)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// postLocalMessage posts a message to a local channel, creating the channel
+// if necessary.
+func (u *user) postLocalMessage(name string, msg *irc.Message) {
+	nameCM := casemapASCII(name)
+	ch := u.localChannels[nameCM]
+	created := ch == nil
+	if created {
+		ch = &localChannel{
+			Name:      name,
+			delivered: make(map[string]int64),
+		}
+		u.localChannels[nameCM] = ch
+	}
+
+	msg = msg.Copy()
+	msg.Params[0] = ch.Name
+	ch.history = append(ch.history, msg)
+	if len(ch.history) > localChannelHistoryLimit {
+		ch.history = append([]*irc.Message(nil), ch.history[1:]...)
+	}
+	ch.seq++
+
+	for _, dc := range u.downstreamConns {
+		if !dc.isMultiUpstream {
+			continue
+		}
+		if created {
+			forwardLocalChannel(dc, ch)
+		}
+		dc.SendMessage(msg)
+		ch.delivered[dc.clientName] = ch.seq
+	}
 }
 
 func (u *user) deleteNetwork(ctx context.Context, id int64) error {
@@ -972,13 +2382,21 @@ func (u *user) deleteNetwork(ctx context.Context, id int64) error {
 		panic("tried deleting a non-existing network")
 	}
 
+	if !u.allowNetworkChange() {
+		return errNetworkChangeRateExceeded
+	}
+
 	if err := u.srv.db.DeleteNetwork(ctx, network.ID); err != nil {
 		return err
 	}
 
 	u.removeNetwork(network)
+	u.notifyBouncerNetworkRemoved(network.ID)
+	return nil
+}
 
-	idStr := fmt.Sprintf("%v", network.ID)
+func (u *user) notifyBouncerNetworkRemoved(netID int64) {
+	idStr := fmt.Sprintf("%v", netID)
 	for _, dc := range u.downstreamConns {
 		if dc.caps.IsEnabled("soju.im/bouncer-networks-notify") {
 			dc.SendMessage(&irc.Message{
@@ -988,21 +2406,101 @@ func (u *user) deleteNetwork(ctx context.Context, id int64) error {
 			})
 		}
 	}
+}
+
+// reloadNetwork loads a network record changed by another soju instance from
+// the database.
+func (u *user) reloadNetwork(ctx context.Context, id int64) error {
+	records, err := u.srv.db.ListNetworks(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	var record *Network
+	for i := range records {
+		if records[i].ID == id {
+			record = &records[i]
+			break
+		}
+	}
 
+	network := u.getNetworkByID(id)
+	switch {
+	case record == nil && network == nil:
+		// Created and deleted in the meantime
+	case record == nil:
+		u.logger.Printf("network %q deleted by another instance", network.GetName())
+		u.removeNetwork(network)
+		u.notifyBouncerNetworkRemoved(id)
+	case network == nil:
+		u.logger.Printf("network %q created by another instance", record.GetName())
+		channels, err := u.srv.db.ListChannels(ctx, id)
+		if err != nil {
+			return err
+		}
+		network = newNetwork(u, record, channels)
+		u.addNetwork(network)
+		u.notifyBouncerNetworkState(network.ID, getNetworkAttrs(network))
+	case !networkNeedsReconnect(&network.Network, record):
+		u.updateNetworkRecord(network, record)
+	default:
+		u.logger.Printf("network %q updated by another instance", record.GetName())
+		u.replaceNetwork(network, record)
+	}
 	return nil
 }
 
+// networkNeedsReconnect checks whether the differences between two records
+// of the same network require re-connecting to the upstream server. The other
+// fields are read from the network record as needed, and are updated in
+// place.
+func networkNeedsReconnect(a, b *Network) bool {
+	// Fields used to connect and register, or which change the state of the
+	// connection
+	connFields := func(record *Network) []interface{} {
+		return []interface{}{
+			record.Name, // the message logs need to be moved
+			record.Addr,
+			record.Nick,
+			record.Username,
+			record.Realname,
+			record.Pass,
+			record.ConnectCommands,
+			record.SASL,
+			record.SASLPassthrough,
+			record.NickServ,
+			record.Enabled,
+			record.FallbackNicks,
+			record.MessageDelay,
+			record.MessageBurst,
+			record.Charset,
+			record.ConnectTimeout,
+			record.TLSFingerprint,
+			record.TLSMinVersion,
+			record.WebIRCPassword,
+			record.WebIRCGateway,
+			record.OnDemand,
+			record.Passthrough,
+		}
+	}
+	return !reflect.DeepEqual(connFields(a), connFields(b))
+}
+
 func (u *user) updateUser(ctx context.Context, record *User) error {
 	if u.ID != record.ID {
 		panic("ID mismatch when updating user")
 	}
 
 	realnameUpdated := u.Realname != record.Realname
+	msgStoreUpdated := u.MsgStore != record.MsgStore
 	if err := u.srv.db.StoreUser(ctx, record); err != nil {
 		return fmt.Errorf("failed to update user %q: %v", u.Username, err)
 	}
 	u.User = *record
 
+	if msgStoreUpdated {
+		u.updateMsgStore(ctx)
+	}
+
 	if realnameUpdated {
 		// Re-connect to networks which use the default realname
 		var needUpdate []Network
@@ -1016,7 +2514,7 @@ func (u *user) updateUser(ctx context.Context, record *User) error {
 			if uc := net.conn; uc != nil && uc.caps.IsEnabled("setname") {
 				uc.SendMessage(ctx, &irc.Message{
 					Command: "SETNAME",
-					Params:  []string{GetRealname(&u.User, &net.Network)},
+					Params:  []string{u.srv.getRealname(&u.User, &net.Network)},
 				})
 				continue
 			}
@@ -1038,11 +2536,90 @@ func (u *user) updateUser(ctx context.Context, record *User) error {
 	return nil
 }
 
+// reloadUser applies a user record changed by another soju instance. The
+// username must be unchanged.
+func (u *user) reloadUser(ctx context.Context, record *User) {
+	passwordUpdated := u.Password != record.Password
+	realnameUpdated := u.Realname != record.Realname
+	msgStoreUpdated := u.MsgStore != record.MsgStore
+	u.User = *record
+
+	if msgStoreUpdated {
+		u.updateMsgStore(ctx)
+	}
+
+	if realnameUpdated {
+		// Networks which don't support setname pick up the new realname the
+		// next time they connect
+		for _, net := range u.networks {
+			if uc := net.conn; net.Realname == "" && uc != nil && uc.caps.IsEnabled("setname") {
+				uc.SendMessage(ctx, &irc.Message{
+					Command: "SETNAME",
+					Params:  []string{u.srv.getRealname(&u.User, &net.Network)},
+				})
+			}
+		}
+	}
+
+	// Force downstream connections to re-authenticate with the new
+	// credentials
+	if passwordUpdated {
+		u.revokeSessions(nil)
+	}
+}
+
 func (u *user) stop() {
 	u.events <- eventStop{}
 	<-u.done
 }
 
+// location returns the time zone used to format human-readable timestamps.
+func (u *user) location() *time.Location {
+	if u.Timezone == "" {
+		return time.UTC
+	}
+	if u.loc != nil && u.locName == u.Timezone {
+		return u.loc
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		u.logger.Printf("failed to load time zone %q: %v", u.Timezone, err)
+		loc = time.UTC
+	}
+	u.loc = loc
+	u.locName = u.Timezone
+	return loc
+}
+
+// purgeLogs deletes all the stored messages of the user, including the ones
+// of deleted networks.
+func (u *user) purgeLogs(ctx context.Context) error {
+	if u.msgStore != nil {
+		if err := u.msgStore.Purge(nil, ""); err != nil {
+			return err
+		}
+	}
+	for _, net := range u.networks {
+		if err := net.forgetLogs(ctx, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *user) updateMsgStoreStats() {
+	if u.msgStore == nil {
+		u.msgStoreStats.Store(&messageStoreStats{})
+		return
+	}
+	stats, err := u.msgStore.Stats()
+	if err != nil {
+		u.logger.Printf("failed to compute message store statistics: %v", err)
+		return
+	}
+	u.msgStoreStats.Store(stats)
+}
+
 func (u *user) hasPersistentMsgStore() bool {
 	if u.msgStore == nil {
 		return false
@@ -1055,11 +2632,16 @@ func (u *user) hasPersistentMsgStore() bool {
 // A nil address is returned when the OS should automatically pick one.
 func (u *user) localTCPAddrForHost(ctx context.Context, host string) (*net.TCPAddr, error) {
 	upstreamUserIPs := u.srv.Config().UpstreamUserIPs
-	if len(upstreamUserIPs) == 0 {
+	if len(upstreamUserIPs) == 0 && len(u.UpstreamIPs) == 0 {
 		return nil, nil
 	}
 
-	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	resolver := u.srv.Config().UpstreamResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip", host)
 	if err != nil {
 		return nil, err
 	}
@@ -1072,6 +2654,14 @@ func (u *user) localTCPAddrForHost(ctx context.Context, host string) (*net.TCPAd
 		}
 	}
 
+	// Explicit per-user addresses take precedence over the ranges
+	for _, s := range u.UpstreamIPs {
+		ip := net.ParseIP(s)
+		if ip != nil && wantIPv6 == (ip.To4() == nil) {
+			return &net.TCPAddr{IP: ip}, nil
+		}
+	}
+
 	var ipNet *net.IPNet
 	for _, in := range upstreamUserIPs {
 		if wantIPv6 == (in.IP.To4() == nil) {
@@ -1083,13 +2673,52 @@ func (u *user) localTCPAddrForHost(ctx context.Context, host string) (*net.TCPAd
 		return nil, nil
 	}
 
+	offset, err := userIPOffset(ipNet, u.ID, u.srv.Config().UpstreamUserIPStrategy)
+	if err != nil {
+		return nil, err
+	}
+
 	var ipInt big.Int
 	ipInt.SetBytes(ipNet.IP)
-	ipInt.Add(&ipInt, big.NewInt(u.ID+1))
-	ip := net.IP(ipInt.Bytes())
+	ipInt.Add(&ipInt, offset)
+	if ipInt.BitLen() > 8*len(ipNet.IP) {
+		return nil, fmt.Errorf("IP network %v too small", ipNet)
+	}
+	ip := make(net.IP, len(ipNet.IP))
+	ipInt.FillBytes(ip)
 	if !ipNet.Contains(ip) {
 		return nil, fmt.Errorf("IP network %v too small", ipNet)
 	}
 
 	return &net.TCPAddr{IP: ip}, nil
 }
+
+// userIPOffset returns the offset of the address assigned to a user inside
+// ipNet. The "linear" strategy assigns consecutive addresses in user ID order.
+// The "hash" strategy spreads users across the whole range, skipping the first
+// and last addresses; different users may share an address.
+func userIPOffset(ipNet *net.IPNet, userID int64, strategy string) (*big.Int, error) {
+	switch strategy {
+	case "", "linear":
+		return big.NewInt(userID + 1), nil
+	case "hash":
+		ones, bits := ipNet.Mask.Size()
+		var size big.Int
+		size.Lsh(big.NewInt(1), uint(bits-ones))
+		size.Sub(&size, big.NewInt(2))
+		if size.Sign() <= 0 {
+			return nil, fmt.Errorf("IP network %v too small", ipNet)
+		}
+
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(userID))
+		sum := sha256.Sum256(b[:])
+
+		var offset big.Int
+		offset.SetBytes(sum[:])
+		offset.Mod(&offset, &size)
+		return offset.Add(&offset, big.NewInt(1)), nil
+	default:
+		return nil, fmt.Errorf("unknown IP assignment strategy %q", strategy)
+	}
+}